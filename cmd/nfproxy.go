@@ -26,24 +26,29 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"net/http"
 	_ "net/http/pprof"
 
+	utilnftables "github.com/google/nftables"
 	"github.com/sbezverk/nfproxy/pkg/controller"
 	"github.com/sbezverk/nfproxy/pkg/nftables"
 	"github.com/sbezverk/nfproxy/pkg/proxy"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/util/wait"
 	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/component-base/logs"
+	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/klog"
 	utilnode "k8s.io/kubernetes/pkg/util/node"
 )
@@ -54,6 +59,46 @@ var (
 	ipv6ClusterCIDR  string
 	serviceProxyName string
 	endpointSlice    bool
+	endpointDebounce time.Duration
+	readinessHold    time.Duration
+	preferLocal      bool
+	zone             string
+	resolveSliceFQDN bool
+	minSyncPeriod    time.Duration
+	backlogLimit     int
+	backlogResync    time.Duration
+	syncWorkers      int
+	terminatingNS    bool
+	gcInterval       time.Duration
+	programTimeout   time.Duration
+	noEndpoints      string
+	precedence       string
+	cleanup          bool
+	selfTest         bool
+	zoneWeight       int
+	tableMetrics     time.Duration
+	detectLocalMode  string
+	maxEndpoints     int
+	verifyRules      bool
+	filterPriority   int
+	dnatPriority     int
+	snatPriority     int
+	masqSourceIPv4   string
+	masqSourceIPv6   string
+	nodePortAddrs    string
+	managedCIDRs     string
+	lbMark           uint
+	excludeCordoned  bool
+	healthCheckPorts bool
+	drainGrace       time.Duration
+	auditLog         string
+	unmatchedLog     bool
+	identityComments bool
+	headlessNodePort bool
+	vipDefaultDeny   bool
+	localCIDRs       string
+	localInterface   string
+	remoteClusters   string
 )
 
 type epController interface {
@@ -66,6 +111,46 @@ func init() {
 	flag.StringVar(&ipv6ClusterCIDR, "ipv6clustercidr", "", "The IPv6 CIDR range of pods in the cluster.")
 	flag.StringVar(&serviceProxyName, "service-proxy-name", "", "Let nfproxy only handle services with this label (empty = all services)")
 	flag.BoolVar(&endpointSlice, "endpointslice", false, "Enables to use EndpointSlice instead of Endpoints. Default is flase.")
+	flag.DurationVar(&readinessHold, "endpoint-readiness-hold", 0, "Endpoints of EndpointSlices must stay Ready or Not Ready for this period before the change is applied. Default is 0, changes are applied right away.")
+	flag.DurationVar(&endpointDebounce, "endpoint-debounce", 0, "Coalesces rapid endpoint updates of a service into a single update per window. Default is 0, disabled.")
+	flag.BoolVar(&preferLocal, "prefer-local", false, "Services use only node local endpoints when there are any and fall back to remote endpoints otherwise. Default is false.")
+	flag.BoolVar(&resolveSliceFQDN, "endpointslice-resolve-fqdn", false, "Resolves addresses of EndpointSlices with FQDN address type, otherwise their endpoints are skipped. Default is false.")
+	flag.StringVar(&zone, "zone", "", "The zone of the node, services with PreferClose traffic distribution prefer endpoints in this zone. Default is the node's zone label.")
+	flag.IntVar(&zoneWeight, "zone-weight", 100, "The share in percent of PreferClose services' load balancing given to endpoints in the node's zone, the rest goes to other endpoints. Default is 100, only in-zone endpoints are used when there are any.")
+	flag.DurationVar(&minSyncPeriod, "min-sync-period", 0, "Coalesces bursts of service and endpoints changes, programming only their final state once per period. Default is 0, disabled.")
+	flag.IntVar(&backlogLimit, "backlog-threshold", 0, "The number of events waiting to be programmed above which events are coalesced and programmed in batches until the backlog clears. Default is 0, disabled.")
+	flag.DurationVar(&backlogResync, "backlog-resync-period", time.Second, "The period of batched programming while the backlog is above backlog-threshold. Default is 1s.")
+	flag.BoolVar(&terminatingNS, "reject-terminating-namespaces", false, "Services of a namespace being deleted reject new connections right away instead of waiting for their delete events. Default is false.")
+	flag.IntVar(&syncWorkers, "initial-sync-workers", 1, "The number of services programmed in parallel during the initial sync. Default is 1, services are programmed serially.")
+	flag.DurationVar(&programTimeout, "programming-timeout", 0, "Timeout of nftables calls adding a service port's chains, affinity map and set elements, service port which adding times out is retried. Endpoints' rules, service chain updates and service updates and deletions are not covered. Default is 0, no timeout.")
+	flag.DurationVar(&gcInterval, "endpoint-chain-gc-interval", 0, "Interval of garbage collection of endpoint chains left without a corresponding endpoint. Default is 0, disabled.")
+	flag.StringVar(&precedence, "address-precedence", string(nftables.ExternalIPFirst), "Which of ExternalIP and LoadBalancerIP is matched first when a service's address and port is both. Default is ExternalIP.")
+	flag.StringVar(&noEndpoints, "no-endpoints-action", string(nftables.NoEndpointsReject), "Action for traffic to services without endpoints, Reject, Drop or TCPReset which resets TCP and rejects other traffic with ICMP port unreachable. Default is Reject.")
+	flag.DurationVar(&tableMetrics, "nftables-metrics-interval", 0, "Interval of reading back numbers of chains, rules and sets programmed in the kernel for metrics. Default is 0, disabled.")
+	flag.IntVar(&maxEndpoints, "max-endpoints-per-service", 0, "Limits the number of endpoints in a service's load balancing, endpoints over the limit are left out. Default is 0, no limit.")
+	flag.BoolVar(&verifyRules, "verify-rules", false, "Reads back rules of each programmed service port from the kernel, service ports with missing rules are rolled back and retried. Default is false.")
+	flag.IntVar(&filterPriority, "filter-priority", 0, "Hook priority of nfproxy's filter chains, lower priority than CNI's chains runs nfproxy's rules first. Default is 0.")
+	flag.IntVar(&dnatPriority, "dnat-priority", 0, "Hook priority of nfproxy's prerouting and output nat chains translating services' addresses. Default is 0.")
+	flag.IntVar(&snatPriority, "snat-priority", 0, "Hook priority of nfproxy's postrouting nat chain masquerading traffic. Default is 0.")
+	flag.StringVar(&masqSourceIPv4, "masquerade-source-ipv4", "", "IPv4 address or range of addresses first-last masqueraded traffic is SNATed to. Default is empty, the address chosen by the route.")
+	flag.StringVar(&masqSourceIPv6, "masquerade-source-ipv6", "", "IPv6 address or range of addresses first-last masqueraded traffic is SNATed to. Default is empty, the address chosen by the route.")
+	flag.StringVar(&managedCIDRs, "managed-cluster-cidrs", "", "Comma separated CIDRs, only services with ClusterIP within them are programmed. Default is empty, all services are programmed.")
+	flag.StringVar(&nodePortAddrs, "nodeport-addresses", "", "Comma separated CIDRs nodeports are restricted to, node's addresses within them are followed as the node changes. Default is empty, nodeports are open on all node's addresses.")
+	flag.BoolVar(&healthCheckPorts, "health-check-nodeports", false, "Serves health check node ports of services with externalTrafficPolicy Local, healthy while the node has local endpoints. Default is false.")
+	flag.DurationVar(&drainGrace, "drain-grace-period", 0, "On stop signal health checks start failing and external paths of services with externalTrafficPolicy Local are removed after this period. Default is 0, nfproxy stops right away.")
+	flag.BoolVar(&headlessNodePort, "headless-node-ports", false, "Node ports of headless services are programmed, their ClusterIP None is skipped. Default is false, headless services are skipped.")
+	flag.BoolVar(&vipDefaultDeny, "vip-default-deny", false, "Traffic to services' ClusterIPs on ports not defined by the services is rejected. Default is false.")
+	flag.BoolVar(&identityComments, "identity-comments", false, "Endpoints' rules are commented with endpoint's address and namespace/name:port:protocol of the service, changes apply to newly programmed endpoints. Default is false.")
+	flag.BoolVar(&unmatchedLog, "debug-unmatched-log", false, "Services' chains log traffic no endpoint rule matched with prefix nfproxy-unmatched, the rules are removed by restarting without the flag. Default is false.")
+	flag.StringVar(&auditLog, "audit-log", "", "Path of the file nftables mutations of services' and endpoints' chains are appended to as JSON lines. Default is empty, disabled.")
+	flag.BoolVar(&excludeCordoned, "exclude-cordoned-nodes", false, "Removes endpoints on cordoned nodes, unschedulable or with NoExecute taint, from services' load balancing. Default is false.")
+	flag.UintVar(&lbMark, "loadbalancer-mark", 0, "Mark set on traffic to loadbalancer ips instead of masquerading it, for a userspace helper consuming original source address. Must not carry masquerade mark 0x4000. Default is 0, loadbalancer traffic is masqueraded.")
+	flag.StringVar(&detectLocalMode, "detect-local-mode", "", "Detects locality of endpoints without NodeName, ClusterCIDR, NodeCIDR, BridgeInterface or InterfaceNamePrefix. Default is empty, such endpoints are not local.")
+	flag.StringVar(&localCIDRs, "detect-local-cidrs", "", "Comma separated pod CIDRs of the node for ClusterCIDR and NodeCIDR detect local modes. Default is the node's pod CIDRs.")
+	flag.StringVar(&localInterface, "detect-local-interface", "", "The bridge interface name for BridgeInterface or the interface name prefix for InterfaceNamePrefix detect local modes.")
+	flag.StringVar(&remoteClusters, "remote-clusters", "", "Comma separated cluster=kubeconfig pairs of remote clusters which services are proxied in addition to the local cluster's services, services of the same name in different clusters get distinct chains. Default is empty, only the local cluster's services are proxied.")
+	flag.BoolVar(&cleanup, "cleanup", false, "Removes all nftables tables, chains, rules and sets programmed by nfproxy and exits.")
+	flag.BoolVar(&selfTest, "self-test", false, "Programs a synthetic service into a temporary table, verifies it is read back from the kernel, removes it and exits.")
 }
 
 func setupSignalHandler() (stopCh <-chan struct{}) {
@@ -91,6 +176,26 @@ func main() {
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
+	if cleanup {
+		if err := nftables.Cleanup(); err != nil {
+			klog.Errorf("nfproxy failed to clean up nftables with error: %+v", err)
+			os.Exit(1)
+		}
+		klog.Info("nfproxy cleaned up nftables")
+		return
+	}
+	if selfTest {
+		if err := nftables.SelfTest(); err != nil {
+			klog.Errorf("nfproxy self test failed with error: %+v", err)
+			os.Exit(1)
+		}
+		klog.Info("nfproxy self test passed")
+		return
+	}
+
+	// Exposing nfproxy metrics along with pprof
+	proxy.RegisterMetrics()
+	http.Handle("/metrics", legacyregistry.Handler())
 	go func() {
 		klog.Info(http.ListenAndServe("localhost:6767", nil))
 	}()
@@ -100,11 +205,41 @@ func main() {
 		klog.Errorf("nfproxy failed to get kubernetes clientset with error: %+v", err)
 		os.Exit(1)
 	}
+	clusters, err := parseRemoteClusters(remoteClusters)
+	if err != nil {
+		klog.Errorf("nfproxy invalid remote clusters %s with error: %+v", remoteClusters, err)
+		os.Exit(1)
+	}
+	remoteClients := make([]kubernetes.Interface, len(clusters))
+	for i, cluster := range clusters {
+		if remoteClients[i], err = controller.GetClientset(cluster.kubeconfig); err != nil {
+			klog.Errorf("nfproxy failed to get kubernetes clientset of remote cluster %s with error: %+v", cluster.name, err)
+			os.Exit(1)
+		}
+	}
+
+	noEndpointsAction := nftables.NoEndpointsAction(noEndpoints)
+	if noEndpointsAction != nftables.NoEndpointsReject && noEndpointsAction != nftables.NoEndpointsDrop && noEndpointsAction != nftables.NoEndpointsTCPReset {
+		klog.Errorf("nfproxy invalid no endpoints action %s, supported actions are %s, %s and %s", noEndpoints, nftables.NoEndpointsReject,
+			nftables.NoEndpointsDrop, nftables.NoEndpointsTCPReset)
+		os.Exit(1)
+	}
+
+	addressPrecedence := nftables.AddressPrecedence(precedence)
+	if addressPrecedence != nftables.ExternalIPFirst && addressPrecedence != nftables.LoadBalancerIPFirst {
+		klog.Errorf("nfproxy invalid address precedence %s, supported values are %s and %s", precedence, nftables.ExternalIPFirst, nftables.LoadBalancerIPFirst)
+		os.Exit(1)
+	}
 
 	// Attempt to Init nftables, if fails exit with error
 	// TODO Add validation of ipv4ClusterCIDR, ipv6ClusterCIDR for a valid IPv4 or IPv6 address
 	// One is allowed to be empty but not both.
-	nfti, err := nftables.InitNFTables(ipv4ClusterCIDR, ipv6ClusterCIDR)
+	priorities := nftables.ChainPriorities{
+		Filter: utilnftables.ChainPriority(filterPriority),
+		DNAT:   utilnftables.ChainPriority(dnatPriority),
+		SNAT:   utilnftables.ChainPriority(snatPriority),
+	}
+	nfti, err := nftables.InitNFTables(ipv4ClusterCIDR, ipv6ClusterCIDR, priorities, addressPrecedence)
 	if err != nil {
 		klog.Errorf("nfproxy failed to initialize nftables with error: %+v", err)
 		os.Exit(1)
@@ -120,7 +255,116 @@ func main() {
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "nfproxy", Host: hostname})
 
 	// Create new instance of a proxy process
-	nfproxy := proxy.NewProxy(nfti, hostname, recorder, endpointSlice)
+	opts := []proxy.Option{
+		proxy.WithEndpointSliceDebounce(endpointDebounce),
+		proxy.WithEndpointReadinessHold(readinessHold),
+		proxy.WithEndpointChainGC(gcInterval),
+		proxy.WithProgrammingTimeout(programTimeout),
+		proxy.WithTableMetrics(tableMetrics),
+		proxy.WithNoEndpointsAction(noEndpointsAction),
+		proxy.WithMaxEndpointsPerService(maxEndpoints),
+		proxy.WithMasqueradeSource(masqSourceIPv4, masqSourceIPv6),
+	}
+	if preferLocal {
+		opts = append(opts, proxy.WithPreferLocal())
+	}
+	if verifyRules {
+		opts = append(opts, proxy.WithRuleVerification())
+	}
+	if resolveSliceFQDN {
+		opts = append(opts, proxy.WithEndpointSliceFQDNResolution())
+	}
+	mode := proxy.DetectLocalMode(detectLocalMode)
+	needCIDRs := localCIDRs == "" && (mode == proxy.DetectLocalClusterCIDR || mode == proxy.DetectLocalNodeCIDR)
+	var cidrs []string
+	if localCIDRs != "" {
+		cidrs = strings.Split(localCIDRs, ",")
+	}
+	if zone == "" || needCIDRs {
+		if node, err := client.CoreV1().Nodes().Get(hostname, metav1.GetOptions{}); err != nil {
+			klog.Warningf("nfproxy failed to get node %s to find its zone and pod CIDRs with error: %+v", hostname, err)
+		} else {
+			if z, ok := node.Labels[v1.LabelZoneFailureDomainStable]; zone == "" && ok {
+				zone = z
+			} else if zone == "" {
+				zone = node.Labels[v1.LabelZoneFailureDomain]
+			}
+			if needCIDRs {
+				cidrs = node.Spec.PodCIDRs
+				if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+					cidrs = []string{node.Spec.PodCIDR}
+				}
+			}
+		}
+	}
+	if mode != "" {
+		detector, err := proxy.NewLocalDetector(mode, cidrs, localInterface)
+		if err != nil {
+			klog.Errorf("nfproxy failed to set up detect local mode %s with error: %+v", mode, err)
+			os.Exit(1)
+		}
+		opts = append(opts, proxy.WithDetectLocal(detector))
+	}
+	var nodePortCIDRs []*net.IPNet
+	if nodePortAddrs != "" {
+		for _, cidr := range strings.Split(nodePortAddrs, ",") {
+			_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				klog.Errorf("nfproxy invalid nodeport addresses CIDR %s with error: %+v", cidr, err)
+				os.Exit(1)
+			}
+			nodePortCIDRs = append(nodePortCIDRs, ipnet)
+		}
+		opts = append(opts, proxy.WithNodePortAddresses(nodePortCIDRs))
+	}
+	if managedCIDRs != "" {
+		var cidrs []*net.IPNet
+		for _, cidr := range strings.Split(managedCIDRs, ",") {
+			_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				klog.Errorf("nfproxy invalid managed cluster CIDR %s with error: %+v", cidr, err)
+				os.Exit(1)
+			}
+			cidrs = append(cidrs, ipnet)
+		}
+		opts = append(opts, proxy.WithManagedClusterIPs(cidrs))
+	}
+	if auditLog != "" {
+		f, err := os.OpenFile(auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			klog.Errorf("nfproxy failed to open audit log %s with error: %+v", auditLog, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, proxy.WithAuditLog(f))
+	}
+	if unmatchedLog {
+		opts = append(opts, proxy.WithUnmatchedLog())
+	}
+	if identityComments {
+		opts = append(opts, proxy.WithIdentityComments())
+	}
+	if headlessNodePort {
+		opts = append(opts, proxy.WithHeadlessNodePorts())
+	}
+	if vipDefaultDeny {
+		opts = append(opts, proxy.WithVIPDefaultDeny())
+	}
+	if healthCheckPorts {
+		opts = append(opts, proxy.WithHealthCheckNodePorts(), proxy.WithDrainGracePeriod(drainGrace))
+	}
+	if excludeCordoned {
+		opts = append(opts, proxy.WithCordonedNodeExclusion())
+	}
+	if lbMark != 0 {
+		if lbMark&0x4000 != 0 || lbMark > math.MaxUint32 {
+			klog.Errorf("nfproxy invalid loadbalancer mark 0x%x", lbMark)
+			os.Exit(1)
+		}
+		opts = append(opts, proxy.WithLoadBalancerMark(uint32(lbMark)))
+	}
+	opts = append(opts, proxy.WithZone(zone), proxy.WithZoneWeight(zoneWeight))
+	nfproxy := proxy.NewProxy(nfti, hostname, recorder, endpointSlice, opts...)
 	// For "in-cluster" mode a rule to reach API server must be programmed, otherwise
 	// the services/endpoints controller cannot reach it.
 	iHost := os.Getenv("KUBERNETES_SERVICE_HOST")
@@ -143,6 +387,16 @@ func main() {
 		}
 	}
 
+	if syncWorkers > 1 {
+		nfproxy = proxy.NewParallelSyncProxy(nfproxy, syncWorkers)
+	}
+	if minSyncPeriod > 0 {
+		nfproxy = proxy.NewBatchingProxy(nfproxy, minSyncPeriod)
+	}
+	if backlogLimit > 0 {
+		nfproxy = proxy.NewBackpressureProxy(nfproxy, backlogLimit, backlogResync, wait.NeverStop)
+	}
+
 	noHeadlessEndpoints, err := labels.NewRequirement(v1.IsHeadlessService, selection.DoesNotExist, nil)
 	if err != nil {
 		klog.Fatalf("Failed to create Requirement for noHeadlessEndpoints: %s", err.Error())
@@ -158,36 +412,107 @@ func main() {
 		labelSelector = labelSelector.Add(*noHeadlessEndpoints, *proxySelector)
 	}
 
+	// Cluster annotation of the local cluster's objects is removed, so they cannot pass for objects of a remote cluster
+	startServiceControllers(proxy.NewLocalProxy(nfproxy), client, labelSelector)
+	// Services of remote clusters are tagged with the cluster, so they do not collide with the local cluster's services
+	for i, cluster := range clusters {
+		klog.Infof("Proxying services of remote cluster %s", cluster.name)
+		startServiceControllers(proxy.NewClusterProxy(nfproxy, cluster.name), remoteClients[i], labelSelector)
+	}
+	// All controllers have synced their caches, from now on cache misses are unexpected
+	nfproxy.SetSynced()
+
+	// Namespaces are watched once services are known, so services of namespaces already terminating are rejected.
+	if terminatingNS {
+		nsInformerFactory := kubeinformers.NewSharedInformerFactory(client, time.Minute*10)
+		nsController := controller.NewNamespaceController(nfproxy, nsInformerFactory.Core().V1().Namespaces())
+		nsInformerFactory.Start(wait.NeverStop)
+		if err = nsController.Start(wait.NeverStop); err != nil {
+			klog.Fatalf("Error running Namespace controller: %s", err.Error())
+		}
+	}
+
+	// The node is watched to follow its addresses nodeports are restricted to, all nodes are watched
+	// if endpoints on cordoned nodes are excluded.
+	if len(nodePortCIDRs) != 0 || excludeCordoned {
+		nodeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, time.Minute*10,
+			kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				if !excludeCordoned {
+					options.FieldSelector = fields.OneTermEqualSelector("metadata.name", hostname).String()
+				}
+			}))
+		nodeController := controller.NewNodeController(nfproxy, nodeInformerFactory.Core().V1().Nodes())
+		nodeInformerFactory.Start(wait.NeverStop)
+		if err = nodeController.Start(wait.NeverStop); err != nil {
+			klog.Fatalf("Error running Node controller: %s", err.Error())
+		}
+	}
+
+	stopCh := setupSignalHandler()
+	<-stopCh
+	klog.Info("Received stop signal, shuting down controller")
+	if healthCheckPorts && drainGrace > 0 {
+		// Node is shutting down, external load balancers get the grace period to move traffic away
+		<-nfproxy.StartDraining()
+	}
+
+	os.Exit(0)
+}
+
+// startServiceControllers starts Service and Endpoints or EndpointSlice controllers of the cluster client
+// connects to and waits for their caches to sync.
+func startServiceControllers(p proxy.Proxy, client kubernetes.Interface, labelSelector labels.Selector) {
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, time.Minute*10,
 		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
 			options.LabelSelector = labelSelector.String()
 		}))
 
-	svcController := controller.NewServiceController(nfproxy, client, kubeInformerFactory.Core().V1().Services())
+	svcController := controller.NewServiceController(p, client, kubeInformerFactory.Core().V1().Services())
 
 	// If EndpointSlice support is requested and feature gate for EndpointSLice is enabled,
 	// instantiate EndpointSlice controller, otherwise Endpoints controller will be used.
 	var ep epController
 	if endpointSlice {
-		ep = controller.NewEndpointSliceController(nfproxy, client, kubeInformerFactory.Discovery().V1beta1().EndpointSlices())
+		ep = controller.NewEndpointSliceController(p, client, kubeInformerFactory.Discovery().V1beta1().EndpointSlices())
 	} else {
-		ep = controller.NewEndpointsController(nfproxy, client, kubeInformerFactory.Core().V1().Endpoints())
+		ep = controller.NewEndpointsController(p, client, kubeInformerFactory.Core().V1().Endpoints())
 	}
 
 	kubeInformerFactory.Start(wait.NeverStop)
 
-	if err = svcController.Start(wait.NeverStop); err != nil {
+	if err := svcController.Start(wait.NeverStop); err != nil {
 		klog.Fatalf("Error running Service controller: %s", err.Error())
 	}
-	if err = ep.Start(wait.NeverStop); err != nil {
+	if err := ep.Start(wait.NeverStop); err != nil {
 		klog.Fatalf("Error running endpoint controller: %s", err.Error())
 	}
+}
 
-	stopCh := setupSignalHandler()
-	<-stopCh
-	klog.Info("Received stop signal, shuting down controller")
+type remoteCluster struct {
+	name       string
+	kubeconfig string
+}
 
-	os.Exit(0)
+// parseRemoteClusters parses comma separated cluster=kubeconfig pairs, cluster names must be unique.
+func parseRemoteClusters(s string) ([]remoteCluster, error) {
+	var clusters []remoteCluster
+	if s == "" {
+		return clusters, nil
+	}
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid remote cluster %q, expected cluster=kubeconfig", pair)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("duplicate remote cluster %s", parts[0])
+		}
+		seen[parts[0]] = true
+		clusters = append(clusters, remoteCluster{name: parts[0], kubeconfig: parts[1]})
+	}
+
+	return clusters, nil
 }
 
 func validateAPIEndpoint(strAddr string) (*url.URL, error) {
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	corev1informer "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/sbezverk/nfproxy/pkg/proxy"
+)
+
+// NamespaceController defines interface for managing Namespaces controller
+type NamespaceController interface {
+	Start(<-chan struct{}) error
+}
+
+type namespaceController struct {
+	nsSynced cache.InformerSynced
+	proxy    proxy.Proxy
+}
+
+func (c *namespaceController) handleAddNamespace(obj interface{}) {
+	ns, ok := obj.(*v1.Namespace)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object type: %v", obj))
+		return
+	}
+	c.processNamespace(ns)
+}
+
+func (c *namespaceController) handleUpdateNamespace(oldObj, newObj interface{}) {
+	ns, ok := newObj.(*v1.Namespace)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object type: %v", newObj))
+		return
+	}
+	c.processNamespace(ns)
+}
+
+func (c *namespaceController) processNamespace(ns *v1.Namespace) {
+	if ns.Status.Phase != v1.NamespaceTerminating {
+		return
+	}
+	klog.V(5).Infof("namespace %s is terminating", ns.ObjectMeta.Name)
+	c.proxy.NamespaceTerminating(ns.ObjectMeta.Name)
+}
+
+func (c *namespaceController) Start(stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+
+	klog.Info("Starting nfproxy Namespace controller")
+
+	// Wait for the caches to be synced before starting workers
+	klog.Info("Waiting for informer caches to sync for Namespace controller")
+	if ok := cache.WaitForCacheSync(stopCh, c.nsSynced); !ok {
+		return fmt.Errorf("failed to wait for caches to sync for Namespace controller")
+	}
+
+	return nil
+}
+
+// NewNamespaceController returns a new namespaces controller watching namespaces and calling Proxy's
+// NamespaceTerminating for namespaces entering Terminating phase.
+func NewNamespaceController(
+	proxy proxy.Proxy,
+	nsInformer corev1informer.NamespaceInformer) NamespaceController {
+
+	controller := &namespaceController{
+		nsSynced: nsInformer.Informer().HasSynced,
+		proxy:    proxy,
+	}
+
+	klog.Info("Setting up event handlers for Namespace Controller")
+
+	nsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.handleAddNamespace,
+		UpdateFunc: controller.handleUpdateNamespace,
+	})
+
+	return controller
+}
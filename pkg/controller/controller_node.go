@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	corev1informer "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/sbezverk/nfproxy/pkg/proxy"
+)
+
+// NodeController defines interface for managing Node controller
+type NodeController interface {
+	Start(<-chan struct{}) error
+}
+
+type nodeController struct {
+	nodeSynced cache.InformerSynced
+	proxy      proxy.Proxy
+}
+
+func (c *nodeController) handleAddNode(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object type: %v", obj))
+		return
+	}
+	c.proxy.OnNodeUpdate(node)
+}
+
+func (c *nodeController) handleUpdateNode(oldObj, newObj interface{}) {
+	node, ok := newObj.(*v1.Node)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object type: %v", newObj))
+		return
+	}
+	c.proxy.OnNodeUpdate(node)
+}
+
+func (c *nodeController) Start(stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+
+	klog.Info("Starting nfproxy Node controller")
+
+	// Wait for the caches to be synced before starting workers
+	klog.Info("Waiting for informer caches to sync for Node controller")
+	if ok := cache.WaitForCacheSync(stopCh, c.nodeSynced); !ok {
+		return fmt.Errorf("failed to wait for caches to sync for Node controller")
+	}
+
+	return nil
+}
+
+// NewNodeController returns a new node controller calling Proxy's OnNodeUpdate for added and updated nodes,
+// the informer can be restricted to the node nfproxy runs on if other nodes are of no interest.
+func NewNodeController(
+	proxy proxy.Proxy,
+	nodeInformer corev1informer.NodeInformer) NodeController {
+
+	controller := &nodeController{
+		nodeSynced: nodeInformer.Informer().HasSynced,
+		proxy:      proxy,
+	}
+
+	klog.Info("Setting up event handlers for Node Controller")
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.handleAddNode,
+		UpdateFunc: controller.handleUpdateNode,
+	})
+
+	return controller
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestCleanup(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	// A table not managed by nfproxy must survive the cleanup
+	if err := ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	for _, table := range []struct {
+		name   string
+		family nftables.TableFamily
+	}{
+		{name: nfV4TableName, family: nftables.TableFamilyIPv4},
+		{name: nfV6TableName, family: nftables.TableFamilyIPv6},
+	} {
+		if err := ti.Tables().CreateImm(table.name, table.family); err != nil {
+			t.Fatalf("failed to create table %s with error: %+v", table.name, err)
+		}
+		ci, err := ti.Tables().TableChains(table.name, table.family)
+		if err != nil {
+			t.Fatalf("failed to get chains of table %s with error: %+v", table.name, err)
+		}
+		if err := ci.Chains().CreateImm(K8sSvcPrefix+"ABCDEF", nil); err != nil {
+			t.Fatalf("failed to create chain with error: %+v", err)
+		}
+		rules := []nftableslib.Rule{
+			{
+				Counter:  &nftableslib.Counter{},
+				UserData: nftableslib.MakeRuleComment("service chain for Service Port Name default/app:http"),
+			},
+		}
+		if _, err := programChainRules(ci, K8sSvcPrefix+"ABCDEF", rules, 0); err != nil {
+			t.Fatalf("failed to program rules with error: %+v", err)
+		}
+	}
+	if len(conn.Tables) != 3 || len(conn.Chains) != 2 || len(conn.Rules) != 2 {
+		t.Fatalf("expected 3 tables, 2 chains and 2 rules to be programmed, got %d tables, %d chains and %d rules",
+			len(conn.Tables), len(conn.Chains), len(conn.Rules))
+	}
+
+	// Cleanup starts from the ruleset on the host, not from the state of the instance which programmed it
+	if err := cleanup(nftableslib.InitNFTables(conn)); err != nil {
+		t.Fatalf("cleanup failed with error: %+v", err)
+	}
+	if len(conn.Tables) != 1 || conn.Tables[0].Name != "filter" {
+		t.Errorf("expected only table \"filter\" to be left, got %+v", conn.Tables)
+	}
+	if len(conn.Chains) != 0 || len(conn.Rules) != 0 {
+		t.Errorf("expected no nfproxy chains and rules to be left, got %d chains and %d rules", len(conn.Chains), len(conn.Rules))
+	}
+	// Cleanup of a host without nfproxy tables succeeds
+	if err := cleanup(nftableslib.InitNFTables(conn)); err != nil {
+		t.Errorf("cleanup without nfproxy tables failed with error: %+v", err)
+	}
+}
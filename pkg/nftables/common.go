@@ -18,6 +18,7 @@ package nftables
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
@@ -44,6 +45,8 @@ const (
 	K8sNATServices     = "k8s-nat-services"
 	K8sNATNodeports    = "k8s-nat-nodeports"
 	K8sNATPostrouting  = "k8s-nat-postrouting"
+	// K8sNATDoMarkLB marks packets to loadbalancer ips of services in the do-mark-lb set
+	K8sNATDoMarkLB = "k8s-nat-do-mark-lb"
 
 	K8sNoEndpointsSet    = "no-endpoints"
 	K8sNodeportSet       = "nodeports"
@@ -51,12 +54,103 @@ const (
 	K8sClusterIPSet      = "cluster-ip"
 	K8sExternalIPSet     = "external-ip"
 	K8sLoadbalancerIPSet = "loadbalancer-ip"
+	// K8sNodeportAddressesSet carries node's addresses nodeports are restricted to
+	K8sNodeportAddressesSet = "nodeport-addresses"
+	// K8sMarkLBSet carries loadbalancer ips which traffic is marked with the loadbalancer mark instead of masquerading
+	K8sMarkLBSet = "do-mark-lb"
+	// K8sVIPSet carries ClusterIPs which traffic to ports not defined by their services is rejected
+	K8sVIPSet = "cluster-vips"
+	// K8sVIPPortsSet carries proto.daddr.port of Service Ports defined on ClusterIPs of K8sVIPSet, matching traffic
+	// returns before it reaches the reject rule of K8sVIPSet
+	K8sVIPPortsSet = "cluster-vip-ports"
+
+	// DefaultLoadBalancerMark is the mark of loadbalancer traffic in K8sMarkLBSet, it does not overlap masquerade mark 0x4000
+	DefaultLoadBalancerMark = 0x8000
+	// masqueradeMark is the mark of packets to masquerade
+	masqueradeMark = 0x4000
 
 	K8sSvcPrefix = "k8s-nfproxy-svc-"
 	K8sFwPrefix  = "k8s-nfproxy-fw-"
 	K8sXlbPrefix = "k8s-nfproxy-xlb-"
 
 	K8sAffinityMap = "affinity-map-"
+
+	// UnmatchedLogPrefix is the log prefix of service chains' trailing rule, it logs traffic no endpoint rule matched
+	UnmatchedLogPrefix = "nfproxy-unmatched"
+)
+
+var (
+	// baseChains are chains created in both tables at initialization
+	baseChains = []string{
+		FilterInput, FilterOutput, FilterForward, K8sFilterFirewall, K8sFilterServices, K8sFilterForward, K8sFilterDoReject,
+		NatPrerouting, NatOutput, NatPostrouting, K8sNATMarkDrop, K8sNATDoMarkMasq, K8sNATMarkMasq, K8sNATDoMasquerade,
+		K8sNATServices, K8sNATNodeports, K8sNATPostrouting, K8sNATDoMarkLB,
+	}
+	// serviceChainPrefixes are prefixes of chains programmed for Service Ports
+	serviceChainPrefixes = []string{K8sSvcPrefix, K8sFwPrefix, K8sXlbPrefix}
+)
+
+// OverlapsReservedChains returns true if names of chains starting with the prefix might be names of base chains
+// or chains of Service Ports.
+func OverlapsReservedChains(prefix string) bool {
+	for _, reserved := range serviceChainPrefixes {
+		if strings.HasPrefix(prefix, reserved) || strings.HasPrefix(reserved, prefix) {
+			return true
+		}
+	}
+	for _, chain := range baseChains {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsReservedChain returns true if the chain is a base chain or a chain of a Service Port.
+func IsReservedChain(chain string) bool {
+	for _, prefix := range serviceChainPrefixes {
+		if strings.HasPrefix(chain, prefix) {
+			return true
+		}
+	}
+	for _, c := range baseChains {
+		if c == chain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddressPrecedence defines which of external ips and loadbalancer ips maps of services chain is matched first,
+// it decides how traffic to an address:port present in both maps is handled, as dnat is terminal the first match wins.
+type AddressPrecedence string
+
+const (
+	// ExternalIPFirst matches external ips before loadbalancer ips, it is the default.
+	ExternalIPFirst AddressPrecedence = "ExternalIP"
+	// LoadBalancerIPFirst matches loadbalancer ips, with their marking, before external ips.
+	LoadBalancerIPFirst AddressPrecedence = "LoadBalancerIP"
+)
+
+// NoEndpointsAction defines how traffic to services without endpoints is terminated.
+type NoEndpointsAction string
+
+const (
+	// NoEndpointsReject rejects traffic with ICMP unreachable, failing clients fast, it is the default.
+	NoEndpointsReject NoEndpointsAction = "Reject"
+	// NoEndpointsDrop silently drops traffic, not revealing existence of the service.
+	NoEndpointsDrop NoEndpointsAction = "Drop"
+	// NoEndpointsTCPReset rejects TCP traffic with TCP reset, giving clients the fastest failover, and other
+	// traffic with ICMP port unreachable.
+	NoEndpointsTCPReset NoEndpointsAction = "TCPReset"
+)
+
+const (
+	// icmpPortUnreachable and icmpv6PortUnreachable are port unreachable codes of ICMP and ICMPv6
+	icmpPortUnreachable   = 3
+	icmpv6PortUnreachable = 4
 )
 
 func setActionVerdict(key int, chain ...string) *nftableslib.RuleAction {
@@ -77,7 +171,7 @@ func setIPAddr(addr string) *nftableslib.IPAddr {
 	return a
 }
 
-func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
+func setupNFProxyChains(ci nftableslib.ChainsInterface, priorities ChainPriorities) error {
 	// nat type chains
 	natChains := []struct {
 		name  string
@@ -87,7 +181,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: FilterInput,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeFilter,
-				Priority: 0,
+				Priority: priorities.Filter,
 				Hook:     nftables.ChainHookInput,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -96,7 +190,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: FilterOutput,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeFilter,
-				Priority: 0,
+				Priority: priorities.Filter,
 				Hook:     nftables.ChainHookOutput,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -105,7 +199,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: FilterForward,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeFilter,
-				Priority: 0,
+				Priority: priorities.Filter,
 				Hook:     nftables.ChainHookForward,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -130,7 +224,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: NatPrerouting,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeNAT,
-				Priority: 0,
+				Priority: priorities.DNAT,
 				Hook:     nftables.ChainHookPrerouting,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -139,7 +233,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: NatOutput,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeNAT,
-				Priority: 0,
+				Priority: priorities.DNAT,
 				Hook:     nftables.ChainHookOutput,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -148,7 +242,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name: NatPostrouting,
 			attrs: &nftableslib.ChainAttributes{
 				Type:     nftables.ChainTypeNAT,
-				Priority: 0,
+				Priority: priorities.SNAT,
 				Hook:     nftables.ChainHookPostrouting,
 				Policy:   nftableslib.ChainPolicyAccept,
 			},
@@ -181,6 +275,10 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 			name:  K8sNATPostrouting,
 			attrs: nil,
 		},
+		{
+			name:  K8sNATDoMarkLB,
+			attrs: nil,
+		},
 	}
 	for _, chain := range natChains {
 		if err := ci.Chains().CreateImm(chain.name, chain.attrs); err != nil {
@@ -191,7 +289,7 @@ func setupNFProxyChains(ci nftableslib.ChainsInterface) error {
 	return nil
 }
 
-func setupStaticNATRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInterface, cidr string, ipv6 bool) error {
+func setupStaticNATRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInterface, cidr string, ipv6 bool, precedence AddressPrecedence) error {
 	preroutingRules := []nftableslib.Rule{
 		{
 			Counter: &nftableslib.Counter{},
@@ -258,19 +356,6 @@ func setupStaticNATRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInt
 		return err
 	}
 
-	masqAction, _ := nftableslib.SetMasq(false, false, false)
-	k8sDoMasqRules := []nftableslib.Rule{
-		{
-			Counter: &nftableslib.Counter{},
-		},
-		{
-			Action: masqAction,
-		},
-	}
-	if _, err := programChainRules(ci, K8sNATDoMasquerade, k8sDoMasqRules, 0); err != nil {
-		return err
-	}
-
 	k8sPostroutingRules := []nftableslib.Rule{
 		{
 			Counter: &nftableslib.Counter{},
@@ -351,6 +436,8 @@ func setupStaticNATRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInt
 				Elements: concatElements,
 			},
 		},
+	}
+	externalIPRules := []nftableslib.Rule{
 		{
 			Concat: &nftableslib.Concat{
 				VMap: true,
@@ -362,28 +449,39 @@ func setupStaticNATRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInt
 				Elements: concatElements,
 			},
 		},
+	}
+	loadBalancerIPRules := []nftableslib.Rule{
 		{
+			// Loadbalancer traffic is marked before it is load balanced, the mark chain returns
 			Concat: &nftableslib.Concat{
 				VMap: true,
 				SetRef: &nftableslib.SetRef{
-					Name:  sets[K8sLoadbalancerIPSet].Name,
-					ID:    sets[K8sLoadbalancerIPSet].ID,
+					Name:  sets[K8sMarkLBSet].Name,
+					ID:    sets[K8sMarkLBSet].ID,
 					IsMap: true,
 				},
 				Elements: concatElements,
 			},
 		},
-		// Must be the last rule
 		{
-			Fib: &nftableslib.Fib{
-				ResultADDRTYPE: true,
-				FlagDADDR:      true,
-				Data:           []byte{unix.RTN_LOCAL},
+			Concat: &nftableslib.Concat{
+				VMap: true,
+				SetRef: &nftableslib.SetRef{
+					Name:  sets[K8sLoadbalancerIPSet].Name,
+					ID:    sets[K8sLoadbalancerIPSet].ID,
+					IsMap: true,
+				},
+				Elements: concatElements,
 			},
-			UserData: nftableslib.MakeRuleComment("kubernetes service nodeports; this must be the last rule in this chain"),
-			Action:   setActionVerdict(unix.NFT_JUMP, K8sNATNodeports),
 		},
 	}
+	if precedence == LoadBalancerIPFirst {
+		staticServiceRules = append(staticServiceRules, loadBalancerIPRules...)
+		staticServiceRules = append(staticServiceRules, externalIPRules...)
+	} else {
+		staticServiceRules = append(staticServiceRules, externalIPRules...)
+		staticServiceRules = append(staticServiceRules, loadBalancerIPRules...)
+	}
 	if _, err := programChainRules(ci, K8sNATServices, staticServiceRules, 0); err != nil {
 		return err
 	}
@@ -610,22 +708,215 @@ func setupStaticFilterRules(ci nftableslib.ChainsInterface, clusterCIDR string)
 		return err
 	}
 
-	rejectAction, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMP_UNREACH, unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED)
+	return nil
+}
+
+// setupNoEndpointsRules programs rules of the chain terminating traffic to services without endpoints,
+// the handle of the verdict rule is returned so the action can be changed later.
+func setupNoEndpointsRules(ci nftableslib.ChainsInterface, tableFamily nftables.TableFamily) (uint64, error) {
 	k8sRejectRules := []nftableslib.Rule{
 		{
 			Counter: &nftableslib.Counter{},
 		},
-		{
+		noEndpointsVerdictRule(NoEndpointsReject, tableFamily),
+	}
+	// Programming rules for Filter Chain Firewall hook
+	ids, err := programChainRules(ci, K8sFilterDoReject, k8sRejectRules, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[len(ids)-1], nil
+}
+
+// noEndpointsVerdictRule returns the rule terminating traffic to services without endpoints with the action.
+// With TCPReset action the rule terminates all but TCP traffic, which is reset by noEndpointsTCPResetRule.
+func noEndpointsVerdictRule(action NoEndpointsAction, tableFamily nftables.TableFamily) nftableslib.Rule {
+	switch action {
+	case NoEndpointsDrop:
+		return nftableslib.Rule{
+			UserData: nftableslib.MakeRuleComment("kubernetes drop for services without endpoints"),
+			Action:   setActionVerdict(nftableslib.NFT_DROP),
+		}
+	case NoEndpointsTCPReset:
+		code := icmpPortUnreachable
+		if tableFamily == nftables.TableFamilyIPv6 {
+			code = icmpv6PortUnreachable
+		}
+		rejectAction, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMP_UNREACH, code)
+		return nftableslib.Rule{
+			Meta: &nftableslib.Meta{
+				Expr: []nftableslib.MetaExpr{
+					{Key: unix.NFT_META_L4PROTO, Value: []byte{unix.IPPROTO_TCP}, RelOp: nftableslib.NEQ},
+				},
+			},
 			UserData: nftableslib.MakeRuleComment("kubernetes reject for services without endpoints"),
 			Action:   rejectAction,
+		}
+	}
+	rejectAction, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMP_UNREACH, unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED)
+	return nftableslib.Rule{
+		UserData: nftableslib.MakeRuleComment("kubernetes reject for services without endpoints"),
+		Action:   rejectAction,
+	}
+}
+
+// noEndpointsTCPResetRule returns the rule resetting TCP traffic to services without endpoints, the rule does not
+// depend on position in the chain, as the verdict rule of TCPReset action does not match TCP.
+func noEndpointsTCPResetRule() nftableslib.Rule {
+	resetAction, _ := nftableslib.SetReject(unix.NFT_REJECT_TCP_RST, 0)
+	return nftableslib.Rule{
+		Meta: &nftableslib.Meta{
+			Expr: []nftableslib.MetaExpr{
+				{Key: unix.NFT_META_L4PROTO, Value: []byte{unix.IPPROTO_TCP}},
+			},
 		},
+		UserData: nftableslib.MakeRuleComment("kubernetes tcp reset for services without endpoints"),
+		Action:   resetAction,
 	}
-	// Programming rules for Filter Chain Firewall hook
-	if _, err := programChainRules(ci, K8sFilterDoReject, k8sRejectRules, 0); err != nil {
-		return err
+}
+
+// unmatchedLogRule returns the rule counting and logging packets which reach the end of a service chain, the load
+// balancing rule jumps to an endpoint chain which DNATs, so only traffic no endpoint rule matched gets there.
+func unmatchedLogRule(svcPortName string) nftableslib.Rule {
+	return nftableslib.Rule{
+		Counter:  &nftableslib.Counter{},
+		Log:      &nftableslib.Log{Key: unix.NFTA_LOG_PREFIX, Value: []byte(UnmatchedLogPrefix)},
+		UserData: ruleComment("unmatched traffic of Service Port Name " + svcPortName),
 	}
+}
 
-	return nil
+// ruleComment returns rule's comment, comments carrying names of kubernetes objects can exceed nftables limit,
+// they are truncated and the end is marked with "...".
+func ruleComment(comment string) []byte {
+	return nftableslib.MakeRuleComment(truncateComment(comment))
+}
+
+// truncateComment truncates comment exceeding nftables limit and marks the end with "..."
+func truncateComment(comment string) string {
+	if len(comment) > nftableslib.MaxCommentLength {
+		comment = comment[:nftableslib.MaxCommentLength-3] + "..."
+	}
+
+	return comment
+}
+
+// setupNodeportsJumpRule programs the rule of services chain jumping to nodeports chain, it must be the last rule
+// of the chain. An external ip which is also node's address is matched by external ip map first and as dnat is terminal,
+// the packet never reaches nodeports. The handle of the rule is returned so nodeports can be restricted later.
+func setupNodeportsJumpRule(sets map[string]*nftables.Set, ci nftableslib.ChainsInterface) (uint64, error) {
+	ids, err := programChainRules(ci, K8sNATServices, []nftableslib.Rule{nodeportsJumpRule(sets, false)}, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[0], nil
+}
+
+// nodeportsJumpRule returns the rule jumping to nodeports chain, if restricted only packets to addresses
+// in nodeport addresses set jump, otherwise packets to any node's local address do.
+func nodeportsJumpRule(sets map[string]*nftables.Set, restricted bool) nftableslib.Rule {
+	if restricted {
+		return nftableslib.Rule{
+			L3: &nftableslib.L3Rule{
+				Dst: &nftableslib.IPAddrSpec{
+					SetRef: &nftableslib.SetRef{
+						Name: sets[K8sNodeportAddressesSet].Name,
+						ID:   sets[K8sNodeportAddressesSet].ID,
+					},
+				},
+			},
+			UserData: nftableslib.MakeRuleComment("kubernetes service nodeports on nodeport addresses; this must be the last rule in this chain"),
+			Action:   setActionVerdict(unix.NFT_JUMP, K8sNATNodeports),
+		}
+	}
+	return nftableslib.Rule{
+		Fib: &nftableslib.Fib{
+			ResultADDRTYPE: true,
+			FlagDADDR:      true,
+			Data:           []byte{unix.RTN_LOCAL},
+		},
+		UserData: nftableslib.MakeRuleComment("kubernetes service nodeports; this must be the last rule in this chain"),
+		Action:   setActionVerdict(unix.NFT_JUMP, K8sNATNodeports),
+	}
+}
+
+// setupMasqueradeRules programs rules of the chain masquerading traffic, the handle of the masquerade rule
+// is returned so the source address can be changed later.
+func setupMasqueradeRules(ci nftableslib.ChainsInterface) (uint64, error) {
+	masqRule, _ := masqueradeRule("")
+	k8sDoMasqRules := []nftableslib.Rule{
+		{
+			Counter: &nftableslib.Counter{},
+		},
+		masqRule,
+	}
+	ids, err := programChainRules(ci, K8sNATDoMasquerade, k8sDoMasqRules, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[len(ids)-1], nil
+}
+
+// setupLoadBalancerMarkRules programs rules of the chain marking loadbalancer traffic, the handle of the mark
+// rule is returned so the mark can be changed later.
+func setupLoadBalancerMarkRules(ci nftableslib.ChainsInterface) (uint64, error) {
+	markLBRules := []nftableslib.Rule{
+		{
+			Counter: &nftableslib.Counter{},
+		},
+		loadBalancerMarkRule(DefaultLoadBalancerMark),
+	}
+	ids, err := programChainRules(ci, K8sNATDoMarkLB, markLBRules, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return ids[len(ids)-1], nil
+}
+
+// loadBalancerMarkRule returns the rule setting the mark of loadbalancer traffic and returning to the calling chain.
+func loadBalancerMarkRule(mark uint32) nftableslib.Rule {
+	return nftableslib.Rule{
+		Meta: &nftableslib.Meta{
+			Mark: &nftableslib.MetaMark{
+				Set:   true,
+				Value: int32(mark),
+			},
+		},
+		UserData: nftableslib.MakeRuleComment(fmt.Sprintf("mark loadbalancer packets with 0x%x", mark)),
+		Action:   setActionVerdict(unix.NFT_RETURN),
+	}
+}
+
+// masqueradeRule returns the rule translating source address of masqueraded traffic. Empty source results in
+// masquerade to the address chosen by the route, otherwise traffic is SNATed to the source address or to
+// the range of addresses "first-last".
+func masqueradeRule(source string) (nftableslib.Rule, error) {
+	if source == "" {
+		masqAction, _ := nftableslib.SetMasq(false, false, false)
+		return nftableslib.Rule{
+			Action: masqAction,
+		}, nil
+	}
+	snat := &nftableslib.NATAttributes{}
+	for i, addr := range strings.SplitN(source, "-", 2) {
+		ip := setIPAddr(addr)
+		if ip == nil {
+			return nftableslib.Rule{}, fmt.Errorf("invalid source address %s of masqueraded traffic", source)
+		}
+		snat.L3Addr[i] = ip
+	}
+	snatAction, err := nftableslib.SetSNAT(snat)
+	if err != nil {
+		return nftableslib.Rule{}, err
+	}
+
+	return nftableslib.Rule{
+		UserData: nftableslib.MakeRuleComment("snat masqueraded traffic to " + source),
+		Action:   snatAction,
+	}, nil
 }
 
 func setupK8sFilterRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInterface, ipv6 bool) error {
@@ -661,6 +952,33 @@ func setupK8sFilterRules(sets map[string]*nftables.Set, ci nftableslib.ChainsInt
 			},
 		},
 	}
+	// Traffic of a new connection to ClusterIP which is not DNATed and does not match a defined port is rejected,
+	// both sets stay empty unless default deny of service VIPs is enabled.
+	servicesRules = append(servicesRules,
+		nftableslib.Rule{
+			Concat: &nftableslib.Concat{
+				VMap: true,
+				SetRef: &nftableslib.SetRef{
+					Name:  sets[K8sVIPPortsSet].Name,
+					ID:    sets[K8sVIPPortsSet].ID,
+					IsMap: true,
+				},
+				Elements: concatElements,
+			},
+		},
+		nftableslib.Rule{
+			L3: &nftableslib.L3Rule{
+				Dst: &nftableslib.IPAddrSpec{
+					SetRef: &nftableslib.SetRef{
+						Name: sets[K8sVIPSet].Name,
+						ID:   sets[K8sVIPSet].ID,
+					},
+				},
+			},
+			UserData: nftableslib.MakeRuleComment("kubernetes reject for service VIPs on undefined ports"),
+			Action:   setActionVerdict(unix.NFT_JUMP, K8sFilterDoReject),
+		},
+	)
 	if _, err := programChainRules(ci, K8sFilterServices, servicesRules, 0); err != nil {
 		return err
 	}
@@ -674,7 +992,7 @@ func setupCommonSets(sets map[string]*nftables.Set, si nftableslib.SetsInterface
 	if ipv6 {
 		dataType = nftables.TypeIP6Addr
 	}
-	for _, setName := range []string{K8sNoEndpointsSet, K8sMarkMasqSet, K8sClusterIPSet, K8sExternalIPSet, K8sLoadbalancerIPSet} {
+	for _, setName := range []string{K8sNoEndpointsSet, K8sMarkMasqSet, K8sClusterIPSet, K8sExternalIPSet, K8sLoadbalancerIPSet, K8sMarkLBSet, K8sVIPPortsSet} {
 		s := nftableslib.SetAttributes{
 			Name:     setName,
 			Constant: false,
@@ -701,6 +1019,28 @@ func setupCommonSets(sets map[string]*nftables.Set, si nftableslib.SetsInterface
 		return fmt.Errorf("failed to create set %s with error: %+v", K8sNodeportSet, err)
 	}
 	sets[K8sNodeportSet] = set
+	// Create set for addresses nodeports are restricted to
+	s = nftableslib.SetAttributes{
+		Name:     K8sNodeportAddressesSet,
+		Constant: false,
+		KeyType:  dataType,
+	}
+	set, err = si.Sets().CreateSet(&s, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create set %s with error: %+v", K8sNodeportAddressesSet, err)
+	}
+	sets[K8sNodeportAddressesSet] = set
+	// Create set for ClusterIPs with default deny
+	s = nftableslib.SetAttributes{
+		Name:     K8sVIPSet,
+		Constant: false,
+		KeyType:  dataType,
+	}
+	set, err = si.Sets().CreateSet(&s, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create set %s with error: %+v", K8sVIPSet, err)
+	}
+	sets[K8sVIPSet] = set
 
 	return nil
 }
@@ -709,19 +1049,26 @@ func programCommonChainsRules(nfti *NFTInterface, clusterCIDRIPv4, clusterCIDRIP
 	var clusterCIDR string
 	var ipv6 bool
 	var si nftableslib.SetsInterface
+	var tableFamily nftables.TableFamily
+	nfti.masqueradeRuleID = make(map[nftables.TableFamily]uint64)
+	nfti.nodeportsRuleID = make(map[nftables.TableFamily]uint64)
+	nfti.nodeportAddresses = make(map[nftables.TableFamily][]string)
+	nfti.lbMarkRuleID = make(map[nftables.TableFamily]uint64)
 	for _, ci := range []nftableslib.ChainsInterface{nfti.CIv4, nfti.CIv6} {
 		if ci == nfti.CIv4 {
 			clusterCIDR = clusterCIDRIPv4
 			ipv6 = false
 			si = nfti.SIv4
+			tableFamily = nftables.TableFamilyIPv4
 		} else {
 			clusterCIDR = clusterCIDRIPv6
 			ipv6 = true
 			si = nfti.SIv6
+			tableFamily = nftables.TableFamilyIPv6
 		}
 		// Programming chains and initial rules only if clusterCIDR is specified
 		if clusterCIDR != "" {
-			if err := setupNFProxyChains(ci); err != nil {
+			if err := setupNFProxyChains(ci, nfti.priorities); err != nil {
 				return err
 			}
 			if err := setupCommonSets(nfti.sets, si, ipv6); err != nil {
@@ -730,12 +1077,32 @@ func programCommonChainsRules(nfti *NFTInterface, clusterCIDRIPv4, clusterCIDRIP
 			if err := setupStaticFilterRules(ci, clusterCIDR); err != nil {
 				return err
 			}
+			id, err := setupNoEndpointsRules(ci, tableFamily)
+			if err != nil {
+				return err
+			}
+			nfti.noEndpointsRuleID[tableFamily] = id
 			if err := setupK8sFilterRules(nfti.sets, ci, ipv6); err != nil {
 				return err
 			}
-			if err := setupStaticNATRules(nfti.sets, ci, clusterCIDR, ipv6); err != nil {
+			if err := setupStaticNATRules(nfti.sets, ci, clusterCIDR, ipv6, nfti.precedence); err != nil {
+				return err
+			}
+			id, err = setupMasqueradeRules(ci)
+			if err != nil {
+				return err
+			}
+			nfti.masqueradeRuleID[tableFamily] = id
+			id, err = setupNodeportsJumpRule(nfti.sets, ci)
+			if err != nil {
+				return err
+			}
+			nfti.nodeportsRuleID[tableFamily] = id
+			id, err = setupLoadBalancerMarkRules(ci)
+			if err != nil {
 				return err
 			}
+			nfti.lbMarkRuleID[tableFamily] = id
 		}
 	}
 	return nil
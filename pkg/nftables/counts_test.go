@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestGetTableCounts(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	for _, table := range []struct {
+		name   string
+		family nftables.TableFamily
+	}{
+		{name: nfV4TableName, family: nftables.TableFamilyIPv4},
+		{name: nfV6TableName, family: nftables.TableFamilyIPv6},
+	} {
+		if err := ti.Tables().CreateImm(table.name, table.family); err != nil {
+			t.Fatalf("failed to create table %s with error: %+v", table.name, err)
+		}
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	// Programming 3 ipv4 services with an endpoint and an affinity map each, service chain gets a counter
+	// and a load balancing rule, the latter comes with an anonymous map
+	for i := 0; i < 3; i++ {
+		svcID := fmt.Sprintf("SVC%d", i)
+		if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, svcID); err != nil {
+			t.Fatalf("failed to add service chains with error: %+v", err)
+		}
+		epchains := []*EPRule{{Rule: Rule{Chain: "k8s-nfproxy-sep-" + svcID}}}
+		if _, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, svcID, epchains, nil, false, "default/app:http", false); err != nil {
+			t.Fatalf("failed to program service chain with error: %+v", err)
+		}
+		if err := AddServiceAffinityMap(nfti, nftables.TableFamilyIPv4, svcID, 10800); err != nil {
+			t.Fatalf("failed to add affinity map with error: %+v", err)
+		}
+	}
+
+	counts, err := GetTableCounts(nfti, nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get table counts with error: %+v", err)
+	}
+	if want := (TableCounts{Chains: 3, Rules: 6, Sets: 6}); counts != want {
+		t.Errorf("expected ipv4 table counts %+v, got %+v", want, counts)
+	}
+	counts, err = GetTableCounts(nfti, nftables.TableFamilyIPv6)
+	if err != nil {
+		t.Fatalf("failed to get table counts with error: %+v", err)
+	}
+	if counts != (TableCounts{}) {
+		t.Errorf("expected empty ipv6 table, got %+v", counts)
+	}
+}
+
+func TestGetChainCounter(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	chain := "k8s-nfproxy-sep-ABCDEF"
+	if _, err := AddEndpointRules(nfti, nftables.TableFamilyIPv4, chain, "10.1.1.1", "TCP", 8080, "SVCID", "", ""); err != nil {
+		t.Fatalf("failed to add endpoint rules with error: %+v", err)
+	}
+	// Traffic hits the endpoint's counter
+	var found bool
+	for _, rule := range conn.Rules {
+		for _, e := range rule.Exprs {
+			if c, ok := e.(*expr.Counter); ok {
+				c.Packets, c.Bytes = 3, 180
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected endpoint chain to carry a counter")
+	}
+	counter, err := GetChainCounter(nfti, nftables.TableFamilyIPv4, chain)
+	if err != nil {
+		t.Fatalf("failed to read counter with error: %+v", err)
+	}
+	if counter != (Counter{Packets: 3, Bytes: 180}) {
+		t.Errorf("expected 3 packets and 180 bytes, got %+v", counter)
+	}
+	if _, err := GetChainCounter(nfti, nftables.TableFamilyIPv4, "k8s-nfproxy-sep-UNKNOWN"); err == nil {
+		t.Errorf("expected error for a chain without counter")
+	}
+}
+
+func TestVerifyRules(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	chain := "k8s-nfproxy-sep-ABCDEF"
+	ruleIDs, err := AddEndpointRules(nfti, nftables.TableFamilyIPv4, chain, "10.1.1.1", "TCP", 8080, "SVCID", "", "")
+	if err != nil {
+		t.Fatalf("failed to add endpoint rules with error: %+v", err)
+	}
+	if err := VerifyRules(nfti, nftables.TableFamilyIPv4, chain, ruleIDs); err != nil {
+		t.Fatalf("expected all rules to be found, got error: %+v", err)
+	}
+	// Kernel silently lost the last rule
+	conn.DelRule(&nftables.Rule{Handle: ruleIDs[len(ruleIDs)-1]})
+	if err := VerifyRules(nfti, nftables.TableFamilyIPv4, chain, ruleIDs); err == nil {
+		t.Errorf("expected verification to report the missing rule")
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+// Conn is a netfilter connection keeping tables, chains, rules and sets in memory, changes are applied
+// immediately and flushes are counted. It is used in tests in place of the kernel.
+type Conn struct {
+	sync.Mutex
+	handle  uint64
+	Flushes int
+	Tables  []*nftables.Table
+	Chains  []*nftables.Chain
+	Rules   []*nftables.Rule
+	Sets    []*nftables.Set
+	// Elements are kept per set
+	Elements map[*nftables.Set][]nftables.SetElement
+}
+
+var _ nftableslib.NetNS = &Conn{}
+
+func sameTable(t1, t2 *nftables.Table) bool {
+	return t1.Name == t2.Name && t1.Family == t2.Family
+}
+
+func (c *Conn) Flush() error {
+	c.Lock()
+	defer c.Unlock()
+	c.Flushes++
+	return nil
+}
+
+func (c *Conn) FlushRuleset() {
+	c.Lock()
+	defer c.Unlock()
+	c.handle, c.Flushes = 0, 0
+	c.Tables, c.Chains, c.Rules, c.Sets, c.Elements = nil, nil, nil, nil, nil
+}
+
+func (c *Conn) AddTable(t *nftables.Table) *nftables.Table {
+	c.Lock()
+	defer c.Unlock()
+	c.Tables = append(c.Tables, t)
+	return t
+}
+
+func (c *Conn) DelTable(t *nftables.Table) {
+	c.Lock()
+	defer c.Unlock()
+	tables := c.Tables[:0]
+	for _, table := range c.Tables {
+		if !sameTable(table, t) {
+			tables = append(tables, table)
+		}
+	}
+	c.Tables = tables
+	// Deleting a table deletes everything it contains
+	chains := c.Chains[:0]
+	for _, chain := range c.Chains {
+		if !sameTable(chain.Table, t) {
+			chains = append(chains, chain)
+		}
+	}
+	c.Chains = chains
+	rules := c.Rules[:0]
+	for _, rule := range c.Rules {
+		if !sameTable(rule.Table, t) {
+			rules = append(rules, rule)
+		}
+	}
+	c.Rules = rules
+	sets := c.Sets[:0]
+	for _, set := range c.Sets {
+		if !sameTable(set.Table, t) {
+			sets = append(sets, set)
+		}
+	}
+	c.Sets = sets
+}
+
+func (c *Conn) ListTables() ([]*nftables.Table, error) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*nftables.Table{}, c.Tables...), nil
+}
+
+func (c *Conn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	c.Lock()
+	defer c.Unlock()
+	c.Chains = append(c.Chains, ch)
+	return ch
+}
+
+func (c *Conn) DelChain(ch *nftables.Chain) {
+	c.Lock()
+	defer c.Unlock()
+	chains := c.Chains[:0]
+	for _, chain := range c.Chains {
+		if !sameTable(chain.Table, ch.Table) || chain.Name != ch.Name {
+			chains = append(chains, chain)
+		}
+	}
+	c.Chains = chains
+}
+
+func (c *Conn) ListChains() ([]*nftables.Chain, error) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]*nftables.Chain{}, c.Chains...), nil
+}
+
+func (c *Conn) AddRule(r *nftables.Rule) *nftables.Rule {
+	c.Lock()
+	defer c.Unlock()
+	// As the kernel does, a rule carrying a handle replaces the rule with the handle
+	for i, rule := range c.Rules {
+		if r.Handle != 0 && rule.Handle == r.Handle {
+			c.Rules[i] = r
+			return r
+		}
+	}
+	c.handle++
+	r.Handle = c.handle
+	c.Rules = append(c.Rules, r)
+	return r
+}
+
+func (c *Conn) InsertRule(r *nftables.Rule) *nftables.Rule  { return c.AddRule(r) }
+func (c *Conn) ReplaceRule(r *nftables.Rule) *nftables.Rule { return r }
+
+func (c *Conn) DelRule(r *nftables.Rule) error {
+	c.Lock()
+	defer c.Unlock()
+	rules := c.Rules[:0]
+	for _, rule := range c.Rules {
+		if rule.Handle != r.Handle {
+			rules = append(rules, rule)
+		}
+	}
+	c.Rules = rules
+	return nil
+}
+
+func (c *Conn) GetRule(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	c.Lock()
+	defer c.Unlock()
+	var rules []*nftables.Rule
+	for _, rule := range c.Rules {
+		if sameTable(rule.Table, t) && rule.Chain.Name == ch.Name {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (c *Conn) AddSet(s *nftables.Set, elements []nftables.SetElement) error {
+	c.Lock()
+	c.Sets = append(c.Sets, s)
+	c.Unlock()
+	if len(elements) != 0 {
+		return c.SetAddElements(s, elements)
+	}
+	return nil
+}
+
+func (c *Conn) DelSet(s *nftables.Set) {
+	c.Lock()
+	defer c.Unlock()
+	sets := c.Sets[:0]
+	for _, set := range c.Sets {
+		if !sameTable(set.Table, s.Table) || set.Name != s.Name {
+			sets = append(sets, set)
+			continue
+		}
+		delete(c.Elements, set)
+	}
+	c.Sets = sets
+}
+
+func (c *Conn) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	c.Lock()
+	defer c.Unlock()
+	var sets []*nftables.Set
+	for _, set := range c.Sets {
+		if sameTable(set.Table, t) {
+			sets = append(sets, set)
+		}
+	}
+	return sets, nil
+}
+
+func (c *Conn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	c.Lock()
+	defer c.Unlock()
+	for _, set := range c.Sets {
+		if sameTable(set.Table, t) && set.Name == name {
+			return set, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *Conn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	c.Lock()
+	defer c.Unlock()
+	return append([]nftables.SetElement{}, c.Elements[s]...), nil
+}
+
+func (c *Conn) SetAddElements(s *nftables.Set, elements []nftables.SetElement) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.Elements == nil {
+		c.Elements = make(map[*nftables.Set][]nftables.SetElement)
+	}
+	c.Elements[s] = append(c.Elements[s], elements...)
+	return nil
+}
+
+func (c *Conn) SetDeleteElements(s *nftables.Set, elements []nftables.SetElement) error {
+	c.Lock()
+	defer c.Unlock()
+	kept := c.Elements[s][:0]
+	for _, element := range c.Elements[s] {
+		deleted := false
+		for _, e := range elements {
+			if bytes.Equal(element.Key, e.Key) {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, element)
+		}
+	}
+	c.Elements[s] = kept
+	return nil
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package nftables
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/sbezverk/nftableslib"
 	"golang.org/x/sys/unix"
 	v1 "k8s.io/api/core/v1"
@@ -43,6 +46,36 @@ type NFTInterface struct {
 	SIv4            nftableslib.SetsInterface
 	SIv6            nftableslib.SetsInterface
 	sets            map[string]*nftables.Set
+	// noEndpointsRuleID carries handles of the verdict rules of No Endpoints chains
+	noEndpointsRuleID map[nftables.TableFamily]uint64
+	// noEndpointsTCPRuleID carries handles of the TCP reset rules of No Endpoints chains, programmed with TCPReset action
+	noEndpointsTCPRuleID map[nftables.TableFamily]uint64
+	// masqueradeRuleID carries handles of the rules translating source address of masqueraded traffic
+	masqueradeRuleID map[nftables.TableFamily]uint64
+	// nodeportsRuleID carries handles of the rules jumping to nodeports chain, nodeportAddresses carries
+	// addresses nodeports are restricted to, no addresses means nodeports are open on all node's addresses
+	nodeportsRuleID   map[nftables.TableFamily]uint64
+	nodeportAddresses map[nftables.TableFamily][]string
+	// lbMarkRuleID carries handles of the rules marking loadbalancer traffic
+	lbMarkRuleID map[nftables.TableFamily]uint64
+	// conn is the netfilter connection used to read back rules, nftableslib does not expose rules' expressions
+	conn nftableslib.NetNS
+	// priorities are hook priorities of nfproxy's base chains
+	priorities ChainPriorities
+	// precedence defines which of external ips and loadbalancer ips maps of services chain is matched first
+	precedence AddressPrecedence
+}
+
+// ChainPriorities carries hook priorities of nfproxy's base chains. Base chains of other tables, for example
+// CNI's, at the same hook run before nfproxy's chains if their priority is lower and after if it is higher,
+// zero values keep nfproxy's chains at the default priority 0.
+type ChainPriorities struct {
+	// Filter is the priority of input, output and forward filter chains
+	Filter nftables.ChainPriority
+	// DNAT is the priority of prerouting and output nat chains, which translate services' addresses
+	DNAT nftables.ChainPriority
+	// SNAT is the priority of postrouting nat chain, which masquerades traffic
+	SNAT nftables.ChainPriority
 }
 
 // Rule defines nftables chain name, rule and once programmed, rule id is stored in RuleID slice.
@@ -87,19 +120,22 @@ type SVCnft struct {
 	ServiceID     string
 }
 
-// InitNFTables initializes connection to netfilter and instantiates nftables table interface
-func InitNFTables(clusterCIDRIPv4, clusterCIDRIPv6 string) (*NFTInterface, error) {
+// InitNFTables initializes connection to netfilter and instantiates nftables table interface, base chains
+// are created at priorities hook priorities and services chain matches addresses in precedence order.
+func InitNFTables(clusterCIDRIPv4, clusterCIDRIPv6 string, priorities ChainPriorities, precedence AddressPrecedence) (*NFTInterface, error) {
 	//  Initializing connection to netfilter
-	ti := initNFTables()
+	return NewNFTInterface(nftableslib.InitConn(), clusterCIDRIPv4, clusterCIDRIPv6, priorities, precedence)
+}
+
+// NewNFTInterface instantiates nftables table interface over the netfilter connection conn, it allows
+// to program nfproxy tables over an in-memory connection in tests.
+func NewNFTInterface(conn nftableslib.NetNS, clusterCIDRIPv4, clusterCIDRIPv6 string, priorities ChainPriorities, precedence AddressPrecedence) (*NFTInterface, error) {
+	ti := nftableslib.InitNFTables(conn)
 
 	// TODO (sbezverk) Consider rebuilding data structures based on discovered data
-	if ti.Tables().Exist(nfV4TableName, nftables.TableFamilyIPv4) {
-		// Table already exists, removing it
-		ti.Tables().DeleteImm(nfV4TableName, nftables.TableFamilyIPv4)
-	}
-	if ti.Tables().Exist(nfV6TableName, nftables.TableFamilyIPv6) {
-		// Table already exists, removing it
-		ti.Tables().DeleteImm(nfV6TableName, nftables.TableFamilyIPv6)
+	// Tables left by a previous run are removed
+	if err := cleanup(ti); err != nil {
+		return nil, err
 	}
 
 	// Creating required tables for ipv4 and ipv6 families
@@ -116,6 +152,10 @@ func InitNFTables(clusterCIDRIPv4, clusterCIDRIPv6 string) (*NFTInterface, error
 	nfti.ClusterCidrIpv4 = clusterCIDRIPv4
 	nfti.ClusterCidrIpv6 = clusterCIDRIPv6
 	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	nfti.conn = conn
+	nfti.priorities = priorities
+	nfti.precedence = precedence
 
 	if err := programCommonChainsRules(nfti, clusterCIDRIPv4, clusterCIDRIPv6); err != nil {
 		return nil, err
@@ -124,6 +164,31 @@ func InitNFTables(clusterCIDRIPv4, clusterCIDRIPv6 string) (*NFTInterface, error
 	return nfti, nil
 }
 
+// Cleanup removes nfproxy tables together with all their chains, rules and sets. Tables are looked up
+// on the host, so it does not depend on any state of a running nfproxy.
+func Cleanup() error {
+	return cleanup(initNFTables())
+}
+
+func cleanup(ti nftableslib.TablesInterface) error {
+	for _, table := range []struct {
+		name   string
+		family nftables.TableFamily
+	}{
+		{name: nfV4TableName, family: nftables.TableFamilyIPv4},
+		{name: nfV6TableName, family: nftables.TableFamilyIPv6},
+	} {
+		if !ti.Tables().Exist(table.name, table.family) {
+			continue
+		}
+		if err := ti.Tables().DeleteImm(table.name, table.family); err != nil {
+			return fmt.Errorf("failed to delete table %s with error: %+v", table.name, err)
+		}
+	}
+
+	return nil
+}
+
 func initNFTables() nftableslib.TablesInterface {
 	conn := nftableslib.InitConn()
 	return nftableslib.InitNFTables(conn)
@@ -157,18 +222,28 @@ func getNFTInterface(ti nftableslib.TablesInterface) (*NFTInterface, error) {
 }
 
 // AddEndpointRules defines function which creates new nftables chain, rule and
-// if successful return rule ID.
+// if successful return rule ID. svcPortName and appProtocol are optional Service Port Name the endpoint
+// belongs to and application protocol of the endpoint's port, they are added to the rules' comment.
 func AddEndpointRules(nfti *NFTInterface, tableFamily nftables.TableFamily, chain string,
-	ipaddr string, proto v1.Protocol, port int32, serviceID string) ([]uint64, error) {
+	ipaddr string, proto v1.Protocol, port int32, serviceID string, svcPortName string, appProtocol string) ([]uint64, error) {
 	ci := ciForTableFamily(nfti, tableFamily)
-	dnat := &nftableslib.NATAttributes{
-		L3Addr:      [2]*nftableslib.IPAddr{setIPAddr(ipaddr)},
-		FullyRandom: true,
+	rules := endpointRules(ipaddr, port, serviceID, svcPortName, appProtocol)
+	if err := ci.Chains().CreateImm(chain, nil); err != nil {
+		return nil, fmt.Errorf("AddEndpointRules: ci.Chains().CreateImm exit with error: %+v", err)
 	}
-	if port != 0 {
-		dnat.Port = [2]uint16{uint16(port)}
+	id, err := programChainRules(ci, chain, rules, 0)
+	if err != nil {
+		return nil, fmt.Errorf("AddEndpointRules: programChainRules exit with error: %+v", err)
 	}
-	dnatAction, _ := nftableslib.SetDNAT(dnat)
+
+	return id, nil
+}
+
+// endpointRules returns rules of an endpoint's chain, the first rule carries a comment with the service
+// the endpoint belongs to and endpoint's application protocol if it is known. If Service Port Name is given,
+// the comment identifies the endpoint by its address and Service Port Name instead of service's chain.
+func endpointRules(ipaddr string, port int32, serviceID string, svcPortName string, appProtocol string) []nftableslib.Rule {
+	dnatAction, _ := nftableslib.SetDNAT(endpointDNATAttributes(ipaddr, port))
 	rules := []nftableslib.Rule{
 		{
 			Counter: &nftableslib.Counter{},
@@ -191,15 +266,60 @@ func AddEndpointRules(nfti *NFTInterface, tableFamily nftables.TableFamily, chai
 			Action: dnatAction,
 		},
 	}
-	if serviceID != "" {
-		rules[0].UserData = nftableslib.MakeRuleComment("endpoint for " + K8sSvcPrefix + serviceID)
+	var comment string
+	switch {
+	case svcPortName != "":
+		comment = "endpoint " + ipaddr + " of Service Port Name " + svcPortName
+	case serviceID != "":
+		comment = "endpoint for " + K8sSvcPrefix + serviceID
 	}
-	if err := ci.Chains().CreateImm(chain, nil); err != nil {
-		return nil, fmt.Errorf("AddEndpointRules: ci.Chains().CreateImm exit with error: %+v", err)
+	if comment != "" {
+		if appProtocol != "" {
+			comment += " app protocol " + appProtocol
+		}
+		rules[0].UserData = ruleComment(comment)
 	}
-	id, err := programChainRules(ci, chain, rules, 0)
+
+	return rules
+}
+
+// endpointDNATAttributes returns DNAT attributes for an endpoint, port of 0 results in DNAT
+// rewriting only the destination address and keeping the original destination port.
+func endpointDNATAttributes(ipaddr string, port int32) *nftableslib.NATAttributes {
+	dnat := &nftableslib.NATAttributes{
+		L3Addr:      [2]*nftableslib.IPAddr{setIPAddr(ipaddr)},
+		FullyRandom: true,
+	}
+	if port != 0 {
+		dnat.Port = [2]uint16{uint16(port)}
+	}
+
+	return dnat
+}
+
+// ReplaceEndpointDNATRule replaces DNAT rule ruleID of an endpoint's chain with DNAT to port, port of 0 keeps the
+// original destination port. The new rule is added right after the old one before the old one is deleted, so the
+// endpoint translates traffic throughout the change. ID of the new rule is returned.
+func ReplaceEndpointDNATRule(nfti *NFTInterface, tableFamily nftables.TableFamily, chain string, ruleID uint64, ipaddr string, port int32) (uint64, error) {
+	ci := ciForTableFamily(nfti, tableFamily)
+	ri, err := ci.Chains().Chain(chain)
 	if err != nil {
-		return nil, fmt.Errorf("AddEndpointRules: programChainRules exit with error: %+v", err)
+		return 0, fmt.Errorf("fail to get rules' interface for endpoint chain %s with error: %+v", chain, err)
+	}
+	dnatAction, err := nftableslib.SetDNAT(endpointDNATAttributes(ipaddr, port))
+	if err != nil {
+		return 0, err
+	}
+	id, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: dnatAction, Position: int(ruleID)})
+	if err != nil {
+		return 0, fmt.Errorf("fail to add DNAT rule to endpoint chain %s with error: %+v", chain, err)
+	}
+	if err := ri.Rules().DeleteImm(ruleID); err != nil {
+		// Old rule keeps translating traffic, the new one is removed
+		if err := ri.Rules().DeleteImm(id); err != nil {
+			klog.Errorf("failed to delete DNAT rule %d of endpoint chain %s with error: %+v", id, chain, err)
+		}
+		return 0, fmt.Errorf("fail to delete DNAT rule %d of endpoint chain %s with error: %+v", ruleID, chain, err)
 	}
 
 	return id, nil
@@ -273,6 +393,311 @@ func DeleteEndpointRules(nfti *NFTInterface, tableFamily nftables.TableFamily, c
 	return nil
 }
 
+// SetNoEndpointsAction replaces the verdict of No Endpoints chains, traffic to services without endpoints
+// is terminated with the action. TCPReset action adds TCP reset rule before the verdict stops matching TCP,
+// and other actions remove it after the verdict matches TCP again, so TCP is terminated throughout the change.
+func SetNoEndpointsAction(nfti *NFTInterface, action NoEndpointsAction) error {
+	for tableFamily, id := range nfti.noEndpointsRuleID {
+		ri, err := ciForTableFamily(nfti, tableFamily).Chains().Chain(K8sFilterDoReject)
+		if err != nil {
+			return err
+		}
+		tcpID, tcpReset := nfti.noEndpointsTCPRuleID[tableFamily]
+		if action == NoEndpointsTCPReset && !tcpReset {
+			rule := noEndpointsTCPResetRule()
+			tcpID, err = ri.Rules().CreateImm(&rule)
+			if err != nil {
+				return fmt.Errorf("failed to add tcp reset for services without endpoints with error: %+v", err)
+			}
+			if nfti.noEndpointsTCPRuleID == nil {
+				nfti.noEndpointsTCPRuleID = make(map[nftables.TableFamily]uint64)
+			}
+			nfti.noEndpointsTCPRuleID[tableFamily] = tcpID
+		}
+		rule := noEndpointsVerdictRule(action, tableFamily)
+		if err := ri.Rules().Update(&rule, id); err != nil {
+			return fmt.Errorf("failed to set action %s for services without endpoints with error: %+v", action, err)
+		}
+		if action != NoEndpointsTCPReset && tcpReset {
+			if err := ri.Rules().DeleteImm(tcpID); err != nil {
+				return fmt.Errorf("failed to remove tcp reset for services without endpoints with error: %+v", err)
+			}
+			delete(nfti.noEndpointsTCPRuleID, tableFamily)
+		}
+	}
+
+	return nil
+}
+
+// SetMasqueradeSource replaces the masquerade rule of an ip family, masqueraded traffic is SNATed to the source
+// address or to the range of addresses "first-last". Empty source restores masquerade to the address chosen by the route.
+func SetMasqueradeSource(nfti *NFTInterface, tableFamily nftables.TableFamily, source string) error {
+	id, ok := nfti.masqueradeRuleID[tableFamily]
+	if !ok {
+		return fmt.Errorf("no masquerade rule is programmed for family %v", tableFamily)
+	}
+	rule, err := masqueradeRule(source)
+	if err != nil {
+		return err
+	}
+	ri, err := ciForTableFamily(nfti, tableFamily).Chains().Chain(K8sNATDoMasquerade)
+	if err != nil {
+		return err
+	}
+	if err := ri.Rules().Update(&rule, id); err != nil {
+		return fmt.Errorf("failed to set source %s of masqueraded traffic with error: %+v", source, err)
+	}
+
+	return nil
+}
+
+// SetLoadBalancerMark replaces the mark set on packets to loadbalancer ips in K8sMarkLBSet. The mark cannot
+// carry masquerade mark 0x4000, traffic of such loadbalancer ips is not SNATed.
+func SetLoadBalancerMark(nfti *NFTInterface, mark uint32) error {
+	if mark == 0 || mark&masqueradeMark != 0 {
+		return fmt.Errorf("invalid loadbalancer mark 0x%x, mark must be non zero and must not carry masquerade mark 0x%x", mark, masqueradeMark)
+	}
+	for tableFamily, id := range nfti.lbMarkRuleID {
+		ri, err := ciForTableFamily(nfti, tableFamily).Chains().Chain(K8sNATDoMarkLB)
+		if err != nil {
+			return err
+		}
+		rule := loadBalancerMarkRule(mark)
+		if err := ri.Rules().Update(&rule, id); err != nil {
+			return fmt.Errorf("failed to set loadbalancer mark 0x%x with error: %+v", mark, err)
+		}
+	}
+
+	return nil
+}
+
+// SetNodeportAddresses restricts nodeports of an ip family to the node's addresses, the set of addresses
+// is replaced and addresses not in the list are removed. Empty list opens nodeports on all node's addresses.
+func SetNodeportAddresses(nfti *NFTInterface, tableFamily nftables.TableFamily, addrs []string) error {
+	id, ok := nfti.nodeportsRuleID[tableFamily]
+	if !ok {
+		return fmt.Errorf("no nodeports rule is programmed for family %v", tableFamily)
+	}
+	si := nfti.SIv4
+	if tableFamily == nftables.TableFamilyIPv6 {
+		si = nfti.SIv6
+	}
+	current := make(map[string]bool)
+	for _, addr := range nfti.nodeportAddresses[tableFamily] {
+		current[addr] = true
+	}
+	desired := make(map[string]bool)
+	var add, del []nftables.SetElement
+	for _, addr := range addrs {
+		element, err := addressSetElement(addr)
+		if err != nil {
+			return err
+		}
+		desired[addr] = true
+		if !current[addr] {
+			add = append(add, element)
+		}
+	}
+	for addr := range current {
+		if !desired[addr] {
+			element, _ := addressSetElement(addr)
+			del = append(del, element)
+		}
+	}
+	if len(add) != 0 {
+		if err := si.Sets().SetAddElements(K8sNodeportAddressesSet, add); err != nil {
+			return fmt.Errorf("failed to add nodeport addresses with error: %+v", err)
+		}
+	}
+	if len(del) != 0 {
+		if err := si.Sets().SetDelElements(K8sNodeportAddressesSet, del); err != nil {
+			return fmt.Errorf("failed to remove nodeport addresses with error: %+v", err)
+		}
+	}
+	// The jump rule is replaced only when nodeports change between restricted and open
+	if (len(current) == 0) != (len(desired) == 0) {
+		ri, err := ciForTableFamily(nfti, tableFamily).Chains().Chain(K8sNATServices)
+		if err != nil {
+			return err
+		}
+		rule := nodeportsJumpRule(nfti.sets, len(desired) != 0)
+		if err := ri.Rules().Update(&rule, id); err != nil {
+			return fmt.Errorf("failed to update nodeports rule with error: %+v", err)
+		}
+	}
+	nfti.nodeportAddresses[tableFamily] = append([]string{}, addrs...)
+
+	return nil
+}
+
+// addressSetElement returns the element of an address set for an ip address.
+func addressSetElement(addr string) (nftables.SetElement, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nftables.SetElement{}, fmt.Errorf("invalid address %s", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return nftables.SetElement{Key: ip}, nil
+}
+
+// GetChains returns names of all chains programmed in the table of a specific ip family.
+func GetChains(nfti *NFTInterface, tableFamily nftables.TableFamily) ([]string, error) {
+	return ciForTableFamily(nfti, tableFamily).Chains().Get()
+}
+
+// TableCounts carries numbers of chains, rules and sets programmed in a table.
+type TableCounts struct {
+	Chains int
+	Rules  int
+	Sets   int
+}
+
+// GetTableCounts reads back from the kernel numbers of chains, rules and sets programmed in the table of
+// a specific ip family.
+func GetTableCounts(nfti *NFTInterface, tableFamily nftables.TableFamily) (TableCounts, error) {
+	var counts TableCounts
+	ci := ciForTableFamily(nfti, tableFamily)
+	si := nfti.SIv4
+	if tableFamily == nftables.TableFamilyIPv6 {
+		si = nfti.SIv6
+	}
+	chains, err := ci.Chains().Get()
+	if err != nil {
+		return counts, fmt.Errorf("failed to get chains with error: %+v", err)
+	}
+	counts.Chains = len(chains)
+	for _, chain := range chains {
+		ri, err := ci.Chains().Chain(chain)
+		if err != nil {
+			return counts, err
+		}
+		// All rules programmed by nftableslib carry user data with rule's id
+		rules, err := ri.Rules().GetRulesUserData()
+		if err != nil {
+			return counts, fmt.Errorf("failed to get rules of chain %s with error: %+v", chain, err)
+		}
+		counts.Rules += len(rules)
+	}
+	sets, err := si.Sets().GetSets()
+	if err != nil {
+		return counts, fmt.Errorf("failed to get sets with error: %+v", err)
+	}
+	counts.Sets = len(sets)
+
+	return counts, nil
+}
+
+// Counter carries numbers of packets and bytes counted by a counter.
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// GetChainCounter reads back from the kernel the first counter found in a chain's rules. Service and endpoint
+// chains carry a counter in their first rule.
+func GetChainCounter(nfti *NFTInterface, tableFamily nftables.TableFamily, chain string) (Counter, error) {
+	table := nfTable(tableFamily)
+	rules, err := nfti.conn.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		return Counter{}, fmt.Errorf("failed to get rules of chain %s with error: %+v", chain, err)
+	}
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if c, ok := e.(*expr.Counter); ok {
+				return Counter{Packets: c.Packets, Bytes: c.Bytes}, nil
+			}
+		}
+	}
+
+	return Counter{}, fmt.Errorf("chain %s has no counter", chain)
+}
+
+// VerifyRules reads back rules of a chain from the kernel and confirms that rules with ruleIDs handles exist,
+// the error lists rules which are missing.
+func VerifyRules(nfti *NFTInterface, tableFamily nftables.TableFamily, chain string, ruleIDs []uint64) error {
+	return verifyRules(nfti.conn, nfTable(tableFamily), chain, ruleIDs)
+}
+
+func verifyRules(conn nftableslib.NetNS, table *nftables.Table, chain string, ruleIDs []uint64) error {
+	rules, err := conn.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		return fmt.Errorf("failed to get rules of chain %s with error: %+v", chain, err)
+	}
+	handles := make(map[uint64]bool, len(rules))
+	for _, rule := range rules {
+		handles[rule.Handle] = true
+	}
+	var missing []uint64
+	for _, id := range ruleIDs {
+		if !handles[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("rules %v of chain %s are missing in the kernel", missing, chain)
+	}
+
+	return nil
+}
+
+// nfTable returns nfproxy table of a specific ip family.
+func nfTable(tableFamily nftables.TableFamily) *nftables.Table {
+	if tableFamily == nftables.TableFamilyIPv6 {
+		return &nftables.Table{Name: nfV6TableName, Family: nftables.TableFamilyIPv6}
+	}
+
+	return &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+}
+
+// DeleteServiceChainsBatch deletes rules and chains of a Service Port in a single nftables transaction, so
+// the service is never left half deleted. If the transaction fails, nothing is deleted and chains are synced
+// back from the kernel, the caller can fall back to DeleteServiceRules and DeleteServiceChains.
+func DeleteServiceChainsBatch(nfti *NFTInterface, tableFamily nftables.TableFamily, chains SVCChain) error {
+	ci := ciForTableFamily(nfti, tableFamily)
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	if tableFamily == nftables.TableFamilyIPv6 {
+		table = &nftables.Table{Name: nfV6TableName, Family: nftables.TableFamilyIPv6}
+	}
+	names := make([]string, 0, len(chains.Chain))
+	for name := range chains.Chain {
+		// Checking all chains before anything is queued, a failure must not leave a partial batch behind
+		if _, err := ci.Chains().Chain(name); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Rules are deleted first, a chain can be deleted only when it is empty
+	for _, name := range names {
+		for _, handle := range chains.Chain[name].RuleID {
+			rule := &nftables.Rule{
+				Table:  table,
+				Chain:  &nftables.Chain{Name: name, Table: table},
+				Handle: handle,
+			}
+			if err := nfti.conn.DelRule(rule); err != nil {
+				return fmt.Errorf("failed to delete rule %d of chain %s with error: %+v", handle, name, err)
+			}
+		}
+	}
+	for _, name := range names {
+		if err := ci.Chains().Delete(name); err != nil {
+			return err
+		}
+	}
+	if err := nfti.conn.Flush(); err != nil {
+		if serr := ci.Chains().Sync(); serr != nil {
+			klog.Errorf("failed to sync chains after failed deletion with error: %+v", serr)
+		}
+		return fmt.Errorf("failed to delete chains %v in a single transaction with error: %+v", names, err)
+	}
+
+	return nil
+}
+
 // DeleteServiceRules deletes nftables rules associated with a service
 func DeleteServiceRules(nfti *NFTInterface, tableFamily nftables.TableFamily, chain string, ruleID []uint64) error {
 	ci := ciForTableFamily(nfti, tableFamily)
@@ -337,6 +762,8 @@ func GetSvcChain(tableFamily nftables.TableFamily, svcID string) map[nftables.Ta
 		Chain:  K8sSvcPrefix + svcID,
 		RuleID: nil,
 	}
+	// Firewall and external load balancer chains are not created, LoadBalancer ips jump to the service chain,
+	// so downgrade of a LoadBalancer service leaves no chains of its own behind.
 	//	chain.Chain[K8sFwPrefix+svcID] = &Rule{
 	//		Chain:  K8sFwPrefix + svcID,
 	//		RuleID: nil,
@@ -353,6 +780,12 @@ func GetSvcChain(tableFamily nftables.TableFamily, svcID string) map[nftables.Ta
 // AddToSet adds service's proto.ip.port to a set specified by set parameter
 func AddToSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16,
 	set string, chain string) error {
+	return addToSet(nfti, tableFamily, proto, addr, port, set, setActionVerdict(unix.NFT_JUMP, chain))
+}
+
+// addToSet adds proto.ip.port with the verdict ra to a set specified by set parameter
+func addToSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16,
+	set string, ra *nftableslib.RuleAction) error {
 	si := nfti.SIv4
 	ipaddr := net.ParseIP(addr).To4()
 	dataType := nftables.TypeIPAddr
@@ -363,7 +796,6 @@ func AddToSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Pro
 		klog.V(6).Infof("IPv6 Family is requested, address: [%s]", ipaddr)
 	}
 	se := []nftables.SetElement{}
-	ra := setActionVerdict(unix.NFT_JUMP, chain)
 	protoB := protoByteFromV1Proto(proto)
 	element, err := nftableslib.MakeConcatElement([]nftables.SetDatatype{nftables.TypeInetProto, dataType, nftables.TypeInetService},
 		[]nftableslib.ElementValue{{InetProto: &protoB}, {IPAddr: ipaddr}, {InetService: &port}}, ra)
@@ -392,6 +824,12 @@ func AddToSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Pro
 // RemoveFromSet removes service's proto.ip.port from a set specified by a parameter set
 func RemoveFromSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16,
 	set string, chain string) error {
+	return removeFromSet(nfti, tableFamily, proto, addr, port, set, setActionVerdict(unix.NFT_JUMP, chain))
+}
+
+// removeFromSet removes proto.ip.port with the verdict ra from a set specified by a parameter set
+func removeFromSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16,
+	set string, ra *nftableslib.RuleAction) error {
 	si := nfti.SIv4
 	ipaddr := net.ParseIP(addr).To4()
 	dataType := nftables.TypeIPAddr
@@ -402,7 +840,6 @@ func RemoveFromSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v
 	}
 
 	se := []nftables.SetElement{}
-	ra := setActionVerdict(unix.NFT_JUMP, chain)
 	protoB := protoByteFromV1Proto(proto)
 	element, err := nftableslib.MakeConcatElement([]nftables.SetDatatype{nftables.TypeInetProto, dataType, nftables.TypeInetService},
 		[]nftableslib.ElementValue{{InetProto: &protoB}, {IPAddr: ipaddr}, {InetService: &port}}, ra)
@@ -428,6 +865,57 @@ func RemoveFromSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v
 	return nil
 }
 
+// AddToVIPPortsSet adds Service Port's proto.ClusterIP.port to defined ports of service VIPs, traffic to the port is
+// not rejected by default deny of the VIP.
+func AddToVIPPortsSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16) error {
+	return addToSet(nfti, tableFamily, proto, addr, port, K8sVIPPortsSet, setActionVerdict(unix.NFT_RETURN))
+}
+
+// RemoveFromVIPPortsSet removes Service Port's proto.ClusterIP.port from defined ports of service VIPs.
+func RemoveFromVIPPortsSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16) error {
+	return removeFromSet(nfti, tableFamily, proto, addr, port, K8sVIPPortsSet, setActionVerdict(unix.NFT_RETURN))
+}
+
+// AddVIP adds ClusterIP to service VIPs with default deny, traffic to the VIP on ports not in defined ports is rejected.
+func AddVIP(nfti *NFTInterface, tableFamily nftables.TableFamily, addr string) error {
+	si := nfti.SIv4
+	if tableFamily == nftables.TableFamilyIPv6 {
+		si = nfti.SIv6
+	}
+	element, err := addressSetElement(addr)
+	if err != nil {
+		return err
+	}
+	if err := si.Sets().SetAddElements(K8sVIPSet, []nftables.SetElement{element}); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("failed to add %s to set %s with error: %+v", addr, K8sVIPSet, err)
+	}
+
+	return nil
+}
+
+// RemoveVIP removes ClusterIP from service VIPs with default deny.
+func RemoveVIP(nfti *NFTInterface, tableFamily nftables.TableFamily, addr string) error {
+	si := nfti.SIv4
+	if tableFamily == nftables.TableFamilyIPv6 {
+		si = nfti.SIv6
+	}
+	element, err := addressSetElement(addr)
+	if err != nil {
+		return err
+	}
+	if err := si.Sets().SetDelElements(K8sVIPSet, []nftables.SetElement{element}); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove %s from set %s with error: %+v", addr, K8sVIPSet, err)
+	}
+
+	return nil
+}
+
 // AddToNodeportSet adds service's port to the nodeport set
 func AddToNodeportSet(nfti *NFTInterface, tableFamily nftables.TableFamily, proto v1.Protocol, port uint16, chain string) error {
 	si := nfti.SIv4
@@ -517,9 +1005,14 @@ func DeleteServiceChains(nfti *NFTInterface, tableFamily nftables.TableFamily, s
 }
 
 // ProgramServiceEndpoints programms endpoints to the service chain, if multiple endpoint exists, endpoint rules
-// will be programmed for loadbalancing.
+// will be programmed for loadbalancing. An endpoint is selected by a single numgen lookup into an anonymous verdict
+// map of all endpoints' chains, "numgen inc mod N vmap { 0 : jump ep0, ... }", so the cost of the selection does
+// not grow with the number of endpoints. nftableslib ignores the requested numgen mode, endpoints are selected
+// round robin. If unmatchedLog is true, the chain's first programming appends a rule
+// logging traffic which no endpoint rule matched, the rule stays the last one across updates and is deleted
+// with the other rules of the chain.
 func ProgramServiceEndpoints(nfti *NFTInterface, tableFamily nftables.TableFamily, svcID string, epchains []*EPRule, ruleID []uint64,
-	withAffinity bool, svcPortName string) ([]uint64, error) {
+	withAffinity bool, svcPortName string, unmatchedLog bool) ([]uint64, error) {
 	var id []uint64
 
 	chain := K8sSvcPrefix + svcID
@@ -532,7 +1025,7 @@ func ProgramServiceEndpoints(nfti *NFTInterface, tableFamily nftables.TableFamil
 	rules := []nftableslib.Rule{
 		nftableslib.Rule{
 			Counter:  &nftableslib.Counter{},
-			UserData: nftableslib.MakeRuleComment("service chain for Service Port Name " + svcPortName),
+			UserData: ruleComment("service chain for Service Port Name " + svcPortName),
 		},
 	}
 	// If Service Port has Session Affinity then MatchAct rule must be inserted before normal load balancing rule.
@@ -579,6 +1072,9 @@ func ProgramServiceEndpoints(nfti *NFTInterface, tableFamily nftables.TableFamil
 	})
 	if len(ruleID) == 0 {
 		// Since ruleID len is 0, it is the first time when the service has endpoints' rule programmed
+		if unmatchedLog {
+			rules = append(rules, unmatchedLogRule(svcPortName))
+		}
 		id, err = programChainRules(ci, chain, rules, 0)
 		if err != nil {
 			return nil, fmt.Errorf("fail to program endpoints rules for service chain %s with error: %+v", chain, err)
@@ -708,6 +1204,44 @@ func DeleteServiceAffinityMap(nfti *NFTInterface, tableFamily nftables.TableFami
 	return nil
 }
 
+// DeleteAffinityMapEntries removes from Service Port's affinity map all entries pointing to the endpoint with index,
+// the index identifies endpoint's chain in the MatchAct rule's vmap.
+func DeleteAffinityMapEntries(nfti *NFTInterface, tableFamily nftables.TableFamily, svcID string, index int) error {
+	si := nfti.SIv4
+	if tableFamily == nftables.TableFamilyIPv6 {
+		si = nfti.SIv6
+	}
+	elements, err := si.Sets().GetSetElements(K8sAffinityMap + svcID)
+	if err != nil {
+		return fmt.Errorf("failed to get elements of affinity map %s with error: %+v", K8sAffinityMap+svcID, err)
+	}
+	stale := affinityMapEntriesForIndex(elements, index)
+	if len(stale) == 0 {
+		return nil
+	}
+	if err := si.Sets().SetDelElements(K8sAffinityMap+svcID, stale); err != nil {
+		return fmt.Errorf("failed to delete %d entries from affinity map %s with error: %+v", len(stale), K8sAffinityMap+svcID, err)
+	}
+
+	return nil
+}
+
+// affinityMapEntriesForIndex returns affinity map entries which map a source address to the endpoint with index,
+// endpoint's Update rule stores the index as big endian uint32.
+func affinityMapEntriesForIndex(elements []nftables.SetElement, index int) []nftables.SetElement {
+	var entries []nftables.SetElement
+	for _, e := range elements {
+		if len(e.Val) != 4 {
+			continue
+		}
+		if binary.BigEndian.Uint32(e.Val) == uint32(index) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
 // AddServiceMatchActRule programms Service Port's MatchAct rule. This rule is inserted as a second rule (after the counter rule)
 // in order to process packet based on the content of Service Port's Affinity map. If the map has an entry for a specific source,
 // then traffic will be send to the same endpoint chain instead of round robin load balancing between available endpoints.
@@ -0,0 +1,861 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEndpointDNATAttributes(t *testing.T) {
+	tests := []struct {
+		name string
+		port int32
+		want [2]uint16
+	}{
+		{
+			name: "Rewrite to endpoint port",
+			port: 8080,
+			want: [2]uint16{8080},
+		},
+		{
+			name: "Preserve destination port",
+			port: 0,
+			want: [2]uint16{},
+		},
+	}
+	for _, tt := range tests {
+		dnat := endpointDNATAttributes("10.1.1.1", tt.port)
+		if dnat.Port != tt.want {
+			t.Errorf("Test: \"%s\" failed, expected DNAT port %v but got %v", tt.name, tt.want, dnat.Port)
+		}
+		if dnat.L3Addr[0] == nil || dnat.L3Addr[0].String() != "10.1.1.1" {
+			t.Errorf("Test: \"%s\" failed, expected DNAT address 10.1.1.1 but got %v", tt.name, dnat.L3Addr[0])
+		}
+	}
+}
+
+func TestAffinityMapEntriesForIndex(t *testing.T) {
+	elements := []nftables.SetElement{
+		{Key: []byte{10, 0, 0, 1}, Val: binaryutil.BigEndian.PutUint32(0)},
+		{Key: []byte{10, 0, 0, 2}, Val: binaryutil.BigEndian.PutUint32(1)},
+		{Key: []byte{10, 0, 0, 3}, Val: binaryutil.BigEndian.PutUint32(0)},
+	}
+	// Deleting endpoint with index 0, its entries must be purged and entries of endpoint 1 kept
+	stale := affinityMapEntriesForIndex(elements, 0)
+	if len(stale) != 2 {
+		t.Fatalf("expected 2 affinity entries for deleted endpoint but got %d", len(stale))
+	}
+	for _, e := range stale {
+		if e.Key[3] == 2 {
+			t.Errorf("affinity entry of a remaining endpoint must not be purged")
+		}
+	}
+	if len(affinityMapEntriesForIndex(elements, 5)) != 0 {
+		t.Errorf("expected no affinity entries for endpoint without sticky clients")
+	}
+}
+
+func TestEndpointRulesComment(t *testing.T) {
+	tests := []struct {
+		serviceID   string
+		appProtocol string
+		comment     string
+	}{
+		{serviceID: "ABCDEF", appProtocol: "grpc", comment: "endpoint for " + K8sSvcPrefix + "ABCDEF app protocol grpc"},
+		{serviceID: "ABCDEF", comment: "endpoint for " + K8sSvcPrefix + "ABCDEF"},
+		{appProtocol: "grpc"},
+	}
+	for _, tt := range tests {
+		rules := endpointRules("10.1.1.1", 8080, tt.serviceID, "", tt.appProtocol)
+		if len(rules) != 3 {
+			t.Fatalf("expected 3 endpoint rules but got %d", len(rules))
+		}
+		var expected []byte
+		if tt.comment != "" {
+			expected = nftableslib.MakeRuleComment(tt.comment)
+		}
+		if !bytes.Equal(rules[0].UserData, expected) {
+			t.Errorf("service id \"%s\" app protocol \"%s\": expected comment \"%s\" but got %q", tt.serviceID, tt.appProtocol, tt.comment, rules[0].UserData)
+		}
+	}
+}
+
+func TestEndpointRulesIdentityComment(t *testing.T) {
+	rules := endpointRules("10.1.1.1", 8080, "ABCDEF", "default/app:http:TCP", "grpc")
+	expected := nftableslib.MakeRuleComment("endpoint 10.1.1.1 of Service Port Name default/app:http:TCP app protocol grpc")
+	if !bytes.Equal(rules[0].UserData, expected) {
+		t.Errorf("expected comment %q but got %q", expected, rules[0].UserData)
+	}
+	// Names of kubernetes objects can exceed comment's limit, comment is truncated and marked
+	long := "default/" + strings.Repeat("a", 63) + ":" + strings.Repeat("b", 63) + ":TCP"
+	rules = endpointRules("10.1.1.1", 8080, "ABCDEF", long, "")
+	comment := string(rules[0].UserData[2 : len(rules[0].UserData)-1])
+	if len(comment) != nftableslib.MaxCommentLength || !strings.HasPrefix(comment, "endpoint 10.1.1.1 of Service Port Name default/") ||
+		!strings.HasSuffix(comment, "...") {
+		t.Errorf("expected comment truncated to %d characters and ending with \"...\", got %q", nftableslib.MaxCommentLength, comment)
+	}
+}
+
+func TestNoEndpointsVerdictRule(t *testing.T) {
+	reject := noEndpointsVerdictRule(NoEndpointsReject, nftables.TableFamilyIPv4)
+	drop := noEndpointsVerdictRule(NoEndpointsDrop, nftables.TableFamilyIPv4)
+	if reflect.DeepEqual(reject.Action, drop.Action) {
+		t.Fatalf("expected Reject and Drop modes to generate different verdicts, got %+v", reject.Action)
+	}
+	if !reflect.DeepEqual(drop.Action, setActionVerdict(nftableslib.NFT_DROP)) {
+		t.Errorf("expected Drop mode to generate drop verdict, got %+v", drop.Action)
+	}
+	if reflect.DeepEqual(reject.Action, setActionVerdict(nftableslib.NFT_DROP)) {
+		t.Errorf("expected Reject mode not to generate drop verdict")
+	}
+	if !reflect.DeepEqual(noEndpointsVerdictRule("", nftables.TableFamilyIPv4).Action, reject.Action) {
+		t.Errorf("expected Reject to be the default mode")
+	}
+}
+
+func TestDeleteServiceChainsBatch(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	svcID := "SVCID"
+	chains := GetSvcChain(nftables.TableFamilyIPv4, svcID)[nftables.TableFamilyIPv4]
+	if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, svcID); err != nil {
+		t.Fatalf("failed to add service chains with error: %+v", err)
+	}
+	epchains := []*EPRule{{Rule: Rule{Chain: "k8s-nfproxy-sep-A"}}, {Rule: Rule{Chain: "k8s-nfproxy-sep-B"}}}
+	ids, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, svcID, epchains, nil, false, "default/app:http", false)
+	if err != nil {
+		t.Fatalf("failed to program service chain with error: %+v", err)
+	}
+	chains.Chain[K8sSvcPrefix+svcID].RuleID = ids
+
+	conn.Flushes = 0
+	if err := DeleteServiceChainsBatch(nfti, nftables.TableFamilyIPv4, chains); err != nil {
+		t.Fatalf("failed to delete service chains with error: %+v", err)
+	}
+	if conn.Flushes != 1 {
+		t.Errorf("expected service chains and rules to be deleted in a single transaction, got %d", conn.Flushes)
+	}
+	if len(conn.Rules) != 0 || len(conn.Chains) != 0 {
+		t.Errorf("expected no rules and chains to be left, got %d rules and %d chains", len(conn.Rules), len(conn.Chains))
+	}
+
+	// Unknown chain fails the deletion before anything is queued
+	conn.Flushes = 0
+	if err := DeleteServiceChainsBatch(nfti, nftables.TableFamilyIPv4, chains); err == nil {
+		t.Errorf("expected error for deletion of unknown chains")
+	}
+	if conn.Flushes != 0 {
+		t.Errorf("expected no transaction for failed deletion, got %d", conn.Flushes)
+	}
+}
+
+func TestUnmatchedLogRule(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	unmatchedLogRules := func(svcID string) []uint64 {
+		var ids []uint64
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sSvcPrefix + svcID, Table: table})
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				if l, ok := e.(*expr.Log); ok && l.Key == unix.NFTA_LOG_PREFIX && string(l.Data) == UnmatchedLogPrefix {
+					ids = append(ids, rule.Handle)
+				}
+			}
+		}
+		return ids
+	}
+	epchains := []*EPRule{{Rule: Rule{Chain: "k8s-nfproxy-sep-A"}}, {Rule: Rule{Chain: "k8s-nfproxy-sep-B"}}}
+
+	// Debug option is off by default
+	if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, "SVCOFF"); err != nil {
+		t.Fatalf("failed to add service chains with error: %+v", err)
+	}
+	if _, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, "SVCOFF", epchains, nil, false, "default/off:http", false); err != nil {
+		t.Fatalf("failed to program service chain with error: %+v", err)
+	}
+	if ids := unmatchedLogRules("SVCOFF"); len(ids) != 0 {
+		t.Errorf("expected no unmatched log rule when the option is disabled, got %v", ids)
+	}
+
+	if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, "SVCID"); err != nil {
+		t.Fatalf("failed to add service chains with error: %+v", err)
+	}
+	ids, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, "SVCID", epchains, nil, false, "default/app:http", true)
+	if err != nil {
+		t.Fatalf("failed to program service chain with error: %+v", err)
+	}
+	if logIDs := unmatchedLogRules("SVCID"); len(logIDs) != 1 || logIDs[0] != ids[len(ids)-1] {
+		t.Fatalf("expected unmatched log rule to be the last rule %v of the service chain, got %v", ids, logIDs)
+	}
+	// Updates of load balancing keep the rule
+	ids, err = ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, "SVCID", epchains[:1], ids, false, "default/app:http", true)
+	if err != nil {
+		t.Fatalf("failed to update service chain with error: %+v", err)
+	}
+	if logIDs := unmatchedLogRules("SVCID"); len(logIDs) != 1 || logIDs[0] != ids[len(ids)-1] {
+		t.Errorf("expected unmatched log rule to stay the last rule %v after update, got %v", ids, logIDs)
+	}
+	// The rule is removed with the other rules of the service chain
+	if err := DeleteServiceRules(nfti, nftables.TableFamilyIPv4, K8sSvcPrefix+"SVCID", ids); err != nil {
+		t.Fatalf("failed to delete service rules with error: %+v", err)
+	}
+	if logIDs := unmatchedLogRules("SVCID"); len(logIDs) != 0 {
+		t.Errorf("expected unmatched log rule to be removed, got %v", logIDs)
+	}
+}
+
+func TestServiceEndpointsVerdictMap(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, "SVCID"); err != nil {
+		t.Fatalf("failed to add service chains with error: %+v", err)
+	}
+	var epchains []*EPRule
+	for i := 0; i < 50; i++ {
+		epchains = append(epchains, &EPRule{Rule: Rule{Chain: fmt.Sprintf("k8s-nfproxy-sep-%02d", i)}})
+	}
+	if _, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, "SVCID", epchains, nil, false, "default/app:http", false); err != nil {
+		t.Fatalf("failed to program service chain with error: %+v", err)
+	}
+
+	// Service chain carries the counter rule and a single load balancing rule regardless of the number of endpoints
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sSvcPrefix + "SVCID", Table: table})
+	if len(rules) != 2 {
+		t.Fatalf("expected counter and load balancing rules in the service chain, got %d rules", len(rules))
+	}
+	var numgen *expr.Numgen
+	var lookup *expr.Lookup
+	for _, e := range rules[1].Exprs {
+		switch e := e.(type) {
+		case *expr.Numgen:
+			numgen = e
+		case *expr.Lookup:
+			lookup = e
+		}
+	}
+	// nftableslib does not pass the requested random mode to numgen
+	if numgen == nil || numgen.Modulus != 50 || numgen.Type != unix.NFT_NG_INCREMENTAL {
+		t.Fatalf("expected incremental numgen modulo 50, got %+v", numgen)
+	}
+	if lookup == nil || !lookup.IsDestRegSet || lookup.SourceRegister != numgen.Register {
+		t.Fatalf("expected numgen result to be looked up in the verdict map, got %+v", lookup)
+	}
+
+	// The verdict map maps every index to a jump to the endpoint's chain
+	var vmap *nftables.Set
+	for _, s := range conn.Sets {
+		if s.Anonymous && s.IsMap && s.DataType == nftables.TypeVerdict {
+			vmap = s
+		}
+	}
+	if vmap == nil || !vmap.Constant || vmap.KeyType != nftables.TypeInteger {
+		t.Fatalf("expected anonymous constant verdict map keyed by integer, got %+v", vmap)
+	}
+	elements := conn.Elements[vmap]
+	if len(elements) != 50 {
+		t.Fatalf("expected 50 elements of the verdict map, got %d", len(elements))
+	}
+	for i, element := range elements {
+		if !bytes.Equal(element.Key, binaryutil.NativeEndian.PutUint32(uint32(i))) {
+			t.Errorf("expected key %d of element %d, got %v", i, i, element.Key)
+		}
+		if element.VerdictData == nil || element.VerdictData.Kind != expr.VerdictJump || element.VerdictData.Chain != epchains[i].Chain {
+			t.Errorf("expected element %d to jump to %s, got %+v", i, epchains[i].Chain, element.VerdictData)
+		}
+	}
+}
+
+func BenchmarkDeleteServiceChainsBatch(b *testing.B) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		b.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		b.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		b.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.conn = conn
+	epchains := []*EPRule{{Rule: Rule{Chain: "k8s-nfproxy-sep-A"}}, {Rule: Rule{Chain: "k8s-nfproxy-sep-B"}}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		chains := GetSvcChain(nftables.TableFamilyIPv4, "SVCID")[nftables.TableFamilyIPv4]
+		if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, "SVCID"); err != nil {
+			b.Fatalf("failed to add service chains with error: %+v", err)
+		}
+		ids, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, "SVCID", epchains, nil, false, "default/app:http", false)
+		if err != nil {
+			b.Fatalf("failed to program service chain with error: %+v", err)
+		}
+		chains.Chain[K8sSvcPrefix+"SVCID"].RuleID = ids
+		b.StartTimer()
+		if err := DeleteServiceChainsBatch(nfti, nftables.TableFamilyIPv4, chains); err != nil {
+			b.Fatalf("failed to delete service chains with error: %+v", err)
+		}
+	}
+}
+
+func TestExternalIPPrecedesNodeports(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	// An external ip which is also node's address matches both external ip map and nodeports jump, the packet
+	// must be handled once by the external ip path, dnat is terminal so the first match wins.
+	externalIP, nodeports := -1, -1
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATServices, Table: table})
+	for i, rule := range rules {
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Lookup:
+				if e.SetName == K8sExternalIPSet {
+					externalIP = i
+				}
+			case *expr.Fib:
+				nodeports = i
+			}
+		}
+	}
+	if externalIP == -1 || nodeports == -1 {
+		t.Fatalf("expected external ip and nodeports rules in chain %s, got external ip rule %d nodeports rule %d", K8sNATServices, externalIP, nodeports)
+	}
+	if externalIP > nodeports || nodeports != len(rules)-1 {
+		t.Errorf("expected external ip rule %d to precede nodeports rule %d which is the last of %d rules", externalIP, nodeports, len(rules))
+	}
+}
+
+func TestAddressPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence AddressPrecedence
+		lbFirst    bool
+	}{
+		{name: "default", precedence: "", lbFirst: false},
+		{name: "external ip first", precedence: ExternalIPFirst, lbFirst: false},
+		{name: "loadbalancer ip first", precedence: LoadBalancerIPFirst, lbFirst: true},
+	}
+	for _, tt := range tests {
+		conn := &fake.Conn{}
+		ti := nftableslib.InitNFTables(conn)
+		if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		nfti, err := getNFTInterface(ti)
+		if err != nil {
+			t.Fatalf("failed to get nftables interface with error: %+v", err)
+		}
+		nfti.sets = make(map[string]*nftables.Set)
+		nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+		nfti.precedence = tt.precedence
+		if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+			t.Fatalf("%s: failed to program common chains with error: %+v", tt.name, err)
+		}
+		externalIP, markLB, loadBalancerIP := -1, -1, -1
+		table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATServices, Table: table})
+		for i, rule := range rules {
+			for _, e := range rule.Exprs {
+				if e, ok := e.(*expr.Lookup); ok {
+					switch e.SetName {
+					case K8sExternalIPSet:
+						externalIP = i
+					case K8sMarkLBSet:
+						markLB = i
+					case K8sLoadbalancerIPSet:
+						loadBalancerIP = i
+					}
+				}
+			}
+		}
+		if externalIP == -1 || markLB == -1 || loadBalancerIP == -1 {
+			t.Fatalf("%s: expected external ip, loadbalancer mark and loadbalancer ip rules in chain %s, got %d, %d and %d", tt.name, K8sNATServices, externalIP, markLB, loadBalancerIP)
+		}
+		// Loadbalancer traffic must be marked before it is load balanced regardless of precedence
+		if markLB > loadBalancerIP {
+			t.Errorf("%s: expected loadbalancer mark rule %d to precede loadbalancer ip rule %d", tt.name, markLB, loadBalancerIP)
+		}
+		if lbFirst := loadBalancerIP < externalIP; lbFirst != tt.lbFirst {
+			t.Errorf("%s: expected loadbalancer ip rule first %t, got loadbalancer ip rule %d external ip rule %d", tt.name, tt.lbFirst, loadBalancerIP, externalIP)
+		}
+	}
+}
+
+func TestChainPriorities(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	nfti.priorities = ChainPriorities{Filter: -10, DNAT: -110, SNAT: 110}
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	expected := map[string]nftables.ChainPriority{
+		FilterInput:    -10,
+		FilterOutput:   -10,
+		FilterForward:  -10,
+		NatPrerouting:  -110,
+		NatOutput:      -110,
+		NatPostrouting: 110,
+	}
+	chains, _ := conn.ListChains()
+	found := 0
+	for _, chain := range chains {
+		priority, ok := expected[chain.Name]
+		if !ok || chain.Table.Family != nftables.TableFamilyIPv4 {
+			continue
+		}
+		found++
+		if chain.Priority != priority {
+			t.Errorf("expected chain %s hook priority %d, got %d", chain.Name, priority, chain.Priority)
+		}
+	}
+	if found != len(expected) {
+		t.Errorf("expected %d base chains, found %d", len(expected), found)
+	}
+}
+
+func TestMasqueradeSource(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	lastRuleExprs := func() []expr.Any {
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATDoMasquerade, Table: table})
+		if len(rules) == 0 {
+			t.Fatalf("expected rules in chain %s", K8sNATDoMasquerade)
+		}
+		return rules[len(rules)-1].Exprs
+	}
+	hasExpr := func(exprs []expr.Any, match func(expr.Any) bool) bool {
+		for _, e := range exprs {
+			if match(e) {
+				return true
+			}
+		}
+		return false
+	}
+	isMasq := func(e expr.Any) bool { _, ok := e.(*expr.Masq); return ok }
+	isSNAT := func(e expr.Any) bool { n, ok := e.(*expr.NAT); return ok && n.Type == expr.NATTypeSourceNAT }
+
+	if exprs := lastRuleExprs(); !hasExpr(exprs, isMasq) || hasExpr(exprs, isSNAT) {
+		t.Fatalf("expected masquerade rule without configured source, got %+v", exprs)
+	}
+	if err := SetMasqueradeSource(nfti, nftables.TableFamilyIPv4, "192.168.1.10"); err != nil {
+		t.Fatalf("failed to set source of masqueraded traffic with error: %+v", err)
+	}
+	if exprs := lastRuleExprs(); !hasExpr(exprs, isSNAT) || hasExpr(exprs, isMasq) {
+		t.Errorf("expected snat rule with configured source, got %+v", exprs)
+	}
+	if err := SetMasqueradeSource(nfti, nftables.TableFamilyIPv4, "not-an-address"); err == nil {
+		t.Errorf("expected invalid source to fail")
+	}
+	if err := SetMasqueradeSource(nfti, nftables.TableFamilyIPv6, "fd00::10"); err == nil {
+		t.Errorf("expected source of family without masquerade rule to fail")
+	}
+}
+
+func TestNodeportAddresses(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	// nodeportsJump returns kinds of match of the last rule of services chain, which jumps to nodeports
+	nodeportsJump := func() (fib bool, lookup bool) {
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATServices, Table: table})
+		for _, e := range rules[len(rules)-1].Exprs {
+			switch e := e.(type) {
+			case *expr.Fib:
+				fib = true
+			case *expr.Lookup:
+				lookup = e.SetName == K8sNodeportAddressesSet
+			}
+		}
+		return fib, lookup
+	}
+	if fib, lookup := nodeportsJump(); !fib || lookup {
+		t.Fatalf("expected nodeports open on all node's addresses")
+	}
+	if err := SetNodeportAddresses(nfti, nftables.TableFamilyIPv4, []string{"192.168.1.10", "192.168.2.10"}); err != nil {
+		t.Fatalf("failed to set nodeport addresses with error: %+v", err)
+	}
+	if fib, lookup := nodeportsJump(); fib || !lookup {
+		t.Errorf("expected nodeports restricted to nodeport addresses set")
+	}
+	if err := SetNodeportAddresses(nfti, nftables.TableFamilyIPv4, nil); err != nil {
+		t.Fatalf("failed to clear nodeport addresses with error: %+v", err)
+	}
+	if fib, lookup := nodeportsJump(); !fib || lookup {
+		t.Errorf("expected nodeports open on all node's addresses after addresses are cleared")
+	}
+}
+
+func TestLoadBalancerMark(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	// Loadbalancer traffic in do-mark-lb set jumps to the mark chain before it is load balanced
+	rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATServices, Table: table})
+	markLookup, lbLookup := -1, -1
+	for i, rule := range rules {
+		for _, e := range rule.Exprs {
+			if l, ok := e.(*expr.Lookup); ok {
+				switch l.SetName {
+				case K8sMarkLBSet:
+					markLookup = i
+				case K8sLoadbalancerIPSet:
+					lbLookup = i
+				}
+			}
+		}
+	}
+	if markLookup == -1 || lbLookup == -1 || markLookup > lbLookup {
+		t.Fatalf("expected loadbalancer traffic to be marked before it is load balanced")
+	}
+	// markSet returns the mark set by the last rule of the mark chain
+	markSet := func() uint32 {
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sNATDoMarkLB, Table: table})
+		exprs := rules[len(rules)-1].Exprs
+		for i, e := range exprs {
+			if m, ok := e.(*expr.Meta); ok && m.Key == expr.MetaKeyMARK && m.SourceRegister && i > 0 {
+				if imm, ok := exprs[i-1].(*expr.Immediate); ok {
+					return binaryutil.NativeEndian.Uint32(imm.Data)
+				}
+			}
+		}
+		return 0
+	}
+	if mark := markSet(); mark != DefaultLoadBalancerMark {
+		t.Fatalf("expected default loadbalancer mark 0x%x, got 0x%x", DefaultLoadBalancerMark, mark)
+	}
+	if err := SetLoadBalancerMark(nfti, 0x10000); err != nil {
+		t.Fatalf("failed to set loadbalancer mark with error: %+v", err)
+	}
+	if mark := markSet(); mark != 0x10000 {
+		t.Errorf("expected loadbalancer mark 0x10000, got 0x%x", mark)
+	}
+	if err := SetLoadBalancerMark(nfti, 0x4000); err == nil {
+		t.Errorf("expected loadbalancer mark carrying masquerade mark to fail")
+	}
+}
+
+func TestVIPDefaultDeny(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", ""); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+	vip := "10.96.0.10"
+	for _, port := range []uint16{80, 443} {
+		if err := AddToVIPPortsSet(nfti, nftables.TableFamilyIPv4, v1.ProtocolTCP, vip, port); err != nil {
+			t.Fatalf("failed to add port %d with error: %+v", port, err)
+		}
+		if err := AddVIP(nfti, nftables.TableFamilyIPv4, vip); err != nil {
+			t.Fatalf("failed to add vip with error: %+v", err)
+		}
+	}
+
+	// verdict walks services filter chain for a new TCP connection to vip:port and returns the verdict of
+	// the first matching rule, "" if the packet reaches the end of the chain.
+	table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+	sets, _ := conn.GetSets(table)
+	setByName := func(name string) *nftables.Set {
+		for _, set := range sets {
+			if set.Name == name {
+				return set
+			}
+		}
+		t.Fatalf("set %s is not programmed", name)
+		return nil
+	}
+	verdictName := func(v *expr.Verdict) string {
+		switch v.Kind {
+		case expr.VerdictReturn:
+			return "return"
+		case expr.VerdictJump:
+			return "jump " + v.Chain
+		}
+		return "unexpected"
+	}
+	verdict := func(port uint16) string {
+		protoB := protoByteFromV1Proto(v1.ProtocolTCP)
+		key, _ := nftableslib.MakeConcatElement([]nftables.SetDatatype{nftables.TypeInetProto, nftables.TypeIPAddr, nftables.TypeInetService},
+			[]nftableslib.ElementValue{{InetProto: &protoB}, {IPAddr: net.ParseIP(vip).To4()}, {InetService: &port}}, setActionVerdict(unix.NFT_RETURN))
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sFilterServices, Table: table})
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				lookup, ok := e.(*expr.Lookup)
+				if !ok {
+					continue
+				}
+				switch lookup.SetName {
+				case K8sNoEndpointsSet, K8sVIPPortsSet:
+					for _, element := range conn.Elements[setByName(lookup.SetName)] {
+						if bytes.Equal(element.Key, key.Key) {
+							return verdictName(element.VerdictData)
+						}
+					}
+				case K8sVIPSet:
+					for _, element := range conn.Elements[setByName(lookup.SetName)] {
+						if bytes.Equal(element.Key, net.ParseIP(vip).To4()) {
+							return verdictName(rule.Exprs[len(rule.Exprs)-1].(*expr.Verdict))
+						}
+					}
+				}
+			}
+		}
+		return ""
+	}
+	reject := "jump " + K8sFilterDoReject
+
+	// Two ports are defined, the third port of the VIP is rejected
+	if v := verdict(80); v != "return" {
+		t.Errorf("expected defined port 80 to return, got %q", v)
+	}
+	if v := verdict(443); v != "return" {
+		t.Errorf("expected defined port 443 to return, got %q", v)
+	}
+	if v := verdict(8080); v != reject {
+		t.Errorf("expected undefined port 8080 to be rejected, got %q", v)
+	}
+	// Removed port gets rejected
+	if err := RemoveFromVIPPortsSet(nfti, nftables.TableFamilyIPv4, v1.ProtocolTCP, vip, 443); err != nil {
+		t.Fatalf("failed to remove port with error: %+v", err)
+	}
+	if v := verdict(443); v != reject {
+		t.Errorf("expected removed port 443 to be rejected, got %q", v)
+	}
+	// VIP without default deny is not rejected
+	if err := RemoveVIP(nfti, nftables.TableFamilyIPv4, vip); err != nil {
+		t.Fatalf("failed to remove vip with error: %+v", err)
+	}
+	if v := verdict(8080); v != "" {
+		t.Errorf("expected traffic to VIP without default deny not to match, got %q", v)
+	}
+}
+
+func TestNoEndpointsTCPReset(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm(nfV6TableName, nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nfti, err := getNFTInterface(ti)
+	if err != nil {
+		t.Fatalf("failed to get nftables interface with error: %+v", err)
+	}
+	nfti.sets = make(map[string]*nftables.Set)
+	nfti.noEndpointsRuleID = make(map[nftables.TableFamily]uint64)
+	if err := programCommonChainsRules(nfti, "10.244.0.0/16", "fd00::/64"); err != nil {
+		t.Fatalf("failed to program common chains with error: %+v", err)
+	}
+
+	// reject walks No Endpoints chain for a packet of the protocol and returns the reject of the first rule
+	// matching it, nil if no rule rejects the packet.
+	reject := func(tableFamily nftables.TableFamily, proto byte) *expr.Reject {
+		table := &nftables.Table{Name: nfV4TableName, Family: nftables.TableFamilyIPv4}
+		if tableFamily == nftables.TableFamilyIPv6 {
+			table = &nftables.Table{Name: nfV6TableName, Family: nftables.TableFamilyIPv6}
+		}
+		rules, _ := conn.GetRule(table, &nftables.Chain{Name: K8sFilterDoReject, Table: table})
+		for _, rule := range rules {
+			matched := true
+			var meta *expr.Meta
+			for _, e := range rule.Exprs {
+				switch e := e.(type) {
+				case *expr.Meta:
+					meta = e
+				case *expr.Cmp:
+					if meta != nil && meta.Key == expr.MetaKey(unix.NFT_META_L4PROTO) &&
+						bytes.Equal(e.Data, []byte{proto}) != (e.Op == expr.CmpOpEq) {
+						matched = false
+					}
+				case *expr.Reject:
+					if matched {
+						return e
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := SetNoEndpointsAction(nfti, NoEndpointsTCPReset); err != nil {
+		t.Fatalf("failed to set TCPReset action with error: %+v", err)
+	}
+	for tableFamily, code := range map[nftables.TableFamily]uint8{nftables.TableFamilyIPv4: icmpPortUnreachable, nftables.TableFamilyIPv6: icmpv6PortUnreachable} {
+		if r := reject(tableFamily, unix.IPPROTO_TCP); r == nil || r.Type != unix.NFT_REJECT_TCP_RST {
+			t.Errorf("expected TCP to services without endpoints of family %v to be reset, got %+v", tableFamily, r)
+		}
+		if r := reject(tableFamily, unix.IPPROTO_UDP); r == nil || r.Type != unix.NFT_REJECT_ICMP_UNREACH || r.Code != code {
+			t.Errorf("expected UDP to services without endpoints of family %v to get ICMP port unreachable, got %+v", tableFamily, r)
+		}
+	}
+	// Setting the action again does not add another TCP reset rule
+	if err := SetNoEndpointsAction(nfti, NoEndpointsTCPReset); err != nil {
+		t.Fatalf("failed to set TCPReset action with error: %+v", err)
+	}
+	if n := len(nfti.noEndpointsTCPRuleID); n != 2 {
+		t.Errorf("expected a TCP reset rule per ip family, got %d", n)
+	}
+	// Back to Reject, TCP gets ICMP reject as any other protocol
+	if err := SetNoEndpointsAction(nfti, NoEndpointsReject); err != nil {
+		t.Fatalf("failed to set Reject action with error: %+v", err)
+	}
+	if r := reject(nftables.TableFamilyIPv4, unix.IPPROTO_TCP); r == nil || r.Type != unix.NFT_REJECT_ICMP_UNREACH {
+		t.Errorf("expected TCP to be rejected with ICMP once TCPReset action is replaced, got %+v", r)
+	}
+	if len(nfti.noEndpointsTCPRuleID) != 0 {
+		t.Errorf("expected TCP reset rules to be removed, got %v", nfti.noEndpointsTCPRuleID)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Script collects services' and endpoints' chains, rules and map elements and renders them as a script
+// accepted by "nft -f". Rules are rendered the same way nfproxy programs them, chains and elements are sorted,
+// so the same state always renders the same script. Base chains, common rules and sets created when tables
+// are initialized are expected to exist and are not rendered.
+type Script struct {
+	tables map[nftables.TableFamily]*scriptTable
+}
+
+type scriptTable struct {
+	chains   map[string][]string
+	elements map[string][]string
+}
+
+// NewScript returns an empty Script
+func NewScript() *Script {
+	return &Script{
+		tables: make(map[nftables.TableFamily]*scriptTable),
+	}
+}
+
+func (s *Script) table(tableFamily nftables.TableFamily) *scriptTable {
+	t, ok := s.tables[tableFamily]
+	if !ok {
+		t = &scriptTable{
+			chains:   make(map[string][]string),
+			elements: make(map[string][]string),
+		}
+		s.tables[tableFamily] = t
+	}
+
+	return t
+}
+
+// AddEndpointChain renders endpoint's chain with the same rules AddEndpointRules programs, preceded by
+// the affinity map update rule if the endpoint's service has Session Affinity.
+func (s *Script) AddEndpointChain(tableFamily nftables.TableFamily, epRule *EPRule, ipaddr string, port int32,
+	svcPortName string, appProtocol string) {
+	var rules []string
+	if epRule.WithAffinity {
+		rules = append(rules, fmt.Sprintf("update @%s { %s saddr : %d }", K8sAffinityMap+epRule.ServiceID, l3Keyword(tableFamily), epRule.EpIndex))
+	}
+	var comment string
+	switch {
+	case svcPortName != "":
+		comment = "endpoint " + ipaddr + " of Service Port Name " + svcPortName
+	case epRule.ServiceID != "":
+		comment = "endpoint for " + K8sSvcPrefix + epRule.ServiceID
+	}
+	if comment != "" && appProtocol != "" {
+		comment += " app protocol " + appProtocol
+	}
+	dnat := "dnat to " + ipaddr
+	if port != 0 {
+		if tableFamily == nftables.TableFamilyIPv6 {
+			dnat = "dnat to [" + ipaddr + "]"
+		}
+		dnat += ":" + strconv.Itoa(int(port))
+	}
+	rules = append(rules,
+		"counter"+scriptComment(comment),
+		fmt.Sprintf("%s saddr %s meta mark set 0x00004000", l3Keyword(tableFamily), ipaddr),
+		dnat+" fully-random",
+	)
+	s.table(tableFamily).chains[epRule.Chain] = rules
+}
+
+// AddServiceChain renders service's chain with the same rules ProgramServiceEndpoints programs, a service without
+// endpoints gets an empty chain.
+func (s *Script) AddServiceChain(tableFamily nftables.TableFamily, svcID string, epchains []*EPRule, withAffinity bool,
+	svcPortName string, unmatchedLog bool) {
+	var rules []string
+	if len(epchains) != 0 {
+		rules = append(rules, "counter"+scriptComment("service chain for Service Port Name "+svcPortName))
+		if withAffinity {
+			act := make([]string, 0, len(epchains))
+			for _, ep := range epchains {
+				act = append(act, fmt.Sprintf("%d : jump %s", ep.EpIndex, ep.Chain))
+			}
+			rules = append(rules, fmt.Sprintf("%s saddr map @%s vmap { %s }", l3Keyword(tableFamily), K8sAffinityMap+svcID, strings.Join(act, ", ")))
+		}
+		lb := make([]string, 0, len(epchains))
+		for i, ep := range epchains {
+			lb = append(lb, fmt.Sprintf("%d : jump %s", i, ep.Chain))
+		}
+		rules = append(rules, fmt.Sprintf("numgen inc mod %d vmap { %s }", len(epchains), strings.Join(lb, ", ")))
+		if unmatchedLog {
+			rules = append(rules, "counter log prefix \""+UnmatchedLogPrefix+"\""+scriptComment("unmatched traffic of Service Port Name "+svcPortName))
+		}
+	}
+	s.table(tableFamily).chains[K8sSvcPrefix+svcID] = rules
+}
+
+// AddToSet renders service's proto.ip.port element of a set specified by set parameter, the element jumps to chain
+func (s *Script) AddToSet(tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) {
+	s.addElement(tableFamily, set, fmt.Sprintf("%s . %s . %d : jump %s", protoKeyword(proto), addr, port, chain))
+}
+
+// AddToVIPPortsSet renders service's proto.ip.port element of service VIP ports map, the element accepts traffic
+// to a defined port of the VIP.
+func (s *Script) AddToVIPPortsSet(tableFamily nftables.TableFamily, proto v1.Protocol, addr string, port uint16) {
+	s.addElement(tableFamily, K8sVIPPortsSet, fmt.Sprintf("%s . %s . %d : return", protoKeyword(proto), addr, port))
+}
+
+// AddVIP renders service VIP element of service VIPs set
+func (s *Script) AddVIP(tableFamily nftables.TableFamily, addr string) {
+	s.addElement(tableFamily, K8sVIPSet, addr)
+}
+
+// AddToNodeportSet renders service's proto.port element of node ports map, the element jumps to chain
+func (s *Script) AddToNodeportSet(tableFamily nftables.TableFamily, proto v1.Protocol, port uint16, chain string) {
+	s.addElement(tableFamily, K8sNodeportSet, fmt.Sprintf("%s . %d : jump %s", protoKeyword(proto), port, chain))
+}
+
+func (s *Script) addElement(tableFamily nftables.TableFamily, set string, element string) {
+	t := s.table(tableFamily)
+	for _, e := range t.elements[set] {
+		if e == element {
+			return
+		}
+	}
+	t.elements[set] = append(t.elements[set], element)
+}
+
+// String returns the script, all chains are added before rules, so rules can jump to chains which are added later.
+func (s *Script) String() string {
+	var b strings.Builder
+	for _, tableFamily := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		t, ok := s.tables[tableFamily]
+		if !ok {
+			continue
+		}
+		table := tableKeyword(tableFamily)
+		chains := make([]string, 0, len(t.chains))
+		for chain := range t.chains {
+			chains = append(chains, chain)
+		}
+		sort.Strings(chains)
+		for _, chain := range chains {
+			fmt.Fprintf(&b, "add chain %s %s\n", table, chain)
+		}
+		for _, chain := range chains {
+			for _, rule := range t.chains[chain] {
+				fmt.Fprintf(&b, "add rule %s %s %s\n", table, chain, rule)
+			}
+		}
+		sets := make([]string, 0, len(t.elements))
+		for set := range t.elements {
+			sets = append(sets, set)
+		}
+		sort.Strings(sets)
+		for _, set := range sets {
+			elements := append([]string{}, t.elements[set]...)
+			sort.Strings(elements)
+			fmt.Fprintf(&b, "add element %s %s { %s }\n", table, set, strings.Join(elements, ", "))
+		}
+	}
+
+	return b.String()
+}
+
+// tableKeyword returns family and name of nfproxy table of tableFamily as used in nft script
+func tableKeyword(tableFamily nftables.TableFamily) string {
+	if tableFamily == nftables.TableFamilyIPv6 {
+		return "ip6 " + nfV6TableName
+	}
+
+	return "ip " + nfV4TableName
+}
+
+// l3Keyword returns nft script keyword matching ip header of tableFamily
+func l3Keyword(tableFamily nftables.TableFamily) string {
+	if tableFamily == nftables.TableFamilyIPv6 {
+		return "ip6"
+	}
+
+	return "ip"
+}
+
+func protoKeyword(proto v1.Protocol) string {
+	return strings.ToLower(string(proto))
+}
+
+// scriptComment returns rule's comment statement truncated the same way as programmed comments, empty comment
+// renders no statement.
+func scriptComment(comment string) string {
+	if comment == "" {
+		return ""
+	}
+
+	return " comment " + strconv.Quote(truncateComment(comment))
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	selfTestTableName = "kube-nfproxy-selftest"
+	selfTestSvcID     = "SELFTEST"
+	// Synthetic service's virtual ip and endpoint come from TEST-NET-1 range, they are never routed
+	selfTestVIP      = "192.0.2.1"
+	selfTestPort     = 80
+	selfTestEndpoint = "192.0.2.2"
+	selfTestEpPort   = 8080
+)
+
+// SelfTest validates that nftables features nfproxy relies on are supported by the host's kernel. A synthetic
+// service with a virtual ip and an endpoint is programmed into a temporary table, its chains, rules and set
+// elements are read back and the table is removed. No test packet is sent, the datapath itself is not verified.
+func SelfTest() error {
+	return selfTest(nftableslib.InitConn())
+}
+
+func selfTest(conn nftableslib.NetNS) (err error) {
+	ti := nftableslib.InitNFTables(conn)
+	// Table left behind by an interrupted self test is removed first
+	if ti.Tables().Exist(selfTestTableName, nftables.TableFamilyIPv4) {
+		if err := ti.Tables().DeleteImm(selfTestTableName, nftables.TableFamilyIPv4); err != nil {
+			return fmt.Errorf("failed to delete stale table %s with error: %+v", selfTestTableName, err)
+		}
+	}
+	if err := ti.Tables().CreateImm(selfTestTableName, nftables.TableFamilyIPv4); err != nil {
+		return fmt.Errorf("failed to create table %s with error: %+v", selfTestTableName, err)
+	}
+	defer func() {
+		// Deleting the table deletes all chains, rules and sets programmed by the self test
+		if derr := ti.Tables().DeleteImm(selfTestTableName, nftables.TableFamilyIPv4); derr != nil && err == nil {
+			err = fmt.Errorf("failed to delete table %s with error: %+v", selfTestTableName, derr)
+		}
+	}()
+	ci, err := ti.Tables().TableChains(selfTestTableName, nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to get chains interface of table %s with error: %+v", selfTestTableName, err)
+	}
+	si, err := ti.Tables().TableSets(selfTestTableName, nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("failed to get sets interface of table %s with error: %+v", selfTestTableName, err)
+	}
+	nfti := &NFTInterface{
+		CIv4: ci,
+		SIv4: si,
+		sets: make(map[string]*nftables.Set),
+		conn: conn,
+	}
+	if err := setupCommonSets(nfti.sets, si, false); err != nil {
+		return err
+	}
+	if err := AddServiceChains(nfti, nftables.TableFamilyIPv4, selfTestSvcID); err != nil {
+		return fmt.Errorf("failed to add service chains with error: %+v", err)
+	}
+	epChain := "k8s-nfproxy-sep-" + selfTestSvcID
+	epRuleID, err := AddEndpointRules(nfti, nftables.TableFamilyIPv4, epChain, selfTestEndpoint, v1.ProtocolTCP, selfTestEpPort, selfTestSvcID, "", "")
+	if err != nil {
+		return fmt.Errorf("failed to add endpoint rules with error: %+v", err)
+	}
+	epchains := []*EPRule{{Rule: Rule{Chain: epChain, RuleID: epRuleID}}}
+	svcChain := K8sSvcPrefix + selfTestSvcID
+	svcRuleID, err := ProgramServiceEndpoints(nfti, nftables.TableFamilyIPv4, selfTestSvcID, epchains, nil, false, "nfproxy/selftest:http", false)
+	if err != nil {
+		return fmt.Errorf("failed to program service chain with error: %+v", err)
+	}
+	if err := AddToSet(nfti, nftables.TableFamilyIPv4, v1.ProtocolTCP, selfTestVIP, selfTestPort, K8sClusterIPSet, svcChain); err != nil {
+		return fmt.Errorf("failed to add virtual ip to set %s with error: %+v", K8sClusterIPSet, err)
+	}
+
+	// Reading back what has been programmed
+	table := &nftables.Table{Name: selfTestTableName, Family: nftables.TableFamilyIPv4}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return fmt.Errorf("failed to list chains with error: %+v", err)
+	}
+	found := make(map[string]bool)
+	for _, chain := range chains {
+		if chain.Table != nil && chain.Table.Name == table.Name && chain.Table.Family == table.Family {
+			found[chain.Name] = true
+		}
+	}
+	for _, chain := range []string{svcChain, epChain} {
+		if !found[chain] {
+			return fmt.Errorf("chain %s is missing in the kernel", chain)
+		}
+	}
+	if err := verifyRules(conn, table, svcChain, svcRuleID); err != nil {
+		return err
+	}
+	if err := verifyRules(conn, table, epChain, epRuleID); err != nil {
+		return err
+	}
+	elements, err := si.Sets().GetSetElements(K8sClusterIPSet)
+	if err != nil {
+		return fmt.Errorf("failed to get elements of set %s with error: %+v", K8sClusterIPSet, err)
+	}
+	if len(elements) != 1 {
+		return fmt.Errorf("expected 1 element in set %s, got %d", K8sClusterIPSet, len(elements))
+	}
+
+	return nil
+}
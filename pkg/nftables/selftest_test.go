@@ -0,0 +1,50 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nftables
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestSelfTest(t *testing.T) {
+	conn := &fake.Conn{}
+	ti := nftableslib.InitNFTables(conn)
+	// nfproxy's own table must not be touched by the self test
+	if err := ti.Tables().CreateImm(nfV4TableName, nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := selfTest(conn); err != nil {
+		t.Fatalf("self test failed with error: %+v", err)
+	}
+	if len(conn.Tables) != 1 || conn.Tables[0].Name != nfV4TableName {
+		t.Errorf("expected only table %s to be left, got %+v", nfV4TableName, conn.Tables)
+	}
+	if len(conn.Chains) != 0 || len(conn.Rules) != 0 || len(conn.Sets) != 0 {
+		t.Errorf("expected self test to clean up, got %d chains, %d rules and %d sets left", len(conn.Chains), len(conn.Rules), len(conn.Sets))
+	}
+	if conn.Flushes == 0 {
+		t.Errorf("expected self test to program the kernel")
+	}
+	// Self test can be repeated
+	if err := selfTest(conn); err != nil {
+		t.Fatalf("repeated self test failed with error: %+v", err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// endpointWarmupAnnotation defines a number of seconds a newly ready endpoint is kept out of
+	// the service's load balancing, the endpoint's chain is programmed right away. Endpoints of the
+	// initial sync are not warmed up.
+	endpointWarmupAnnotation = "nfproxy.nordix.org/endpoint-warmup-seconds"
+	// fqdnAnnotation defines a FQDN the service forwards to, the FQDN is periodically resolved and
+	// resolved addresses are programmed as the service's endpoints.
+	fqdnAnnotation = "nfproxy.nordix.org/target-fqdn"
+	// fqdnRefreshAnnotation defines a number of seconds between FQDN resolutions.
+	fqdnRefreshAnnotation = "nfproxy.nordix.org/fqdn-refresh-seconds"
+	// preserveDstPortAnnotation when set to "true", endpoints' DNAT rewrites only the destination address
+	// and keeps the original service port, used by transparent interception setups.
+	preserveDstPortAnnotation = "nfproxy.nordix.org/preserve-destination-port"
+	// loadBalancerClassAnnotation carries the service's load balancer class, it stands for spec.loadBalancerClass
+	// which is not available in the supported core API version.
+	loadBalancerClassAnnotation = "nfproxy.nordix.org/load-balancer-class"
+	// trafficDistributionAnnotation carries the service's traffic distribution, it stands for spec.trafficDistribution
+	// which is not available in the supported core API version.
+	trafficDistributionAnnotation = "nfproxy.nordix.org/traffic-distribution"
+	// zoneWeightAnnotation defines the share in percent of PreferClose service's load balancing given to endpoints
+	// in the node's zone, the rest goes to other endpoints. 100 means in-zone endpoints are used exclusively.
+	zoneWeightAnnotation = "nfproxy.nordix.org/zone-weight"
+	// preferNodeLocalAnnotation when set to "true", the service uses only node local endpoints when there are any
+	// and falls back to remote endpoints otherwise, used for node local DNS.
+	preferNodeLocalAnnotation = "nfproxy.nordix.org/prefer-node-local"
+	// skipAnnotation when set to "true", the service is not programmed, adding it to a programmed service removes
+	// the service and removing it programs the service again.
+	skipAnnotation = "nfproxy.nordix.org/skip"
+)
+
+const (
+	// trafficDistributionPreferClose requests endpoints in the node's zone to be preferred.
+	trafficDistributionPreferClose = "PreferClose"
+)
+
+const (
+	defaultFQDNRefresh = 30 * time.Second
+)
+
+// getEndpointWarmup returns the endpoint warmup period requested by the service's annotation,
+// 0 is returned when the annotation is not present or carries an invalid value.
+func getEndpointWarmup(svc *v1.Service) time.Duration {
+	value, ok := svc.ObjectMeta.Annotations[endpointWarmupAnnotation]
+	if !ok {
+		return 0
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, endpointWarmupAnnotation)
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// getFQDNTarget returns the FQDN and its refresh interval requested by the service's annotations,
+// empty string is returned if the service does not request FQDN target.
+func getFQDNTarget(svc *v1.Service) (string, time.Duration) {
+	fqdn, ok := svc.ObjectMeta.Annotations[fqdnAnnotation]
+	if !ok || fqdn == "" {
+		return "", 0
+	}
+	value, ok := svc.ObjectMeta.Annotations[fqdnRefreshAnnotation]
+	if !ok {
+		return fqdn, defaultFQDNRefresh
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, using default %v", svc.Namespace, svc.Name, value, fqdnRefreshAnnotation, defaultFQDNRefresh)
+		return fqdn, defaultFQDNRefresh
+	}
+
+	return fqdn, time.Duration(seconds) * time.Second
+}
+
+// isPreserveDstPort returns true if the service requests to keep the original destination port in endpoints' DNAT.
+func isPreserveDstPort(svc *v1.Service) bool {
+	value, ok := svc.ObjectMeta.Annotations[preserveDstPortAnnotation]
+	if !ok {
+		return false
+	}
+	preserve, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, preserveDstPortAnnotation)
+		return false
+	}
+
+	return preserve
+}
+
+// getLoadBalancerClass returns the load balancer class of the service, empty string if the service does not have one.
+func getLoadBalancerClass(svc *v1.Service) string {
+	return svc.ObjectMeta.Annotations[loadBalancerClassAnnotation]
+}
+
+// isPreferClose returns true if the service's traffic distribution is PreferClose.
+func isPreferClose(svc *v1.Service) bool {
+	value, ok := svc.ObjectMeta.Annotations[trafficDistributionAnnotation]
+	if !ok {
+		return false
+	}
+	if value != trafficDistributionPreferClose {
+		klog.Warningf("service %s/%s has unsupported value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, trafficDistributionAnnotation)
+		return false
+	}
+
+	return true
+}
+
+// getZoneWeight returns the share in percent of load balancing given to in-zone endpoints requested by the service's
+// annotation, 0 is returned when the annotation is not present or carries an invalid value.
+func getZoneWeight(svc *v1.Service) int {
+	value, ok := svc.ObjectMeta.Annotations[zoneWeightAnnotation]
+	if !ok {
+		return 0
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight <= 0 || weight > 100 {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, zoneWeightAnnotation)
+		return 0
+	}
+
+	return weight
+}
+
+// isPreferNodeLocal returns true if the service requests node local endpoints to be preferred.
+func isPreferNodeLocal(svc *v1.Service) bool {
+	value, ok := svc.ObjectMeta.Annotations[preferNodeLocalAnnotation]
+	if !ok {
+		return false
+	}
+	prefer, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, preferNodeLocalAnnotation)
+		return false
+	}
+
+	return prefer
+}
+
+// isSkipAnnotated returns true if the service requests not to be programmed.
+func isSkipAnnotated(svc *v1.Service) bool {
+	value, ok := svc.ObjectMeta.Annotations[skipAnnotation]
+	if !ok {
+		return false
+	}
+	skip, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("service %s/%s has invalid value \"%s\" for annotation %s, ignoring it", svc.Namespace, svc.Name, value, skipAnnotation)
+		return false
+	}
+
+	return skip
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"k8s.io/klog"
+)
+
+// Operations recorded in the audit log.
+const (
+	auditAddService     = "add-service"
+	auditUpdateService  = "update-service"
+	auditDeleteService  = "delete-service"
+	auditAddEndpoint    = "add-endpoint"
+	auditDeleteEndpoint = "delete-endpoint"
+)
+
+// auditRecord is a single nftables programming mutation, added and removed are ids of rules added to
+// and removed from the chain.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Operation   string    `json:"operation"`
+	ServicePort string    `json:"servicePort"`
+	Family      string    `json:"family"`
+	Chain       string    `json:"chain"`
+	Added       []uint64  `json:"added,omitempty"`
+	Removed     []uint64  `json:"removed,omitempty"`
+}
+
+// auditLog writes audit records to a sink as JSON lines, nil auditLog is disabled and records nothing.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	now func() time.Time
+}
+
+func newAuditLog(w io.Writer) *auditLog {
+	return &auditLog{enc: json.NewEncoder(w), now: time.Now}
+}
+
+// record writes a record of a mutation of Service Port's chain, failures to write are logged.
+func (a *auditLog) record(operation string, svcPortName ServicePortName, tableFamily utilnftables.TableFamily, chain string, added, removed []uint64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec := auditRecord{
+		Time:        a.now(),
+		Operation:   operation,
+		ServicePort: svcPortName.String(),
+		Family:      tableFamilyLabel(tableFamily),
+		Chain:       chain,
+		Added:       added,
+		Removed:     removed,
+	}
+	if err := a.enc.Encode(&rec); err != nil {
+		klog.Errorf("failed to write audit record of %s of chain %s with error: %+v", operation, chain, err)
+	}
+}
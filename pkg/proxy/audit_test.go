@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestAuditLog(t *testing.T) {
+	p := newTestProxy()
+	deleter := &fakeEndpointRulesDeleter{}
+	p.epRules = deleter
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 1)
+	rule := ep.epnft.Rule[utilnftables.TableFamilyIPv4]
+
+	// Disabled audit log records nothing
+	if err := p.deleteEndpointRules(svcPortName, utilnftables.TableFamilyIPv4, rule); err != nil {
+		t.Fatalf("failed to delete endpoint rules with error: %+v", err)
+	}
+
+	var sink bytes.Buffer
+	WithAuditLog(&sink)(p)
+	p.audit.now = func() time.Time { return time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC) }
+	// Endpoint's rules are added as recorded by addEndpointRules and then deleted
+	p.audit.record(auditAddEndpoint, svcPortName, utilnftables.TableFamilyIPv4, rule.Chain, rule.RuleID, nil)
+	if err := p.deleteEndpointRules(svcPortName, utilnftables.TableFamilyIPv4, rule); err != nil {
+		t.Fatalf("failed to delete endpoint rules with error: %+v", err)
+	}
+	// Failed deletion is not a mutation
+	deleter.fail = true
+	p.deleteEndpointRules(svcPortName, utilnftables.TableFamilyIPv4, rule)
+
+	var records []auditRecord
+	dec := json.NewDecoder(&sink)
+	for dec.More() {
+		var rec auditRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("failed to decode audit record with error: %+v", err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records, got %d: %+v", len(records), records)
+	}
+	add, del := records[0], records[1]
+	if add.Operation != auditAddEndpoint || del.Operation != auditDeleteEndpoint {
+		t.Errorf("expected add and delete records, got %s and %s", add.Operation, del.Operation)
+	}
+	if add.Chain != rule.Chain || del.Chain != rule.Chain {
+		t.Errorf("expected records of chain %s, got %s and %s", rule.Chain, add.Chain, del.Chain)
+	}
+	if !reflect.DeepEqual(add.Added, rule.RuleID) || !reflect.DeepEqual(del.Removed, add.Added) || len(del.Added) != 0 {
+		t.Errorf("expected deleted rule ids to match added %v, got added %v removed %v", add.Added, del.Added, del.Removed)
+	}
+	if add.ServicePort != svcPortName.String() || add.Family != "ipv4" || !add.Time.Equal(p.audit.now()) {
+		t.Errorf("unexpected audit record %+v", add)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/klog"
+)
+
+// eventKind is a kind of object an event is about.
+type eventKind int
+
+const (
+	serviceEvent eventKind = iota
+	endpointsEvent
+	endpointSliceEvent
+)
+
+// backlogEvent is an event waiting in the backlog to be applied, nil prev means the object was added,
+// nil cur means the object was deleted.
+type backlogEvent struct {
+	kind eventKind
+	name objectName
+	prev interface{}
+	cur  interface{}
+}
+
+// backpressureProxy is a Proxy which applies events to the wrapped Proxy one by one from a backlog. When the backlog
+// grows above a threshold, programming can not keep up with events, the backlog is coalesced and from then on events
+// are applied in batches once per resync period, until fewer events than the threshold arrive within a period.
+// Methods other than events handlers are passed to the wrapped Proxy.
+type backpressureProxy struct {
+	Proxy
+	threshold    int
+	resyncPeriod time.Duration
+	wake         chan struct{}
+	mu           sync.Mutex // protects the following fields
+	queue        []backlogEvent
+	batched      bool
+	// received counts events received in batched mode since the last batch was applied
+	received      int
+	services      *pendingChanges
+	endpoints     *pendingChanges
+	endpointSlice *pendingChanges
+}
+
+var _ Proxy = &backpressureProxy{}
+
+// NewBackpressureProxy returns a Proxy which applies services, endpoints and endpoint slices events to p one by one,
+// when more than threshold events are waiting, events are coalesced and applied once per resyncPeriod until
+// the backlog clears. Events are applied until stopCh is closed.
+func NewBackpressureProxy(p Proxy, threshold int, resyncPeriod time.Duration, stopCh <-chan struct{}) Proxy {
+	b := newBackpressureProxy(p, threshold, resyncPeriod)
+	go b.run(stopCh)
+
+	return b
+}
+
+func newBackpressureProxy(p Proxy, threshold int, resyncPeriod time.Duration) *backpressureProxy {
+	return &backpressureProxy{
+		Proxy:         p,
+		threshold:     threshold,
+		resyncPeriod:  resyncPeriod,
+		wake:          make(chan struct{}, 1),
+		services:      newPendingChanges(),
+		endpoints:     newPendingChanges(),
+		endpointSlice: newPendingChanges(),
+	}
+}
+
+func (b *backpressureProxy) AddService(svc *v1.Service) {
+	b.enqueue(backlogEvent{kind: serviceEvent, name: nameOf(&svc.ObjectMeta), cur: svc})
+}
+
+func (b *backpressureProxy) DeleteService(svc *v1.Service) {
+	b.enqueue(backlogEvent{kind: serviceEvent, name: nameOf(&svc.ObjectMeta), prev: svc})
+}
+
+func (b *backpressureProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	b.enqueue(backlogEvent{kind: serviceEvent, name: nameOf(&svcNew.ObjectMeta), prev: svcOld, cur: svcNew})
+}
+
+func (b *backpressureProxy) AddEndpoints(ep *v1.Endpoints) {
+	b.enqueue(backlogEvent{kind: endpointsEvent, name: nameOf(&ep.ObjectMeta), cur: ep})
+}
+
+func (b *backpressureProxy) DeleteEndpoints(ep *v1.Endpoints) {
+	b.enqueue(backlogEvent{kind: endpointsEvent, name: nameOf(&ep.ObjectMeta), prev: ep})
+}
+
+func (b *backpressureProxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
+	b.enqueue(backlogEvent{kind: endpointsEvent, name: nameOf(&epNew.ObjectMeta), prev: epOld, cur: epNew})
+}
+
+func (b *backpressureProxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
+	b.enqueue(backlogEvent{kind: endpointSliceEvent, name: nameOf(&epsl.ObjectMeta), cur: epsl})
+}
+
+func (b *backpressureProxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
+	b.enqueue(backlogEvent{kind: endpointSliceEvent, name: nameOf(&epsl.ObjectMeta), prev: epsl})
+}
+
+func (b *backpressureProxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
+	b.enqueue(backlogEvent{kind: endpointSliceEvent, name: nameOf(&epslNew.ObjectMeta), prev: epslOld, cur: epslNew})
+}
+
+// enqueue adds the event to the backlog, in batched mode the event is coalesced with pending changes.
+func (b *backpressureProxy) enqueue(ev backlogEvent) {
+	b.mu.Lock()
+	if b.batched {
+		b.record(ev)
+		b.received++
+	} else {
+		b.queue = append(b.queue, ev)
+		if len(b.queue) > b.threshold {
+			klog.Warningf("backlog of %d events exceeds threshold %d, switching to batched programming every %v", len(b.queue), b.threshold, b.resyncPeriod)
+			for _, queued := range b.queue {
+				b.record(queued)
+			}
+			b.queue = nil
+			b.batched = true
+		}
+	}
+	b.updateBacklogDepth()
+	b.mu.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// record coalesces the event with pending changes of its kind. It must be called with b.mu held.
+func (b *backpressureProxy) record(ev backlogEvent) {
+	switch ev.kind {
+	case serviceEvent:
+		b.services.record(ev.name, ev.prev, ev.cur)
+	case endpointsEvent:
+		b.endpoints.record(ev.name, ev.prev, ev.cur)
+	case endpointSliceEvent:
+		b.endpointSlice.record(ev.name, ev.prev, ev.cur)
+	}
+}
+
+// updateBacklogDepth reflects the number of events, or coalesced changes in batched mode, waiting to be applied.
+// It must be called with b.mu held.
+func (b *backpressureProxy) updateBacklogDepth() {
+	depth := len(b.queue)
+	if b.batched {
+		depth = len(b.services.order) + len(b.endpoints.order) + len(b.endpointSlice.order)
+	}
+	backlogDepth.Set(float64(depth))
+}
+
+// run applies events until stopCh is closed, one by one or in batches once per resync period in batched mode.
+func (b *backpressureProxy) run(stopCh <-chan struct{}) {
+	for {
+		b.mu.Lock()
+		batched, queued := b.batched, len(b.queue)
+		b.mu.Unlock()
+		switch {
+		case batched:
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(b.resyncPeriod):
+				b.resync()
+			}
+		case queued != 0:
+			b.next()
+		default:
+			select {
+			case <-stopCh:
+				return
+			case <-b.wake:
+			}
+		}
+	}
+}
+
+// next applies the oldest event of the backlog.
+func (b *backpressureProxy) next() {
+	b.mu.Lock()
+	if len(b.queue) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	ev := b.queue[0]
+	b.queue = b.queue[1:]
+	b.updateBacklogDepth()
+	b.mu.Unlock()
+	changes := map[eventKind]*pendingChanges{
+		serviceEvent:       newPendingChanges(),
+		endpointsEvent:     newPendingChanges(),
+		endpointSliceEvent: newPendingChanges(),
+	}
+	changes[ev.kind].record(ev.name, ev.prev, ev.cur)
+	applyPendingChanges(b.Proxy, changes[serviceEvent], changes[endpointsEvent], changes[endpointSliceEvent])
+}
+
+// resync applies all pending changes in a batch, when no more than threshold events arrived since the previous
+// batch, the backlog has cleared and events arriving from now on are applied one by one again.
+func (b *backpressureProxy) resync() {
+	b.mu.Lock()
+	services, endpoints, endpointSlice := b.services, b.endpoints, b.endpointSlice
+	b.services, b.endpoints, b.endpointSlice = newPendingChanges(), newPendingChanges(), newPendingChanges()
+	if b.received <= b.threshold {
+		klog.Infof("backlog cleared, %d events arrived within %v, switching back to programming events one by one", b.received, b.resyncPeriod)
+		b.batched = false
+	}
+	b.received = 0
+	b.updateBacklogDepth()
+	b.mu.Unlock()
+	applyPendingChanges(b.Proxy, services, endpoints, endpointSlice)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestBackpressureProxy(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(backlogDepth)
+	defer backlogDepth.Set(0)
+	svc := func(name string, version int) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: fmt.Sprint(version)}}
+	}
+	depth := func(expected int) {
+		t.Helper()
+		metric := fmt.Sprintf(`
+# HELP nfproxy_backlog_depth [ALPHA] Number of services, endpoints and endpoint slices events waiting to be programmed.
+# TYPE nfproxy_backlog_depth gauge
+nfproxy_backlog_depth %d
+`, expected)
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(metric), "nfproxy_backlog_depth"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := &recordingProxy{}
+	b := newBackpressureProxy(r, 5, time.Hour)
+
+	// Below the threshold events are applied one by one
+	b.AddService(svc("app", 1))
+	b.UpdateService(svc("app", 1), svc("app", 2))
+	depth(2)
+	b.next()
+	b.next()
+	depth(0)
+	if expected := []string{"AddService default/app@1", "UpdateService default/app@2"}; !reflect.DeepEqual(r.calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, r.calls)
+	}
+
+	// High event volume switches to batched programming, events are coalesced
+	r.calls = nil
+	for version := 2; version < 12; version++ {
+		b.UpdateService(svc("app", version), svc("app", version+1))
+		b.AddService(svc(fmt.Sprintf("svc-%d", version), 1))
+	}
+	if !b.batched {
+		t.Fatalf("expected backlog above threshold to switch to batched programming")
+	}
+	depth(11)
+	b.next()
+	if len(r.calls) != 0 {
+		t.Fatalf("expected no events applied one by one in batched mode, got %v", r.calls)
+	}
+	// Events keep arriving above the threshold within the period, programming stays batched
+	b.resync()
+	if len(r.calls) != 11 || r.calls[0] != "UpdateService default/app@12" {
+		t.Fatalf("expected 11 coalesced changes, first one the final state of default/app, got %v", r.calls)
+	}
+	if !b.batched {
+		t.Fatalf("expected programming to stay batched as more events than threshold arrived within the period")
+	}
+	depth(0)
+
+	// Backlog clears, programming switches back to events one by one
+	r.calls = nil
+	b.DeleteService(svc("svc-2", 1))
+	b.resync()
+	if b.batched {
+		t.Fatalf("expected programming to switch back to events one by one once backlog cleared")
+	}
+	b.AddService(svc("svc-2", 2))
+	b.next()
+	depth(0)
+	if expected := []string{"DeleteService default/svc-2@1", "AddService default/svc-2@2"}; !reflect.DeepEqual(r.calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, r.calls)
+	}
+}
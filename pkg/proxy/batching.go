@@ -0,0 +1,198 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/klog"
+)
+
+// pendingChange carries the state of an object before the first and after the last change within
+// a sync period, nil old means the object did not exist, nil new means the object was deleted.
+type pendingChange struct {
+	old interface{}
+	new interface{}
+}
+
+// pendingChanges accumulates changes of objects of a single kind in the order objects were first changed.
+type pendingChanges struct {
+	order   []objectName
+	changes map[objectName]*pendingChange
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{changes: make(map[objectName]*pendingChange)}
+}
+
+// record coalesces a change with already pending change of the object, the state before the first change is kept
+// and the state after the last change wins.
+func (c *pendingChanges) record(name objectName, prev, cur interface{}) {
+	change, ok := c.changes[name]
+	if !ok {
+		c.changes[name] = &pendingChange{old: prev, new: cur}
+		c.order = append(c.order, name)
+		return
+	}
+	change.new = cur
+}
+
+// batchingProxy is a Proxy which coalesces Add/Update/Delete events arriving within a minimum sync period
+// and applies them to the wrapped Proxy at most once per period. Methods other than events handlers
+// are passed to the wrapped Proxy.
+type batchingProxy struct {
+	Proxy
+	minSyncPeriod time.Duration
+	// syncMu serializes syncs, changes taken by a sync are applied after changes of the previous one
+	syncMu        sync.Mutex
+	mu            sync.Mutex // protects the following fields
+	lastSync      time.Time
+	scheduled     bool
+	services      *pendingChanges
+	endpoints     *pendingChanges
+	endpointSlice *pendingChanges
+}
+
+var _ Proxy = &batchingProxy{}
+
+// NewBatchingProxy returns a Proxy which applies services, endpoints and endpoint slices events to p at most
+// once per minSyncPeriod, events arriving within the period are coalesced and the last state of each object wins.
+func NewBatchingProxy(p Proxy, minSyncPeriod time.Duration) Proxy {
+	return &batchingProxy{
+		Proxy:         p,
+		minSyncPeriod: minSyncPeriod,
+		services:      newPendingChanges(),
+		endpoints:     newPendingChanges(),
+		endpointSlice: newPendingChanges(),
+	}
+}
+
+func (b *batchingProxy) AddService(svc *v1.Service) {
+	b.record(&b.services, nameOf(&svc.ObjectMeta), nil, svc)
+}
+
+func (b *batchingProxy) DeleteService(svc *v1.Service) {
+	b.record(&b.services, nameOf(&svc.ObjectMeta), svc, nil)
+}
+
+func (b *batchingProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	b.record(&b.services, nameOf(&svcNew.ObjectMeta), svcOld, svcNew)
+}
+
+func (b *batchingProxy) AddEndpoints(ep *v1.Endpoints) {
+	b.record(&b.endpoints, nameOf(&ep.ObjectMeta), nil, ep)
+}
+
+func (b *batchingProxy) DeleteEndpoints(ep *v1.Endpoints) {
+	b.record(&b.endpoints, nameOf(&ep.ObjectMeta), ep, nil)
+}
+
+func (b *batchingProxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
+	b.record(&b.endpoints, nameOf(&epNew.ObjectMeta), epOld, epNew)
+}
+
+func (b *batchingProxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
+	b.record(&b.endpointSlice, nameOf(&epsl.ObjectMeta), nil, epsl)
+}
+
+func (b *batchingProxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
+	b.record(&b.endpointSlice, nameOf(&epsl.ObjectMeta), epsl, nil)
+}
+
+func (b *batchingProxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
+	b.record(&b.endpointSlice, nameOf(&epslNew.ObjectMeta), epslOld, epslNew)
+}
+
+// record stores the change and schedules a sync, the sync runs right away if the last sync happened
+// more than a period ago, otherwise when the period expires. changes points to the field of pending changes,
+// it is read with b.mu held as sync replaces it.
+func (b *batchingProxy) record(changes **pendingChanges, name objectName, prev, cur interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	(*changes).record(name, prev, cur)
+	if b.scheduled {
+		return
+	}
+	b.scheduled = true
+	delay := b.minSyncPeriod - time.Since(b.lastSync)
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, b.sync)
+}
+
+// sync applies all pending changes to the wrapped Proxy, a sync scheduled while the previous one applies its
+// changes waits for it to complete.
+func (b *batchingProxy) sync() {
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+	b.mu.Lock()
+	services, endpoints, endpointSlice := b.services, b.endpoints, b.endpointSlice
+	b.services, b.endpoints, b.endpointSlice = newPendingChanges(), newPendingChanges(), newPendingChanges()
+	b.scheduled = false
+	b.lastSync = time.Now()
+	b.mu.Unlock()
+	applyPendingChanges(b.Proxy, services, endpoints, endpointSlice)
+}
+
+// applyPendingChanges applies pending changes to p, services are applied first, so endpoints
+// find their services programmed.
+func applyPendingChanges(p Proxy, services, endpoints, endpointSlice *pendingChanges) {
+	klog.V(5).Infof("applying %d service(s), %d endpoints and %d endpoint slice(s) changes", len(services.order), len(endpoints.order), len(endpointSlice.order))
+	for _, name := range services.order {
+		change := services.changes[name]
+		prev, _ := change.old.(*v1.Service)
+		cur, _ := change.new.(*v1.Service)
+		switch {
+		case prev == nil && cur != nil:
+			p.AddService(cur)
+		case prev != nil && cur != nil:
+			p.UpdateService(prev, cur)
+		case prev != nil && cur == nil:
+			p.DeleteService(prev)
+		}
+	}
+	for _, name := range endpoints.order {
+		change := endpoints.changes[name]
+		prev, _ := change.old.(*v1.Endpoints)
+		cur, _ := change.new.(*v1.Endpoints)
+		switch {
+		case prev == nil && cur != nil:
+			p.AddEndpoints(cur)
+		case prev != nil && cur != nil:
+			p.UpdateEndpoints(prev, cur)
+		case prev != nil && cur == nil:
+			p.DeleteEndpoints(prev)
+		}
+	}
+	for _, name := range endpointSlice.order {
+		change := endpointSlice.changes[name]
+		prev, _ := change.old.(*discovery.EndpointSlice)
+		cur, _ := change.new.(*discovery.EndpointSlice)
+		switch {
+		case prev == nil && cur != nil:
+			p.AddEndpointSlice(cur)
+		case prev != nil && cur != nil:
+			p.UpdateEndpointSlice(prev, cur)
+		case prev != nil && cur == nil:
+			p.DeleteEndpointSlice(prev)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// recordingProxy records events handlers calls with names and versions of objects.
+type recordingProxy struct {
+	Proxy
+	calls   []string
+	standby bool
+}
+
+func (r *recordingProxy) record(call string, meta metav1.ObjectMeta) {
+	r.calls = append(r.calls, call+" "+meta.Namespace+"/"+meta.Name+"@"+meta.ResourceVersion)
+}
+
+func (r *recordingProxy) AddService(svc *v1.Service)    { r.record("AddService", svc.ObjectMeta) }
+func (r *recordingProxy) DeleteService(svc *v1.Service) { r.record("DeleteService", svc.ObjectMeta) }
+func (r *recordingProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	r.record("UpdateService", svcNew.ObjectMeta)
+}
+func (r *recordingProxy) AddEndpoints(ep *v1.Endpoints) { r.record("AddEndpoints", ep.ObjectMeta) }
+func (r *recordingProxy) DeleteEndpoints(ep *v1.Endpoints) {
+	r.record("DeleteEndpoints", ep.ObjectMeta)
+}
+func (r *recordingProxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
+	r.record("UpdateEndpoints", epNew.ObjectMeta)
+}
+func (r *recordingProxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
+	r.record("AddEndpointSlice", epsl.ObjectMeta)
+}
+func (r *recordingProxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
+	r.record("DeleteEndpointSlice", epsl.ObjectMeta)
+}
+func (r *recordingProxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
+	r.record("UpdateEndpointSlice", epslNew.ObjectMeta)
+}
+func (r *recordingProxy) ProgramService(spec ServiceSpec) error {
+	r.calls = append(r.calls, "ProgramService "+spec.Namespace+"/"+spec.Name)
+	return nil
+}
+func (r *recordingProxy) PinService(svcPortName ServicePortName, endpointIP string) error {
+	r.calls = append(r.calls, "PinService "+svcPortName.String()+" "+endpointIP)
+	return nil
+}
+func (r *recordingProxy) UnpinService(svcPortName ServicePortName) error {
+	r.calls = append(r.calls, "UnpinService "+svcPortName.String())
+	return nil
+}
+func (r *recordingProxy) NamespaceTerminating(ns string) {
+	r.calls = append(r.calls, "NamespaceTerminating "+ns)
+}
+func (r *recordingProxy) OnNodeUpdate(node *v1.Node) { r.record("OnNodeUpdate", node.ObjectMeta) }
+func (r *recordingProxy) SetStandby(standby bool)    { r.standby = standby }
+
+func TestBatchingProxy(t *testing.T) {
+	svc := func(name, version string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: version}}
+	}
+	ep := func(name, version string) *v1.Endpoints {
+		return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: version}}
+	}
+	epsl := func(name, version string) *discovery.EndpointSlice {
+		return &discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: version}}
+	}
+	r := &recordingProxy{}
+	b := NewBatchingProxy(r, time.Hour).(*batchingProxy)
+	// Last sync has just happened, all events fall into the same period
+	b.lastSync = time.Now()
+
+	// New service updated twice is added with its final state
+	b.AddService(svc("app", "1"))
+	b.UpdateService(svc("app", "1"), svc("app", "2"))
+	b.UpdateService(svc("app", "2"), svc("app", "3"))
+	// Existing service updated and deleted is deleted with its last programmed state
+	b.UpdateService(svc("db", "1"), svc("db", "2"))
+	b.DeleteService(svc("db", "2"))
+	// Service added and deleted within the period is never programmed
+	b.AddService(svc("tmp", "1"))
+	b.DeleteService(svc("tmp", "1"))
+	// Existing service deleted and added again is updated
+	b.DeleteService(svc("web", "1"))
+	b.AddService(svc("web", "2"))
+	b.AddEndpoints(ep("app", "1"))
+	b.UpdateEndpoints(ep("app", "1"), ep("app", "2"))
+	b.UpdateEndpointSlice(epsl("app-abcde", "1"), epsl("app-abcde", "2"))
+	b.UpdateEndpointSlice(epsl("app-abcde", "2"), epsl("app-abcde", "3"))
+	b.DeleteEndpointSlice(epsl("app-fghij", "1"))
+	if len(r.calls) != 0 {
+		t.Fatalf("expected no calls before the period expires, got %v", r.calls)
+	}
+
+	b.sync()
+	expected := []string{
+		"AddService default/app@3",
+		"DeleteService default/db@1",
+		"UpdateService default/web@2",
+		"AddEndpoints default/app@2",
+		"UpdateEndpointSlice default/app-abcde@3",
+		"DeleteEndpointSlice default/app-fghij@1",
+	}
+	if !reflect.DeepEqual(r.calls, expected) {
+		t.Errorf("expected calls %v but got %v", expected, r.calls)
+	}
+	// All changes were applied in a single pass
+	b.sync()
+	if len(r.calls) != len(expected) {
+		t.Errorf("expected no calls without new events, got %v", r.calls[len(expected):])
+	}
+}
+
+func TestBatchingProxySerializesSyncs(t *testing.T) {
+	r := newProgrammingProxy(50 * time.Millisecond)
+	b := NewBatchingProxy(r, 0)
+
+	// Second change is recorded while the first sync applies its change, its sync waits for the first one
+	b.AddService(testSyncService(0, "1"))
+	time.Sleep(10 * time.Millisecond)
+	b.AddService(testSyncService(1, "1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		programmed, maxActive := len(r.services), r.maxActive
+		r.mu.Unlock()
+		if programmed == 2 {
+			if maxActive != 1 {
+				t.Errorf("expected syncs to apply changes one at a time, got %d applied in parallel", maxActive)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both services to be programmed, got %d", programmed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
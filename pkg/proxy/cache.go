@@ -22,39 +22,38 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 )
 
 // cache defines a struct to store latest version of the seen service or endpoint. Once a service/endpoint add received
 // and processed (ServicePorts are created), it will be added to cache map with key
-// types.NamespacedName of a service/endpoint.
+// the name of a service/endpoint qualified by its cluster.
 type cache struct {
 	sync.Mutex
-	svcCache  map[types.NamespacedName]*v1.Service
-	epCache   map[types.NamespacedName]*v1.Endpoints
-	epslCache map[types.NamespacedName]*discovery.EndpointSlice
+	svcCache  map[objectName]*v1.Service
+	epCache   map[objectName]*v1.Endpoints
+	epslCache map[objectName]*discovery.EndpointSlice
 }
 
 // getCachedSvcVersion return version of stored service
-func (c *cache) getCachedSvcVersion(name, namespace string) (string, error) {
+func (c *cache) getCachedSvcVersion(name objectName) (string, error) {
 	c.Lock()
 	defer c.Unlock()
-	s, ok := c.svcCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	s, ok := c.svcCache[name]
 	if !ok {
-		return "", fmt.Errorf("service %s/%s not found in the cache", namespace, name)
+		return "", fmt.Errorf("service %s not found in the cache", name.String())
 	}
 
 	return s.ObjectMeta.GetResourceVersion(), nil
 }
 
 // getLastKnownSvcFromCache return pointer to the latest known/stored instance of the service
-func (c *cache) getLastKnownSvcFromCache(name, namespace string) (*v1.Service, error) {
+func (c *cache) getLastKnownSvcFromCache(name objectName) (*v1.Service, error) {
 	c.Lock()
 	defer c.Unlock()
-	s, ok := c.svcCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	s, ok := c.svcCache[name]
 	if !ok {
-		return nil, fmt.Errorf("service %s/%s not found in the cache", namespace, name)
+		return nil, fmt.Errorf("service %s not found in the cache", name.String())
 	}
 
 	return s, nil
@@ -66,39 +65,39 @@ func (c *cache) getLastKnownSvcFromCache(name, namespace string) (*v1.Service, e
 func (c *cache) storeSvcInCache(s *v1.Service) {
 	c.Lock()
 	defer c.Unlock()
-	c.svcCache[types.NamespacedName{Name: s.ObjectMeta.Name, Namespace: s.ObjectMeta.Namespace}] = s.DeepCopy()
+	c.svcCache[nameOf(&s.ObjectMeta)] = s.DeepCopy()
 }
 
 // removeSvcFromCache removes stored service from cache.
-func (c *cache) removeSvcFromCache(name, namespace string) {
+func (c *cache) removeSvcFromCache(name objectName) {
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.svcCache[types.NamespacedName{Name: name, Namespace: namespace}]; ok {
-		delete(c.svcCache, types.NamespacedName{Name: name, Namespace: namespace})
+	if _, ok := c.svcCache[name]; ok {
+		delete(c.svcCache, name)
 	} else {
-		klog.Warningf("service %s/%s not found in the cache", namespace, name)
+		klog.Warningf("service %s not found in the cache", name.String())
 	}
 }
 
 // getCachedEpVersion return version of stored endpoint
-func (c *cache) getCachedEpVersion(name, namespace string) (string, error) {
+func (c *cache) getCachedEpVersion(name objectName) (string, error) {
 	c.Lock()
 	defer c.Unlock()
-	ep, ok := c.epCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	ep, ok := c.epCache[name]
 	if !ok {
-		return "", fmt.Errorf("endpoint %s/%s not found in the cache", namespace, name)
+		return "", fmt.Errorf("endpoint %s not found in the cache", name.String())
 	}
 
 	return ep.ObjectMeta.GetResourceVersion(), nil
 }
 
 // getLastKnownEpFromCache return pointer to the latest known/stored instance of the endpoint
-func (c *cache) getLastKnownEpFromCache(name, namespace string) (*v1.Endpoints, error) {
+func (c *cache) getLastKnownEpFromCache(name objectName) (*v1.Endpoints, error) {
 	c.Lock()
 	defer c.Unlock()
-	ep, ok := c.epCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	ep, ok := c.epCache[name]
 	if !ok {
-		return nil, fmt.Errorf("endpoint %s/%s not found in the cache", namespace, name)
+		return nil, fmt.Errorf("endpoint %s not found in the cache", name.String())
 	}
 
 	return ep, nil
@@ -110,39 +109,39 @@ func (c *cache) getLastKnownEpFromCache(name, namespace string) (*v1.Endpoints,
 func (c *cache) storeEpInCache(ep *v1.Endpoints) {
 	c.Lock()
 	defer c.Unlock()
-	c.epCache[types.NamespacedName{Name: ep.ObjectMeta.Name, Namespace: ep.ObjectMeta.Namespace}] = ep.DeepCopy()
+	c.epCache[nameOf(&ep.ObjectMeta)] = ep.DeepCopy()
 }
 
 // removeEpFromCache removes stored service from cache.
-func (c *cache) removeEpFromCache(name, namespace string) {
+func (c *cache) removeEpFromCache(name objectName) {
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.epCache[types.NamespacedName{Name: name, Namespace: namespace}]; ok {
-		delete(c.epCache, types.NamespacedName{Name: name, Namespace: namespace})
+	if _, ok := c.epCache[name]; ok {
+		delete(c.epCache, name)
 	} else {
-		klog.Warningf("endpoint %s/%s not found in the cache", namespace, name)
+		klog.Warningf("endpoint %s not found in the cache", name.String())
 	}
 }
 
 // getCachedEpSlVersion return version of stored endpoint slice
-func (c *cache) getCachedEpSlVersion(name, namespace string) (string, error) {
+func (c *cache) getCachedEpSlVersion(name objectName) (string, error) {
 	c.Lock()
 	defer c.Unlock()
-	epsl, ok := c.epslCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	epsl, ok := c.epslCache[name]
 	if !ok {
-		return "", fmt.Errorf("endpoint slice %s/%s not found in the cache", namespace, name)
+		return "", fmt.Errorf("endpoint slice %s not found in the cache", name.String())
 	}
 
 	return epsl.ObjectMeta.GetResourceVersion(), nil
 }
 
 // getLastKnownEpSlFromCache return pointer to the latest known/stored instance of the endpoint slice
-func (c *cache) getLastKnownEpSlFromCache(name, namespace string) (*discovery.EndpointSlice, error) {
+func (c *cache) getLastKnownEpSlFromCache(name objectName) (*discovery.EndpointSlice, error) {
 	c.Lock()
 	defer c.Unlock()
-	epsl, ok := c.epslCache[types.NamespacedName{Name: name, Namespace: namespace}]
+	epsl, ok := c.epslCache[name]
 	if !ok {
-		return nil, fmt.Errorf("endpoint slice %s/%s not found in the cache", namespace, name)
+		return nil, fmt.Errorf("endpoint slice %s not found in the cache", name.String())
 	}
 
 	return epsl, nil
@@ -154,16 +153,16 @@ func (c *cache) getLastKnownEpSlFromCache(name, namespace string) (*discovery.En
 func (c *cache) storeEpSlInCache(epsl *discovery.EndpointSlice) {
 	c.Lock()
 	defer c.Unlock()
-	c.epslCache[types.NamespacedName{Name: epsl.ObjectMeta.Name, Namespace: epsl.ObjectMeta.Namespace}] = epsl.DeepCopy()
+	c.epslCache[nameOf(&epsl.ObjectMeta)] = epsl.DeepCopy()
 }
 
 // removeEpSlFromCache removes stored service from cache.
-func (c *cache) removeEpSlFromCache(name, namespace string) {
+func (c *cache) removeEpSlFromCache(name objectName) {
 	c.Lock()
 	defer c.Unlock()
-	if _, ok := c.epslCache[types.NamespacedName{Name: name, Namespace: namespace}]; ok {
-		delete(c.epslCache, types.NamespacedName{Name: name, Namespace: namespace})
+	if _, ok := c.epslCache[name]; ok {
+		delete(c.epslCache, name)
 	} else {
-		klog.Warningf("endpoint slice %s/%s not found in the cache", namespace, name)
+		klog.Warningf("endpoint slice %s not found in the cache", name.String())
 	}
 }
@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+const (
+	defaultEndpointChainPrefix = "k8s-nfproxy-sep-"
+	defaultEndpointChainLength = 16
+	// maxEndpointChainLength is the length of base32 encoded sha256 without padding
+	maxEndpointChainLength = 52
+	serviceIDLength        = 16
+)
+
+// ChainNamer generates names of chains programmed for Service Ports and their endpoints. Names of Service Port's
+// chains are made of fixed prefixes and the Service Port's ID, names of endpoints' chains are generated as a whole.
+// IDs and endpoint chain names must be stable for the same input and should be distinct for distinct Service Ports
+// and endpoints. Colliding Service Ports and endpoints get long IDs and endpoint chain names, which must be distinct
+// from short ones.
+type ChainNamer interface {
+	// ServiceID returns the ID of a Service Port, the suffix of its chains' names
+	ServiceID(servicePortName string, protocol string, service string) string
+	// EndpointChain returns the name of the chain of an endpoint of a Service Port
+	EndpointChain(servicePortName string, protocol string, endpoint string) string
+	// LongServiceID returns the ID of a Service Port which ServiceID collides with the ID of another Service Port
+	LongServiceID(servicePortName string, protocol string, service string) string
+	// LongEndpointChain returns the name of the chain of an endpoint which EndpointChain collides with the chain
+	// of another endpoint, IsEndpointChain must recognize it
+	LongEndpointChain(servicePortName string, protocol string, endpoint string) string
+	// IsEndpointChain returns true if the chain name is of an endpoint chain, it is used by garbage collection
+	IsEndpointChain(chain string) bool
+}
+
+// hashChainNamer is the default ChainNamer, it generates IDs and endpoint chain names from a truncated
+// sha256 hash encoded in base32, endpoint chains' names are prefixed. Long names use the full hash.
+type hashChainNamer struct {
+	prefix string
+	length int
+	// encode returns the hash of data encoded in base32, it is at least maxEndpointChainLength long
+	encode func(data string) string
+}
+
+var _ ChainNamer = &hashChainNamer{}
+
+func sha256Base32(data string) string {
+	hash := sha256.Sum256([]byte(data))
+	return base32.StdEncoding.EncodeToString(hash[:])
+}
+
+func (h *hashChainNamer) ServiceID(servicePortName string, protocol string, service string) string {
+	return h.encode(servicePortName + protocol + service)[:serviceIDLength]
+}
+
+func (h *hashChainNamer) EndpointChain(servicePortName string, protocol string, endpoint string) string {
+	return h.prefix + h.encode(servicePortName + protocol + endpoint)[:h.length]
+}
+
+func (h *hashChainNamer) LongServiceID(servicePortName string, protocol string, service string) string {
+	return h.encode(servicePortName + protocol + service)[:maxEndpointChainLength]
+}
+
+func (h *hashChainNamer) LongEndpointChain(servicePortName string, protocol string, endpoint string) string {
+	return h.prefix + h.encode(servicePortName + protocol + endpoint)[:maxEndpointChainLength]
+}
+
+func (h *hashChainNamer) IsEndpointChain(chain string) bool {
+	return strings.HasPrefix(chain, h.prefix)
+}
+
+// endpointChainNamer generates chain names with a ChainNamer, since names might collide, for example when
+// the hash is truncated, it keeps track of names allocated for endpoints and IDs allocated for Service Ports.
+type endpointChainNamer struct {
+	namer ChainNamer
+	// chains maps an allocated chain name to the identity of the endpoint it was allocated for.
+	chains map[string]string
+	// services maps an allocated ID to the identity of the Service Port it was allocated for.
+	services map[string]string
+}
+
+func newEndpointChainNamer(prefix string, length int) *endpointChainNamer {
+	if length <= 0 || length > maxEndpointChainLength {
+		klog.Warningf("invalid endpoint chain hash length %d, using default %d", length, defaultEndpointChainLength)
+		length = defaultEndpointChainLength
+	}
+	// Chains with the prefix are deleted by garbage collection, the prefix must not match other chains
+	if prefix == "" || nftables.OverlapsReservedChains(prefix) {
+		klog.Warningf("invalid endpoint chain prefix %q, it must not be empty nor overlap names of base and service chains, using default %s",
+			prefix, defaultEndpointChainPrefix)
+		prefix = defaultEndpointChainPrefix
+	}
+	return newCustomEndpointChainNamer(&hashChainNamer{prefix: prefix, length: length, encode: sha256Base32})
+}
+
+func newCustomEndpointChainNamer(namer ChainNamer) *endpointChainNamer {
+	return &endpointChainNamer{
+		namer:    namer,
+		chains:   make(map[string]string),
+		services: make(map[string]string),
+	}
+}
+
+// name returns the chain name for an endpoint of a Service Port.
+func (n *endpointChainNamer) name(servicePortName string, protocol string, endpoint string) string {
+	return n.namer.EndpointChain(servicePortName, protocol, endpoint)
+}
+
+// serviceID returns the ID of a Service Port.
+func (n *endpointChainNamer) serviceID(servicePortName string, protocol string, service string) string {
+	return n.namer.ServiceID(servicePortName, protocol, service)
+}
+
+// register records the chain name as allocated for the endpoint, false is returned and collision is logged
+// if the name has already been allocated for a different endpoint.
+func (n *endpointChainNamer) register(chain string, servicePortName string, protocol string, endpoint string) bool {
+	id := servicePortName + "/" + protocol + "/" + endpoint
+	if owner, ok := n.chains[chain]; ok && owner != id {
+		klog.Errorf("endpoint chain name collision detected, chain %s is used by %s and %s, consider increasing endpoint chain hash length",
+			chain, owner, id)
+		return false
+	}
+	n.chains[chain] = id
+
+	return true
+}
+
+// release removes the chain name from allocated names if it was allocated for the endpoint.
+func (n *endpointChainNamer) release(chain string, servicePortName string, protocol string, endpoint string) {
+	if n.chains[chain] == servicePortName+"/"+protocol+"/"+endpoint {
+		delete(n.chains, chain)
+	}
+}
+
+// allocate returns the chain name for an endpoint of a Service Port and records it as allocated. If the name
+// is already allocated for a different endpoint, the collision is counted and the endpoint gets a long name.
+func (n *endpointChainNamer) allocate(servicePortName string, protocol string, endpoint string) string {
+	cn := n.name(servicePortName, protocol, endpoint)
+	if n.register(cn, servicePortName, protocol, endpoint) {
+		return cn
+	}
+	chainNameCollisions.WithLabelValues("endpoint").Inc()
+	cn = n.namer.LongEndpointChain(servicePortName, protocol, endpoint)
+	klog.Warningf("endpoint %s of service port %s uses long chain name %s", endpoint, servicePortName, cn)
+	n.register(cn, servicePortName, protocol, endpoint)
+
+	return cn
+}
+
+// allocateServiceID returns the ID of a Service Port and records it as allocated. If the ID is already allocated
+// for a different Service Port, the collision is counted and the Service Port gets a long ID.
+func (n *endpointChainNamer) allocateServiceID(servicePortName string, protocol string, service string) string {
+	id := n.serviceID(servicePortName, protocol, service)
+	owner := servicePortName + "/" + protocol + "/" + service
+	if allocated, ok := n.services[id]; ok && allocated != owner {
+		klog.Errorf("service chain name collision detected, id %s is used by %s and %s", id, allocated, owner)
+		chainNameCollisions.WithLabelValues("service").Inc()
+		id = n.namer.LongServiceID(servicePortName, protocol, service)
+		klog.Warningf("service port %s uses long id %s", servicePortName, id)
+		if allocated, ok := n.services[id]; ok && allocated != owner {
+			klog.Errorf("service chain name collision detected, long id %s is used by %s and %s", id, allocated, owner)
+			return id
+		}
+	}
+	n.services[id] = owner
+
+	return id
+}
+
+// reownServiceID records the ID allocated for the Service Port under the Service Port's new description, the ID
+// itself is kept, so the Service Port's chains keep their names.
+func (n *endpointChainNamer) reownServiceID(id string, servicePortName string, protocol string, oldService string, newService string) {
+	if n.services[id] == servicePortName+"/"+protocol+"/"+oldService {
+		n.services[id] = servicePortName + "/" + protocol + "/" + newService
+	}
+}
+
+// releaseServiceID removes the ID from allocated IDs if it was allocated for the Service Port.
+func (n *endpointChainNamer) releaseServiceID(id string, servicePortName string, protocol string, service string) {
+	if n.services[id] == servicePortName+"/"+protocol+"/"+service {
+		delete(n.services, id)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestEndpointChainNamer(t *testing.T) {
+	n := newEndpointChainNamer("sep-", 4)
+	cn := n.name("default/app:http", "TCP", "10.1.1.1:8080")
+	if !strings.HasPrefix(cn, "sep-") || len(cn) != len("sep-")+4 {
+		t.Fatalf("expected chain name with prefix sep- and 4 characters hash but got %s", cn)
+	}
+	if cn != n.name("default/app:http", "TCP", "10.1.1.1:8080") {
+		t.Fatalf("expected chain name to be stable for the same endpoint")
+	}
+	if !n.register(cn, "default/app:http", "TCP", "10.1.1.1:8080") {
+		t.Fatalf("expected the first registration of %s to succeed", cn)
+	}
+	// Registering the same endpoint again is not a collision
+	if !n.register(cn, "default/app:http", "TCP", "10.1.1.1:8080") {
+		t.Fatalf("expected repeated registration of the same endpoint not to be a collision")
+	}
+	// Synthetic collision, a distinct endpoint claiming the same chain name
+	if n.register(cn, "default/app:http", "TCP", "10.1.1.2:8080") {
+		t.Fatalf("expected collision to be detected for chain %s", cn)
+	}
+	n.release(cn, "default/app:http", "TCP", "10.1.1.1:8080")
+	if !n.register(cn, "default/app:http", "TCP", "10.1.1.2:8080") {
+		t.Fatalf("expected chain %s to be available after release", cn)
+	}
+
+	// With 1 character hash, out of 33 distinct endpoints at least 2 must collide
+	n = newEndpointChainNamer("sep-", 1)
+	collision := false
+	for i := 0; i <= 32; i++ {
+		ep := fmt.Sprintf("10.1.1.%d:8080", i)
+		if !n.register(n.name("default/app:http", "TCP", ep), "default/app:http", "TCP", ep) {
+			collision = true
+		}
+	}
+	if !collision {
+		t.Errorf("expected a collision with 1 character hash")
+	}
+}
+
+func TestEndpointChainPrefixValidation(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{prefix: "sep-", expected: "sep-"},
+		{prefix: "", expected: defaultEndpointChainPrefix},
+		{prefix: "k8s-nfproxy-", expected: defaultEndpointChainPrefix},
+		{prefix: "k8s-nfproxy-svc-ep-", expected: defaultEndpointChainPrefix},
+		{prefix: "k8s-nfproxy-fw", expected: defaultEndpointChainPrefix},
+		{prefix: "k8s-nfproxy-xlb-", expected: defaultEndpointChainPrefix},
+		// Prefix of base chains
+		{prefix: "k8s-nat-", expected: defaultEndpointChainPrefix},
+	}
+	for _, tt := range tests {
+		p := newTestProxy()
+		WithEndpointChainName(tt.prefix, 8)(p)
+		cn := p.sepNamer.name("default/app:http", "TCP", "10.1.1.1:8080")
+		if !strings.HasPrefix(cn, tt.expected) || len(cn) != len(tt.expected)+8 {
+			t.Errorf("expected prefix %q to result in chain name with prefix %q, got %s", tt.prefix, tt.expected, cn)
+		}
+	}
+}
+
+// customChainNamer names chains after Service Ports and endpoints in a readable form.
+type customChainNamer struct{}
+
+func (customChainNamer) ServiceID(servicePortName string, protocol string, service string) string {
+	return strings.NewReplacer("/", "-", ":", "-").Replace(servicePortName)
+}
+
+func (customChainNamer) EndpointChain(servicePortName string, protocol string, endpoint string) string {
+	return "ep-" + strings.NewReplacer("/", "-", ":", "-").Replace(servicePortName+"/"+endpoint)
+}
+
+func (customChainNamer) LongServiceID(servicePortName string, protocol string, service string) string {
+	return strings.NewReplacer("/", "-", ":", "-").Replace(servicePortName + "/" + service)
+}
+
+func (customChainNamer) LongEndpointChain(servicePortName string, protocol string, endpoint string) string {
+	return "ep-long-" + strings.NewReplacer("/", "-", ":", "-").Replace(servicePortName+"/"+endpoint)
+}
+
+func (customChainNamer) IsEndpointChain(chain string) bool {
+	return strings.HasPrefix(chain, "ep-")
+}
+
+func TestCustomChainNamer(t *testing.T) {
+	p := newTestProxy()
+	WithChainNamer(customChainNamer{})(p)
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if id := p.sepNamer.serviceID(svcPortName.String(), "TCP", "IPv4:10.96.0.10:80/TCP"); id != "default-app-http-TCP" {
+		t.Errorf("expected custom service id default-app-http-TCP, got %s", id)
+	}
+	addr := &v1.EndpointAddress{IP: "10.1.1.1"}
+	port := &v1.EndpointPort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}
+	if err := p.addEndpoint(svcPortName, addr, port, endpointAttributes{}); err != nil {
+		t.Fatalf("failed to add endpoint with error: %+v", err)
+	}
+	chain := "ep-default-app-http-TCP-IPv4-10.1.1.1-8080-TCP"
+	snapshots := p.Endpoints(svcPortName)
+	if len(snapshots) != 1 || snapshots[0].Chain != chain {
+		t.Fatalf("expected endpoint chain %s, got %+v", chain, snapshots)
+	}
+
+	// Garbage collection recognizes endpoint chains of the custom scheme
+	store := &fakeChainStore{chains: make(map[utilnftables.TableFamily][]string)}
+	store.chains[utilnftables.TableFamilyIPv4] = []string{"k8s-nfproxy-sep-ABCDEF", chain, "ep-orphan"}
+	p.chains = store
+	chains, _ := store.list(utilnftables.TableFamilyIPv4)
+	p.deleteOrphanedEndpointChains(utilnftables.TableFamilyIPv4, chains)
+	if got := store.chains[utilnftables.TableFamilyIPv4]; len(got) != 2 || got[0] != "k8s-nfproxy-sep-ABCDEF" || got[1] != chain {
+		t.Errorf("expected only orphaned custom endpoint chain to be collected, got %v", got)
+	}
+}
+
+func TestChainNameCollision(t *testing.T) {
+	// Stubbed hash makes truncated names of all services and endpoints collide
+	n := newCustomEndpointChainNamer(&hashChainNamer{
+		prefix: "sep-",
+		length: 16,
+		encode: func(data string) string { return strings.Repeat("A", 16) + sha256Base32(data) },
+	})
+	first := n.allocate("default/app:http", "TCP", "10.1.1.1:8080")
+	second := n.allocate("default/app:http", "TCP", "10.1.1.2:8080")
+	if first == second {
+		t.Fatalf("expected colliding endpoints to get distinct chains, both got %s", first)
+	}
+	if first != "sep-"+strings.Repeat("A", 16) || len(second) != len("sep-")+maxEndpointChainLength {
+		t.Errorf("expected the second endpoint to get long chain name, got %s and %s", first, second)
+	}
+	if again := n.allocate("default/app:http", "TCP", "10.1.1.1:8080"); again != first {
+		t.Errorf("expected the same endpoint to keep its chain %s, got %s", first, again)
+	}
+
+	svc1 := n.allocateServiceID("default/app:http", "TCP", "IPv4:10.96.0.10:80/TCP")
+	svc2 := n.allocateServiceID("default/web:http", "TCP", "IPv4:10.96.0.20:80/TCP")
+	if svc1 == svc2 || len(svc2) != maxEndpointChainLength {
+		t.Fatalf("expected colliding service ports to get distinct ids, got %s and %s", svc1, svc2)
+	}
+	// Once released, the id is available again for another service port
+	n.releaseServiceID(svc1, "default/app:http", "TCP", "IPv4:10.96.0.10:80/TCP")
+	if id := n.allocateServiceID("default/web:http", "TCP", "IPv4:10.96.0.30:80/TCP"); id != svc1 {
+		t.Errorf("expected released id %s to be allocated, got %s", svc1, id)
+	}
+}
+
+// collidingChainNamer gives the same short ID and endpoint chain name to all Service Ports and endpoints.
+type collidingChainNamer struct {
+	customChainNamer
+}
+
+func (collidingChainNamer) ServiceID(servicePortName string, protocol string, service string) string {
+	return "svc"
+}
+
+func (collidingChainNamer) EndpointChain(servicePortName string, protocol string, endpoint string) string {
+	return "ep-0"
+}
+
+func TestCustomChainNameCollision(t *testing.T) {
+	n := newCustomEndpointChainNamer(collidingChainNamer{})
+	first := n.allocate("default/app:http", "TCP", "10.1.1.1:8080")
+	second := n.allocate("default/app:http", "TCP", "10.1.1.2:8080")
+	if first != "ep-0" || second != "ep-long-default-app-http-10.1.1.2-8080" {
+		t.Errorf("expected the second endpoint to get the custom long chain name, got %s and %s", first, second)
+	}
+	svc1 := n.allocateServiceID("default/app:http", "TCP", "IPv4:10.96.0.10:80/TCP")
+	svc2 := n.allocateServiceID("default/web:http", "TCP", "IPv4:10.96.0.20:80/TCP")
+	if svc1 != "svc" || svc2 != "default-web-http-IPv4-10.96.0.20-80-TCP" {
+		t.Errorf("expected the second service port to get the custom long id, got %s and %s", svc1, svc2)
+	}
+}
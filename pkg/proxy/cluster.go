@@ -0,0 +1,176 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// clusterAnnotation carries the identifier of the cluster an object comes from, it is set by the cluster
+// proxy on services, endpoints and endpoint slices of remote clusters. The local proxy removes it from objects
+// of the local cluster, so users cannot make their objects pass for objects of a remote cluster.
+const clusterAnnotation = "nfproxy.nordix.org/cluster"
+
+// objectName identifies an object by its namespaced name and the cluster it comes from, the cluster is empty
+// for objects of the local cluster.
+type objectName struct {
+	types.NamespacedName
+	Cluster string
+}
+
+func (n objectName) String() string {
+	if n.Cluster != "" {
+		return fmt.Sprintf("%s/%s", n.Cluster, n.NamespacedName.String())
+	}
+	return n.NamespacedName.String()
+}
+
+// clusterOf returns the cluster an object comes from, empty for objects of the local cluster.
+func clusterOf(obj metav1.Object) string {
+	return obj.GetAnnotations()[clusterAnnotation]
+}
+
+// nameOf returns the name of an object qualified by the cluster it comes from.
+func nameOf(meta *metav1.ObjectMeta) objectName {
+	return objectName{NamespacedName: types.NamespacedName{Namespace: meta.Namespace, Name: meta.Name}, Cluster: clusterOf(meta)}
+}
+
+// getObjSvcPortName returns Service Port Name of a port of the service, qualified by the cluster the service comes from.
+func getObjSvcPortName(svc metav1.Object, portName string, protocol v1.Protocol) ServicePortName {
+	svcPortName := getSvcPortName(svc.GetName(), svc.GetNamespace(), portName, protocol)
+	svcPortName.Cluster = clusterOf(svc)
+
+	return svcPortName
+}
+
+// clusterProxy is a Proxy which tags services, endpoints and endpoint slices with the cluster they come from
+// before passing them to the wrapped Proxy, so objects of the same name in different clusters get distinct
+// Service Ports and chains. Objects of the local cluster, with empty cluster, get the cluster annotation removed.
+// Methods other than events handlers are passed to the wrapped Proxy.
+type clusterProxy struct {
+	Proxy
+	cluster string
+}
+
+var _ Proxy = &clusterProxy{}
+
+// NewClusterProxy returns a Proxy which passes services, endpoints and endpoint slices events of the cluster
+// to p, it is used to feed p from informers of a remote cluster.
+func NewClusterProxy(p Proxy, cluster string) Proxy {
+	return &clusterProxy{
+		Proxy:   p,
+		cluster: cluster,
+	}
+}
+
+// NewLocalProxy returns a Proxy which passes services, endpoints and endpoint slices events of the local cluster
+// to p, it is used to feed p from informers of the local cluster. The cluster annotation is removed from objects
+// carrying it, they are programmed as objects of the local cluster.
+func NewLocalProxy(p Proxy) Proxy {
+	return &clusterProxy{
+		Proxy: p,
+	}
+}
+
+func (c *clusterProxy) AddService(svc *v1.Service) {
+	c.Proxy.AddService(c.tagService(svc))
+}
+
+func (c *clusterProxy) DeleteService(svc *v1.Service) {
+	c.Proxy.DeleteService(c.tagService(svc))
+}
+
+func (c *clusterProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	c.Proxy.UpdateService(c.tagService(svcOld), c.tagService(svcNew))
+}
+
+func (c *clusterProxy) AddEndpoints(ep *v1.Endpoints) {
+	c.Proxy.AddEndpoints(c.tagEndpoints(ep))
+}
+
+func (c *clusterProxy) DeleteEndpoints(ep *v1.Endpoints) {
+	c.Proxy.DeleteEndpoints(c.tagEndpoints(ep))
+}
+
+func (c *clusterProxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
+	c.Proxy.UpdateEndpoints(c.tagEndpoints(epOld), c.tagEndpoints(epNew))
+}
+
+func (c *clusterProxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
+	c.Proxy.AddEndpointSlice(c.tagEndpointSlice(epsl))
+}
+
+func (c *clusterProxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
+	c.Proxy.DeleteEndpointSlice(c.tagEndpointSlice(epsl))
+}
+
+func (c *clusterProxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
+	c.Proxy.UpdateEndpointSlice(c.tagEndpointSlice(epslOld), c.tagEndpointSlice(epslNew))
+}
+
+// tagService returns a copy of the service annotated with the cluster, informers' objects must not be modified.
+func (c *clusterProxy) tagService(svc *v1.Service) *v1.Service {
+	if !c.needsTag(svc) {
+		return svc
+	}
+	tagged := svc.DeepCopy()
+	c.tag(&tagged.ObjectMeta)
+	return tagged
+}
+
+// tagEndpoints returns a copy of the endpoints annotated with the cluster.
+func (c *clusterProxy) tagEndpoints(ep *v1.Endpoints) *v1.Endpoints {
+	if !c.needsTag(ep) {
+		return ep
+	}
+	tagged := ep.DeepCopy()
+	c.tag(&tagged.ObjectMeta)
+	return tagged
+}
+
+// tagEndpointSlice returns a copy of the endpoint slice annotated with the cluster.
+func (c *clusterProxy) tagEndpointSlice(epsl *discovery.EndpointSlice) *discovery.EndpointSlice {
+	if !c.needsTag(epsl) {
+		return epsl
+	}
+	tagged := epsl.DeepCopy()
+	c.tag(&tagged.ObjectMeta)
+	return tagged
+}
+
+// needsTag returns false for objects of the local cluster without the cluster annotation, they are passed as they are.
+func (c *clusterProxy) needsTag(obj metav1.Object) bool {
+	_, ok := obj.GetAnnotations()[clusterAnnotation]
+	return c.cluster != "" || ok
+}
+
+func (c *clusterProxy) tag(meta *metav1.ObjectMeta) {
+	if c.cluster == "" {
+		warnings.warningf(warnClusterAnnotation, "object %s/%s of the local cluster carries annotation %s, ignoring it", meta.Namespace, meta.Name, clusterAnnotation)
+		delete(meta.Annotations, clusterAnnotation)
+		return
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[clusterAnnotation] = c.cluster
+}
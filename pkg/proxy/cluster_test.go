@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestClusterProxy(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	ready := true
+	nodeName := p.hostname
+	name, port, proto := "http", int32(8080), v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-abcde",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}, Hostname: &nodeName},
+		},
+		Ports: []discovery.EndpointPort{{Name: &name, Port: &port, Protocol: &proto}},
+	}
+
+	// The same EndpointSlice arrives from informers of two clusters
+	NewClusterProxy(p, "east").AddEndpointSlice(epsl)
+	NewClusterProxy(p, "west").AddEndpointSlice(epsl)
+	if len(epsl.Annotations) != 0 {
+		t.Errorf("expected informer's EndpointSlice not to be modified, got annotations %v", epsl.Annotations)
+	}
+
+	east := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	east.Cluster = "east"
+	west := east
+	west.Cluster = "west"
+	if east.String() != "east/default/app:http:TCP" {
+		t.Errorf("expected Service Port Name to be qualified by the cluster, got %s", east.String())
+	}
+	chains := make(map[string]ServicePortName)
+	for _, svcPortName := range []ServicePortName{east, west} {
+		eps := p.endpointsMap[svcPortName]
+		if len(eps) != 1 {
+			t.Fatalf("expected 1 endpoint of %s, got %d", svcPortName.String(), len(eps))
+		}
+		epInfo := eps[0].(*endpointsInfo)
+		if epInfo.GetIsLocal() {
+			t.Errorf("expected endpoint %s of remote cluster %s not to be local", epInfo.String(), svcPortName.Cluster)
+		}
+		chain := epInfo.epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+		if other, ok := chains[chain]; ok {
+			t.Errorf("expected distinct endpoint chains, %s and %s share chain %s", other.String(), svcPortName.String(), chain)
+		}
+		chains[chain] = svcPortName
+	}
+	if _, ok := p.endpointsMap[getSvcPortName("app", "default", "http", v1.ProtocolTCP)]; ok {
+		t.Errorf("expected no endpoints of the local cluster's Service Port")
+	}
+	if p.sepNamer.serviceID(east.String(), string(v1.ProtocolTCP), "10.96.0.10:80/TCP") == p.sepNamer.serviceID(west.String(), string(v1.ProtocolTCP), "10.96.0.10:80/TCP") {
+		t.Errorf("expected distinct service ids of %s and %s", east.String(), west.String())
+	}
+
+	// Deleting the slice of one cluster leaves the other cluster's endpoints intact
+	NewClusterProxy(p, "east").DeleteEndpointSlice(epsl)
+	if _, ok := p.endpointsMap[east]; ok {
+		t.Errorf("expected endpoints of %s to be removed", east.String())
+	}
+	if len(p.endpointsMap[west]) != 1 {
+		t.Errorf("expected endpoints of %s to be kept, got %d", west.String(), len(p.endpointsMap[west]))
+	}
+	sliceName := nameOf(&epsl.ObjectMeta)
+	sliceName.Cluster = "west"
+	if _, err := p.cache.getLastKnownEpSlFromCache(sliceName); err != nil {
+		t.Errorf("expected EndpointSlice of cluster west to stay cached")
+	}
+}
+
+func TestLocalProxyIgnoresClusterAnnotation(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	ready := true
+	name, port, proto := "http", int32(8080), v1.ProtocolTCP
+	// EndpointSlice of the local cluster claims to come from a remote cluster
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app-abcde",
+			Namespace:   "default",
+			Labels:      map[string]string{discovery.LabelServiceName: "app"},
+			Annotations: map[string]string{clusterAnnotation: "east"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+		Ports:       []discovery.EndpointPort{{Name: &name, Port: &port, Protocol: &proto}},
+	}
+	NewLocalProxy(p).AddEndpointSlice(epsl)
+	if epsl.Annotations[clusterAnnotation] != "east" {
+		t.Errorf("expected informer's EndpointSlice not to be modified, got annotations %v", epsl.Annotations)
+	}
+	local := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if n := len(p.endpointsMap[local]); n != 1 {
+		t.Errorf("expected endpoint of the local cluster's Service Port, got %d endpoints", n)
+	}
+	east := local
+	east.Cluster = "east"
+	if _, ok := p.endpointsMap[east]; ok {
+		t.Errorf("expected no endpoints of remote cluster east")
+	}
+}
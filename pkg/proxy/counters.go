@@ -0,0 +1,102 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+// counterReader reads back counters of chains programmed in nftables.
+type counterReader interface {
+	counter(tableFamily utilnftables.TableFamily, chain string) (nftables.Counter, error)
+}
+
+type nftCounterReader struct {
+	nfti *nftables.NFTInterface
+}
+
+func (r *nftCounterReader) counter(tableFamily utilnftables.TableFamily, chain string) (nftables.Counter, error) {
+	return nftables.GetChainCounter(r.nfti, tableFamily, chain)
+}
+
+// ServicePortCounters carries traffic counters of a Service Port's service chains and of its endpoints' chains.
+type ServicePortCounters struct {
+	// Service carries counters of the service chain of each ip family the Service Port is programmed in
+	Service map[v1.IPFamily]nftables.Counter
+	// Endpoints carries counters of endpoints' chains, keyed by endpoint
+	Endpoints map[string]nftables.Counter
+}
+
+// Counters reads back from nftables traffic counters of a Service Port and its programmed endpoints.
+func (p *proxy) Counters(svcPortName ServicePortName) (ServicePortCounters, error) {
+	type chainRef struct {
+		tableFamily utilnftables.TableFamily
+		chain       string
+	}
+	// Chains are collected under the lock, counters are read without holding it
+	p.mu.RLock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		p.mu.RUnlock()
+		return ServicePortCounters{}, fmt.Errorf("service port %s is not found", svcPortName.String())
+	}
+	svcnft := baseServiceInfo(svc).svcnft
+	svcChains := make(map[v1.IPFamily]chainRef)
+	for tableFamily := range svcnft.Chains {
+		svcChains[ipFamilyOfTable(tableFamily)] = chainRef{tableFamily: tableFamily, chain: nftables.K8sSvcPrefix + svcnft.ServiceID}
+	}
+	epChains := make(map[string]chainRef)
+	for _, ep := range p.endpointsMap[svcPortName] {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok || epInfo.epnft == nil {
+			continue
+		}
+		for tableFamily, rule := range epInfo.epnft.Rule {
+			if rule.RuleID == nil {
+				// Endpoint's rules are not programmed yet
+				continue
+			}
+			epChains[epInfo.String()] = chainRef{tableFamily: tableFamily, chain: rule.Chain}
+		}
+	}
+	p.mu.RUnlock()
+
+	counters := ServicePortCounters{
+		Service:   make(map[v1.IPFamily]nftables.Counter),
+		Endpoints: make(map[string]nftables.Counter),
+	}
+	for ipFamily, ref := range svcChains {
+		counter, err := p.counters.counter(ref.tableFamily, ref.chain)
+		if err != nil {
+			return ServicePortCounters{}, fmt.Errorf("failed to read counter of service port %s with error: %+v", svcPortName.String(), err)
+		}
+		counters.Service[ipFamily] = counter
+	}
+	for ep, ref := range epChains {
+		counter, err := p.counters.counter(ref.tableFamily, ref.chain)
+		if err != nil {
+			return ServicePortCounters{}, fmt.Errorf("failed to read counter of endpoint %s with error: %+v", ep, err)
+		}
+		counters.Endpoints[ep] = counter
+	}
+
+	return counters, nil
+}
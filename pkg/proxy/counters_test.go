@@ -0,0 +1,74 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+// fakeCounterReader keeps counters by chain name.
+type fakeCounterReader map[string]nftables.Counter
+
+func (r fakeCounterReader) counter(tableFamily utilnftables.TableFamily, chain string) (nftables.Counter, error) {
+	counter, ok := r[chain]
+	if !ok {
+		return nftables.Counter{}, fmt.Errorf("chain %s has no counter", chain)
+	}
+
+	return counter, nil
+}
+
+func TestCounters(t *testing.T) {
+	p := newTestProxy()
+	reader := fakeCounterReader{}
+	p.counters = reader
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if _, err := p.Counters(svcPortName); err == nil {
+		t.Errorf("expected error for unknown service port")
+	}
+	svcInfo := &BaseServiceInfo{svcnft: &nftables.SVCnft{ServiceID: "SVCID"}}
+	svcInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "SVCID")
+	p.serviceMap[svcPortName] = &serviceInfo{BaseServiceInfo: svcInfo}
+	ep1 := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)
+	ep2 := newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 1)
+	// Endpoint which rules are not programmed yet has no counter
+	pending := newTestEndpoint(svcPortName, "10.1.1.3", 8080, false, 2)
+	pending.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID = nil
+	p.endpointsMap[svcPortName] = []Endpoint{ep1, ep2, pending}
+	reader[nftables.K8sSvcPrefix+"SVCID"] = nftables.Counter{Packets: 10, Bytes: 600}
+	reader[ep1.epnft.Rule[utilnftables.TableFamilyIPv4].Chain] = nftables.Counter{Packets: 7, Bytes: 420}
+	reader[ep2.epnft.Rule[utilnftables.TableFamilyIPv4].Chain] = nftables.Counter{Packets: 3, Bytes: 180}
+
+	counters, err := p.Counters(svcPortName)
+	if err != nil {
+		t.Fatalf("failed to read counters with error: %+v", err)
+	}
+	if counters.Service[v1.IPv4Protocol] != (nftables.Counter{Packets: 10, Bytes: 600}) || len(counters.Service) != 1 {
+		t.Errorf("expected ipv4 service counter of 10 packets and 600 bytes, got %+v", counters.Service)
+	}
+	if len(counters.Endpoints) != 2 {
+		t.Fatalf("expected counters of 2 programmed endpoints, got %+v", counters.Endpoints)
+	}
+	if counters.Endpoints[ep1.String()].Packets != 7 || counters.Endpoints[ep2.String()].Packets != 3 {
+		t.Errorf("expected 7 and 3 packets for endpoints, got %+v", counters.Endpoints)
+	}
+}
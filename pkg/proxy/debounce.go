@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"k8s.io/klog"
+)
+
+// serviceChainKey identifies a service chain of a specific ip family
+type serviceChainKey struct {
+	svcPortName ServicePortName
+	tableFamily utilnftables.TableFamily
+}
+
+// debouncer coalesces service chain updates requested within a window, only the latest endpoints set
+// is applied once the window expires.
+type debouncer struct {
+	window  time.Duration
+	apply   func(serviceChainKey)
+	mu      sync.Mutex // protects pending
+	pending map[serviceChainKey]*time.Timer
+}
+
+func newDebouncer(window time.Duration, apply func(serviceChainKey)) *debouncer {
+	return &debouncer{
+		window:  window,
+		apply:   apply,
+		pending: make(map[serviceChainKey]*time.Timer),
+	}
+}
+
+// trigger schedules an update for the key, if an update is already pending, the call is coalesced with it.
+func (d *debouncer) trigger(key serviceChainKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pending[key]; ok {
+		return
+	}
+	d.pending[key] = time.AfterFunc(d.window, func() {
+		d.mu.Lock()
+		delete(d.pending, key)
+		d.mu.Unlock()
+		d.apply(key)
+	})
+}
+
+// cancel drops a pending update for the key, it is used when the update gets applied right away.
+func (d *debouncer) cancel(key serviceChainKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.pending[key]; ok {
+		t.Stop()
+		delete(d.pending, key)
+	}
+}
+
+// applyServiceChainUpdate is called by the debouncer when the window for a service chain expires.
+func (p *proxy) applyServiceChainUpdate(key serviceChainKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.updateServiceChain(key.svcPortName, key.tableFamily); err != nil {
+		klog.Errorf("failed to update service %s chain with error: %+v", key.svcPortName.String(), err)
+	}
+}
+
+// scheduleServiceChainUpdate updates service chain right away if debouncing is not enabled, otherwise the update
+// is coalesced with other updates for the same service chain. It must be called with p.mu held.
+func (p *proxy) scheduleServiceChainUpdate(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) error {
+	if p.debouncer == nil {
+		return p.updateServiceChain(svcPortName, tableFamily)
+	}
+	klog.V(6).Infof("debouncing service chain update for service %s address family %v", svcPortName.String(), tableFamily)
+	p.debouncer.trigger(serviceChainKey{svcPortName: svcPortName, tableFamily: tableFamily})
+
+	return nil
+}
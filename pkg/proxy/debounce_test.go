@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEndpointsUpdatesDebounced(t *testing.T) {
+	window := 200 * time.Millisecond
+	p, conn := newFakeNFTProxy(t, false, WithEndpointSliceDebounce(window))
+	p.AddService(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	})
+	ips := []string{"10.244.0.1"}
+	ep := newTestEndpoints("1", 8080, ips...)
+	p.AddEndpoints(ep)
+	time.Sleep(2 * window)
+	programmed := len(verdictMaps(conn))
+	if programmed == 0 {
+		t.Fatalf("expected service chain to be programmed with the first endpoint")
+	}
+
+	// 20 updates within a window, each adding an endpoint
+	for i := 2; i <= 21; i++ {
+		ips = append(ips, fmt.Sprintf("10.244.0.%d", i))
+		epNew := newTestEndpoints(fmt.Sprint(i), 8080, ips...)
+		p.UpdateEndpoints(ep, epNew)
+		ep = epNew
+	}
+	if n := len(verdictMaps(conn)); n != programmed {
+		t.Fatalf("expected service chain updates to be held for the window, got %d programs", n-programmed)
+	}
+	time.Sleep(2 * window)
+	vmaps := verdictMaps(conn)
+	if len(vmaps) != programmed+1 {
+		t.Fatalf("expected 20 updates within a window to result in a single reprogram, got %d", len(vmaps)-programmed)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	if n := len(conn.Elements[vmaps[len(vmaps)-1]]); n != 21 {
+		t.Errorf("expected the reprogram to apply the latest 21 endpoints, got %d", n)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+	utilnet "k8s.io/utils/net"
+)
+
+// healthCheckServer serves a health check node port of a service with externalTrafficPolicy Local,
+// the port is shared by all the service's ports.
+type healthCheckServer struct {
+	svcPortNames sets.String
+	server       *http.Server
+}
+
+// healthCheckResponse is the body of health check responses, it follows kube-proxy's format.
+type healthCheckResponse struct {
+	Service struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"service"`
+	LocalEndpoints int `json:"localEndpoints"`
+}
+
+// listenHealthCheck opens a listener of a health check node port on all node's addresses.
+func listenHealthCheck(port int) (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+// startHealthCheck starts serving Service Port's health check node port, if it is not served already.
+// It must be called with p.mu held.
+func (p *proxy) startHealthCheck(svcPortName ServicePortName, baseInfo *BaseServiceInfo) {
+	port := baseInfo.healthCheckNodePort
+	if !p.healthCheckNodePorts || port == 0 {
+		return
+	}
+	if hc, ok := p.healthChecks[port]; ok {
+		hc.svcPortNames.Insert(svcPortName.String())
+		return
+	}
+	ln, err := p.listen(port)
+	if err != nil {
+		klog.Errorf("failed to listen on health check node port %d of service %s with error: %+v", port, svcPortName.String(), err)
+		return
+	}
+	hc := &healthCheckServer{
+		svcPortNames: sets.NewString(svcPortName.String()),
+		server:       &http.Server{Handler: p.healthCheckHandler(svcPortName.serviceName())},
+	}
+	go func() {
+		if err := hc.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("health check node port %d of service %s failed with error: %+v", port, svcPortName.NamespacedName.String(), err)
+		}
+	}()
+	if p.healthChecks == nil {
+		p.healthChecks = make(map[int]*healthCheckServer)
+	}
+	p.healthChecks[port] = hc
+	klog.V(5).Infof("serving health check node port %d of service %s", port, svcPortName.NamespacedName.String())
+}
+
+// stopHealthCheck stops serving Service Port's health check node port once no other port of the service uses it.
+// It must be called with p.mu held.
+func (p *proxy) stopHealthCheck(svcPortName ServicePortName, baseInfo *BaseServiceInfo) {
+	port := baseInfo.healthCheckNodePort
+	hc, ok := p.healthChecks[port]
+	if !ok {
+		return
+	}
+	hc.svcPortNames.Delete(svcPortName.String())
+	if hc.svcPortNames.Len() != 0 {
+		return
+	}
+	if err := hc.server.Close(); err != nil {
+		klog.Errorf("failed to close health check node port %d of service %s with error: %+v", port, svcPortName.NamespacedName.String(), err)
+	}
+	delete(p.healthChecks, port)
+}
+
+// healthCheckHandler returns a handler of service's health checks, the service is healthy while it has
+// local endpoints and the node is not draining, otherwise it responds with 503.
+func (p *proxy) healthCheckHandler(svcName objectName) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := healthCheckResponse{LocalEndpoints: p.localEndpointsCount(svcName)}
+		resp.Service.Namespace = svcName.Namespace
+		resp.Service.Name = svcName.Name
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if resp.LocalEndpoints == 0 || p.isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		if err := json.NewEncoder(w).Encode(&resp); err != nil {
+			klog.Errorf("failed to write health check response of service %s with error: %+v", svcName.String(), err)
+		}
+	})
+}
+
+// localEndpointsCount returns the number of service's distinct local endpoints across all its ports.
+func (p *proxy) localEndpointsCount(svcName objectName) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ips := sets.NewString()
+	for svcPortName, eps := range p.endpointsMap {
+		if svcPortName.serviceName() != svcName {
+			continue
+		}
+		for _, ep := range eps {
+			if ep.GetIsLocal() {
+				ips.Insert(ep.IP())
+			}
+		}
+	}
+
+	return ips.Len()
+}
+
+// StartDraining is called when the node is shutting down, health checks of services with externalTrafficPolicy
+// Local start failing right away, so external load balancers stop sending traffic to the node. After the drain
+// grace period, external addresses and nodeports of such services are removed, so external traffic no longer
+// reaches local endpoints, while the services' cluster IPs are kept. The returned channel is closed once external
+// paths are removed.
+func (p *proxy) StartDraining() <-chan struct{} {
+	if !atomic.CompareAndSwapInt32(&p.draining, 0, 1) {
+		return p.drained
+	}
+	klog.Infof("node is draining, external paths of services with local traffic policy are removed in %s", p.drainGracePeriod)
+	time.AfterFunc(p.drainGracePeriod, func() {
+		p.drainExternalPaths()
+		close(p.drained)
+	})
+
+	return p.drained
+}
+
+func (p *proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// drainExternalPaths removes external addresses and nodeports of all Service Ports with externalTrafficPolicy Local.
+func (p *proxy) drainExternalPaths() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.externalPathsDrained = true
+	for svcPortName, svc := range p.serviceMap {
+		baseInfo := baseServiceInfo(svc)
+		if !baseInfo.onlyNodeLocalEndpoints || baseInfo.externalDrained {
+			continue
+		}
+		if err := p.removeExternalPaths(baseInfo); err != nil {
+			klog.Errorf("failed to drain external paths of service %s with error: %+v", svcPortName.String(), err)
+			continue
+		}
+		baseInfo.externalDrained = true
+		klog.V(5).Infof("external paths of service %s are drained", svcPortName.String())
+	}
+}
+
+// removeExternalPaths removes Service Port's external ip, loadbalancer ip and nodeport entries pointing to
+// its service chain. It must be called with p.mu held.
+func (p *proxy) removeExternalPaths(baseInfo *BaseServiceInfo) error {
+	proto := baseInfo.Protocol()
+	port := uint16(baseInfo.Port())
+	chain := nftables.K8sSvcPrefix + baseInfo.svcnft.ServiceID
+	var errs []error
+	remove := func(addr string, set string, setChain string) {
+		_, tableFamily := getIPFamily(addr)
+		if err := p.setElements.remove(tableFamily, proto, addr, port, set, setChain); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, extIP := range baseInfo.ExternalIPStrings() {
+		remove(extIP, nftables.K8sExternalIPSet, chain)
+		remove(extIP, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+	}
+	markSet, markChain := p.loadBalancerMarkSet()
+	for _, lbIP := range baseInfo.LoadBalancerIPStrings() {
+		remove(lbIP, nftables.K8sLoadbalancerIPSet, chain)
+		remove(lbIP, markSet, markChain)
+	}
+	if nodePort := uint16(baseInfo.NodePort()); nodePort != 0 {
+		tableFamily := utilnftables.TableFamilyIPv4
+		if utilnet.IsIPv6(baseInfo.ClusterIP()) {
+			tableFamily = utilnftables.TableFamilyIPv6
+		}
+		if err := p.nodePortRules.remove(tableFamily, proto, nodePort, chain); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// fakeSetElementProgrammer records added and removed elements as "set addr" strings.
+type fakeSetElementProgrammer struct {
+	added   sets.String
+	removed sets.String
+}
+
+func (f *fakeSetElementProgrammer) add(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error {
+	f.added.Insert(set + " " + addr)
+	return nil
+}
+
+func (f *fakeSetElementProgrammer) remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error {
+	f.removed.Insert(set + " " + addr)
+	return nil
+}
+
+func TestStartDraining(t *testing.T) {
+	p := newTestProxy()
+	p.healthCheckNodePorts = true
+	p.drained = make(chan struct{})
+	var listener net.Listener
+	p.listen = func(port int) (net.Listener, error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		listener = ln
+		return ln, err
+	}
+	elements := &fakeSetElementProgrammer{added: sets.NewString(), removed: sets.NewString()}
+	p.setElements = elements
+	nodePorts := &fakeNodePortProgrammer{nodePorts: map[uint16]string{31000: "", 31001: ""}}
+	p.nodePortRules = nodePorts
+
+	newService := func(name string, policy v1.ServiceExternalTrafficPolicyType, nodePort int32) (ServicePortName, *BaseServiceInfo) {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:                  v1.ServiceTypeLoadBalancer,
+				ClusterIP:             "10.96.0.10",
+				ExternalIPs:           []string{"192.168.1.10"},
+				ExternalTrafficPolicy: policy,
+				Ports:                 []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: nodePort}},
+			},
+			Status: v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.1.20"}}}},
+		}
+		if policy == v1.ServiceExternalTrafficPolicyTypeLocal {
+			svc.Spec.HealthCheckNodePort = 32000
+		}
+		svcPortName := getSvcPortName(name, "default", "http", v1.ProtocolTCP)
+		baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+		baseInfo.svcnft.ServiceID = name
+		p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+		return svcPortName, baseInfo
+	}
+	local, localInfo := newService("local", v1.ServiceExternalTrafficPolicyTypeLocal, 31000)
+	_, clusterInfo := newService("cluster", v1.ServiceExternalTrafficPolicyTypeCluster, 31001)
+	p.endpointsMap[local] = []Endpoint{newTestEndpoint(local, "10.1.1.1", 8080, true, 0)}
+	p.mu.Lock()
+	p.startHealthCheck(local, localInfo)
+	p.mu.Unlock()
+	if listener == nil {
+		t.Fatalf("expected health check node port of service with local traffic policy to be served")
+	}
+	healthCheck := func() (int, healthCheckResponse) {
+		var body healthCheckResponse
+		resp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("health check failed with error: %+v", err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("failed to decode health check response with error: %+v", err)
+		}
+		return resp.StatusCode, body
+	}
+	if code, body := healthCheck(); code != http.StatusOK || body.LocalEndpoints != 1 || body.Service.Name != "local" {
+		t.Fatalf("expected healthy service with 1 local endpoint, got %d %+v", code, body)
+	}
+
+	p.drainGracePeriod = 100 * time.Millisecond
+	drained := p.StartDraining()
+	// Health check fails right away, external paths are kept for the grace period
+	if code, _ := healthCheck(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected health check to fail once node is draining, got %d", code)
+	}
+	p.mu.RLock()
+	removed := elements.removed.Len()
+	p.mu.RUnlock()
+	if removed != 0 {
+		t.Fatalf("expected external paths to be kept during grace period, got %v removed", elements.removed.List())
+	}
+	<-drained
+
+	expected := sets.NewString(
+		nftables.K8sExternalIPSet+" 192.168.1.10",
+		nftables.K8sMarkMasqSet+" 192.168.1.10",
+		nftables.K8sLoadbalancerIPSet+" 192.168.1.20",
+		nftables.K8sMarkMasqSet+" 192.168.1.20",
+	)
+	if !elements.removed.Equal(expected) {
+		t.Errorf("expected external paths %v to be removed, got %v", expected.List(), elements.removed.List())
+	}
+	if _, ok := nodePorts.nodePorts[31000]; ok {
+		t.Errorf("expected nodeport of service with local traffic policy to be removed")
+	}
+	if _, ok := nodePorts.nodePorts[31001]; !ok || clusterInfo.externalDrained {
+		t.Errorf("expected service with cluster traffic policy to keep its external paths")
+	}
+	if !localInfo.externalDrained {
+		t.Errorf("expected service with local traffic policy to be marked drained")
+	}
+	// Cluster paths are kept, drained service port's sets steps program only its cluster IP
+	for _, step := range p.servicePortSetsSteps(localInfo, utilnftables.TableFamilyIPv4, "local") {
+		if step.name != "adding 10.96.0.10 to ipv4 set "+nftables.K8sClusterIPSet && step.name != "adding 10.96.0.10 to ipv4 set "+nftables.K8sMarkMasqSet {
+			t.Errorf("expected only cluster IP steps of drained service port, got %s", step.name)
+		}
+	}
+
+	p.mu.Lock()
+	p.stopHealthCheck(local, localInfo)
+	p.mu.Unlock()
+	if len(p.healthChecks) != 0 {
+		t.Errorf("expected health check node port to be closed")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+// endpointRulesDeleter deletes endpoint's rules and chain from the kernel.
+type endpointRulesDeleter interface {
+	deleteEndpointRules(tableFamily utilnftables.TableFamily, epRule *nftables.EPRule) error
+}
+
+type nftEndpointRulesDeleter struct {
+	nfti *nftables.NFTInterface
+}
+
+func (d *nftEndpointRulesDeleter) deleteEndpointRules(tableFamily utilnftables.TableFamily, epRule *nftables.EPRule) error {
+	cn := epRule.Chain
+	if err := nftables.DeleteEndpointRules(d.nfti, tableFamily, cn, epRule.RuleID); err != nil {
+		return err
+	}
+	// Sticky clients of the deleted endpoint must not be sent to its index anymore, purging
+	// affinity map entries pointing to the endpoint.
+	if epRule.WithAffinity {
+		if err := nftables.DeleteAffinityMapEntries(d.nfti, tableFamily, epRule.ServiceID, epRule.EpIndex); err != nil {
+			klog.Errorf("failed to purge affinity entries of endpoint chain: %s with error: %+v", cn, err)
+		}
+	}
+	// Deleting endpoint's chain
+	if err := nftables.DeleteChain(d.nfti, tableFamily, cn); err != nil {
+		klog.Errorf("failed to delete endpoint chain: %s with error: %+v", cn, err)
+		return err
+	}
+	return nil
+}
+
+// endpointDeletion is the state of an endpoint deletion which failed part way, it is keyed by the endpoint's chain
+// and retried from the first step which has not succeeded.
+type endpointDeletion struct {
+	svcPortName ServicePortName
+	tableFamily utilnftables.TableFamily
+	ep          *endpointsInfo
+	rule        nftables.EPRule
+	// serviceUpdated is true once the service chain does not reference the endpoint's chain anymore
+	serviceUpdated bool
+}
+
+// endpointRetry is the item of retries queue for endpoint deletions, chain is the key in p.endpointDeletions.
+type endpointRetry struct {
+	chain string
+}
+
+// queueEndpointDeletion records a failed endpoint deletion and queues it for retry. Until the service chain is
+// updated, the endpoint is kept in endpoints map as it is still in the service's load balancing, after that it is
+// kept out of endpoints map and only its leaked chain is retried. It must be called with p.mu held.
+func (p *proxy) queueEndpointDeletion(deletion *endpointDeletion) {
+	if !deletion.serviceUpdated && !p.isEndpointInMap(deletion.svcPortName, deletion.ep) {
+		p.endpointsMap[deletion.svcPortName] = append(p.endpointsMap[deletion.svcPortName], deletion.ep)
+	}
+	if p.endpointDeletions == nil {
+		p.endpointDeletions = make(map[string]*endpointDeletion)
+	}
+	p.endpointDeletions[deletion.rule.Chain] = deletion
+	p.retries.AddRateLimited(endpointRetry{chain: deletion.rule.Chain})
+}
+
+// retryEndpointDeletion completes a queued endpoint deletion, on failure the deletion is queued again.
+func (p *proxy) retryEndpointDeletion(item endpointRetry) {
+	p.mu.Lock()
+	deletion, ok := p.endpointDeletions[item.chain]
+	if !ok {
+		p.mu.Unlock()
+		p.retries.Forget(item)
+		return
+	}
+	delete(p.endpointDeletions, item.chain)
+	if !deletion.serviceUpdated {
+		if !p.removeEndpointFromMap(deletion.svcPortName, deletion.ep) {
+			// Endpoint is gone, its deletion was completed by someone else
+			p.mu.Unlock()
+			p.retries.Forget(item)
+			return
+		}
+		if err := p.updateServiceChain(deletion.svcPortName, deletion.tableFamily); err != nil {
+			klog.Errorf("retry to update service %s chain without endpoint %s failed with error: %+v", deletion.svcPortName.String(), deletion.ep.String(), err)
+			p.queueEndpointDeletion(deletion)
+			p.mu.Unlock()
+			return
+		}
+		deletion.serviceUpdated = true
+	}
+	p.mu.Unlock()
+
+	if err := p.deleteEndpointRules(deletion.svcPortName, deletion.tableFamily, &deletion.rule); err != nil {
+		klog.Errorf("retry to delete rules of endpoint %s failed with error: %+v", deletion.ep.String(), err)
+		p.mu.Lock()
+		p.queueEndpointDeletion(deletion)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Lock()
+	p.sepNamer.release(deletion.rule.Chain, deletion.svcPortName.String(), string(deletion.ep.protocol), deletion.ep.Endpoint)
+	p.mu.Unlock()
+	p.retries.Forget(item)
+}
@@ -19,14 +19,13 @@ package proxy
 import (
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/sbezverk/nfproxy/pkg/nftables"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
-
-	utilproxy "k8s.io/kubernetes/pkg/proxy/util"
 )
 
 // epInfo is used to carry a single processed instance of EP's information,
@@ -36,6 +35,21 @@ type epInfo struct {
 	addr  *v1.EndpointAddress
 	port  *v1.EndpointPort
 	ready bool
+	// attrs carries endpoint's attributes available only for EndpointSlice's endpoints.
+	attrs endpointAttributes
+}
+
+// endpointAttributes carries optional attributes of an endpoint.
+type endpointAttributes struct {
+	topology map[string]string
+	// appProtocol is the application protocol of endpoint's port
+	appProtocol string
+	// move is true when the endpoint replaces an endpoint with the same TargetRef but a different address,
+	// such endpoint joins the service's load balancing right away.
+	move bool
+	// resolved is true for endpoints of addresses resolved from a service's FQDN target, they are not
+	// local and their locality is not detected.
+	resolved bool
 }
 
 // BaseEndpointInfo contains base information that defines an endpoint.
@@ -48,7 +62,23 @@ type BaseEndpointInfo struct {
 	// IsLocal indicates whether the endpoint is running in same host as kube-proxy.
 	IsLocal  bool
 	Topology map[string]string
+	ip       string
+	port     int
 	epnft    *nftables.EPnft
+	// warmup carries the timer of an endpoint which is not yet included into the service's load balancing,
+	// nil means the endpoint is eligible for load balancing.
+	warmup *time.Timer
+	// pendingService is true for an endpoint recorded before its Service Port was added, such endpoint's
+	// rules are programmed once the Service Port is added.
+	pendingService bool
+	// appProtocol is the application protocol of endpoint's port, empty if not known.
+	appProtocol string
+	// nodeName is the name of the node hosting the endpoint, empty if not known, IsLocal is derived from it.
+	nodeName string
+	// lastProgrammed is the time of the last successful programming of the endpoint's rules
+	lastProgrammed time.Time
+	// resolved is true for an endpoint of an address resolved from the service's FQDN target, it is never local.
+	resolved bool
 }
 
 var _ Endpoint = &BaseEndpointInfo{}
@@ -70,12 +100,12 @@ func (info *BaseEndpointInfo) GetTopology() map[string]string {
 
 // IP returns just the IP part of the endpoint, it's a part of proxy.Endpoint interface.
 func (info *BaseEndpointInfo) IP() string {
-	return utilproxy.IPPart(info.Endpoint)
+	return info.ip
 }
 
 // Port returns just the Port part of the endpoint.
 func (info *BaseEndpointInfo) Port() (int, error) {
-	return utilproxy.PortPart(info.Endpoint)
+	return info.port, nil
 }
 
 // Equal is part of proxy.Endpoint interface.
@@ -89,6 +119,8 @@ func newBaseEndpointInfo(ipFamily v1.IPFamily, protocol v1.Protocol, IP string,
 		Endpoint: string(ipFamily) + ":" + net.JoinHostPort(IP, strconv.Itoa(port)) + "/" + string(protocol),
 		IsLocal:  isLocal,
 		Topology: topology,
+		ip:       IP,
+		port:     port,
 	}
 }
 
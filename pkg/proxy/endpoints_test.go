@@ -0,0 +1,1351 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+// newTestEndpoint builds an endpoint with nftables information as it would look like after being programmed.
+func newTestEndpoint(svcPortName ServicePortName, ip string, port int, isLocal bool, index int) *endpointsInfo {
+	ipFamily, tableFamily := getIPFamily(ip)
+	base := newBaseEndpointInfo(ipFamily, svcPortName.Protocol, ip, port, isLocal, nil)
+	base.epnft = &nftables.EPnft{
+		Rule: map[utilnftables.TableFamily]*nftables.EPRule{
+			tableFamily: {
+				Rule: nftables.Rule{
+					Chain:  servicePortEndpointChainName(svcPortName.String(), string(svcPortName.Protocol), base.Endpoint),
+					RuleID: []uint64{uint64(3 * index), uint64(3*index + 1), uint64(3*index + 2)},
+				},
+				EpIndex: index,
+			},
+		},
+	}
+
+	return newEndpointInfo(base, svcPortName.Protocol).(*endpointsInfo)
+}
+
+func newTestProxy() *proxy {
+	return &proxy{
+		hostname:     "node1",
+		serviceMap:   make(ServiceMap),
+		endpointsMap: make(EndpointsMap),
+		cache: cache{
+			svcCache: make(map[objectName]*v1.Service),
+		},
+		fqdnTargets:           make(map[objectName]*fqdnTarget),
+		sepNamer:              newEndpointChainNamer(defaultEndpointChainPrefix, defaultEndpointChainLength),
+		terminatingNamespaces: sets.NewString(),
+	}
+}
+
+func TestEndpointWarmup(t *testing.T) {
+	p, _ := newFakeNFTProxy(t, false)
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1",
+			Annotations: map[string]string{endpointWarmupAnnotation: "1"}},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	eligible := func() int {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return len(p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4))
+	}
+	p.AddService(svc)
+
+	// Endpoints of the initial sync are already serving, they join the service's load balancing right away
+	p.AddEndpoints(newTestEndpoints("1", 8080, "10.1.1.1"))
+	if n := eligible(); n != 1 {
+		t.Fatalf("expected endpoint of initial sync not to be warmed up, got %d endpoints in load balancing", n)
+	}
+
+	// Endpoint becoming ready after the initial sync is warmed up
+	p.SetSynced()
+	p.UpdateEndpoints(newTestEndpoints("1", 8080, "10.1.1.1"), newTestEndpoints("2", 8080, "10.1.1.1", "10.1.1.2"))
+	if n := eligible(); n != 1 {
+		t.Fatalf("expected only ready endpoint in load balancing before warmup expires, got %d endpoints", n)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return eligible() == 2, nil
+	}); err != nil {
+		t.Fatalf("warming up endpoint has not been added to load balancing after warmup expired")
+	}
+
+	// Warmup removed by a service update does not apply to endpoints becoming ready later
+	noWarmup := svc.DeepCopy()
+	noWarmup.ResourceVersion = "2"
+	noWarmup.Annotations = nil
+	p.UpdateService(svc, noWarmup)
+	p.UpdateEndpoints(newTestEndpoints("2", 8080, "10.1.1.1", "10.1.1.2"), newTestEndpoints("3", 8080, "10.1.1.1", "10.1.1.2", "10.1.1.3"))
+	if n := eligible(); n != 3 {
+		t.Errorf("expected endpoint to join load balancing right away once warmup is removed, got %d endpoints", n)
+	}
+}
+
+func TestGetEndpointWarmup(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		warmup      time.Duration
+	}{
+		{
+			name:   "No annotation",
+			warmup: 0,
+		},
+		{
+			name:        "Valid annotation",
+			annotations: map[string]string{endpointWarmupAnnotation: "30"},
+			warmup:      30 * time.Second,
+		},
+		{
+			name:        "Invalid annotation",
+			annotations: map[string]string{endpointWarmupAnnotation: "thirty"},
+			warmup:      0,
+		},
+	}
+	for _, tt := range tests {
+		svc := &v1.Service{}
+		svc.Annotations = tt.annotations
+		if got := getEndpointWarmup(svc); got != tt.warmup {
+			t.Errorf("Test: \"%s\" failed, expected warmup %v but got %v", tt.name, tt.warmup, got)
+		}
+	}
+}
+
+func TestEndpointsSnapshot(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ipv4 := newTestEndpoint(svcPortName, "10.1.1.1", 8080, true, 0)
+	ipv6 := newTestEndpoint(svcPortName, "2001:db8::1", 8080, false, 1)
+	p.endpointsMap[svcPortName] = []Endpoint{ipv4, ipv6}
+
+	snapshots := p.Endpoints(svcPortName)
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 endpoints but got %d", len(snapshots))
+	}
+	tests := []struct {
+		ep       *endpointsInfo
+		ip       string
+		ipFamily v1.IPFamily
+		family   utilnftables.TableFamily
+		isLocal  bool
+	}{
+		{ep: ipv4, ip: "10.1.1.1", ipFamily: v1.IPv4Protocol, family: utilnftables.TableFamilyIPv4, isLocal: true},
+		{ep: ipv6, ip: "2001:db8::1", ipFamily: v1.IPv6Protocol, family: utilnftables.TableFamilyIPv6, isLocal: false},
+	}
+	for i, tt := range tests {
+		s := snapshots[i]
+		if s.IP != tt.ip || s.Port != 8080 || s.Protocol != v1.ProtocolTCP || s.IPFamily != tt.ipFamily || s.IsLocal != tt.isLocal {
+			t.Errorf("endpoint %s: unexpected snapshot %+v", tt.ip, s)
+		}
+		rule := tt.ep.epnft.Rule[tt.family]
+		if s.Chain != rule.Chain {
+			t.Errorf("endpoint %s: expected chain %s but got %s", tt.ip, rule.Chain, s.Chain)
+		}
+		if len(s.RuleID) != len(rule.RuleID) {
+			t.Errorf("endpoint %s: expected rule ids %v but got %v", tt.ip, rule.RuleID, s.RuleID)
+		}
+	}
+	if len(p.Endpoints(getSvcPortName("app", "default", "https", v1.ProtocolTCP))) != 0 {
+		t.Errorf("expected no endpoints for unknown Service Port Name")
+	}
+}
+
+// TestConcurrentEndpointsSnapshot is meant to be run with -race, snapshots are taken
+// while endpoints are churned the same way addEndpoint and deleteEndpoint modify endpoints map.
+func TestConcurrentEndpointsSnapshot(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, s := range p.Endpoints(svcPortName) {
+					if s.Chain == "" {
+						t.Errorf("endpoint %s: snapshot without chain", s.IP)
+						return
+					}
+				}
+				p.getServicePortSvcID(svcPortName)
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		ep := newTestEndpoint(svcPortName, fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), 8080, false, i)
+		p.mu.Lock()
+		p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], ep)
+		if len(p.endpointsMap[svcPortName]) > 10 {
+			p.endpointsMap[svcPortName] = p.endpointsMap[svcPortName][1:]
+		}
+		p.mu.Unlock()
+	}
+	close(stop)
+	wg.Wait()
+	if n := len(p.Endpoints(svcPortName)); n != 10 {
+		t.Errorf("expected 10 endpoints but got %d", n)
+	}
+}
+
+// TestConcurrentEndpointAddDelete is meant to be run with -race, endpoints which rules are still being programmed
+// are added and deleted concurrently, such endpoints must never be selected for the service's load balancing.
+func TestConcurrentEndpointAddDelete(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	port := &v1.EndpointPort{Port: 8080, Protocol: v1.ProtocolTCP}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				ip := fmt.Sprintf("10.1.%d.%d", w, i+1)
+				ep := newTestEndpoint(svcPortName, ip, 8080, false, i)
+				ep.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID = nil
+				p.mu.Lock()
+				p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], ep)
+				p.mu.Unlock()
+				if err := p.deleteEndpoint(svcPortName, &v1.EndpointAddress{IP: ip}, port); err != nil {
+					t.Errorf("endpoint %s: unexpected error %+v", ip, err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				p.Endpoints(svcPortName)
+				p.mu.RLock()
+				eps := p.selectEndpoints(svcPortName, utilnftables.TableFamilyIPv4)
+				p.mu.RUnlock()
+				if len(eps) != 0 {
+					t.Errorf("expected no endpoints to be selected but got %d", len(eps))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := p.endpointsMap[svcPortName]; ok {
+		t.Errorf("expected Service Port Name to be removed from endpoints map")
+	}
+}
+
+func TestDualStackNoEndpointsPerFamily(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"2001:db8::10"},
+			Ports:       []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svc.Name, svc.Namespace = "app", "default"
+	svcInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	p.endpointsMap[svcPortName] = []Endpoint{newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)}
+
+	addrs := serviceAddressesByFamily(svcInfo)
+	if len(addrs[utilnftables.TableFamilyIPv4]) != 1 || addrs[utilnftables.TableFamilyIPv4][0] != "10.96.0.10" {
+		t.Errorf("expected IPv4 addresses [10.96.0.10] but got %v", addrs[utilnftables.TableFamilyIPv4])
+	}
+	if len(addrs[utilnftables.TableFamilyIPv6]) != 1 || addrs[utilnftables.TableFamilyIPv6][0] != "2001:db8::10" {
+		t.Errorf("expected IPv6 addresses [2001:db8::10] but got %v", addrs[utilnftables.TableFamilyIPv6])
+	}
+	if len(p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)) != 1 {
+		t.Errorf("expected IPv4 VIP to have endpoints and stay out of No Endpoints set")
+	}
+	if len(p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv6)) != 0 {
+		t.Errorf("expected IPv6 VIP to have no endpoints and be added to No Endpoints set")
+	}
+
+	// No Endpoints set membership is tracked per family, only IPv6 VIP gets rejected
+	elements := &fakeSetElementProgrammer{added: sets.NewString(), removed: sets.NewString()}
+	p.setElements = elements
+	updateFamilies := func() {
+		for _, family := range []utilnftables.TableFamily{utilnftables.TableFamilyIPv4, utilnftables.TableFamilyIPv6} {
+			p.updateNoEndpointsList(svcInfo, svcPortName, family, len(p.getServicePortEndpointChains(svcPortName, family)) != 0)
+		}
+	}
+	updateFamilies()
+	if svcInfo.noEndpoints[utilnftables.TableFamilyIPv4] || !svcInfo.noEndpoints[utilnftables.TableFamilyIPv6] {
+		t.Errorf("expected only IPv6 family without endpoints, got %v", svcInfo.noEndpoints)
+	}
+	if !reflect.DeepEqual(elements.added.List(), []string{nftables.K8sNoEndpointsSet + " 2001:db8::10"}) || elements.removed.Len() != 0 {
+		t.Errorf("expected only IPv6 VIP added to No Endpoints set, added %v removed %v", elements.added.List(), elements.removed.List())
+	}
+	// IPv6 endpoint arrives, IPv6 VIP leaves No Endpoints set
+	p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], newTestEndpoint(svcPortName, "2001:db8::1:1", 8080, false, 1))
+	updateFamilies()
+	if len(svcInfo.noEndpoints) != 0 {
+		t.Errorf("expected no family without endpoints, got %v", svcInfo.noEndpoints)
+	}
+	if !reflect.DeepEqual(elements.removed.List(), []string{nftables.K8sNoEndpointsSet + " 2001:db8::10"}) || elements.added.Len() != 1 {
+		t.Errorf("expected IPv6 VIP removed from No Endpoints set, added %v removed %v", elements.added.List(), elements.removed.List())
+	}
+}
+
+func TestEndpointSliceCacheMiss(t *testing.T) {
+	p := newTestProxy()
+	if severity := p.logCacheMiss("Endpoint Slice", "default", "app-abcde"); severity != severityInfo {
+		t.Errorf("expected cache miss before initial sync to be logged as informational")
+	}
+	p.SetSynced()
+	if severity := p.logCacheMiss("Endpoint Slice", "default", "app-abcde"); severity != severityError {
+		t.Errorf("expected cache miss after initial sync to be logged as error")
+	}
+}
+
+func TestPreferLocalEndpoints(t *testing.T) {
+	p := newTestProxy()
+	p.preferLocal = true
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	local := newTestEndpoint(svcPortName, "10.1.1.1", 8080, true, 0)
+	remote1 := newTestEndpoint(svcPortName, "10.1.2.1", 8080, false, 1)
+	remote2 := newTestEndpoint(svcPortName, "10.1.3.1", 8080, false, 2)
+
+	// Local endpoint present, only local endpoints are used
+	p.endpointsMap[svcPortName] = []Endpoint{remote1, local, remote2}
+	chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)
+	if len(chains) != 1 || chains[0] != local.epnft.Rule[utilnftables.TableFamilyIPv4] {
+		t.Errorf("expected only local endpoint to be used when it is present, got %d endpoints", len(chains))
+	}
+
+	// No local endpoints, falling back to all remote endpoints
+	p.endpointsMap[svcPortName] = []Endpoint{remote1, remote2}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 2 {
+		t.Errorf("expected fallback to 2 remote endpoints when no local endpoints exist, got %d endpoints", len(chains))
+	}
+}
+
+func TestPreferCloseEndpoints(t *testing.T) {
+	p := newTestProxy()
+	p.zone = "zone-a"
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{trafficDistributionAnnotation: trafficDistributionPreferClose},
+		},
+	}
+	p.serviceMap[svcPortName] = &serviceInfo{BaseServiceInfo: &BaseServiceInfo{preferClose: isPreferClose(svc)}}
+	sameZone := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)
+	sameZone.Topology = map[string]string{v1.LabelZoneFailureDomainStable: "zone-a"}
+	crossZone1 := newTestEndpoint(svcPortName, "10.1.2.1", 8080, false, 1)
+	crossZone1.Topology = map[string]string{v1.LabelZoneFailureDomainStable: "zone-b"}
+	crossZone2 := newTestEndpoint(svcPortName, "10.1.3.1", 8080, false, 2)
+	crossZone2.Topology = map[string]string{v1.LabelZoneFailureDomain: "zone-b"}
+
+	// Same zone endpoint present, only same zone endpoints are used
+	p.endpointsMap[svcPortName] = []Endpoint{crossZone1, sameZone, crossZone2}
+	chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)
+	if len(chains) != 1 || chains[0] != sameZone.epnft.Rule[utilnftables.TableFamilyIPv4] {
+		t.Errorf("expected only same zone endpoint to be used when it is present, got %d endpoints", len(chains))
+	}
+
+	// No same zone endpoints, falling back to all endpoints
+	p.endpointsMap[svcPortName] = []Endpoint{crossZone1, crossZone2}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 2 {
+		t.Errorf("expected fallback to 2 cross zone endpoints when no same zone endpoints exist, got %d endpoints", len(chains))
+	}
+
+	// Service without PreferClose uses all endpoints
+	p.serviceMap[svcPortName].(*serviceInfo).preferClose = false
+	p.endpointsMap[svcPortName] = []Endpoint{crossZone1, sameZone, crossZone2}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 3 {
+		t.Errorf("expected all 3 endpoints to be used without PreferClose, got %d endpoints", len(chains))
+	}
+}
+
+func TestZoneWeightedLoadBalancing(t *testing.T) {
+	p := newTestProxy()
+	p.zone = "zone-a"
+	p.zoneWeight = 80
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	p.serviceMap[svcPortName] = &serviceInfo{BaseServiceInfo: &BaseServiceInfo{preferClose: true}}
+	var eps []Endpoint
+	zones := []string{"zone-a", "zone-a", "zone-b", "zone-b", "zone-c"}
+	for i, zone := range zones {
+		ep := newTestEndpoint(svcPortName, fmt.Sprintf("10.1.1.%d", i+1), 8080, false, i)
+		ep.Topology = make(map[string]string)
+		ep.Topology[v1.LabelZoneFailureDomainStable] = zone
+		eps = append(eps, ep)
+	}
+	p.endpointsMap[svcPortName] = eps
+	share := func() (map[string]int, int) {
+		slots := make(map[string]int)
+		chains := p.getServicePortLoadBalancingChains(svcPortName, utilnftables.TableFamilyIPv4)
+		for _, chain := range chains {
+			slots[chain.Chain]++
+		}
+		return slots, len(chains)
+	}
+
+	// 2 in-zone endpoints get 80% of slots, 3 other endpoints get 20%
+	slots, total := share()
+	local := 0
+	for i, ep := range eps {
+		chain := ep.(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+		if zones[i] == p.zone {
+			local += slots[chain]
+		}
+		if slots[chain] == 0 {
+			t.Errorf("expected endpoint %s to get load balancing slots", chain)
+		}
+	}
+	if local*100 != 80*total {
+		t.Errorf("expected in-zone endpoints to get 80%% of %d slots, got %d slots", total, local)
+	}
+	// Endpoints eligible for the service do not change, only their slots
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 5 {
+		t.Errorf("expected all 5 endpoints to be eligible with weighted split, got %d", len(chains))
+	}
+
+	// Service's annotation overrides the proxy's weight, 100% strictly prefers in-zone endpoints
+	p.serviceMap[svcPortName].(*serviceInfo).zoneWeight = 100
+	if slots, total := share(); total != 2 || len(slots) != 2 {
+		t.Errorf("expected only 2 in-zone endpoints with 100%% zone weight, got %d slots", total)
+	}
+
+	// Exact split needing too many slots is approximated
+	if localSlots, remoteSlots := weightedSlots(7, 13, 83); 7*localSlots+13*remoteSlots > maxLoadBalancingSlots {
+		t.Errorf("expected weighted split to be limited to %d slots, got %d", maxLoadBalancingSlots, 7*localSlots+13*remoteSlots)
+	}
+}
+
+func TestEndpointSliceReadinessGate(t *testing.T) {
+	ready := true
+	portName := "http"
+	port := int32(8080)
+	proto := v1.ProtocolTCP
+	gate := "example.com/warm"
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		Endpoints: []discovery.Endpoint{
+			{
+				Addresses:  []string{"10.1.1.1"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+				Topology:   map[string]string{gate: "true"},
+			},
+			{
+				Addresses:  []string{"10.1.1.2"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+				Topology:   map[string]string{gate: "false"},
+			},
+		},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	isReady := func(gate string) map[string]bool {
+		info, err := processEpSlice(epsl, gate)
+		if err != nil {
+			t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+		}
+		r := make(map[string]bool)
+		for _, e := range info {
+			r[e.addr.IP] = e.ready
+		}
+		return r
+	}
+	// Without custom gate, Ready condition alone decides
+	if r := isReady(""); !r["10.1.1.1"] || !r["10.1.1.2"] {
+		t.Errorf("expected both endpoints to be ready without readiness gate, got %v", r)
+	}
+	// Ready endpoint with failing custom gate is excluded
+	if r := isReady(gate); !r["10.1.1.1"] || r["10.1.1.2"] {
+		t.Errorf("expected only endpoint satisfying readiness gate to be ready, got %v", r)
+	}
+	if ready, found := isPortInEndpointSlice(epsl, &v1.EndpointPort{Name: portName, Port: port, Protocol: proto}, &v1.EndpointAddress{IP: "10.1.1.2"}, gate); !found || ready {
+		t.Errorf("expected endpoint failing readiness gate to be found and not ready")
+	}
+}
+
+func TestPendingServiceEndpoints(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(endpointsPendingService)
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	nodeName := "node2"
+	port := &v1.EndpointPort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}
+
+	// Endpoints arrive before the service, they are recorded as pending
+	for _, ip := range []string{"10.1.1.1", "10.1.1.2"} {
+		if err := p.addEndpoint(svcPortName, &v1.EndpointAddress{IP: ip, NodeName: &nodeName}, port, endpointAttributes{}); err != nil {
+			t.Fatalf("failed to add endpoint %s with error: %+v", ip, err)
+		}
+	}
+	if len(p.endpointsMap[svcPortName]) != 2 {
+		t.Fatalf("expected 2 pending endpoints to be recorded, got %d", len(p.endpointsMap[svcPortName]))
+	}
+	for _, ep := range p.endpointsMap[svcPortName] {
+		epInfo := ep.(*endpointsInfo)
+		if !epInfo.pendingService || epInfo.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID != nil {
+			t.Errorf("expected endpoint %s to be pending and not programmed", epInfo.Endpoint)
+		}
+	}
+	if eps := p.selectEndpoints(svcPortName, utilnftables.TableFamilyIPv4); len(eps) != 0 {
+		t.Errorf("expected pending endpoints not to be eligible for load balancing, got %d", len(eps))
+	}
+	expected := `
+# HELP nfproxy_endpoints_pending_service_total [ALPHA] Number of endpoints added before their Service Port is known.
+# TYPE nfproxy_endpoints_pending_service_total counter
+nfproxy_endpoints_pending_service_total 2
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nfproxy_endpoints_pending_service_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting pending endpoint only drops it from the map and releases its chain name
+	chain := p.endpointsMap[svcPortName][0].(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+	if err := p.deleteEndpoint(svcPortName, &v1.EndpointAddress{IP: "10.1.1.1", NodeName: &nodeName}, port); err != nil {
+		t.Fatalf("failed to delete pending endpoint with error: %+v", err)
+	}
+	if len(p.endpointsMap[svcPortName]) != 1 {
+		t.Errorf("expected 1 pending endpoint to remain, got %d", len(p.endpointsMap[svcPortName]))
+	}
+	if _, ok := p.sepNamer.chains[chain]; ok {
+		t.Errorf("expected chain name %s of deleted pending endpoint to be released", chain)
+	}
+}
+
+func TestEndpointChainsOrder(t *testing.T) {
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	var eps []Endpoint
+	for i, ip := range []string{"10.1.1.1", "10.1.1.2", "10.1.1.3", "10.1.1.4"} {
+		eps = append(eps, newTestEndpoint(svcPortName, ip, 8080, false, i))
+	}
+	chains := func(order []int) []string {
+		p := newTestProxy()
+		for _, i := range order {
+			p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], eps[i])
+		}
+		var names []string
+		for _, rule := range p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4) {
+			names = append(names, rule.Chain)
+		}
+		return names
+	}
+	expected := chains([]int{0, 1, 2, 3})
+	if !sort.StringsAreSorted(expected) {
+		t.Errorf("expected endpoint chains to be sorted by name, got %v", expected)
+	}
+	for _, order := range [][]int{{3, 2, 1, 0}, {2, 0, 3, 1}} {
+		if got := chains(order); !reflect.DeepEqual(got, expected) {
+			t.Errorf("endpoints added in order %v: expected chains %v but got %v", order, expected, got)
+		}
+	}
+}
+
+func TestTargetRefMoves(t *testing.T) {
+	ready := true
+	portName := "http"
+	port := int32(8080)
+	proto := v1.ProtocolTCP
+	slice := func(addrs map[string]string) *discovery.EndpointSlice {
+		epsl := &discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discovery.LabelServiceName: "app"},
+			},
+			Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+		}
+		for _, pod := range []string{"pod-1", "pod-2", "pod-3"} {
+			ip, ok := addrs[pod]
+			if !ok {
+				continue
+			}
+			epsl.Endpoints = append(epsl.Endpoints, discovery.Endpoint{
+				Addresses:  []string{ip},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod},
+			})
+		}
+		return epsl
+	}
+	oldInfo, err := processEpSlice(slice(map[string]string{"pod-1": "10.1.1.1", "pod-2": "10.1.1.2"}), "")
+	if err != nil {
+		t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+	}
+	// pod-1 is recreated with a new address, pod-2 keeps its address and pod-3 is a new pod
+	newInfo, err := processEpSlice(slice(map[string]string{"pod-1": "10.1.1.5", "pod-2": "10.1.1.2", "pod-3": "10.1.1.9"}), "")
+	if err != nil {
+		t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+	}
+	moves := targetRefMoves(oldInfo, newInfo)
+	svcPortName := getSvcPortName("app", "default", portName, proto)
+	if moves.Len() != 1 || !moves.Has(svcPortName.String()+"/10.1.1.5") {
+		t.Errorf("expected only new address of pod-1 to be a move, got %v", moves.List())
+	}
+	// Endpoints without TargetRef are never correlated
+	for i := range newInfo {
+		newInfo[i].addr.TargetRef = nil
+	}
+	if moves := targetRefMoves(oldInfo, newInfo); moves.Len() != 0 {
+		t.Errorf("expected no moves for endpoints without TargetRef, got %v", moves.List())
+	}
+}
+
+func TestDNSServicePortsProtocols(t *testing.T) {
+	ready := true
+	dnsName, dnsTCPName := "dns", "dns-tcp"
+	port := int32(53)
+	udp, tcp := v1.ProtocolUDP, v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kube-dns-abcde",
+			Namespace: "kube-system",
+			Labels:    map[string]string{discovery.LabelServiceName: "kube-dns"},
+		},
+		Endpoints: []discovery.Endpoint{
+			{
+				Addresses:  []string{"10.1.1.1"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+			},
+		},
+		Ports: []discovery.EndpointPort{
+			{Name: &dnsName, Port: &port, Protocol: &udp},
+			{Name: &dnsTCPName, Port: &port, Protocol: &tcp},
+			// Protocol defaults to TCP
+			{Name: &dnsTCPName, Port: &port},
+		},
+	}
+	info, err := processEpSlice(epsl, "")
+	if err != nil {
+		t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+	}
+	if len(info) != 3 {
+		t.Fatalf("expected 3 endpoint ports but got %d", len(info))
+	}
+	expected := []v1.Protocol{v1.ProtocolUDP, v1.ProtocolTCP, v1.ProtocolTCP}
+	p := newTestProxy()
+	chains := make(map[v1.Protocol]string)
+	for i, e := range info {
+		if e.port.Protocol != expected[i] || e.name.Protocol != expected[i] {
+			t.Errorf("expected endpoint port %d protocol %s, got port protocol %s and service port protocol %s",
+				i, expected[i], e.port.Protocol, e.name.Protocol)
+		}
+		if ready, found := isPortInEndpointSlice(epsl, e.port, e.addr, ""); !found || !ready {
+			t.Errorf("expected endpoint port %d to be found in EndpointSlice and ready", i)
+		}
+		ipFamily, _ := getIPFamily(e.addr.IP)
+		base := newBaseEndpointInfo(ipFamily, e.port.Protocol, e.addr.IP, int(e.port.Port), false, nil)
+		chains[e.port.Protocol] = p.sepNamer.name(e.name.String(), string(e.port.Protocol), base.Endpoint)
+	}
+	if info[0].name == info[1].name {
+		t.Errorf("expected 53/UDP and 53/TCP to be distinct Service Ports, both are %s", info[0].name.String())
+	}
+	if chains[v1.ProtocolUDP] == chains[v1.ProtocolTCP] {
+		t.Errorf("expected 53/UDP and 53/TCP endpoints to get independent chains, both got %s", chains[v1.ProtocolUDP])
+	}
+}
+
+func TestPreferNodeLocalAnnotation(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("kube-dns", "kube-system", "dns", v1.ProtocolUDP)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "kube-dns",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{preferNodeLocalAnnotation: "true"},
+		},
+	}
+	p.serviceMap[svcPortName] = &serviceInfo{BaseServiceInfo: &BaseServiceInfo{preferNodeLocal: isPreferNodeLocal(svc)}}
+	local := newTestEndpoint(svcPortName, "10.1.1.1", 53, true, 0)
+	remote1 := newTestEndpoint(svcPortName, "10.1.2.1", 53, false, 1)
+	remote2 := newTestEndpoint(svcPortName, "10.1.3.1", 53, false, 2)
+	remote3 := newTestEndpoint(svcPortName, "10.1.4.1", 53, false, 3)
+
+	// Local endpoint present, it is used exclusively
+	p.endpointsMap[svcPortName] = []Endpoint{remote1, remote2, local, remote3}
+	chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)
+	if len(chains) != 1 || chains[0] != local.epnft.Rule[utilnftables.TableFamilyIPv4] {
+		t.Errorf("expected only local endpoint to be used when it is present, got %d endpoints", len(chains))
+	}
+
+	// Local endpoint is gone, traffic is not dropped but goes to remote endpoints
+	p.endpointsMap[svcPortName] = []Endpoint{remote1, remote2, remote3}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 3 {
+		t.Errorf("expected fallback to 3 remote endpoints when no local endpoint exists, got %d endpoints", len(chains))
+	}
+
+	// Service without the annotation uses all endpoints
+	p.serviceMap[svcPortName].(*serviceInfo).preferNodeLocal = false
+	p.endpointsMap[svcPortName] = []Endpoint{remote1, remote2, local, remote3}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 4 {
+		t.Errorf("expected all 4 endpoints to be used without the annotation, got %d endpoints", len(chains))
+	}
+}
+
+func TestEndpointSliceAddressTypeMismatch(t *testing.T) {
+	ready := true
+	portName := "http"
+	port := int32(8080)
+	proto := v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{
+				Addresses:  []string{"10.1.1.1"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+			},
+			{
+				Addresses:  []string{"2001:db8::1"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+			},
+		},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	info, err := processEpSlice(epsl, "")
+	if err != nil {
+		t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+	}
+	if len(info) != 1 || info[0].addr.IP != "10.1.1.1" {
+		t.Errorf("expected only ipv4 address of ipv4 slice to be processed, got %+v", info)
+	}
+
+	// Slice of IP address type, deprecated but still served, carries addresses of any family
+	epsl.AddressType = discovery.AddressTypeIP
+	if info, err := processEpSlice(epsl, ""); err != nil || len(info) != 2 {
+		t.Errorf("expected both addresses of IP typed slice to be processed, got %+v error: %v", info, err)
+	}
+}
+
+func TestDualStackEndpointFamilyRouting(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = map[utilnftables.TableFamily]nftables.SVCChain{
+		utilnftables.TableFamilyIPv4: {
+			Chain: map[string]*nftables.Rule{
+				nftables.K8sSvcPrefix + "svcid": {Chain: nftables.K8sSvcPrefix + "svcid", RuleID: []uint64{7}},
+			},
+		},
+	}
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	p.endpointsMap[svcPortName] = []Endpoint{
+		newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0),
+		newTestEndpoint(svcPortName, "2001:db8::1", 8080, false, 1),
+	}
+
+	// IPv6 endpoint change rebuilds only IPv6 load balancing, the service has no IPv6 chains
+	if err := p.updateServiceChain(svcPortName, utilnftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to update IPv6 service chain with error: %+v", err)
+	}
+	rules := baseInfo.svcnft.Chains[utilnftables.TableFamilyIPv4].Chain[nftables.K8sSvcPrefix+"svcid"]
+	if !reflect.DeepEqual(rules.RuleID, []uint64{7}) {
+		t.Errorf("expected IPv4 service rule ids to be untouched, got %v", rules.RuleID)
+	}
+	if len(baseInfo.noEndpoints) != 0 {
+		t.Errorf("expected no change in No Endpoints set membership, got %v", baseInfo.noEndpoints)
+	}
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv6); len(chains) != 1 {
+		t.Errorf("expected 1 IPv6 endpoint eligible, got %d", len(chains))
+	}
+}
+
+func TestServiceSnapshotLastProgrammed(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "5"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+	p.cache.storeSvcInCache(svc)
+
+	p.markServicePortsProgrammed(svc)
+	first, ok := p.Service(svcPortName)
+	if !ok {
+		t.Fatalf("expected snapshot of service port %s", svcPortName.String())
+	}
+	if first.LastProgrammed.IsZero() || first.ResourceVersion != "5" {
+		t.Fatalf("expected programming time and resource version 5, got %+v", first)
+	}
+	time.Sleep(10 * time.Millisecond)
+	p.markServicePortsProgrammed(svc)
+	second, _ := p.Service(svcPortName)
+	if !second.LastProgrammed.After(first.LastProgrammed) {
+		t.Errorf("expected programming time to advance after reprogram, got %v and %v", first.LastProgrammed, second.LastProgrammed)
+	}
+	if _, ok := p.Service(getSvcPortName("other", "default", "http", v1.ProtocolTCP)); ok {
+		t.Errorf("expected no snapshot of unknown service port")
+	}
+}
+
+func TestSingleUnnamedServicePortMatching(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	p.cache.storeSvcInCache(svc)
+	ready := true
+	name := "http"
+	port := int32(8080)
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"10.1.1.2"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+		},
+		Ports: []discovery.EndpointPort{{Name: &name, Port: &port}},
+	}
+	info, err := processEpSlice(epsl, "")
+	if err != nil {
+		t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+	}
+	p.matchSingleServicePort(info)
+	svcPortName := getSvcPortName("app", "default", "", v1.ProtocolTCP)
+	for _, e := range info {
+		if e.name != svcPortName {
+			t.Fatalf("expected named endpoint port to match unnamed service port %s, got %s", svcPortName.String(), e.name.String())
+		}
+		if err := p.addEndpoint(e.name, e.addr, e.port, e.attrs); err != nil {
+			t.Fatalf("failed to add endpoint with error: %+v", err)
+		}
+	}
+	if n := len(p.endpointsMap[svcPortName]); n != 2 {
+		t.Errorf("expected 2 endpoints wired to unnamed service port, got %d", n)
+	}
+
+	// Service of multiple ports is matched by name
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP})
+	p.cache.storeSvcInCache(svc)
+	info, _ = processEpSlice(epsl, "")
+	p.matchSingleServicePort(info)
+	if info[0].name.Port != name {
+		t.Errorf("expected endpoint port of multiple ports service to keep its name, got %q", info[0].name.Port)
+	}
+}
+
+func TestNotReadyAddressesPublished(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:                "10.96.0.10",
+			Ports:                    []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			PublishNotReadyAddresses: true,
+		},
+	}
+	p.cache.storeSvcInCache(svc)
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{
+			{
+				NotReadyAddresses: []v1.EndpointAddress{{IP: "10.1.1.1"}, {IP: "10.1.1.2"}},
+				Ports:             []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+			},
+		},
+	}
+	info, err := processEpSubsets(ep)
+	if err != nil {
+		t.Fatalf("failed to process Endpoints with error: %+v", err)
+	}
+	for _, e := range p.selectSubsetsAddresses(info) {
+		if err := p.addEndpoint(e.name, e.addr, e.port, e.attrs); err != nil {
+			t.Fatalf("failed to add endpoint with error: %+v", err)
+		}
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if n := len(p.endpointsMap[svcPortName]); n != 2 {
+		t.Errorf("expected 2 not ready endpoints to be programmed, got %d", n)
+	}
+
+	// Not ready addresses are skipped when ready ones exist and the service does not publish them
+	ep.Subsets[0].Addresses = []v1.EndpointAddress{{IP: "10.1.1.3"}}
+	info, _ = processEpSubsets(ep)
+	if n := len(p.selectSubsetsAddresses(info)); n != 3 {
+		t.Errorf("expected 3 endpoints selected for publishing service, got %d", n)
+	}
+	svc.Spec.PublishNotReadyAddresses = false
+	p.cache.storeSvcInCache(svc)
+	selected := p.selectSubsetsAddresses(info)
+	if len(selected) != 1 || selected[0].addr.IP != "10.1.1.3" {
+		t.Errorf("expected only ready endpoint selected, got %d endpoints", len(selected))
+	}
+}
+
+// fakeEndpointRulesDeleter fails deletion of endpoints' rules while fail is set and records deleted chains.
+type fakeEndpointRulesDeleter struct {
+	fail    bool
+	deleted []string
+}
+
+func (d *fakeEndpointRulesDeleter) deleteEndpointRules(tableFamily utilnftables.TableFamily, epRule *nftables.EPRule) error {
+	if d.fail {
+		return fmt.Errorf("failed to delete chain %s", epRule.Chain)
+	}
+	d.deleted = append(d.deleted, epRule.Chain)
+	return nil
+}
+
+func TestDeleteEndpointRulesFailure(t *testing.T) {
+	p := newTestProxy()
+	deleter := &fakeEndpointRulesDeleter{fail: true}
+	p.epRules = deleter
+	p.retries = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer p.retries.ShutDown()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 1)
+	chain := ep.epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+	p.endpointsMap[svcPortName] = []Endpoint{ep}
+
+	addr := &v1.EndpointAddress{IP: "10.1.1.1"}
+	port := &v1.EndpointPort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}
+	if err := p.deleteEndpoint(svcPortName, addr, port); err == nil {
+		t.Fatalf("expected deletion of endpoint rules to fail")
+	}
+	if n := len(p.endpointsMap[svcPortName]); n != 0 {
+		t.Errorf("expected endpoint removed from load balancing not to be in endpoints map, got %d endpoints", n)
+	}
+	if _, ok := p.endpointDeletions[chain]; !ok {
+		t.Fatalf("expected failed deletion of chain %s to be recorded", chain)
+	}
+	if p.retries.NumRequeues(endpointRetry{chain: chain}) != 1 {
+		t.Fatalf("expected deletion of chain %s to be queued for retry", chain)
+	}
+
+	deleter.fail = false
+	p.processNextRetry()
+	if len(deleter.deleted) != 1 || deleter.deleted[0] != chain {
+		t.Errorf("expected retry to delete chain %s, deleted %v", chain, deleter.deleted)
+	}
+	if len(p.endpointDeletions) != 0 || p.retries.NumRequeues(endpointRetry{chain: chain}) != 0 {
+		t.Errorf("expected completed deletion to be forgotten")
+	}
+	if n := len(p.endpointsMap[svcPortName]); n != 0 {
+		t.Errorf("expected no endpoints after retry, got %d endpoints", n)
+	}
+}
+
+func TestStandbyDropsRetries(t *testing.T) {
+	p := newTestProxy()
+	deleter := &fakeEndpointRulesDeleter{fail: true}
+	p.epRules = deleter
+	p.retries = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer p.retries.ShutDown()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 1)
+	chain := ep.epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+	p.endpointsMap[svcPortName] = []Endpoint{ep}
+	addr := &v1.EndpointAddress{IP: "10.1.1.1"}
+	port := &v1.EndpointPort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}
+	if err := p.deleteEndpoint(svcPortName, addr, port); err == nil {
+		t.Fatalf("expected deletion of endpoint rules to fail")
+	}
+
+	// Chain of the same name might be programmed by the leader, standby instance does not delete it
+	p.SetStandby(true)
+	deleter.fail = false
+	p.processNextRetry()
+	if len(deleter.deleted) != 0 {
+		t.Errorf("expected standby instance not to retry deletion, deleted %v", deleter.deleted)
+	}
+	if len(p.endpointDeletions) != 0 || p.retries.NumRequeues(endpointRetry{chain: chain}) != 0 {
+		t.Errorf("expected dropped deletion to be forgotten")
+	}
+}
+
+func TestStaleEndpointSliceOfRecreatedService(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	// Service got deleted and recreated with the same name, it carries a new uid
+	p.cache.storeSvcInCache(&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "uid-new"}})
+	ready := true
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	stale := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-old",
+			Namespace:       "default",
+			Labels:          map[string]string{discovery.LabelServiceName: "app"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Service", Name: "app", UID: "uid-old"}},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+		Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	p.AddEndpointSlice(stale)
+	if _, err := p.cache.getLastKnownEpSlFromCache(nameOf(&stale.ObjectMeta)); err == nil {
+		t.Errorf("expected stale endpoint slice not to be stored in the cache")
+	}
+	if len(p.endpointsMap) != 0 {
+		t.Errorf("expected no endpoints of stale endpoint slice, got %d", len(p.endpointsMap))
+	}
+	p.UpdateEndpointSlice(stale, stale)
+	if len(p.endpointsMap) != 0 {
+		t.Errorf("expected update of stale endpoint slice to be ignored, got %d endpoints", len(p.endpointsMap))
+	}
+
+	current := stale.DeepCopy()
+	current.Name = "app-new"
+	current.OwnerReferences[0].UID = "uid-new"
+	if p.isStaleEndpointSlice(current) {
+		t.Errorf("expected endpoint slice of the current service not to be stale")
+	}
+	current.OwnerReferences = nil
+	if p.isStaleEndpointSlice(current) {
+		t.Errorf("expected endpoint slice without owner not to be stale")
+	}
+}
+
+func TestAddEndpointSliceTwice(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	ready := true
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+			{Addresses: []string{"10.1.1.2"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+		},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	// Informer's resync adds the same slice again
+	p.AddEndpointSlice(epsl)
+	p.AddEndpointSlice(epsl)
+
+	svcPortName := getSvcPortName("app", "default", portName, proto)
+	eps := p.endpointsMap[svcPortName]
+	if len(eps) != 2 {
+		t.Fatalf("expected 2 endpoints after adding the slice twice, got %d", len(eps))
+	}
+	chains := sets.NewString()
+	for _, ep := range eps {
+		chains.Insert(ep.(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain)
+	}
+	if chains.Len() != 2 || len(p.sepNamer.chains) != 2 {
+		t.Errorf("expected 2 endpoint chains, got chains %v and %d allocated chain names", chains.List(), len(p.sepNamer.chains))
+	}
+}
+
+func TestEndpointReadinessHold(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	hold := 100 * time.Millisecond
+	WithEndpointReadinessHold(hold)(p)
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	svcPortName := getSvcPortName("app", "default", portName, proto)
+	slice := func(ready bool) *discovery.EndpointSlice {
+		return &discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discovery.LabelServiceName: "app"},
+			},
+			AddressType: discovery.AddressTypeIPv4,
+			Endpoints:   []discovery.Endpoint{{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+			Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+		}
+	}
+	balanced := func() bool {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return len(p.endpointsMap[svcPortName]) != 0
+	}
+	// update feeds the readiness change to the proxy, as the informer does
+	last := slice(true)
+	update := func(ready bool) {
+		next := slice(ready)
+		p.UpdateEndpointSlice(last, next)
+		last = next
+	}
+
+	p.AddEndpointSlice(last)
+	if !balanced() {
+		t.Fatalf("expected Ready endpoint of a new slice to be added right away")
+	}
+	// Rapid toggles do not change the balancing set
+	for i := 0; i < 5; i++ {
+		update(false)
+		update(true)
+		if !balanced() {
+			t.Fatalf("expected flapping endpoint to stay in the balancing set")
+		}
+	}
+	time.Sleep(2 * hold)
+	if !balanced() {
+		t.Fatalf("expected endpoint which flapped back to Ready to stay in the balancing set")
+	}
+
+	// Not Ready held for the period removes the endpoint
+	update(false)
+	if !balanced() {
+		t.Errorf("expected endpoint to stay in the balancing set before the hold period expires")
+	}
+	time.Sleep(2 * hold)
+	if balanced() {
+		t.Fatalf("expected endpoint to be removed once Not Ready was held for the period")
+	}
+
+	// Ready held for the period adds the endpoint
+	update(true)
+	if balanced() {
+		t.Errorf("expected endpoint to stay out of the balancing set before the hold period expires")
+	}
+	time.Sleep(2 * hold)
+	if !balanced() {
+		t.Fatalf("expected endpoint to be added once Ready was held for the period")
+	}
+
+	// Deleting the slice drops the pending change and removes the endpoint still programmed as Ready
+	update(false)
+	p.DeleteEndpointSlice(last)
+	if balanced() {
+		t.Errorf("expected endpoint of deleted slice to be removed")
+	}
+	time.Sleep(2 * hold)
+	if balanced() || len(p.readinessPending) != 0 {
+		t.Errorf("expected pending change of deleted slice's endpoint to be dropped")
+	}
+}
+
+func TestEffectiveEndpoints(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeNodePort,
+			ClusterIP:             "10.96.0.10",
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+			Ports:                 []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 31000}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "APPID"
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "APPID")
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	p.endpointsMap[svcPortName] = []Endpoint{
+		newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 0),
+		newTestEndpoint(svcPortName, "10.1.1.1", 8080, true, 1),
+	}
+	all := []string{"10.1.1.1", "10.1.1.2"}
+
+	if ips := p.EffectiveEndpoints(svcPortName, InternalPath); !reflect.DeepEqual(ips, all) {
+		t.Errorf("expected internal path to be load balanced to %v, got %v", all, ips)
+	}
+	// Both paths share the service chain, Local policy does not narrow endpoints of the external path
+	if ips := p.EffectiveEndpoints(svcPortName, ExternalPath); !reflect.DeepEqual(ips, all) {
+		t.Errorf("expected external path to be load balanced to %v, got %v", all, ips)
+	}
+	baseInfo.externalDrained = true
+	if ips := p.EffectiveEndpoints(svcPortName, ExternalPath); len(ips) != 0 {
+		t.Errorf("expected drained external path to have no endpoints, got %v", ips)
+	}
+	if ips := p.EffectiveEndpoints(svcPortName, InternalPath); !reflect.DeepEqual(ips, all) {
+		t.Errorf("expected draining not to affect internal path, got %v", ips)
+	}
+	if ips := p.EffectiveEndpoints(getSvcPortName("unknown", "default", "http", v1.ProtocolTCP), InternalPath); len(ips) != 0 {
+		t.Errorf("expected no endpoints of unknown service port, got %v", ips)
+	}
+}
+
+func TestEndpointSliceEndpointLosingAllAddresses(t *testing.T) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	ready := true
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.1.1.1", "10.1.1.2", "10.1.1.3"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+		},
+		Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	svcPortName := getSvcPortName("app", "default", portName, proto)
+	p.AddEndpointSlice(epsl)
+	if n := len(p.endpointsMap[svcPortName]); n != 3 {
+		t.Fatalf("expected 3 endpoints, got %d", n)
+	}
+
+	// Pod got deleted, the endpoint keeps its entry and the slice keeps its ports
+	emptied := epsl.DeepCopy()
+	emptied.Endpoints[0].Addresses = []string{}
+	p.UpdateEndpointSlice(epsl, emptied)
+	if eps, ok := p.endpointsMap[svcPortName]; ok {
+		t.Errorf("expected all endpoints to be removed, got %d endpoints", len(eps))
+	}
+	if n := len(p.sepNamer.chains); n != 0 {
+		t.Errorf("expected chain names of removed endpoints to be released, got %d", n)
+	}
+	stored, err := p.cache.getLastKnownEpSlFromCache(nameOf(&emptied.ObjectMeta))
+	if err != nil || len(stored.Endpoints[0].Addresses) != 0 {
+		t.Errorf("expected cache to carry the slice without addresses")
+	}
+}
+
+func TestMultipleEndpointSlicesOrder(t *testing.T) {
+	ready := true
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	slice := func(name string, ips ...string) *discovery.EndpointSlice {
+		epsl := &discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{discovery.LabelServiceName: "app"},
+			},
+			AddressType: discovery.AddressTypeIPv4,
+			Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+		}
+		for _, ip := range ips {
+			epsl.Endpoints = append(epsl.Endpoints, discovery.Endpoint{Addresses: []string{ip}, Conditions: discovery.EndpointConditions{Ready: &ready}})
+		}
+		return epsl
+	}
+	svcPortName := getSvcPortName("app", "default", portName, proto)
+	chains := func(slices ...*discovery.EndpointSlice) []string {
+		p := newTestProxy()
+		p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+		for _, epsl := range slices {
+			p.AddEndpointSlice(epsl)
+		}
+		// Service is not known, endpoints are pending, marking them programmed makes them eligible
+		for _, ep := range p.endpointsMap[svcPortName] {
+			ep.(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].RuleID = []uint64{1}
+		}
+		var names []string
+		for _, rule := range p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4) {
+			names = append(names, rule.Chain)
+		}
+		return names
+	}
+	// Endpoints of a service span two slices, the balancing set is built from endpoints of both
+	first, second := slice("app-abcde", "10.1.1.3", "10.1.1.1"), slice("app-fghij", "10.1.1.4", "10.1.1.2")
+	expected := chains(first, second)
+	if len(expected) != 4 {
+		t.Fatalf("expected 4 endpoints in the balancing set, got %v", expected)
+	}
+	if got := chains(second, first); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected balancing set %v regardless of slices' arrival order, got %v", expected, got)
+	}
+	// Endpoints of all slices are ordered together by chain name, not slice by slice
+	if !sort.StringsAreSorted(expected) {
+		t.Errorf("expected balancing set of both slices to be sorted by chain name, got %v", expected)
+	}
+}
+
+func TestEndpointReadinessTransitionsMetric(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(endpointReadinessTransitions)
+	defer endpointReadinessTransitions.Reset()
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	portName, port, proto := "http", int32(8080), v1.ProtocolTCP
+	slice := func(ready bool) *discovery.EndpointSlice {
+		return &discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "app-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discovery.LabelServiceName: "app"},
+			},
+			AddressType: discovery.AddressTypeIPv4,
+			Endpoints: []discovery.Endpoint{
+				{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+				// Endpoint which stays ready is not a transition
+				{Addresses: []string{"10.1.1.2"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+			},
+			Ports: []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+		}
+	}
+	ready, notReady := slice(true), slice(false)
+	notReady.Endpoints[1].Conditions.Ready = ready.Endpoints[1].Conditions.Ready
+
+	p.AddEndpointSlice(ready)
+	p.UpdateEndpointSlice(ready, notReady)
+	p.UpdateEndpointSlice(notReady, ready)
+	expected := `
+# HELP nfproxy_endpoint_ready_transitions_total [ALPHA] Number of endpoints' readiness changes observed in EndpointSlice updates, by direction.
+# TYPE nfproxy_endpoint_ready_transitions_total counter
+nfproxy_endpoint_ready_transitions_total{direction="to_notready"} 1
+nfproxy_endpoint_ready_transitions_total{direction="to_ready"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nfproxy_endpoint_ready_transitions_total"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+const (
+	fqdnResolveTimeout = 5 * time.Second
+)
+
+// resolver defines methods used to resolve a FQDN, net.Resolver implements it.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// fqdnTarget carries the state of a service's FQDN resolver
+type fqdnTarget struct {
+	fqdn    string
+	refresh time.Duration
+	svcName objectName
+	// ips is the list of addresses currently programmed as the service's endpoints and ports is the list of
+	// ports they are programmed for, failed is the list of resolved addresses which failed to be added to some
+	// of the ports, they are retried on the next resolution. All are accessed only by the resolver's goroutine
+	// or after the goroutine has stopped.
+	ips    []string
+	ports  []fqdnEndpointPort
+	failed []string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// fqdnEndpointPort is a Service Port and the port of endpoints programmed for resolved addresses.
+type fqdnEndpointPort struct {
+	svcPortName ServicePortName
+	port        v1.EndpointPort
+}
+
+// startFQDNResolver starts a resolver goroutine if the service requests FQDN target.
+func (p *proxy) startFQDNResolver(svc *v1.Service) {
+	fqdn, refresh := getFQDNTarget(svc)
+	if fqdn == "" {
+		return
+	}
+	if len(svc.Spec.Selector) != 0 {
+		klog.Warningf("service %s/%s has a selector, annotation %s is ignored", svc.Namespace, svc.Name, fqdnAnnotation)
+		return
+	}
+	svcName := nameOf(&svc.ObjectMeta)
+	t := &fqdnTarget{
+		fqdn:    fqdn,
+		refresh: refresh,
+		svcName: svcName,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.mu.Lock()
+	if _, ok := p.fqdnTargets[svcName]; ok {
+		p.mu.Unlock()
+		klog.V(5).Infof("resolver of %s for service %s is already running", fqdn, svcName.String())
+		return
+	}
+	p.fqdnTargets[svcName] = t
+	p.mu.Unlock()
+	klog.V(5).Infof("starting resolver of %s for service %s/%s, refresh interval: %v", fqdn, svc.Namespace, svc.Name, refresh)
+	go p.runFQDNResolver(t)
+}
+
+// stopFQDNResolver stops the service's resolver goroutine, if cleanup is true, endpoints programmed for resolved
+// addresses get removed.
+func (p *proxy) stopFQDNResolver(svcName objectName, cleanup bool) {
+	p.mu.Lock()
+	t, ok := p.fqdnTargets[svcName]
+	delete(p.fqdnTargets, svcName)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	klog.V(5).Infof("stopped resolver of %s for service %s", t.fqdn, svcName.String())
+	if cleanup {
+		for _, port := range t.ports {
+			p.applyFQDNEndpoints(port, nil, t.programmed())
+		}
+	}
+}
+
+// isFQDNTargetChanged returns true if FQDN target annotations differ between two versions of a service.
+func isFQDNTargetChanged(svcNew, storedSvc *v1.Service) bool {
+	newFQDN, newRefresh := getFQDNTarget(svcNew)
+	oldFQDN, oldRefresh := getFQDNTarget(storedSvc)
+
+	return newFQDN != oldFQDN || newRefresh != oldRefresh
+}
+
+func (p *proxy) runFQDNResolver(t *fqdnTarget) {
+	defer close(t.done)
+	ticker := time.NewTicker(t.refresh)
+	defer ticker.Stop()
+	for {
+		p.syncFQDNEndpoints(t)
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncFQDNEndpoints resolves the target's FQDN and reprograms the service's endpoints to match resolved addresses
+// and the current ports of the service.
+func (p *proxy) syncFQDNEndpoints(t *fqdnTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(), fqdnResolveTimeout)
+	defer cancel()
+	ips, err := resolveFQDN(ctx, p.resolver, t.fqdn)
+	if err != nil {
+		// Keeping previously resolved addresses until the next successful resolution
+		klog.Warningf("failed to resolve %s for service %s with error: %+v", t.fqdn, t.svcName.String(), err)
+		return
+	}
+	// Ports of the service might have changed since the resolver started, the last known service is used
+	p.mu.RLock()
+	svc, err := p.cache.getLastKnownSvcFromCache(t.svcName)
+	p.mu.RUnlock()
+	if err != nil {
+		klog.Warningf("service %s of resolver of %s is not known with error: %+v", t.svcName.String(), t.fqdn, err)
+		return
+	}
+	ports := fqdnEndpointPorts(svc)
+	// Addresses which failed to be added are added again, addresses gone from the resolution are removed
+	// including failed ones, which might have been added to some of the ports
+	add, _ := diffAddresses(t.ips, ips)
+	_, del := diffAddresses(t.programmed(), ips)
+	if len(add) == 0 && len(del) == 0 && reflect.DeepEqual(ports, t.ports) {
+		return
+	}
+	klog.V(5).Infof("resolved addresses of %s changed, added: %v removed: %v", t.fqdn, add, del)
+	for _, port := range t.ports {
+		if !isFQDNEndpointPortInPorts(port, ports) {
+			// Port is gone from the service, all its endpoints are removed
+			p.applyFQDNEndpoints(port, nil, t.programmed())
+		}
+	}
+	failed := sets.NewString()
+	for _, port := range ports {
+		if isFQDNEndpointPortInPorts(port, t.ports) {
+			failed.Insert(p.applyFQDNEndpoints(port, add, del)...)
+			continue
+		}
+		// Port is new, it gets endpoints for all resolved addresses
+		failed.Insert(p.applyFQDNEndpoints(port, ips, nil)...)
+	}
+	// Only addresses added to all ports are recorded as programmed
+	t.ips = make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if !failed.Has(ip) {
+			t.ips = append(t.ips, ip)
+		}
+	}
+	t.failed = failed.List()
+	t.ports = ports
+}
+
+// programmed returns addresses which might be programmed as the service's endpoints, programmed ones and
+// failed ones, which might have been added to some of the ports.
+func (t *fqdnTarget) programmed() []string {
+	return append(append([]string(nil), t.ips...), t.failed...)
+}
+
+// fqdnEndpointPorts returns ports of a service endpoints for resolved addresses get programmed for.
+func fqdnEndpointPorts(svc *v1.Service) []fqdnEndpointPort {
+	ports := make([]fqdnEndpointPort, 0, len(svc.Spec.Ports))
+	for i := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		port := v1.EndpointPort{
+			Name:     servicePort.Name,
+			Port:     servicePort.Port,
+			Protocol: servicePort.Protocol,
+		}
+		if targetPort := servicePort.TargetPort.IntValue(); targetPort != 0 {
+			port.Port = int32(targetPort)
+		}
+		ports = append(ports, fqdnEndpointPort{
+			svcPortName: getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol),
+			port:        port,
+		})
+	}
+
+	return ports
+}
+
+func isFQDNEndpointPortInPorts(port fqdnEndpointPort, ports []fqdnEndpointPort) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyFQDNEndpoints adds and removes endpoints for resolved addresses to a port of the target's service, addresses
+// which failed to be added are returned. Resolved addresses carry no node, their locality is not detected and they
+// are considered not local.
+func (p *proxy) applyFQDNEndpoints(port fqdnEndpointPort, add, del []string) []string {
+	var failed []string
+	for _, ip := range add {
+		if err := p.addEndpoint(port.svcPortName, &v1.EndpointAddress{IP: ip}, &port.port, endpointAttributes{resolved: true}); err != nil {
+			klog.Errorf("failed to add endpoint %s for Service Port name: %s with error: %+v", ip, port.svcPortName.String(), err)
+			failed = append(failed, ip)
+		}
+	}
+	for _, ip := range del {
+		if err := p.deleteEndpoint(port.svcPortName, &v1.EndpointAddress{IP: ip}, &port.port); err != nil {
+			klog.Errorf("failed to remove endpoint %s for Service Port name: %s with error: %+v", ip, port.svcPortName.String(), err)
+		}
+	}
+
+	return failed
+}
+
+// resolveFQDN returns a sorted list of unique addresses the FQDN resolves to.
+func resolveFQDN(ctx context.Context, r resolver, fqdn string) ([]string, error) {
+	addrs, err := r.LookupIPAddr(ctx, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := addr.IP.String()
+		if isStringInSlice(ip, ips) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	return ips, nil
+}
+
+// diffAddresses returns addresses present only in new list and addresses present only in old list.
+func diffAddresses(old, new []string) ([]string, []string) {
+	var add, del []string
+	for _, ip := range new {
+		if !isStringInSlice(ip, old) {
+			add = append(add, ip)
+		}
+	}
+	for _, ip := range old {
+		if !isStringInSlice(ip, new) {
+			del = append(del, ip)
+		}
+	}
+
+	return add, del
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeResolver returns a next set of addresses on every lookup.
+type fakeResolver struct {
+	results [][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.lookups >= len(r.results) {
+		return nil, fmt.Errorf("no more results for %s", host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range r.results[r.lookups] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	r.lookups++
+
+	return addrs, nil
+}
+
+func TestFQDNEndpointChurn(t *testing.T) {
+	r := &fakeResolver{
+		results: [][]string{
+			{"192.0.2.2", "192.0.2.1", "192.0.2.1"},
+			{"192.0.2.2", "192.0.2.3"},
+			{"192.0.2.3", "192.0.2.2"},
+		},
+	}
+	tests := []struct {
+		add []string
+		del []string
+	}{
+		{add: []string{"192.0.2.1", "192.0.2.2"}},
+		{add: []string{"192.0.2.3"}, del: []string{"192.0.2.1"}},
+		{},
+	}
+	var current []string
+	for i, tt := range tests {
+		ips, err := resolveFQDN(context.Background(), r, "service.example.com")
+		if err != nil {
+			t.Fatalf("resolution %d failed with error: %+v", i, err)
+		}
+		add, del := diffAddresses(current, ips)
+		if !reflect.DeepEqual(add, tt.add) || !reflect.DeepEqual(del, tt.del) {
+			t.Errorf("resolution %d: expected to add %v and remove %v, but got add %v and remove %v", i, tt.add, tt.del, add, del)
+		}
+		current = ips
+	}
+	if _, err := resolveFQDN(context.Background(), r, "service.example.com"); err == nil {
+		t.Errorf("expected resolution error")
+	}
+}
+
+func TestEndpointSliceFQDNAddressType(t *testing.T) {
+	portName := "http"
+	port := int32(8080)
+	proto := v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeFQDN,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"backend.example.com"}}},
+		Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	addresses := func(epsl *discovery.EndpointSlice) []string {
+		info, err := processEpSlice(epsl, "")
+		if err != nil {
+			t.Fatalf("failed to process EndpointSlice with error: %+v", err)
+		}
+		var ips []string
+		for _, e := range info {
+			ips = append(ips, e.addr.IP)
+		}
+		return ips
+	}
+
+	// Without resolution FQDN must never be treated as ip address
+	p := newTestProxy()
+	p.resolver = &fakeResolver{results: [][]string{{"192.0.2.1"}}}
+	if ips := addresses(p.resolveEndpointSlice(epsl)); len(ips) != 0 {
+		t.Errorf("expected FQDN endpoints to be skipped without resolution, got %v", ips)
+	}
+
+	// With resolution, every resolved address becomes an endpoint, the original slice is not modified
+	p.resolveSliceFQDN = true
+	p.resolver = &fakeResolver{results: [][]string{{"192.0.2.2", "2001:db8::1"}}}
+	ips := addresses(p.resolveEndpointSlice(epsl))
+	if len(ips) != 2 || ips[0] != "192.0.2.2" || ips[1] != "2001:db8::1" {
+		t.Errorf("expected resolved addresses [192.0.2.2 2001:db8::1], got %v", ips)
+	}
+	if epsl.Endpoints[0].Addresses[0] != "backend.example.com" {
+		t.Errorf("original EndpointSlice must not be modified")
+	}
+
+	// Failed resolution leaves the endpoint without addresses
+	if ips := addresses(p.resolveEndpointSlice(epsl)); len(ips) != 0 {
+		t.Errorf("expected no addresses when resolution fails, got %v", ips)
+	}
+}
+
+func TestFQDNEndpointsFollowServicePorts(t *testing.T) {
+	p := newTestProxy()
+	detector, err := NewLocalDetector(DetectLocalClusterCIDR, []string{"192.0.2.0/24"}, "")
+	if err != nil {
+		t.Fatalf("failed to create local detector with error: %+v", err)
+	}
+	p.localDetector = detector
+	p.resolver = &fakeResolver{results: [][]string{{"192.0.2.1"}, {"192.0.2.1"}}}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{fqdnAnnotation: "backend.example.com"}},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+	}
+	p.cache.storeSvcInCache(svc)
+	target := &fqdnTarget{fqdn: "backend.example.com", svcName: nameOf(&svc.ObjectMeta)}
+	http := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	https := getSvcPortName("app", "default", "https", v1.ProtocolTCP)
+
+	p.syncFQDNEndpoints(target)
+	if n := len(p.endpointsMap[http]); n != 1 {
+		t.Fatalf("expected 1 endpoint of port http, got %d", n)
+	}
+	// Resolved addresses are never local, even when the local detector would classify them as local
+	if p.endpointsMap[http][0].GetIsLocal() {
+		t.Errorf("expected endpoint of resolved address not to be local")
+	}
+
+	// Service gets a new port after the resolver started, the port gets endpoints on the next resolution
+	updated := svc.DeepCopy()
+	updated.Spec.Ports = append(updated.Spec.Ports, v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP})
+	p.cache.storeSvcInCache(updated)
+	p.syncFQDNEndpoints(target)
+	if n := len(p.endpointsMap[https]); n != 1 {
+		t.Fatalf("expected 1 endpoint of port https added after the resolver started, got %d", n)
+	}
+	if n := len(p.endpointsMap[http]); n != 1 {
+		t.Errorf("expected endpoint of port http to be kept, got %d endpoints", n)
+	}
+	// Endpoints of resolved addresses are found for removal regardless of the local detector
+	p.applyFQDNEndpoints(target.ports[0], nil, target.ips)
+	if n := len(p.endpointsMap[http]); n != 0 {
+		t.Errorf("expected endpoint of port http to be removed, got %d endpoints", n)
+	}
+}
+
+func TestFQDNEndpointAddRetried(t *testing.T) {
+	conn := &failingChainConn{Conn: &fake.Conn{}}
+	p := newConnProxy(t, conn, false)
+	p.resolver = &fakeResolver{results: [][]string{{"192.0.2.1"}, {"192.0.2.1"}}}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	// Resolver is driven by the test, the service is added without the annotation starting it
+	p.AddService(svc)
+	target := &fqdnTarget{fqdn: "backend.example.com", svcName: nameOf(&svc.ObjectMeta)}
+	http := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newBaseEndpointInfo(v1.IPv4Protocol, v1.ProtocolTCP, "192.0.2.1", 80, false, nil)
+	conn.mu.Lock()
+	conn.chain, conn.failures = p.sepNamer.name(http.String(), string(v1.ProtocolTCP), ep.Endpoint), 1
+	conn.mu.Unlock()
+
+	// Adding of the endpoint fails, the address is not recorded as programmed
+	p.syncFQDNEndpoints(target)
+	if len(target.ips) != 0 {
+		t.Fatalf("expected failed address not to be recorded as programmed, got %v", target.ips)
+	}
+	p.mu.RLock()
+	n := len(p.endpointsMap[http])
+	p.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("expected no endpoint of port http after failed add, got %d", n)
+	}
+
+	// Next resolution returns the same address, its add is retried
+	p.syncFQDNEndpoints(target)
+	if !reflect.DeepEqual(target.ips, []string{"192.0.2.1"}) || len(target.failed) != 0 {
+		t.Fatalf("expected address to be recorded as programmed after retry, got %v, failed %v", target.ips, target.failed)
+	}
+	p.mu.RLock()
+	n = len(p.endpointsMap[http])
+	p.mu.RUnlock()
+	if n != 1 {
+		t.Fatalf("expected 1 endpoint of port http after retry, got %d", n)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// chainStore lists and deletes chains programmed in nftables.
+type chainStore interface {
+	list(tableFamily utilnftables.TableFamily) ([]string, error)
+	delete(tableFamily utilnftables.TableFamily, chain string) error
+}
+
+type nftChainStore struct {
+	nfti *nftables.NFTInterface
+}
+
+func (s *nftChainStore) list(tableFamily utilnftables.TableFamily) ([]string, error) {
+	return nftables.GetChains(s.nfti, tableFamily)
+}
+
+func (s *nftChainStore) delete(tableFamily utilnftables.TableFamily, chain string) error {
+	return nftables.DeleteChain(s.nfti, tableFamily, chain)
+}
+
+// collectEndpointChains deletes endpoint chains which are left in nftables without a corresponding endpoint,
+// for example after failed or raced endpoint programming. Chains of endpoints known to endpointsMap and names
+// allocated for endpoints being programmed are kept, service chains jump only to such chains.
+func (p *proxy) collectEndpointChains() {
+	if !p.isSynced() {
+		// Until the initial sync is completed, endpointsMap does not reflect all programmed endpoints
+		return
+	}
+	if p.isStandby() {
+		// Endpoint chains are programmed by the leader, standby instance knows none of them
+		return
+	}
+	for _, tableFamily := range []utilnftables.TableFamily{utilnftables.TableFamilyIPv4, utilnftables.TableFamilyIPv6} {
+		chains, err := p.chains.list(tableFamily)
+		if err != nil {
+			klog.Errorf("failed to list chains of family %v for endpoint chains garbage collection with error: %+v", tableFamily, err)
+			continue
+		}
+		p.deleteOrphanedEndpointChains(tableFamily, chains)
+	}
+}
+
+// deleteOrphanedEndpointChains deletes nfproxy managed endpoint chains out of the list which are not referenced.
+// Base chains and chains of Service Ports are never collected, even if a ChainNamer claims them as endpoint chains.
+// The lock is held for deletion, so a name being released cannot be allocated for a new endpoint meanwhile.
+func (p *proxy) deleteOrphanedEndpointChains(tableFamily utilnftables.TableFamily, chains []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	live := p.liveEndpointChains()
+	for _, chain := range chains {
+		if nftables.IsReservedChain(chain) || !p.sepNamer.namer.IsEndpointChain(chain) || live.Has(chain) {
+			continue
+		}
+		klog.V(5).Infof("deleting orphaned endpoint chain %s of family %v", chain, tableFamily)
+		if err := p.chains.delete(tableFamily, chain); err != nil {
+			klog.Errorf("failed to delete orphaned endpoint chain %s with error: %+v", chain, err)
+			continue
+		}
+		endpointChainsCollected.Inc()
+	}
+}
+
+// liveEndpointChains returns names of chains of all endpoints known to endpointsMap and names allocated for
+// endpoints. It must be called with p.mu held.
+func (p *proxy) liveEndpointChains() sets.String {
+	live := sets.NewString()
+	for chain := range p.sepNamer.chains {
+		live.Insert(chain)
+	}
+	for _, eps := range p.endpointsMap {
+		for _, ep := range eps {
+			epInfo, ok := ep.(*endpointsInfo)
+			if !ok || epInfo.epnft == nil {
+				continue
+			}
+			for _, rule := range epInfo.epnft.Rule {
+				live.Insert(rule.Chain)
+			}
+		}
+	}
+
+	return live
+}
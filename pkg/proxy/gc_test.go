@@ -0,0 +1,118 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+// fakeChainStore keeps chains of each ip family in memory.
+type fakeChainStore struct {
+	chains map[utilnftables.TableFamily][]string
+}
+
+func (s *fakeChainStore) list(tableFamily utilnftables.TableFamily) ([]string, error) {
+	return append([]string{}, s.chains[tableFamily]...), nil
+}
+
+func (s *fakeChainStore) delete(tableFamily utilnftables.TableFamily, chain string) error {
+	chains := s.chains[tableFamily][:0]
+	for _, c := range s.chains[tableFamily] {
+		if c != chain {
+			chains = append(chains, c)
+		}
+	}
+	s.chains[tableFamily] = chains
+	return nil
+}
+
+func TestCollectEndpointChains(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)
+	p.endpointsMap[svcPortName] = []Endpoint{ep}
+	live := ep.epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+	// Chain name allocated for an endpoint being programmed
+	inflight := p.sepNamer.name(svcPortName.String(), string(v1.ProtocolTCP), "10.1.1.2:8080")
+	p.sepNamer.register(inflight, svcPortName.String(), string(v1.ProtocolTCP), "10.1.1.2:8080")
+	orphan := p.sepNamer.name(svcPortName.String(), string(v1.ProtocolTCP), "10.1.1.3:8080")
+	store := &fakeChainStore{chains: make(map[utilnftables.TableFamily][]string)}
+	store.chains[utilnftables.TableFamilyIPv4] = []string{"k8s-nat-services", "k8s-nfproxy-svc-ABCDEF", live, inflight, orphan}
+	store.chains[utilnftables.TableFamilyIPv6] = []string{"k8s-nat-services", orphan}
+	p.chains = store
+
+	// Before initial sync, endpoints map is incomplete and nothing is collected
+	p.collectEndpointChains()
+	if len(store.chains[utilnftables.TableFamilyIPv4]) != 5 || len(store.chains[utilnftables.TableFamilyIPv6]) != 2 {
+		t.Fatalf("expected no chains to be collected before initial sync, got %v", store.chains)
+	}
+	p.SetSynced()
+	// Standby instance does not know endpoint chains programmed by the leader and collects nothing
+	p.SetStandby(true)
+	p.collectEndpointChains()
+	if len(store.chains[utilnftables.TableFamilyIPv4]) != 5 || len(store.chains[utilnftables.TableFamilyIPv6]) != 2 {
+		t.Fatalf("expected no chains to be collected by standby instance, got %v", store.chains)
+	}
+	p.SetStandby(false)
+	p.collectEndpointChains()
+	expected := make(map[utilnftables.TableFamily][]string)
+	expected[utilnftables.TableFamilyIPv4] = []string{"k8s-nat-services", "k8s-nfproxy-svc-ABCDEF", live, inflight}
+	expected[utilnftables.TableFamilyIPv6] = []string{"k8s-nat-services"}
+	for family, chains := range expected {
+		sort.Strings(chains)
+		got := store.chains[family]
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, chains) {
+			t.Errorf("expected chains %v of family %v after garbage collection, got %v", chains, family, got)
+		}
+	}
+}
+
+// greedyChainNamer claims every chain as an endpoint chain.
+type greedyChainNamer struct {
+	customChainNamer
+}
+
+func (greedyChainNamer) IsEndpointChain(chain string) bool {
+	return true
+}
+
+func TestCollectEndpointChainsSkipsReservedChains(t *testing.T) {
+	p := newTestProxy()
+	p.sepNamer = newCustomEndpointChainNamer(greedyChainNamer{})
+	store := &fakeChainStore{chains: make(map[utilnftables.TableFamily][]string)}
+	store.chains[utilnftables.TableFamilyIPv4] = []string{
+		nftables.NatPrerouting, nftables.K8sNATServices, nftables.K8sFilterDoReject,
+		nftables.K8sSvcPrefix + "ABCDEF", nftables.K8sFwPrefix + "ABCDEF", nftables.K8sXlbPrefix + "ABCDEF", "ep-orphan",
+	}
+	p.chains = store
+	p.SetSynced()
+	p.collectEndpointChains()
+	expected := []string{
+		nftables.NatPrerouting, nftables.K8sNATServices, nftables.K8sFilterDoReject,
+		nftables.K8sSvcPrefix + "ABCDEF", nftables.K8sFwPrefix + "ABCDEF", nftables.K8sXlbPrefix + "ABCDEF",
+	}
+	if got := store.chains[utilnftables.TableFamilyIPv4]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected only orphaned endpoint chain to be collected, got %v", got)
+	}
+}
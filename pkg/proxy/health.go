@@ -0,0 +1,75 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"k8s.io/klog"
+)
+
+// ServiceHealthStatus tells whether a Service Port load balances to endpoints, intentionally rejects traffic
+// because it has no endpoints or failed to be programmed.
+type ServiceHealthStatus string
+
+const (
+	// ServiceHealthy is a programmed Service Port with endpoints in its load balancing.
+	ServiceHealthy ServiceHealthStatus = "Healthy"
+	// ServiceNoEndpoints is a programmed Service Port without endpoints, its addresses are in No Endpoints set.
+	ServiceNoEndpoints ServiceHealthStatus = "NoEndpoints"
+	// ServiceProgrammingError is a Service Port which last programming attempt failed.
+	ServiceProgrammingError ServiceHealthStatus = "ProgrammingError"
+)
+
+// ServiceHealth returns health status of a Service Port, false is returned if the Service Port is neither
+// programmed nor failed to be programmed.
+func (p *proxy) ServiceHealth(svcPortName ServicePortName) (ServiceHealthStatus, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		if _, failed := p.failedServicePorts[svcPortName]; failed {
+			return ServiceProgrammingError, true
+		}
+		return "", false
+	}
+	base := baseServiceInfo(svc)
+	switch {
+	case base.lastError != nil:
+		return ServiceProgrammingError, true
+	case !base.svcnft.WithEndpoints:
+		return ServiceNoEndpoints, true
+	}
+
+	return ServiceHealthy, true
+}
+
+// recordServicePortFailure records the error of a failed programming of a Service Port which is not in serviceMap.
+// It must be called with p.mu held.
+func (p *proxy) recordServicePortFailure(svcPortName ServicePortName, err error) {
+	if p.failedServicePorts == nil {
+		p.failedServicePorts = make(map[ServicePortName]error)
+	}
+	p.failedServicePorts[svcPortName] = err
+}
+
+// clearServicePortFailure forgets a failed programming of a Service Port once it is programmed or deleted.
+// It must be called with p.mu held.
+func (p *proxy) clearServicePortFailure(svcPortName ServicePortName) {
+	if _, ok := p.failedServicePorts[svcPortName]; ok {
+		klog.V(5).Infof("service port %s is no longer failed", svcPortName.String())
+		delete(p.failedServicePorts, svcPortName)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceHealth(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if _, ok := p.ServiceHealth(svcPortName); ok {
+		t.Fatalf("expected no health status of unknown service port %s", svcPortName.String())
+	}
+
+	p.mu.Lock()
+	p.recordServicePortFailure(svcPortName, fmt.Errorf("adding service chains failed"))
+	p.mu.Unlock()
+	if status, ok := p.ServiceHealth(svcPortName); !ok || status != ServiceProgrammingError {
+		t.Errorf("expected service port which failed to be added to be %s, got %s", ServiceProgrammingError, status)
+	}
+
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "svcid")
+	p.mu.Lock()
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	p.clearServicePortFailure(svcPortName)
+	p.mu.Unlock()
+	if status, _ := p.ServiceHealth(svcPortName); status != ServiceNoEndpoints {
+		t.Errorf("expected programmed service port without endpoints to be %s, got %s", ServiceNoEndpoints, status)
+	}
+
+	baseInfo.svcnft.WithEndpoints = true
+	if status, _ := p.ServiceHealth(svcPortName); status != ServiceHealthy {
+		t.Errorf("expected programmed service port with endpoints to be %s, got %s", ServiceHealthy, status)
+	}
+
+	baseInfo.lastError = fmt.Errorf("programming endpoints rules failed")
+	if status, _ := p.ServiceHealth(svcPortName); status != ServiceProgrammingError {
+		t.Errorf("expected service port which chain failed to be updated to be %s, got %s", ServiceProgrammingError, status)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"k8s.io/klog"
+)
+
+// hookQueueLength is the number of notifications waiting for hooks, once it is reached notifications are dropped.
+const hookQueueLength = 1024
+
+// Hooks are optional callbacks notifying external controllers about changes committed to nftables. Hooks are
+// invoked from a dedicated goroutine and never stall programming, a slow hook delays only following notifications.
+type Hooks struct {
+	// OnServiceProgrammed is called when a Service Port is programmed
+	OnServiceProgrammed func(svcPortName ServicePortName)
+	// OnServiceUnprogrammed is called when a Service Port is removed
+	OnServiceUnprogrammed func(svcPortName ServicePortName)
+	// OnEndpointProgrammed is called when an endpoint's chain and rules of a Service Port are programmed
+	OnEndpointProgrammed func(svcPortName ServicePortName, endpoint string)
+}
+
+// hookNotifier queues notifications and invokes hooks in order.
+type hookNotifier struct {
+	hooks Hooks
+	queue chan func()
+}
+
+func newHookNotifier(hooks Hooks) *hookNotifier {
+	n := &hookNotifier{
+		hooks: hooks,
+		queue: make(chan func(), hookQueueLength),
+	}
+	go n.run()
+
+	return n
+}
+
+func (n *hookNotifier) run() {
+	for notify := range n.queue {
+		notify()
+	}
+}
+
+// notify queues a notification without blocking.
+func (n *hookNotifier) notify(notification func()) {
+	select {
+	case n.queue <- notification:
+	default:
+		klog.Warningf("hooks did not keep up with %d queued notifications, dropping notification", hookQueueLength)
+	}
+}
+
+func (p *proxy) serviceProgrammed(svcPortName ServicePortName) {
+	if p.notifier == nil || p.notifier.hooks.OnServiceProgrammed == nil {
+		return
+	}
+	p.notifier.notify(func() { p.notifier.hooks.OnServiceProgrammed(svcPortName) })
+}
+
+func (p *proxy) serviceUnprogrammed(svcPortName ServicePortName) {
+	if p.notifier == nil || p.notifier.hooks.OnServiceUnprogrammed == nil {
+		return
+	}
+	p.notifier.notify(func() { p.notifier.hooks.OnServiceUnprogrammed(svcPortName) })
+}
+
+func (p *proxy) endpointProgrammed(svcPortName ServicePortName, endpoint string) {
+	if p.notifier == nil || p.notifier.hooks.OnEndpointProgrammed == nil {
+		return
+	}
+	p.notifier.notify(func() { p.notifier.hooks.OnEndpointProgrammed(svcPortName, endpoint) })
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestHooks(t *testing.T) {
+	programmed := make(chan ServicePortName, 1)
+	release := make(chan struct{})
+	p := newTestProxy()
+	p.notifier = newHookNotifier(Hooks{
+		OnServiceProgrammed: func(svcPortName ServicePortName) {
+			programmed <- svcPortName
+		},
+		OnEndpointProgrammed: func(svcPortName ServicePortName, endpoint string) {
+			<-release
+		},
+	})
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+
+	// Service Port programmed by addServicePort is notified to the hook
+	p.serviceProgrammed(svcPortName)
+	select {
+	case got := <-programmed:
+		if got != svcPortName {
+			t.Fatalf("expected hook for %s, got %s", svcPortName.String(), got.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("hook for programmed service %s was not called", svcPortName.String())
+	}
+	// Unset hook is skipped
+	p.serviceUnprogrammed(svcPortName)
+
+	// A stuck hook must not block notifying, notifications beyond the queue length are dropped
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < hookQueueLength+2; i++ {
+			p.endpointProgrammed(svcPortName, "10.1.1.1:8080")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("notifying blocked on a stuck hook")
+	}
+	close(release)
+}
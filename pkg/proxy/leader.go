@@ -0,0 +1,350 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// LeaderElection tells whether the proxy instance is the leader of active/standby instances, only the leader
+// programs the kernel.
+type LeaderElection interface {
+	// IsLeader returns true if the instance is currently the leader
+	IsLeader() bool
+	// OnLeaderChange registers f to be called with the new state on every change of leadership
+	OnLeaderChange(f func(leader bool))
+}
+
+// leaderProxy is a Proxy which applies services, endpoints and endpoint slices events, ProgramService, PinService,
+// UnpinService, NamespaceTerminating and OnNodeUpdate to the wrapped Proxy only while the instance is the leader.
+// Last state of every object, spec, pin, terminating namespace and node is kept regardless of leadership, becoming
+// the leader programs all of them, losing leadership removes programmed objects and specs. The wrapped Proxy is
+// set to standby while the instance is not the leader, which pauses its retries, endpoints' warmup and readiness
+// hold and garbage collection of endpoint chains.
+// SetNodeInfo, StartDraining and SetSynced are passed to the wrapped Proxy regardless of leadership, while standby
+// the wrapped Proxy has no services programmed, so they only update its state applied once it becomes the leader.
+// Read only methods are passed to the wrapped Proxy.
+type leaderProxy struct {
+	Proxy
+	mu            sync.Mutex // protects the following fields
+	leader        bool
+	services      map[objectName]*v1.Service
+	endpoints     map[objectName]*v1.Endpoints
+	endpointSlice map[objectName]*discovery.EndpointSlice
+	specs         map[objectName]ServiceSpec
+	pins          map[ServicePortName]string
+	namespaces    sets.String
+	nodes         map[string]*v1.Node
+}
+
+var _ Proxy = &leaderProxy{}
+
+// NewLeaderProxy returns a Proxy which applies services, endpoints and endpoint slices events to p only while
+// election reports the instance as the leader.
+func NewLeaderProxy(p Proxy, election LeaderElection) Proxy {
+	l := &leaderProxy{
+		Proxy:         p,
+		leader:        election.IsLeader(),
+		services:      make(map[objectName]*v1.Service),
+		endpoints:     make(map[objectName]*v1.Endpoints),
+		endpointSlice: make(map[objectName]*discovery.EndpointSlice),
+		specs:         make(map[objectName]ServiceSpec),
+		pins:          make(map[ServicePortName]string),
+		namespaces:    sets.NewString(),
+		nodes:         make(map[string]*v1.Node),
+	}
+	p.SetStandby(!l.leader)
+	election.OnLeaderChange(l.setLeader)
+
+	return l
+}
+
+func (l *leaderProxy) AddService(svc *v1.Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.services[nameOf(&svc.ObjectMeta)] = svc
+	if l.leader {
+		l.Proxy.AddService(svc)
+	}
+}
+
+func (l *leaderProxy) DeleteService(svc *v1.Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	name := nameOf(&svc.ObjectMeta)
+	delete(l.services, name)
+	// Service programmed by ProgramService is removed by DeleteService as well
+	delete(l.specs, name)
+	// Pins of deleted Service Ports are dropped
+	for svcPortName := range l.pins {
+		if svcPortName.Cluster == name.Cluster && svcPortName.NamespacedName == name.NamespacedName {
+			delete(l.pins, svcPortName)
+		}
+	}
+	if name.Cluster == "" {
+		l.releaseNamespace(name.Namespace)
+	}
+	if l.leader {
+		l.Proxy.DeleteService(svc)
+	}
+}
+
+// releaseNamespace forgets a terminating namespace once its last service or spec is deleted, so a namespace
+// re-created with the same name is not rejected when the instance becomes the leader. It must be called with
+// l.mu held.
+func (l *leaderProxy) releaseNamespace(ns string) {
+	if !l.namespaces.Has(ns) {
+		return
+	}
+	for name := range l.services {
+		if name.Cluster == "" && name.Namespace == ns {
+			return
+		}
+	}
+	for name := range l.specs {
+		if name.Cluster == "" && name.Namespace == ns {
+			return
+		}
+	}
+	l.namespaces.Delete(ns)
+}
+
+func (l *leaderProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.services[nameOf(&svcNew.ObjectMeta)] = svcNew
+	if l.leader {
+		l.Proxy.UpdateService(svcOld, svcNew)
+	}
+}
+
+func (l *leaderProxy) AddEndpoints(ep *v1.Endpoints) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endpoints[nameOf(&ep.ObjectMeta)] = ep
+	if l.leader {
+		l.Proxy.AddEndpoints(ep)
+	}
+}
+
+func (l *leaderProxy) DeleteEndpoints(ep *v1.Endpoints) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.endpoints, nameOf(&ep.ObjectMeta))
+	if l.leader {
+		l.Proxy.DeleteEndpoints(ep)
+	}
+}
+
+func (l *leaderProxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endpoints[nameOf(&epNew.ObjectMeta)] = epNew
+	if l.leader {
+		l.Proxy.UpdateEndpoints(epOld, epNew)
+	}
+}
+
+func (l *leaderProxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endpointSlice[nameOf(&epsl.ObjectMeta)] = epsl
+	if l.leader {
+		l.Proxy.AddEndpointSlice(epsl)
+	}
+}
+
+func (l *leaderProxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.endpointSlice, nameOf(&epsl.ObjectMeta))
+	if l.leader {
+		l.Proxy.DeleteEndpointSlice(epsl)
+	}
+}
+
+func (l *leaderProxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endpointSlice[nameOf(&epslNew.ObjectMeta)] = epslNew
+	if l.leader {
+		l.Proxy.UpdateEndpointSlice(epslOld, epslNew)
+	}
+}
+
+// ProgramService programs the service described by the spec while the instance is the leader, standby instance
+// only validates and records the spec.
+func (l *leaderProxy) ProgramService(spec ServiceSpec) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	l.specs[nameOf(&spec.service().ObjectMeta)] = spec
+	if !l.leader {
+		return nil
+	}
+
+	return l.Proxy.ProgramService(spec)
+}
+
+// PinService pins the Service Port while the instance is the leader, standby instance only records the pin, it is
+// applied once the instance becomes the leader.
+func (l *leaderProxy) PinService(svcPortName ServicePortName, endpointIP string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.leader {
+		l.pins[svcPortName] = endpointIP
+		return nil
+	}
+	if err := l.Proxy.PinService(svcPortName, endpointIP); err != nil {
+		return err
+	}
+	l.pins[svcPortName] = endpointIP
+
+	return nil
+}
+
+func (l *leaderProxy) UnpinService(svcPortName ServicePortName) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pins, svcPortName)
+	if !l.leader {
+		return nil
+	}
+
+	return l.Proxy.UnpinService(svcPortName)
+}
+
+func (l *leaderProxy) NamespaceTerminating(ns string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.namespaces.Insert(ns)
+	if l.leader {
+		l.Proxy.NamespaceTerminating(ns)
+	}
+}
+
+func (l *leaderProxy) OnNodeUpdate(node *v1.Node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nodes[node.Name] = node
+	if l.leader {
+		l.Proxy.OnNodeUpdate(node)
+	}
+}
+
+// setLeader applies a change of leadership. The new leader does a full programming pass of all known nodes,
+// objects and specs, services first, so endpoints find their services programmed, then terminating namespaces
+// and pins are applied to the programmed services. The instance losing leadership removes all programmed objects
+// and specs, endpoints first, so the kernel is left to the new leader.
+func (l *leaderProxy) setLeader(leader bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.leader == leader {
+		return
+	}
+	l.leader = leader
+	if leader {
+		klog.Infof("became the leader, programming %d service(s), %d endpoints, %d endpoint slice(s) and %d service spec(s)",
+			len(l.services), len(l.endpoints), len(l.endpointSlice), len(l.specs))
+		l.Proxy.SetStandby(false)
+		for _, node := range l.nodes {
+			l.Proxy.OnNodeUpdate(node)
+		}
+		for _, svc := range l.services {
+			l.Proxy.AddService(svc)
+		}
+		for _, spec := range l.specs {
+			if err := l.Proxy.ProgramService(spec); err != nil {
+				klog.Errorf("failed to program service %s/%s with error: %+v", spec.Namespace, spec.Name, err)
+			}
+		}
+		for _, ep := range l.endpoints {
+			l.Proxy.AddEndpoints(ep)
+		}
+		for _, epsl := range l.endpointSlice {
+			l.Proxy.AddEndpointSlice(epsl)
+		}
+		for _, ns := range l.namespaces.List() {
+			l.Proxy.NamespaceTerminating(ns)
+		}
+		for svcPortName, endpointIP := range l.pins {
+			if err := l.Proxy.PinService(svcPortName, endpointIP); err != nil {
+				klog.Errorf("failed to pin service port %s with error: %+v", svcPortName.String(), err)
+			}
+		}
+		return
+	}
+	klog.Infof("lost leadership, removing %d service(s), %d endpoints, %d endpoint slice(s) and %d service spec(s)",
+		len(l.services), len(l.endpoints), len(l.endpointSlice), len(l.specs))
+	l.Proxy.SetStandby(true)
+	for _, epsl := range l.endpointSlice {
+		l.Proxy.DeleteEndpointSlice(epsl)
+	}
+	for _, ep := range l.endpoints {
+		l.Proxy.DeleteEndpoints(ep)
+	}
+	for _, svc := range l.services {
+		l.Proxy.DeleteService(svc)
+	}
+	for _, spec := range l.specs {
+		l.Proxy.DeleteService(spec.service())
+	}
+}
+
+// SetStandby pauses background programming while the instance is not the leader: retries are dropped, endpoints
+// completing warmup or readiness hold and garbage collection of endpoint chains are skipped. Objects are removed
+// by the caller, so leaked chains are left to the leader's garbage collection.
+func (p *proxy) SetStandby(standby bool) {
+	var v int32
+	if standby {
+		v = 1
+	}
+	atomic.StoreInt32(&p.standby, v)
+}
+
+func (p *proxy) isStandby() bool {
+	return atomic.LoadInt32(&p.standby) == 1
+}
+
+// dropRetry drops a queued retry while the instance is standby, an endpoint deletion queued for retry is dropped
+// with the endpoint.
+func (p *proxy) dropRetry(item interface{}) {
+	defer p.retries.Forget(item)
+	retry, ok := item.(endpointRetry)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deletion, ok := p.endpointDeletions[retry.chain]
+	if !ok {
+		return
+	}
+	delete(p.endpointDeletions, retry.chain)
+	if !deletion.serviceUpdated {
+		p.removeEndpointFromMap(deletion.svcPortName, deletion.ep)
+	}
+	p.sepNamer.release(deletion.rule.Chain, deletion.svcPortName.String(), string(deletion.ep.protocol), deletion.ep.Endpoint)
+}
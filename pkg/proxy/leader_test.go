@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeLeaderElection struct {
+	leader   bool
+	onChange func(leader bool)
+}
+
+func (f *fakeLeaderElection) IsLeader() bool                      { return f.leader }
+func (f *fakeLeaderElection) OnLeaderChange(fn func(leader bool)) { f.onChange = fn }
+
+func TestLeaderProxy(t *testing.T) {
+	svc := func(name, version string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: version}}
+	}
+	epsl := func(name, version string) *discovery.EndpointSlice {
+		return &discovery.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", ResourceVersion: version}}
+	}
+	r := &recordingProxy{}
+	election := &fakeLeaderElection{}
+	l := NewLeaderProxy(r, election)
+
+	// Standby instance keeps objects' state without programming them
+	l.AddService(svc("app", "1"))
+	l.UpdateService(svc("app", "1"), svc("app", "2"))
+	l.AddService(svc("db", "1"))
+	l.AddService(svc("old", "1"))
+	l.DeleteService(svc("old", "1"))
+	l.AddEndpointSlice(epsl("app-abcde", "1"))
+	if len(r.calls) != 0 {
+		t.Fatalf("expected standby instance not to program anything, got %v", r.calls)
+	}
+
+	// Becoming the leader programs the last state of all known objects, services first
+	election.onChange(true)
+	services := append([]string(nil), r.calls[:2]...)
+	sort.Strings(services)
+	expected := []string{"AddService default/app@2", "AddService default/db@1"}
+	if !reflect.DeepEqual(services, expected) || len(r.calls) != 3 || r.calls[2] != "AddEndpointSlice default/app-abcde@1" {
+		t.Fatalf("expected full programming pass of %v and the endpoint slice, got %v", expected, r.calls)
+	}
+	// Leader applies events as they come
+	r.calls = nil
+	l.UpdateEndpointSlice(epsl("app-abcde", "1"), epsl("app-abcde", "2"))
+	if !reflect.DeepEqual(r.calls, []string{"UpdateEndpointSlice default/app-abcde@2"}) {
+		t.Errorf("expected leader to apply the update, got %v", r.calls)
+	}
+	// Repeated notification does not program again
+	r.calls = nil
+	election.onChange(true)
+	if len(r.calls) != 0 {
+		t.Errorf("expected no programming without a change of leadership, got %v", r.calls)
+	}
+
+	// Losing leadership removes programmed objects, endpoint slices first
+	election.onChange(false)
+	if len(r.calls) != 3 || r.calls[0] != "DeleteEndpointSlice default/app-abcde@2" {
+		t.Errorf("expected endpoint slice and 2 services to be removed, got %v", r.calls)
+	}
+}
+
+func TestLeaderProxyGatesMutatingMethods(t *testing.T) {
+	r := &recordingProxy{}
+	election := &fakeLeaderElection{}
+	l := NewLeaderProxy(r, election)
+	if !r.standby {
+		t.Fatalf("expected wrapped proxy of standby instance to be set to standby")
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	spec := ServiceSpec{Name: "vip", Namespace: "default", ClusterIP: "10.96.0.20", Ports: []ServicePortSpec{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}}}
+
+	// Standby instance records specs, pins, terminating namespaces and nodes without applying them
+	if err := l.ProgramService(spec); err != nil {
+		t.Fatalf("expected standby instance to accept valid spec, got error: %+v", err)
+	}
+	if err := l.ProgramService(ServiceSpec{Name: "invalid"}); err == nil {
+		t.Errorf("expected standby instance to reject invalid spec")
+	}
+	if err := l.PinService(svcPortName, "10.1.1.1"); err != nil {
+		t.Fatalf("expected standby instance to record the pin, got error: %+v", err)
+	}
+	l.NamespaceTerminating("old")
+	l.OnNodeUpdate(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", ResourceVersion: "1"}})
+	if len(r.calls) != 0 {
+		t.Fatalf("expected standby instance not to program anything, got %v", r.calls)
+	}
+
+	// Becoming the leader applies them, nodes first, pins after the services they pin
+	election.onChange(true)
+	expected := []string{
+		"OnNodeUpdate /node1@1",
+		"ProgramService default/vip",
+		"NamespaceTerminating old",
+		"PinService " + svcPortName.String() + " 10.1.1.1",
+	}
+	if r.standby || !reflect.DeepEqual(r.calls, expected) {
+		t.Fatalf("expected leader to apply %v, got %v, standby %t", expected, r.calls, r.standby)
+	}
+	r.calls = nil
+	if err := l.UnpinService(svcPortName); err != nil || !reflect.DeepEqual(r.calls, []string{"UnpinService " + svcPortName.String()}) {
+		t.Errorf("expected leader to unpin the service port, got %v, error %v", r.calls, err)
+	}
+
+	// Losing leadership removes services programmed by specs and sets the wrapped proxy to standby
+	r.calls = nil
+	election.onChange(false)
+	if !r.standby || !reflect.DeepEqual(r.calls, []string{"DeleteService default/vip@"}) {
+		t.Errorf("expected service of the spec to be removed and standby to be set, got %v, standby %t", r.calls, r.standby)
+	}
+}
+
+func TestLeaderProxyReleasesDeletedNamespace(t *testing.T) {
+	svc := func(name, namespace string) *v1.Service {
+		return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, ResourceVersion: "1"}}
+	}
+	r := &recordingProxy{}
+	election := &fakeLeaderElection{leader: true}
+	l := NewLeaderProxy(r, election)
+
+	l.AddService(svc("app", "old"))
+	l.AddService(svc("db", "old"))
+	l.NamespaceTerminating("old")
+	l.DeleteService(svc("app", "old"))
+	election.onChange(false)
+	// Namespace is deleted and re-created with the same name while standby
+	l.DeleteService(svc("db", "old"))
+	l.AddService(svc("app", "old"))
+
+	// Regaining leadership programs the service of the re-created namespace without rejecting its traffic
+	r.calls = nil
+	election.onChange(true)
+	expected := []string{"AddService old/app@1"}
+	if !reflect.DeepEqual(r.calls, expected) {
+		t.Errorf("expected leader to program %v only, got %v", expected, r.calls)
+	}
+}
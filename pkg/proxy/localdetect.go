@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// DetectLocalMode defines how locality of endpoints without NodeName is detected, modes follow kube-proxy's
+// DetectLocalMode.
+type DetectLocalMode string
+
+const (
+	// DetectLocalClusterCIDR detects endpoints with addresses in the node's pod CIDRs as local
+	DetectLocalClusterCIDR DetectLocalMode = "ClusterCIDR"
+	// DetectLocalNodeCIDR detects endpoints with addresses in the node's pod CIDRs as local
+	DetectLocalNodeCIDR DetectLocalMode = "NodeCIDR"
+	// DetectLocalBridgeInterface detects endpoints with addresses in subnets of the bridge interface as local
+	DetectLocalBridgeInterface DetectLocalMode = "BridgeInterface"
+	// DetectLocalInterfaceNamePrefix detects endpoints with addresses in subnets of interfaces with the name prefix as local
+	DetectLocalInterfaceNamePrefix DetectLocalMode = "InterfaceNamePrefix"
+)
+
+// LocalDetector detects if an endpoint's address belongs to a pod running on the local node, it is used
+// for endpoints without NodeName.
+type LocalDetector interface {
+	IsLocal(ip string) bool
+}
+
+// NewLocalDetector returns LocalDetector for the mode, CIDR modes use cidrs and interface modes use iface
+// as the interface name or the interface name prefix.
+func NewLocalDetector(mode DetectLocalMode, cidrs []string, iface string) (LocalDetector, error) {
+	switch mode {
+	case DetectLocalClusterCIDR, DetectLocalNodeCIDR:
+		return newCIDRDetector(cidrs)
+	case DetectLocalBridgeInterface:
+		if iface == "" {
+			return nil, fmt.Errorf("detect local mode %s requires the bridge interface name", mode)
+		}
+		return newInterfaceDetector(func(name string) bool { return name == iface }), nil
+	case DetectLocalInterfaceNamePrefix:
+		if iface == "" {
+			return nil, fmt.Errorf("detect local mode %s requires the interface name prefix", mode)
+		}
+		return newInterfaceDetector(func(name string) bool { return strings.HasPrefix(name, iface) }), nil
+	}
+
+	return nil, fmt.Errorf("unsupported detect local mode %s", mode)
+}
+
+// cidrDetector detects endpoints with addresses in any of the CIDRs as local.
+type cidrDetector struct {
+	cidrs []*net.IPNet
+}
+
+func newCIDRDetector(cidrs []string) (LocalDetector, error) {
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no pod CIDR to detect local endpoints")
+	}
+	d := &cidrDetector{}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pod CIDR %s with error: %+v", cidr, err)
+		}
+		d.cidrs = append(d.cidrs, ipnet)
+	}
+
+	return d, nil
+}
+
+func (d *cidrDetector) IsLocal(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range d.cidrs {
+		if cidr.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interfaceDetector detects endpoints with addresses in subnets configured on matching interfaces as local.
+// Interfaces are listed on each check as addresses of interfaces can change at any time, interfaces without
+// addresses such as point-to-point veths do not match any endpoint.
+type interfaceDetector struct {
+	match func(name string) bool
+	// subnets lists subnets configured on interfaces, it is replaced in tests
+	subnets func(match func(name string) bool) ([]*net.IPNet, error)
+}
+
+func newInterfaceDetector(match func(name string) bool) LocalDetector {
+	return &interfaceDetector{
+		match:   match,
+		subnets: interfaceSubnets,
+	}
+}
+
+func (d *interfaceDetector) IsLocal(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	subnets, err := d.subnets(d.match)
+	if err != nil {
+		klog.Warningf("failed to list interfaces to detect locality of endpoint %s with error: %+v", ip, err)
+		return false
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func interfaceSubnets(match func(name string) bool) ([]*net.IPNet, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	for _, intf := range intfs {
+		if !match(intf.Name) {
+			continue
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				subnets = append(subnets, ipnet)
+			}
+		}
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestDetectLocalClusterCIDR(t *testing.T) {
+	detector, err := NewLocalDetector(DetectLocalClusterCIDR, []string{"10.244.1.0/24", "fd00:10:244:1::/64"}, "")
+	if err != nil {
+		t.Fatalf("failed to create local detector with error: %+v", err)
+	}
+	p := newTestProxy()
+	p.localDetector = detector
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	node1 := "node1"
+	tests := []struct {
+		addr    v1.EndpointAddress
+		isLocal bool
+	}{
+		{addr: v1.EndpointAddress{IP: "10.244.1.5"}, isLocal: true},
+		{addr: v1.EndpointAddress{IP: "fd00:10:244:1::5"}, isLocal: true},
+		{addr: v1.EndpointAddress{IP: "10.244.2.5"}, isLocal: false},
+		// NodeName takes precedence over the pod CIDR
+		{addr: v1.EndpointAddress{IP: "10.244.2.5", NodeName: &node1}, isLocal: true},
+	}
+	for _, tt := range tests {
+		if isLocal := p.isLocalEndpoint(svcPortName, &tt.addr); isLocal != tt.isLocal {
+			t.Errorf("expected endpoint %s to be local %t, got %t", tt.addr.IP, tt.isLocal, isLocal)
+		}
+	}
+	if _, err := NewLocalDetector(DetectLocalNodeCIDR, nil, ""); err == nil {
+		t.Errorf("expected error for NodeCIDR mode without pod CIDRs")
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// logThrottleBurst is the number of warnings of a kind logged before throttling kicks in
+	logThrottleBurst = 5
+	// logThrottleInterval is the interval in which a throttled kind of warning gets one more message logged
+	logThrottleInterval = time.Minute
+)
+
+// Kinds of benign warnings which are frequent during resyncs and get throttled
+const (
+	warnAlreadyExists = "already-exists"
+	warnNotFound      = "not-found"
+	// warnClusterAnnotation is logged for every event of a local object carrying the cluster annotation
+	warnClusterAnnotation = "cluster-annotation"
+)
+
+// warnings throttles benign high frequency warnings
+var warnings = newLogThrottle(logThrottleBurst, logThrottleInterval)
+
+// logThrottle is a token bucket per kind of message, a message is logged when its kind has a token left,
+// otherwise it is suppressed and counted. The next logged message of the kind carries the number of suppressed ones.
+type logThrottle struct {
+	burst    int
+	interval time.Duration
+	logf     func(format string, args ...interface{})
+	now      func() time.Time
+	mu       sync.Mutex // protects buckets
+	buckets  map[string]*logBucket
+}
+
+type logBucket struct {
+	tokens     int
+	last       time.Time
+	suppressed int
+}
+
+func newLogThrottle(burst int, interval time.Duration) *logThrottle {
+	return &logThrottle{
+		burst:    burst,
+		interval: interval,
+		logf:     klog.Warningf,
+		now:      time.Now,
+		buckets:  make(map[string]*logBucket),
+	}
+}
+
+// warningf logs a warning of a kind unless the kind ran out of tokens.
+func (l *logThrottle) warningf(kind string, format string, args ...interface{}) {
+	l.mu.Lock()
+	now := l.now()
+	b, ok := l.buckets[kind]
+	if !ok {
+		b = &logBucket{tokens: l.burst, last: now}
+		l.buckets[kind] = b
+	}
+	if refill := int(now.Sub(b.last) / l.interval); refill > 0 {
+		b.tokens += refill
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = b.last.Add(time.Duration(refill) * l.interval)
+	}
+	if b.tokens == 0 {
+		b.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	b.tokens--
+	suppressed := b.suppressed
+	b.suppressed = 0
+	l.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if suppressed != 0 {
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, suppressed)
+	}
+	l.logf("%s", msg)
+}
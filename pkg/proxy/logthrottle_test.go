@@ -0,0 +1,65 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDuplicateAddWarningThrottled(t *testing.T) {
+	var logged []string
+	saved := warnings
+	defer func() { warnings = saved }()
+	warnings = newLogThrottle(logThrottleBurst, logThrottleInterval)
+	warnings.logf = func(format string, args ...interface{}) {
+		logged = append(logged, args[0].(string))
+	}
+	now := time.Now()
+	warnings.now = func() time.Time { return now }
+
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+	}
+	svcPortName := getSvcPortName(svc.Name, svc.Namespace, "http", v1.ProtocolTCP)
+	p.serviceMap[svcPortName] = &serviceInfo{BaseServiceInfo: newBaseServiceInfo(&svc.Spec.Ports[0], svc)}
+	for i := 0; i < 100; i++ {
+		p.addServicePort(svcPortName, &svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+	}
+	if len(logged) != logThrottleBurst {
+		t.Fatalf("expected %d warnings out of 100 duplicate adds, got %d", logThrottleBurst, len(logged))
+	}
+
+	// Once the interval passes, the next warning carries the number of suppressed ones
+	now = now.Add(logThrottleInterval)
+	p.addServicePort(svcPortName, &svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+	if len(logged) != logThrottleBurst+1 {
+		t.Fatalf("expected a warning to be logged after throttle interval, got %d warnings", len(logged))
+	}
+	if !strings.Contains(logged[len(logged)-1], "95 similar messages suppressed") {
+		t.Errorf("expected warning to carry suppressed count, got %q", logged[len(logged)-1])
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// isManagedService returns true if the service is programmed by the proxy.
+func (p *proxy) isManagedService(svc *v1.Service) bool {
+	return p.unmanagedReason(svc) == ""
+}
+
+// unmanagedReason returns why the service is not programmed, or an empty string if it is. A service annotated
+// to be skipped is not managed, otherwise the service's ClusterIP must be within managed ClusterIP CIDRs, all services
+// are managed when no CIDRs are configured. Services without valid ClusterIP are not managed by a sharded proxy.
+func (p *proxy) unmanagedReason(svc *v1.Service) string {
+	if isSkipAnnotated(svc) {
+		return fmt.Sprintf("service is annotated with %s", skipAnnotation)
+	}
+	if len(p.managedCIDRs) == 0 {
+		return ""
+	}
+	ip := net.ParseIP(svc.Spec.ClusterIP)
+	if ip != nil {
+		for _, cidr := range p.managedCIDRs {
+			if cidr.Contains(ip) {
+				return ""
+			}
+		}
+	}
+
+	return fmt.Sprintf("ClusterIP %s is not within managed CIDRs", svc.Spec.ClusterIP)
+}
+
+// processManagedChange programs or removes the service when it becomes managed or stops being managed, either by
+// its ClusterIP moving in or out of managed ClusterIP CIDRs or by the skip annotation being removed or added.
+// true is returned if the service is not managed before or after the update and needs no further processing.
+func (p *proxy) processManagedChange(svcNew, storedSvc *v1.Service) bool {
+	reason, wasManaged := p.unmanagedReason(svcNew), p.isManagedService(storedSvc)
+	managed := reason == ""
+	svcName := nameOf(&svcNew.ObjectMeta)
+	switch {
+	case managed && wasManaged:
+		return false
+	case managed:
+		klog.Infof("service %s became managed, programming the service", svcName.String())
+		p.addServicePorts(svcNew)
+	case wasManaged:
+		klog.Infof("service %s is not managed: %s, removing the service", svcName.String(), reason)
+		p.stopFQDNResolver(svcName, true)
+		for i := range storedSvc.Spec.Ports {
+			servicePort := &storedSvc.Spec.Ports[i]
+			svcPortName := getObjSvcPortName(storedSvc, servicePort.Name, servicePort.Protocol)
+			p.deleteServicePort(svcPortName, servicePort, storedSvc)
+			p.suspendServicePortEndpoints(svcPortName)
+		}
+	default:
+		klog.V(5).Infof("service %s is not managed: %s, skipping the update", svcName.String(), reason)
+	}
+
+	return true
+}
+
+// suspendServicePortEndpoints removes rules and chains of endpoints of a removed Service Port which keeps existing,
+// the endpoints are kept as pending and get programmed again when the Service Port is added.
+func (p *proxy) suspendServicePortEndpoints(svcPortName ServicePortName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ep := range p.endpointsMap[svcPortName] {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok || epInfo.pendingService {
+			continue
+		}
+		p.stopEndpointWarmup(epInfo)
+		for tableFamily, rule := range epInfo.epnft.Rule {
+			if rule.RuleID == nil {
+				continue
+			}
+			if err := p.deleteEndpointRules(svcPortName, tableFamily, rule); err != nil {
+				klog.Errorf("failed to delete rules of endpoint %s of service port name: %s with error: %+v", epInfo.Endpoint, svcPortName.String(), err)
+				continue
+			}
+			rule.RuleID = nil
+		}
+		epInfo.pendingService = true
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestManagedClusterIPs(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.96.0.0/16")
+	_, v6, _ := net.ParseCIDR("fd00:96::/64")
+	p := newTestProxy()
+	WithManagedClusterIPs([]*net.IPNet{v4, v6})(p)
+	newService := func(clusterIP string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: clusterIP},
+			Spec: v1.ServiceSpec{
+				ClusterIP: clusterIP,
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+	}
+	tests := []struct {
+		clusterIP string
+		managed   bool
+	}{
+		{clusterIP: "10.96.1.1", managed: true},
+		{clusterIP: "fd00:96::1", managed: true},
+		{clusterIP: "10.97.1.1", managed: false},
+		{clusterIP: "fd00:97::1", managed: false},
+		{clusterIP: "", managed: false},
+	}
+	for _, tt := range tests {
+		if managed := p.isManagedService(newService(tt.clusterIP)); managed != tt.managed {
+			t.Errorf("expected service with ClusterIP %q to be managed %t, got %t", tt.clusterIP, tt.managed, managed)
+		}
+	}
+	if !newTestProxy().isManagedService(newService("10.97.1.1")) {
+		t.Errorf("expected all services to be managed when no CIDRs are configured")
+	}
+
+	// Service out of range is kept in the cache but not programmed, nor are its endpoints
+	out := newService("10.97.1.1")
+	p.AddService(out)
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Fatalf("expected service out of managed CIDRs not to be programmed")
+	}
+	if _, err := p.cache.getLastKnownSvcFromCache(nameOf(&out.ObjectMeta)); err != nil {
+		t.Fatalf("expected service out of managed CIDRs to be kept in the cache")
+	}
+	if err := p.addEndpoint(svcPortName, &v1.EndpointAddress{IP: "10.1.1.1"}, &v1.EndpointPort{Port: 8080, Protocol: v1.ProtocolTCP}, endpointAttributes{}); err != nil {
+		t.Fatalf("failed to add endpoint with error: %+v", err)
+	}
+	if ep := p.endpointsMap[svcPortName][0].(*endpointsInfo); !ep.pendingService {
+		t.Errorf("expected endpoint of service out of managed CIDRs to be pending")
+	}
+	// Update keeping the service out of range is not processed
+	moved := newService("10.98.1.1")
+	p.UpdateService(out, moved)
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Errorf("expected service moved out of managed CIDRs not to be programmed")
+	}
+	if stored, _ := p.cache.getLastKnownSvcFromCache(nameOf(&moved.ObjectMeta)); stored.Spec.ClusterIP != moved.Spec.ClusterIP {
+		t.Errorf("expected cache to carry updated service, got ClusterIP %s", stored.Spec.ClusterIP)
+	}
+
+	// Service moving out of range gets its endpoints' rules removed and endpoints kept pending
+	deleter := &fakeEndpointRulesDeleter{}
+	p.epRules = deleter
+	ep := newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 1)
+	p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], ep)
+	p.suspendServicePortEndpoints(svcPortName)
+	rule := ep.epnft.Rule[utilnftables.TableFamilyIPv4]
+	if len(deleter.deleted) != 1 || deleter.deleted[0] != rule.Chain {
+		t.Errorf("expected rules of endpoint %s to be deleted, deleted %v", rule.Chain, deleter.deleted)
+	}
+	if !ep.pendingService || rule.RuleID != nil {
+		t.Errorf("expected endpoint to be kept pending without rules, pending %t rules %v", ep.pendingService, rule.RuleID)
+	}
+	if n := len(p.endpointsMap[svcPortName]); n != 2 {
+		t.Errorf("expected endpoints to be kept, got %d endpoints", n)
+	}
+}
+
+func TestSkipAnnotation(t *testing.T) {
+	p := newTestProxy()
+	p.epRules = &fakeEndpointRulesDeleter{}
+	p.resolver = &fakeResolver{}
+	newService := func(skip string) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "app",
+				Namespace:       "default",
+				ResourceVersion: skip,
+				Annotations:     map[string]string{fqdnAnnotation: "backend.example.com"},
+			},
+			Spec: v1.ServiceSpec{ClusterIP: "10.96.1.1"},
+		}
+		if skip != "" {
+			svc.ObjectMeta.Annotations[skipAnnotation] = skip
+		}
+		return svc
+	}
+	for _, skip := range []string{"", "false", "not-a-bool"} {
+		if !p.isManagedService(newService(skip)) {
+			t.Errorf("expected service with skip annotation %q to be managed", skip)
+		}
+	}
+
+	// Annotated service is kept in the cache but not programmed
+	skipped := newService("true")
+	p.AddService(skipped)
+	svcName := objectName{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+	if _, ok := p.fqdnTargets[svcName]; ok {
+		t.Fatalf("expected service annotated with %s not to be programmed", skipAnnotation)
+	}
+	if _, err := p.cache.getLastKnownSvcFromCache(nameOf(&skipped.ObjectMeta)); err != nil {
+		t.Fatalf("expected service annotated with %s to be kept in the cache", skipAnnotation)
+	}
+
+	// Removing the annotation programs the service
+	programmed := newService("")
+	p.UpdateService(skipped, programmed)
+	if _, ok := p.fqdnTargets[svcName]; !ok {
+		t.Fatalf("expected service to be programmed once %s annotation is removed", skipAnnotation)
+	}
+
+	// Adding the annotation to the programmed service tears it down, its endpoints are kept pending
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	ep := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)
+	p.endpointsMap[svcPortName] = []Endpoint{ep}
+	programmed.Spec.Ports = []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}
+	p.cache.storeSvcInCache(programmed)
+	skipped = newService("true")
+	skipped.Spec.Ports = programmed.Spec.Ports
+	p.UpdateService(programmed, skipped)
+	if _, ok := p.fqdnTargets[svcName]; ok {
+		t.Errorf("expected service to be removed once %s annotation is added", skipAnnotation)
+	}
+	if rule := ep.epnft.Rule[utilnftables.TableFamilyIPv4]; !ep.pendingService || rule.RuleID != nil {
+		t.Errorf("expected endpoint to be kept pending without rules, pending %t rules %v", ep.pendingService, rule.RuleID)
+	}
+	if stored, _ := p.cache.getLastKnownSvcFromCache(nameOf(&skipped.ObjectMeta)); !isSkipAnnotated(stored) {
+		t.Errorf("expected cache to carry the annotated service")
+	}
+}
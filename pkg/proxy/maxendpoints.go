@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"k8s.io/klog"
+)
+
+// updateEndpointsOverflow records the number of Service Port's eligible endpoints of a specific ip family left out
+// of the service's load balancing by maxEndpoints, changes are logged. It must be called with p.mu held.
+func (p *proxy) updateEndpointsOverflow(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) {
+	if p.maxEndpoints <= 0 {
+		return
+	}
+	key := serviceChainKey{svcPortName: svcPortName, tableFamily: tableFamily}
+	overflow := len(p.eligibleEndpoints(svcPortName, tableFamily)) - p.maxEndpoints
+	if overflow < 0 {
+		overflow = 0
+	}
+	if overflow == p.endpointsOverflow[key] {
+		return
+	}
+	labels := map[string]string{"service": svcPortName.String(), "family": tableFamilyLabel(tableFamily)}
+	if overflow == 0 {
+		klog.Infof("all endpoints of service %s family %s are within the limit of %d endpoints", svcPortName.String(), labels["family"], p.maxEndpoints)
+		delete(p.endpointsOverflow, key)
+		endpointsOverflow.Delete(labels)
+		return
+	}
+	klog.Warningf("service %s family %s exceeds the limit of %d endpoints, %d endpoints are left out of load balancing",
+		svcPortName.String(), labels["family"], p.maxEndpoints, overflow)
+	if p.endpointsOverflow == nil {
+		p.endpointsOverflow = make(map[serviceChainKey]int)
+	}
+	p.endpointsOverflow[key] = overflow
+	endpointsOverflow.With(labels).Set(float64(overflow))
+}
+
+// clearEndpointsOverflow removes overflow records of a deleted Service Port. It must be called with p.mu held.
+func (p *proxy) clearEndpointsOverflow(svcPortName ServicePortName) {
+	for _, tableFamily := range []utilnftables.TableFamily{utilnftables.TableFamilyIPv4, utilnftables.TableFamilyIPv6} {
+		key := serviceChainKey{svcPortName: svcPortName, tableFamily: tableFamily}
+		if _, ok := p.endpointsOverflow[key]; !ok {
+			continue
+		}
+		delete(p.endpointsOverflow, key)
+		endpointsOverflow.Delete(map[string]string{"service": svcPortName.String(), "family": tableFamilyLabel(tableFamily)})
+	}
+}
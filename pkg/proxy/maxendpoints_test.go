@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestMaxEndpointsPerService(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(endpointsOverflow)
+	p := newTestProxy()
+	p.maxEndpoints = 5
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	for i := 0; i < 10; i++ {
+		p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], newTestEndpoint(svcPortName, fmt.Sprintf("10.1.1.%d", i+1), 8080, false, i))
+	}
+
+	chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)
+	if len(chains) != 5 {
+		t.Fatalf("expected 5 endpoints to be programmed, got %d", len(chains))
+	}
+	// The subset is stable, the first 5 endpoint chains by name are selected
+	for i := 1; i < len(chains); i++ {
+		if chains[i-1].Chain >= chains[i].Chain {
+			t.Errorf("expected endpoint chains sorted by name, got %s before %s", chains[i-1].Chain, chains[i].Chain)
+		}
+	}
+	if again := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); again[4] != chains[4] {
+		t.Errorf("expected the same subset of endpoints to be selected")
+	}
+	p.updateEndpointsOverflow(svcPortName, utilnftables.TableFamilyIPv4)
+	expected := `
+# HELP nfproxy_endpoints_overflow [ALPHA] Number of eligible endpoints left out of the service's load balancing by the limit of endpoints per service, by service port and ip family.
+# TYPE nfproxy_endpoints_overflow gauge
+nfproxy_endpoints_overflow{family="ipv4",service="default/app:http:TCP"} 5
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nfproxy_endpoints_overflow"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overflow is cleared once the Service Port is gone
+	p.clearEndpointsOverflow(svcPortName)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(""), "nfproxy_endpoints_overflow"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsNamespace = "nfproxy"
+
+var (
+	// endpointsMissingNodeName counts endpoints added without NodeName, such endpoints cannot be
+	// classified as local and are never used by services with Local traffic policy.
+	endpointsMissingNodeName = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoints_missing_nodename_total",
+			Help:           "Number of endpoints added without NodeName which cannot be classified as local or remote.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// endpointsProgrammed counts endpoints which rules got programmed by application protocol of their port.
+	endpointsProgrammed = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoints_programmed_total",
+			Help:           "Number of endpoints which rules got programmed, by application protocol of endpoint's port.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"app_protocol"},
+	)
+	// endpointsPendingService counts endpoints added before their Service Port, such endpoints are not
+	// programmed until the Service Port is added.
+	endpointsPendingService = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoints_pending_service_total",
+			Help:           "Number of endpoints added before their Service Port is known.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// endpointChainsCollected counts orphaned endpoint chains removed by garbage collection.
+	endpointChainsCollected = metrics.NewCounter(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoint_chains_collected_total",
+			Help:           "Number of orphaned endpoint chains removed by garbage collection.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// chainNameCollisions counts names of service and endpoint chains generated for one Service Port or endpoint,
+	// which were already allocated for another one.
+	chainNameCollisions = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "chain_name_collisions_total",
+			Help:           "Number of chain name collisions between service ports or endpoints, by kind of chain.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+	// programmingTimeouts counts nftables programming calls abandoned after programming timeout, by operation.
+	programmingTimeouts = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "programming_timeouts_total",
+			Help:           "Number of nftables programming calls abandoned after programming timeout, by operation.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+	// endpointsOverflow reflects numbers of eligible endpoints left out of services' load balancing by the limit
+	// of endpoints per service.
+	endpointsOverflow = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoints_overflow",
+			Help:           "Number of eligible endpoints left out of the service's load balancing by the limit of endpoints per service, by service port and ip family.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service", "family"},
+	)
+	// endpointReadinessTransitions counts changes of endpoints' readiness observed in EndpointSlice updates,
+	// changes are counted when observed, regardless of readiness hold.
+	endpointReadinessTransitions = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Name:           "endpoint_ready_transitions_total",
+			Help:           "Number of endpoints' readiness changes observed in EndpointSlice updates, by direction.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"direction"},
+	)
+	// backlogDepth reflects the number of events waiting to be programmed, in batched programming the number
+	// of objects with coalesced changes.
+	backlogDepth = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "backlog_depth",
+			Help:           "Number of services, endpoints and endpoint slices events waiting to be programmed.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// nftablesChains, nftablesRules and nftablesSets reflect numbers of chains, rules and sets read back from
+	// nfproxy tables in the kernel, by ip family.
+	nftablesChains = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "nftables_chains",
+			Help:           "Number of chains found in nfproxy table in the kernel, by ip family.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"family"},
+	)
+	nftablesRules = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "nftables_rules",
+			Help:           "Number of rules found in nfproxy table in the kernel, by ip family.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"family"},
+	)
+	nftablesSets = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Name:           "nftables_sets",
+			Help:           "Number of sets found in nfproxy table in the kernel, by ip family.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"family"},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// knownAppProtocols lists application protocols used as metric label values as is, appProtocol is set by users
+// and any other value is labeled "other" to keep the label's cardinality bounded.
+var knownAppProtocols = sets.NewString(
+	"http", "https", "http2", "h2c", "grpc", "tcp", "udp", "sctp", "tls", "ws", "wss",
+	"kubernetes.io/h2c", "kubernetes.io/ws", "kubernetes.io/wss",
+)
+
+// RegisterMetrics registers nfproxy metrics with the legacy registry, served on /metrics endpoint.
+func RegisterMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(endpointsMissingNodeName)
+		legacyregistry.MustRegister(endpointsPendingService)
+		legacyregistry.MustRegister(endpointsProgrammed)
+		legacyregistry.MustRegister(endpointChainsCollected)
+		legacyregistry.MustRegister(chainNameCollisions)
+		legacyregistry.MustRegister(programmingTimeouts)
+		legacyregistry.MustRegister(endpointsOverflow)
+		legacyregistry.MustRegister(endpointReadinessTransitions)
+		legacyregistry.MustRegister(backlogDepth)
+		legacyregistry.MustRegister(nftablesChains)
+		legacyregistry.MustRegister(nftablesRules)
+		legacyregistry.MustRegister(nftablesSets)
+	})
+}
+
+// appProtocolLabel returns application protocol label value, endpoints without application protocol are labeled "none"
+// and endpoints with not known application protocol are labeled "other".
+func appProtocolLabel(appProtocol string) string {
+	if appProtocol == "" {
+		return "none"
+	}
+	if !knownAppProtocols.Has(appProtocol) {
+		return "other"
+	}
+
+	return appProtocol
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestEndpointMissingNodeName(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(endpointsMissingNodeName)
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	nodeName := "node1"
+
+	if !p.isLocalEndpoint(svcPortName, &v1.EndpointAddress{IP: "10.1.1.1", NodeName: &nodeName}) {
+		t.Errorf("expected endpoint on node %s to be local", nodeName)
+	}
+	if p.isLocalEndpoint(svcPortName, &v1.EndpointAddress{IP: "10.1.1.2"}) {
+		t.Errorf("expected endpoint without NodeName not to be local")
+	}
+	expected := `
+# HELP nfproxy_endpoints_missing_nodename_total [ALPHA] Number of endpoints added without NodeName which cannot be classified as local or remote.
+# TYPE nfproxy_endpoints_missing_nodename_total counter
+nfproxy_endpoints_missing_nodename_total 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nfproxy_endpoints_missing_nodename_total"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type fakeTableCounter map[utilnftables.TableFamily]nftables.TableCounts
+
+func (c fakeTableCounter) counts(tableFamily utilnftables.TableFamily) (nftables.TableCounts, error) {
+	return c[tableFamily], nil
+}
+
+func TestTableMetrics(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(nftablesChains)
+	registry.MustRegister(nftablesRules)
+	registry.MustRegister(nftablesSets)
+	tables := fakeTableCounter{}
+	tables[utilnftables.TableFamilyIPv4] = nftables.TableCounts{Chains: 12, Rules: 30, Sets: 9}
+	tables[utilnftables.TableFamilyIPv6] = nftables.TableCounts{Chains: 10, Rules: 24, Sets: 7}
+	p := newTestProxy()
+	p.tables = tables
+
+	p.updateTableMetrics()
+	expected := `
+# HELP nfproxy_nftables_chains [ALPHA] Number of chains found in nfproxy table in the kernel, by ip family.
+# TYPE nfproxy_nftables_chains gauge
+nfproxy_nftables_chains{family="ipv4"} 12
+nfproxy_nftables_chains{family="ipv6"} 10
+# HELP nfproxy_nftables_rules [ALPHA] Number of rules found in nfproxy table in the kernel, by ip family.
+# TYPE nfproxy_nftables_rules gauge
+nfproxy_nftables_rules{family="ipv4"} 30
+nfproxy_nftables_rules{family="ipv6"} 24
+# HELP nfproxy_nftables_sets [ALPHA] Number of sets found in nfproxy table in the kernel, by ip family.
+# TYPE nfproxy_nftables_sets gauge
+nfproxy_nftables_sets{family="ipv4"} 9
+nfproxy_nftables_sets{family="ipv6"} 7
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"nfproxy_nftables_chains", "nfproxy_nftables_rules", "nfproxy_nftables_sets"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppProtocolLabel(t *testing.T) {
+	tests := []struct {
+		appProtocol string
+		label       string
+	}{
+		{appProtocol: "", label: "none"},
+		{appProtocol: "http", label: "http"},
+		{appProtocol: "kubernetes.io/h2c", label: "kubernetes.io/h2c"},
+		{appProtocol: "example.com/custom", label: "other"},
+		{appProtocol: "HTTP", label: "other"},
+	}
+	for _, tt := range tests {
+		if label := appProtocolLabel(tt.appProtocol); label != tt.label {
+			t.Errorf("expected label %q for application protocol %q, got %q", tt.label, tt.appProtocol, label)
+		}
+	}
+}
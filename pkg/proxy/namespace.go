@@ -0,0 +1,68 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"k8s.io/klog"
+)
+
+// NamespaceTerminating is called when a namespace enters Terminating phase. Addresses of all services of
+// the namespace are moved into No Endpoints set right away, so new connections are rejected without waiting
+// for services' delete events, which then clean up as usual.
+func (p *proxy) NamespaceTerminating(ns string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.terminatingNamespaces.Has(ns) {
+		return
+	}
+	svcPortNames := p.namespaceServicePorts(ns)
+	if len(svcPortNames) == 0 {
+		// Nothing to reject
+		return
+	}
+	klog.Infof("namespace %s is terminating, rejecting traffic to its %d service ports", ns, len(svcPortNames))
+	p.terminatingNamespaces.Insert(ns)
+	for _, svcPortName := range svcPortNames {
+		for family := range baseServiceInfo(p.serviceMap[svcPortName]).svcnft.Chains {
+			if err := p.updateServiceChain(svcPortName, family); err != nil {
+				klog.Errorf("failed to reject traffic to service port %s of terminating namespace with error: %+v", svcPortName.String(), err)
+			}
+		}
+	}
+}
+
+// namespaceServicePorts returns Service Port Names of all known services of a namespace of the local cluster.
+// It must be called with p.mu held.
+func (p *proxy) namespaceServicePorts(ns string) []ServicePortName {
+	var svcPortNames []ServicePortName
+	for svcPortName := range p.serviceMap {
+		if svcPortName.Cluster == "" && svcPortName.NamespacedName.Namespace == ns {
+			svcPortNames = append(svcPortNames, svcPortName)
+		}
+	}
+
+	return svcPortNames
+}
+
+// releaseTerminatingNamespace forgets a terminating namespace once its last service is deleted. It must be called with p.mu held.
+func (p *proxy) releaseTerminatingNamespace(ns string) {
+	if !p.terminatingNamespaces.Has(ns) || len(p.namespaceServicePorts(ns)) != 0 {
+		return
+	}
+	klog.V(5).Infof("all services of terminating namespace %s are deleted", ns)
+	p.terminatingNamespaces.Delete(ns)
+}
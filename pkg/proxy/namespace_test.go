@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestNamespaceTerminating(t *testing.T) {
+	p := newTestProxy()
+	addService := func(name, namespace, ip string) ServicePortName {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				ClusterIP: "10.96.0.10",
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		svc.Name, svc.Namespace = name, namespace
+		svcPortName := getSvcPortName(name, namespace, "http", v1.ProtocolTCP)
+		p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+		p.endpointsMap[svcPortName] = []Endpoint{newTestEndpoint(svcPortName, ip, 8080, false, 0)}
+		return svcPortName
+	}
+	app := addService("app", "doomed", "10.1.1.1")
+	db := addService("db", "doomed", "10.1.1.2")
+	web := addService("web", "default", "10.1.1.3")
+
+	p.NamespaceTerminating("empty")
+	if p.terminatingNamespaces.Has("empty") {
+		t.Errorf("expected namespace without services not to be tracked")
+	}
+	p.NamespaceTerminating("doomed")
+	for _, svcPortName := range []ServicePortName{app, db} {
+		if eps := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(eps) != 0 {
+			t.Errorf("expected service port %s of terminating namespace to reject, but it has endpoints %v", svcPortName.String(), eps)
+		}
+	}
+	if eps := p.getServicePortEndpointChains(web, utilnftables.TableFamilyIPv4); len(eps) != 1 {
+		t.Errorf("expected service port %s of other namespace to keep its endpoint, got %v", web.String(), eps)
+	}
+
+	// Services' delete events clean up, the namespace is forgotten with its last service
+	for i, svcPortName := range []ServicePortName{app, db} {
+		delete(p.serviceMap, svcPortName)
+		p.releaseTerminatingNamespace(svcPortName.NamespacedName.Namespace)
+		if tracked := p.terminatingNamespaces.Has("doomed"); tracked != (i == 0) {
+			t.Errorf("expected terminating namespace to be tracked: %t after deleting %s", i == 0, svcPortName.String())
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"sort"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// nodePortAddressSetter restricts nodeports of an ip family to node's addresses.
+type nodePortAddressSetter interface {
+	set(tableFamily utilnftables.TableFamily, addrs []string) error
+}
+
+type nftNodePortAddressSetter struct {
+	nfti *nftables.NFTInterface
+}
+
+func (s *nftNodePortAddressSetter) set(tableFamily utilnftables.TableFamily, addrs []string) error {
+	return nftables.SetNodeportAddresses(s.nfti, tableFamily, addrs)
+}
+
+// SetNodeInfo updates the node's hostname and zone used for endpoints' locality decisions. Endpoints are
+// re-classified as local or remote and service chains of all Service Ports are re-programmed, so Local
+// traffic and topology aware load balancing follow the node's new identity.
+func (p *proxy) SetNodeInfo(hostname, zone string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.hostname == hostname && p.zone == zone {
+		return
+	}
+	klog.Infof("node info changed from hostname %s zone %q to hostname %s zone %q, recomputing endpoints' locality", p.hostname, p.zone, hostname, zone)
+	p.hostname = hostname
+	p.zone = zone
+	for svcPortName, eps := range p.endpointsMap {
+		for _, ep := range eps {
+			if epInfo, ok := ep.(*endpointsInfo); ok && !epInfo.resolved {
+				epInfo.IsLocal, _ = p.endpointLocality(svcPortName.Cluster, epInfo.nodeName, epInfo.ip)
+			}
+		}
+	}
+	for svcPortName, svc := range p.serviceMap {
+		for family := range baseServiceInfo(svc).svcnft.Chains {
+			if err := p.updateServiceChain(svcPortName, family); err != nil {
+				klog.Errorf("failed to update service %s chain after node info change with error: %+v", svcPortName.String(), err)
+			}
+		}
+	}
+}
+
+// OnNodeUpdate is called when a Node object is added or updated. If endpoints on cordoned nodes are excluded, the node's
+// endpoints leave or rejoin services' load balancing as the node gets cordoned or uncordoned. For the node nfproxy runs on,
+// if nodeports are restricted to nodeport CIDRs, node's addresses within them are recomputed and nodeports of all services
+// follow the new addresses.
+func (p *proxy) OnNodeUpdate(node *v1.Node) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.excludeCordoned {
+		p.updateNodeCordon(node)
+	}
+	if node.Name != p.hostname || len(p.nodePortCIDRs) == 0 {
+		return
+	}
+	addrs := p.nodePortAddresses(node)
+	for _, tableFamily := range []utilnftables.TableFamily{utilnftables.TableFamilyIPv4, utilnftables.TableFamilyIPv6} {
+		if reflect.DeepEqual(addrs[tableFamily], p.nodePortAddrs[tableFamily]) {
+			continue
+		}
+		klog.Infof("nodeport addresses of family %v changed from %v to %v", tableFamily, p.nodePortAddrs[tableFamily], addrs[tableFamily])
+		if err := p.nodePorts.set(tableFamily, addrs[tableFamily]); err != nil {
+			klog.Errorf("failed to set nodeport addresses of family %v with error: %+v", tableFamily, err)
+			continue
+		}
+		if p.nodePortAddrs == nil {
+			p.nodePortAddrs = make(map[utilnftables.TableFamily][]string)
+		}
+		p.nodePortAddrs[tableFamily] = addrs[tableFamily]
+	}
+}
+
+// nodePortAddresses returns node's addresses within nodeport CIDRs grouped by ip family and sorted.
+func (p *proxy) nodePortAddresses(node *v1.Node) map[utilnftables.TableFamily][]string {
+	addrs := make(map[utilnftables.TableFamily][]string)
+	seen := make(map[string]bool)
+	for _, addr := range node.Status.Addresses {
+		if addr.Type != v1.NodeInternalIP && addr.Type != v1.NodeExternalIP {
+			continue
+		}
+		ip := net.ParseIP(addr.Address)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		for _, cidr := range p.nodePortCIDRs {
+			if cidr.Contains(ip) {
+				_, tableFamily := getIPFamily(ip.String())
+				addrs[tableFamily] = append(addrs[tableFamily], ip.String())
+				seen[ip.String()] = true
+				break
+			}
+		}
+	}
+	for _, list := range addrs {
+		sort.Strings(list)
+	}
+
+	return addrs
+}
+
+// isNodeCordoned returns true if the node is unschedulable or carries a NoExecute taint, new traffic is not sent to
+// endpoints on such node. NoSchedule taints alone do not drain the node's pods and are ignored.
+func isNodeCordoned(node *v1.Node) bool {
+	if node.Spec.Unschedulable {
+		return true
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectNoExecute {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateNodeCordon tracks the node's cordon state, when it changes service chains of Service Ports with endpoints
+// on the node are re-programmed. Endpoints' chains are kept, so connections in flight are not affected.
+// It must be called with p.mu held.
+func (p *proxy) updateNodeCordon(node *v1.Node) {
+	cordoned := isNodeCordoned(node)
+	if cordoned == p.cordonedNodes.Has(node.Name) {
+		return
+	}
+	if cordoned {
+		klog.Infof("node %s is cordoned, its endpoints are removed from services' load balancing", node.Name)
+		if p.cordonedNodes == nil {
+			p.cordonedNodes = sets.NewString()
+		}
+		p.cordonedNodes.Insert(node.Name)
+	} else {
+		klog.Infof("node %s is uncordoned, its endpoints are added back to services' load balancing", node.Name)
+		p.cordonedNodes.Delete(node.Name)
+	}
+	for svcPortName, eps := range p.endpointsMap {
+		onNode := false
+		for _, ep := range eps {
+			if epInfo, ok := ep.(*endpointsInfo); ok && epInfo.nodeName == node.Name {
+				onNode = true
+				break
+			}
+		}
+		svc, ok := p.serviceMap[svcPortName]
+		if !onNode || !ok {
+			continue
+		}
+		for family := range baseServiceInfo(svc).svcnft.Chains {
+			if err := p.updateServiceChain(svcPortName, family); err != nil {
+				klog.Errorf("failed to update service %s chain after node %s cordon change with error: %+v", svcPortName.String(), node.Name, err)
+			}
+		}
+	}
+}
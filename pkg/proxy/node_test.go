@@ -0,0 +1,133 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetNodeInfo(t *testing.T) {
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	onNode1 := newTestEndpoint(svcPortName, "10.1.1.1", 8080, true, 0)
+	onNode1.nodeName = "node1"
+	onNode2 := newTestEndpoint(svcPortName, "10.1.2.1", 8080, false, 1)
+	onNode2.nodeName = "node2"
+	unknown := newTestEndpoint(svcPortName, "10.1.3.1", 8080, false, 2)
+	p.endpointsMap[svcPortName] = []Endpoint{onNode1, onNode2, unknown}
+
+	p.SetNodeInfo("node2", "zone-b")
+	if p.hostname != "node2" || p.zone != "zone-b" {
+		t.Fatalf("expected hostname node2 and zone zone-b, got hostname %s and zone %s", p.hostname, p.zone)
+	}
+	if onNode1.GetIsLocal() || !onNode2.GetIsLocal() || unknown.GetIsLocal() {
+		t.Errorf("expected only endpoint on node2 to be local, got node1: %t node2: %t unknown: %t",
+			onNode1.GetIsLocal(), onNode2.GetIsLocal(), unknown.GetIsLocal())
+	}
+}
+
+// fakeNodePortAddressSetter records nodeport addresses set per ip family.
+type fakeNodePortAddressSetter struct {
+	addrs map[utilnftables.TableFamily][]string
+	calls int
+}
+
+func (s *fakeNodePortAddressSetter) set(tableFamily utilnftables.TableFamily, addrs []string) error {
+	s.addrs[tableFamily] = addrs
+	s.calls++
+	return nil
+}
+
+func TestOnNodeUpdateNodePortAddresses(t *testing.T) {
+	p := newTestProxy()
+	setter := &fakeNodePortAddressSetter{addrs: make(map[utilnftables.TableFamily][]string)}
+	p.nodePorts = setter
+	_, cidr, _ := net.ParseCIDR("192.168.0.0/16")
+	WithNodePortAddresses([]*net.IPNet{cidr})(p)
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: "node1"},
+				{Type: v1.NodeInternalIP, Address: "192.168.1.10"},
+				{Type: v1.NodeInternalIP, Address: "10.0.0.10"},
+			},
+		},
+	}
+	p.OnNodeUpdate(node)
+	if !reflect.DeepEqual(setter.addrs[utilnftables.TableFamilyIPv4], []string{"192.168.1.10"}) {
+		t.Fatalf("expected nodeports restricted to 192.168.1.10, got %v", setter.addrs[utilnftables.TableFamilyIPv4])
+	}
+
+	// A new interface within nodeport CIDRs brings its address to nodeports
+	node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.2.10"})
+	p.OnNodeUpdate(node)
+	if !reflect.DeepEqual(setter.addrs[utilnftables.TableFamilyIPv4], []string{"192.168.1.10", "192.168.2.10"}) {
+		t.Errorf("expected nodeports restricted to 192.168.1.10 and 192.168.2.10, got %v", setter.addrs[utilnftables.TableFamilyIPv4])
+	}
+	// Unchanged addresses are not reprogrammed
+	calls := setter.calls
+	p.OnNodeUpdate(node)
+	if setter.calls != calls {
+		t.Errorf("expected no reprogramming of unchanged nodeport addresses")
+	}
+}
+
+func TestCordonedNodeEndpoints(t *testing.T) {
+	p := newTestProxy()
+	WithCordonedNodeExclusion()(p)
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	local := newTestEndpoint(svcPortName, "10.1.1.1", 8080, true, 0)
+	local.nodeName = "node1"
+	remote := newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 1)
+	remote.nodeName = "node2"
+	p.endpointsMap[svcPortName] = []Endpoint{local, remote}
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	p.OnNodeUpdate(node)
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 2 {
+		t.Fatalf("expected both endpoints in load balancing, got %d", len(chains))
+	}
+	// Cordoned node's endpoint leaves load balancing, its rules are kept
+	node.Spec.Unschedulable = true
+	p.OnNodeUpdate(node)
+	chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4)
+	if len(chains) != 1 || chains[0] != local.epnft.Rule[utilnftables.TableFamilyIPv4] {
+		t.Fatalf("expected only endpoint on schedulable node in load balancing, got %d endpoints", len(chains))
+	}
+	if remote.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID == nil {
+		t.Errorf("expected rules of endpoint on cordoned node to be kept")
+	}
+	// Uncordoned node's endpoint rejoins load balancing
+	node.Spec.Unschedulable = false
+	p.OnNodeUpdate(node)
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 2 {
+		t.Errorf("expected endpoint on uncordoned node back in load balancing, got %d endpoints", len(chains))
+	}
+	// NoExecute taint drains the node as well
+	node.Spec.Taints = []v1.Taint{{Key: "node.kubernetes.io/unreachable", Effect: v1.TaintEffectNoExecute}}
+	p.OnNodeUpdate(node)
+	if chains := p.getServicePortEndpointChains(svcPortName, utilnftables.TableFamilyIPv4); len(chains) != 1 {
+		t.Errorf("expected endpoint on node with NoExecute taint out of load balancing, got %d endpoints", len(chains))
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Option defines a function which customizes proxy instance created by NewProxy
+type Option func(*proxy)
+
+// WithEndpointSliceDebounce enables coalescing of rapid endpoint updates of a Service Port, the service chain
+// gets reprogrammed once per window instead of once per update. 0 window disables debouncing, which is the default.
+func WithEndpointSliceDebounce(window time.Duration) Option {
+	return func(p *proxy) {
+		if window <= 0 {
+			return
+		}
+		p.debouncer = newDebouncer(window, p.applyServiceChainUpdate)
+	}
+}
+
+// WithEndpointChainName sets the prefix and the length of the hash used for endpoint chains' names,
+// by default "k8s-nfproxy-sep-" prefix and 16 characters hash are used. Empty prefix and prefixes overlapping names
+// of base chains or prefixes of service chains are rejected in favor of the default.
+func WithEndpointChainName(prefix string, length int) Option {
+	return func(p *proxy) {
+		p.sepNamer = newEndpointChainNamer(prefix, length)
+	}
+}
+
+// WithChainNamer sets the generator of names of Service Ports' and endpoints' chains, it allows naming chains
+// in a scheme expected by external tooling. Of WithChainNamer and WithEndpointChainName the last one applied is used.
+func WithChainNamer(namer ChainNamer) Option {
+	return func(p *proxy) {
+		p.sepNamer = newCustomEndpointChainNamer(namer)
+	}
+}
+
+// WithLoadBalancerClasses sets load balancer classes managed by the proxy, LoadBalancer part of services
+// with a class not in the list is not programmed. Empty list means all classes are managed.
+func WithLoadBalancerClasses(classes ...string) Option {
+	return func(p *proxy) {
+		p.lbClasses = sets.NewString(classes...)
+	}
+}
+
+// WithPreferLocal makes services prefer node local endpoints, when a service has local endpoints only they are
+// used for load balancing, otherwise all endpoints are used. Unlike Local traffic policy, traffic is never dropped
+// because of missing local endpoints.
+func WithPreferLocal() Option {
+	return func(p *proxy) {
+		p.preferLocal = true
+	}
+}
+
+// WithEndpointSliceFQDNResolution enables resolution of EndpointSlices with FQDN address type, each FQDN is
+// resolved when the slice is added or updated and resolved addresses are programmed as endpoints. By default
+// endpoints of such slices are skipped.
+func WithEndpointSliceFQDNResolution() Option {
+	return func(p *proxy) {
+		p.resolveSliceFQDN = true
+	}
+}
+
+// WithZone sets the zone of the node, it is used by services with PreferClose traffic distribution
+// to prefer endpoints in the same zone. Without zone, such services use all endpoints.
+func WithZone(zone string) Option {
+	return func(p *proxy) {
+		p.zone = zone
+	}
+}
+
+// WithEndpointChainGC enables periodic garbage collection of endpoint chains left in nftables without
+// a corresponding endpoint. 0 interval disables garbage collection, which is the default.
+func WithEndpointChainGC(interval time.Duration) Option {
+	return func(p *proxy) {
+		p.gcInterval = interval
+	}
+}
+
+// WithTableMetrics enables periodic read back of nfproxy tables from the kernel, numbers of chains, rules
+// and sets found are exposed as metrics. 0 interval disables it, which is the default.
+func WithTableMetrics(interval time.Duration) Option {
+	return func(p *proxy) {
+		p.tableMetricsInterval = interval
+	}
+}
+
+// WithMaxEndpointsPerService limits the number of endpoints in a service's load balancing, endpoints over the limit
+// are left out. 0 is no limit.
+func WithMaxEndpointsPerService(max int) Option {
+	return func(p *proxy) {
+		p.maxEndpoints = max
+	}
+}
+
+// WithDetectLocal sets the strategy detecting if endpoints without NodeName run on the local node.
+func WithDetectLocal(detector LocalDetector) Option {
+	return func(p *proxy) {
+		p.localDetector = detector
+	}
+}
+
+// WithRuleVerification enables reading back rules of each programmed Service Port from the kernel, Service Ports
+// with missing rules are rolled back and retried.
+func WithRuleVerification() Option {
+	return func(p *proxy) {
+		p.verifyRules = true
+	}
+}
+
+// WithHooks sets callbacks notifying external controllers about Service Ports and endpoints programmed in nftables.
+func WithHooks(hooks Hooks) Option {
+	return func(p *proxy) {
+		p.hooks = hooks
+	}
+}
+
+// WithNoEndpointsAction sets how traffic to services without endpoints is terminated, by default it is
+// rejected with ICMP unreachable, dropping it instead does not reveal existence of the service and resetting
+// TCP gives clients the fastest failover.
+func WithNoEndpointsAction(action nftables.NoEndpointsAction) Option {
+	return func(p *proxy) {
+		p.noEndpointsAction = action
+	}
+}
+
+// WithMasqueradeSource sets addresses masqueraded traffic is SNATed to instead of the address chosen by the route,
+// which gives multi-homed nodes a deterministic egress address. A source is an address or a range of addresses
+// "first-last", an empty source keeps masquerade of the ip family.
+func WithMasqueradeSource(ipv4Source, ipv6Source string) Option {
+	return func(p *proxy) {
+		p.masqueradeSource = make(map[utilnftables.TableFamily]string)
+		if ipv4Source != "" {
+			p.masqueradeSource[utilnftables.TableFamilyIPv4] = ipv4Source
+		}
+		if ipv6Source != "" {
+			p.masqueradeSource[utilnftables.TableFamilyIPv6] = ipv6Source
+		}
+	}
+}
+
+// WithProgrammingTimeout sets the timeout of nftables calls adding a Service Port's chains, affinity map and set
+// elements, a call which does not complete in time is abandoned, once the abandoned call completes the Service Port
+// is rolled back and queued for retry. Endpoints' rules, service chain updates and updates and deletions of services
+// are programmed without timeout. By default there is no timeout.
+func WithProgrammingTimeout(timeout time.Duration) Option {
+	return func(p *proxy) {
+		p.programTimeout = timeout
+	}
+}
+
+// WithLoadBalancerMark makes traffic to loadbalancer ips skip masquerading and carry the mark instead, so a userspace
+// helper, for example one adding PROXY protocol header, can recognize it and see the original source address.
+// The mark is set on the first packet of a connection and must not carry masquerade mark 0x4000.
+func WithLoadBalancerMark(mark uint32) Option {
+	return func(p *proxy) {
+		p.lbMark = mark
+	}
+}
+
+// WithCordonedNodeExclusion removes endpoints on cordoned nodes, unschedulable or with NoExecute taint, from services'
+// load balancing. Endpoints' rules are kept for connections in flight until the endpoints are removed. Nodes' state is
+// taken from Node objects passed to OnNodeUpdate.
+func WithCordonedNodeExclusion() Option {
+	return func(p *proxy) {
+		p.excludeCordoned = true
+	}
+}
+
+// WithNodePortAddresses restricts nodeports to node's addresses within the CIDRs, by default nodeports are open on
+// all node's addresses. Addresses are taken from the Node object passed to OnNodeUpdate, nodeports of an ip family
+// without any node's address within the CIDRs stay open on all addresses.
+func WithNodePortAddresses(cidrs []*net.IPNet) Option {
+	return func(p *proxy) {
+		p.nodePortCIDRs = cidrs
+	}
+}
+
+// WithManagedClusterIPs restricts services programmed by the proxy to services with ClusterIP within the CIDRs, proxies
+// sharing a node can split services by ClusterIP ranges. By default all services are programmed.
+func WithManagedClusterIPs(cidrs []*net.IPNet) Option {
+	return func(p *proxy) {
+		p.managedCIDRs = cidrs
+	}
+}
+
+// WithZoneWeight sets the share in percent of PreferClose services' load balancing given to endpoints in the node's
+// zone, the rest is given to other endpoints. The default, 100, uses in-zone endpoints exclusively when there are any.
+// Services can override the share with "nfproxy.nordix.org/zone-weight" annotation.
+func WithZoneWeight(weight int) Option {
+	return func(p *proxy) {
+		p.zoneWeight = weight
+	}
+}
+
+// WithReadinessGate sets a custom readiness gate, an endpoint of EndpointSlice is used only when it is Ready
+// and its topology carries the gate key with "true" value. By default only Ready condition is checked.
+func WithReadinessGate(gate string) Option {
+	return func(p *proxy) {
+		p.readinessGate = gate
+	}
+}
+
+// WithEndpointReadinessHold sets for how long an endpoint of EndpointSlice must stay Ready or Not Ready before
+// the change is applied to its service's load balancing, flapping endpoints do not cause rules churn.
+// 0 applies changes right away, which is the default.
+func WithEndpointReadinessHold(hold time.Duration) Option {
+	return func(p *proxy) {
+		if hold <= 0 {
+			return
+		}
+		p.readinessHold = hold
+		p.readinessPending = make(map[string]*readinessChange)
+	}
+}
+
+// WithHealthCheckNodePorts enables serving health check node ports of services with externalTrafficPolicy Local,
+// a service is healthy while it has local endpoints and the node is not draining.
+func WithHealthCheckNodePorts() Option {
+	return func(p *proxy) {
+		p.healthCheckNodePorts = true
+	}
+}
+
+// WithDrainGracePeriod sets for how long after StartDraining external paths of services with externalTrafficPolicy
+// Local are kept, giving external load balancers time to notice failing health checks.
+func WithDrainGracePeriod(period time.Duration) Option {
+	return func(p *proxy) {
+		p.drainGracePeriod = period
+	}
+}
+
+// WithAuditLog enables the audit log of nftables mutations of services' and endpoints' chains, records are
+// written to w as JSON lines.
+func WithAuditLog(w io.Writer) Option {
+	return func(p *proxy) {
+		p.audit = newAuditLog(w)
+	}
+}
+
+// WithUnmatchedLog enables a debug rule at the end of services' chains, it counts and logs with prefix
+// "nfproxy-unmatched" traffic which no endpoint rule matched.
+func WithUnmatchedLog() Option {
+	return func(p *proxy) {
+		p.unmatchedLog = true
+	}
+}
+
+// WithIdentityComments comments endpoints' rules with endpoint's address and Service Port Name instead of
+// the hashed name of service's chain, services' chains are always commented with Service Port Name.
+func WithIdentityComments() Option {
+	return func(p *proxy) {
+		p.identityComments = true
+	}
+}
+
+// WithHeadlessNodePorts programs node ports of headless services which have them, such services are
+// programmed without ClusterIP. By default headless services are skipped.
+func WithHeadlessNodePorts() Option {
+	return func(p *proxy) {
+		p.headlessNodePorts = true
+	}
+}
+
+// WithVIPDefaultDeny rejects traffic to services' ClusterIPs on ports not defined by the services, by default
+// such traffic is not DNATed and continues to wherever the ClusterIP is routed.
+func WithVIPDefaultDeny() Option {
+	return func(p *proxy) {
+		p.vipDefaultDeny = true
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// parallelSyncProxy is a Proxy which holds services events until the initial sync is completed and then
+// programs the services with a bounded pool of workers, each service's chains are independent of other
+// services, so they can be programmed in parallel. All events of a service are applied by a single worker
+// in their order. Once synced, events are passed to the wrapped Proxy as they arrive.
+type parallelSyncProxy struct {
+	Proxy
+	workers  int
+	mu       sync.Mutex // protects the following fields
+	synced   bool
+	services *pendingChanges
+}
+
+var _ Proxy = &parallelSyncProxy{}
+
+// NewParallelSyncProxy returns a Proxy which programs services of the initial sync with up to workers
+// services programmed in parallel, workers of 1 or less programs them serially.
+func NewParallelSyncProxy(p Proxy, workers int) Proxy {
+	if workers < 1 {
+		workers = 1
+	}
+	return &parallelSyncProxy{
+		Proxy:    p,
+		workers:  workers,
+		services: newPendingChanges(),
+	}
+}
+
+func (s *parallelSyncProxy) AddService(svc *v1.Service) {
+	if s.record(svc, nil, svc) {
+		return
+	}
+	s.Proxy.AddService(svc)
+}
+
+func (s *parallelSyncProxy) DeleteService(svc *v1.Service) {
+	if s.record(svc, svc, nil) {
+		return
+	}
+	s.Proxy.DeleteService(svc)
+}
+
+func (s *parallelSyncProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	if s.record(svcNew, svcOld, svcNew) {
+		return
+	}
+	s.Proxy.UpdateService(svcOld, svcNew)
+}
+
+// record stores the change of the service until the initial sync is completed and returns true,
+// once synced it returns false and the change must be passed to the wrapped Proxy.
+func (s *parallelSyncProxy) record(svc *v1.Service, prev, cur interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.synced {
+		return false
+	}
+	s.services.record(nameOf(&svc.ObjectMeta), prev, cur)
+	return true
+}
+
+// SetSynced programs services held during the initial sync and then marks the wrapped Proxy synced.
+// Services events arriving while held services are programmed wait for the programming to complete.
+func (s *parallelSyncProxy) SetSynced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.synced {
+		return
+	}
+	s.program(s.services)
+	s.services = newPendingChanges()
+	s.synced = true
+	s.Proxy.SetSynced()
+}
+
+// program applies pending changes of services with up to s.workers services programmed in parallel.
+func (s *parallelSyncProxy) program(services *pendingChanges) {
+	klog.Infof("programming %d service(s) of initial sync with %d worker(s)", len(services.order), s.workers)
+	changes := make(chan *pendingChange)
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for change := range changes {
+				s.apply(change)
+			}
+		}()
+	}
+	for _, name := range services.order {
+		changes <- services.changes[name]
+	}
+	close(changes)
+	wg.Wait()
+}
+
+func (s *parallelSyncProxy) apply(change *pendingChange) {
+	prev, _ := change.old.(*v1.Service)
+	cur, _ := change.new.(*v1.Service)
+	switch {
+	case prev == nil && cur != nil:
+		s.Proxy.AddService(cur)
+	case prev != nil && cur != nil:
+		s.Proxy.UpdateService(prev, cur)
+	case prev != nil && cur == nil:
+		s.Proxy.DeleteService(prev)
+	}
+}
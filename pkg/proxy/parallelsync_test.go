@@ -0,0 +1,282 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// programmingProxy keeps versions of programmed services, programming of each service takes delay.
+type programmingProxy struct {
+	Proxy
+	delay     time.Duration
+	mu        sync.Mutex
+	services  map[string]string
+	inFlight  map[string]bool
+	active    int
+	maxActive int
+	// overlapped is set when a service is programmed while its previous programming is still in flight
+	overlapped bool
+	synced     bool
+}
+
+func newProgrammingProxy(delay time.Duration) *programmingProxy {
+	return &programmingProxy{
+		delay:    delay,
+		services: make(map[string]string),
+		inFlight: make(map[string]bool),
+	}
+}
+
+func (r *programmingProxy) program(meta metav1.ObjectMeta, deleted bool) {
+	name := meta.Namespace + "/" + meta.Name
+	r.mu.Lock()
+	if r.inFlight[name] {
+		r.overlapped = true
+	}
+	r.inFlight[name] = true
+	r.active++
+	if r.active > r.maxActive {
+		r.maxActive = r.active
+	}
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if deleted {
+		delete(r.services, name)
+	} else {
+		r.services[name] = meta.ResourceVersion
+	}
+	delete(r.inFlight, name)
+	r.active--
+}
+
+func (r *programmingProxy) AddService(svc *v1.Service)    { r.program(svc.ObjectMeta, false) }
+func (r *programmingProxy) DeleteService(svc *v1.Service) { r.program(svc.ObjectMeta, true) }
+func (r *programmingProxy) UpdateService(svcOld, svcNew *v1.Service) {
+	r.program(svcNew.ObjectMeta, false)
+}
+func (r *programmingProxy) SetSynced() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.synced = true
+}
+
+func testSyncService(i int, version string) *v1.Service {
+	return &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("app-%d", i), Namespace: "default", ResourceVersion: version}}
+}
+
+func TestParallelSyncProxy(t *testing.T) {
+	const services = 500
+	r := newProgrammingProxy(time.Millisecond)
+	s := NewParallelSyncProxy(r, 8)
+
+	for i := 0; i < services; i++ {
+		s.AddService(testSyncService(i, "1"))
+	}
+	// Every third service is updated and every fifth deleted before the initial sync is completed
+	for i := 0; i < services; i += 3 {
+		s.UpdateService(testSyncService(i, "1"), testSyncService(i, "2"))
+	}
+	for i := 0; i < services; i += 5 {
+		s.DeleteService(testSyncService(i, "2"))
+	}
+	if len(r.services) != 0 {
+		t.Fatalf("expected services to be held until initial sync, got %d programmed", len(r.services))
+	}
+	// Events arriving while held services are programmed are applied after them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < services; i += 5 {
+			s.UpdateService(testSyncService(i, "2"), testSyncService(i, "3"))
+		}
+	}()
+	s.SetSynced()
+	<-done
+
+	if !r.synced {
+		t.Errorf("expected wrapped proxy to be synced")
+	}
+	if r.overlapped {
+		t.Errorf("expected events of a service to be applied one at a time")
+	}
+	if r.maxActive > 8 {
+		t.Errorf("expected at most 8 services programmed in parallel, got %d", r.maxActive)
+	}
+	for i := 0; i < services; i++ {
+		name := fmt.Sprintf("default/app-%d", i)
+		expected := "1"
+		switch {
+		case i%5 == 0:
+			expected = ""
+		case i%5 == 1:
+			expected = "3"
+		case i%3 == 0:
+			expected = "2"
+		}
+		if version := r.services[name]; version != expected {
+			t.Errorf("expected service %s with version %q, got %q", name, expected, version)
+		}
+	}
+}
+
+// testSyncClusterService returns ClusterIP service app-i with port http, port is changed by updates.
+func testSyncClusterService(i int, version string, port int32) *v1.Service {
+	svc := testSyncService(i, version)
+	svc.Spec = v1.ServiceSpec{
+		Type:      v1.ServiceTypeClusterIP,
+		ClusterIP: fmt.Sprintf("10.96.%d.%d", i/250, i%250+1),
+		Ports:     []v1.ServicePort{{Name: "http", Port: port, Protocol: v1.ProtocolTCP}},
+	}
+
+	return svc
+}
+
+// testSyncEndpoints returns Endpoints of service app-i with a single address.
+func testSyncEndpoints(i int) *v1.Endpoints {
+	node := "node1"
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("app-%d", i), Namespace: "default", ResourceVersion: "1"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), NodeName: &node}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+}
+
+// TestParallelSyncProxyPrograms drives the proxy through the parallel initial sync while endpoints events arrive,
+// it is meant to be run with -race.
+func TestParallelSyncProxyPrograms(t *testing.T) {
+	const services = 60
+	conn := &fake.Conn{}
+	p := newConnProxy(t, conn, false)
+	s := NewParallelSyncProxy(p, 8)
+
+	for i := 0; i < services; i++ {
+		s.AddService(testSyncClusterService(i, "1", 80))
+	}
+	// Every third service changes its port and every fifth is deleted before the initial sync is completed
+	for i := 0; i < services; i += 3 {
+		s.UpdateService(testSyncClusterService(i, "1", 80), testSyncClusterService(i, "2", 8080))
+	}
+	for i := 0; i < services; i += 5 {
+		s.DeleteService(testSyncClusterService(i, "2", 8080))
+	}
+	// Endpoints arrive while held services are programmed by the workers
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < services; i += 4 {
+				s.AddEndpoints(testSyncEndpoints(i))
+				if i%5 == 0 {
+					s.DeleteEndpoints(testSyncEndpoints(i))
+				}
+			}
+		}(w)
+	}
+	s.SetSynced()
+	wg.Wait()
+
+	// Every service which is not deleted ends up with its endpoint programmed
+	if err := wait.PollImmediate(10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		for i := 0; i < services; i++ {
+			if i%5 == 0 {
+				continue
+			}
+			svcPortName := getSvcPortName(fmt.Sprintf("app-%d", i), "default", "http", v1.ProtocolTCP)
+			if _, ok := p.serviceMap[svcPortName]; !ok {
+				return false, nil
+			}
+			if len(p.selectEndpoints(svcPortName, utilnftables.TableFamilyIPv4)) != 1 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		t.Fatalf("expected all services and their endpoints to be programmed")
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.serviceMap) != services-services/5 {
+		t.Errorf("expected %d service ports, got %d", services-services/5, len(p.serviceMap))
+	}
+	svcChains, epChains := sets.NewString(), sets.NewString()
+	for svcPortName, svc := range p.serviceMap {
+		svcChains.Insert(nftables.K8sSvcPrefix + baseServiceInfo(svc).svcnft.ServiceID)
+		for _, ep := range p.endpointsMap[svcPortName] {
+			epChains.Insert(ep.(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain)
+		}
+	}
+	for svcPortName, eps := range p.endpointsMap {
+		if _, ok := p.serviceMap[svcPortName]; !ok {
+			t.Errorf("expected no endpoints of deleted service port %s, got %d", svcPortName.String(), len(eps))
+		}
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	programmed := sets.NewString()
+	for _, ch := range conn.Chains {
+		programmed.Insert(ch.Name)
+	}
+	if missing := svcChains.Difference(programmed); missing.Len() != 0 {
+		t.Errorf("expected service chains %v to be programmed", missing.List())
+	}
+	if missing := epChains.Difference(programmed); missing.Len() != 0 {
+		t.Errorf("expected endpoint chains %v to be programmed", missing.List())
+	}
+	for _, name := range programmed.List() {
+		if strings.HasPrefix(name, nftables.K8sSvcPrefix) && !svcChains.Has(name) {
+			t.Errorf("expected chain %s of deleted service not to be left", name)
+		}
+		if strings.HasPrefix(name, defaultEndpointChainPrefix) && !epChains.Has(name) {
+			t.Errorf("expected chain %s of deleted endpoint not to be left", name)
+		}
+	}
+}
+
+func benchmarkInitialSync(b *testing.B, workers int) {
+	for n := 0; n < b.N; n++ {
+		r := newProgrammingProxy(100 * time.Microsecond)
+		s := NewParallelSyncProxy(r, workers)
+		for i := 0; i < 500; i++ {
+			s.AddService(testSyncService(i, "1"))
+		}
+		s.SetSynced()
+	}
+}
+
+func BenchmarkInitialSyncSerial(b *testing.B)   { benchmarkInitialSync(b, 1) }
+func BenchmarkInitialSyncParallel(b *testing.B) { benchmarkInitialSync(b, 16) }
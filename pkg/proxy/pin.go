@@ -0,0 +1,100 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	utilnftables "github.com/google/nftables"
+	"k8s.io/klog"
+)
+
+// PinService routes all traffic of a Service Port to a single endpoint, for example for canary testing.
+// The pin is kept across endpoints updates until UnpinService is called or the Service Port is deleted.
+// While the pinned endpoint is not among Service Port's eligible endpoints, the Service Port is load balanced
+// across all its endpoints.
+func (p *proxy) PinService(svcPortName ServicePortName, endpointIP string) error {
+	ip := net.ParseIP(endpointIP)
+	if ip == nil {
+		return fmt.Errorf("invalid endpoint address %q", endpointIP)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.serviceMap[svcPortName]; !ok {
+		return fmt.Errorf("service port %s is not found", svcPortName.String())
+	}
+	_, tableFamily := getIPFamily(ip.String())
+	prior, pinned := p.pins[svcPortName]
+	if p.pins == nil {
+		p.pins = make(map[ServicePortName]string)
+	}
+	p.pins[svcPortName] = ip.String()
+	klog.Infof("service %s is pinned to endpoint %s", svcPortName.String(), ip.String())
+	if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
+		return err
+	}
+	// Service Port pinned before to an endpoint of the other ip family gets that family's load balancing restored
+	if _, priorFamily := getIPFamily(prior); pinned && priorFamily != tableFamily {
+		return p.updateServiceChain(svcPortName, priorFamily)
+	}
+
+	return nil
+}
+
+// UnpinService restores load balancing of a Service Port pinned by PinService across all its endpoints.
+func (p *proxy) UnpinService(svcPortName ServicePortName) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prior, ok := p.pins[svcPortName]
+	if !ok {
+		return nil
+	}
+
+	return p.unpinServicePort(svcPortName, prior)
+}
+
+// unpinServicePort removes the pin of a Service Port and reprograms its service chain of the pinned
+// endpoint's ip family. It must be called with p.mu held.
+func (p *proxy) unpinServicePort(svcPortName ServicePortName, endpointIP string) error {
+	delete(p.pins, svcPortName)
+	klog.Infof("service %s is no longer pinned to endpoint %s", svcPortName.String(), endpointIP)
+	_, tableFamily := getIPFamily(endpointIP)
+
+	return p.updateServiceChain(svcPortName, tableFamily)
+}
+
+// pinnedEndpoints returns only the pinned endpoint when the Service Port is pinned to one of eps,
+// otherwise eps are returned. It must be called with p.mu held.
+func (p *proxy) pinnedEndpoints(svcPortName ServicePortName, tableFamily utilnftables.TableFamily, eps []*endpointsInfo) []*endpointsInfo {
+	pin, ok := p.pins[svcPortName]
+	if !ok {
+		return eps
+	}
+	if _, family := getIPFamily(pin); family != tableFamily {
+		return eps
+	}
+	pinIP := net.ParseIP(pin)
+	for _, ep := range eps {
+		if pinIP.Equal(net.ParseIP(ep.IP())) {
+			return []*endpointsInfo{ep}
+		}
+	}
+	klog.V(5).Infof("endpoint %s of pinned service %s is not eligible, service is load balanced across all endpoints", pin, svcPortName.String())
+
+	return eps
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPinService(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if err := p.PinService(svcPortName, "10.1.1.2"); err == nil {
+		t.Fatalf("expected pinning of unknown service port to fail")
+	}
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+	endpoints := func() []Endpoint {
+		return []Endpoint{
+			newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0),
+			newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 1),
+			newTestEndpoint(svcPortName, "10.1.1.3", 8080, false, 2),
+		}
+	}
+	lbChains := func() []string {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		var chains []string
+		for _, rule := range p.getServicePortLoadBalancingChains(svcPortName, utilnftables.TableFamilyIPv4) {
+			chains = append(chains, rule.Chain)
+		}
+		return chains
+	}
+	eps := endpoints()
+	p.endpointsMap[svcPortName] = eps
+	pinnedChain := eps[1].(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+
+	if err := p.PinService(svcPortName, "not-an-ip"); err == nil {
+		t.Fatalf("expected pinning to invalid address to fail")
+	}
+	if err := p.PinService(svcPortName, "10.1.1.2"); err != nil {
+		t.Fatalf("failed to pin service with error: %+v", err)
+	}
+	if chains := lbChains(); len(chains) != 1 || chains[0] != pinnedChain {
+		t.Fatalf("expected only pinned endpoint chain %s in load balancing, got %v", pinnedChain, chains)
+	}
+	// Pin survives endpoints resync
+	p.endpointsMap[svcPortName] = endpoints()
+	if chains := lbChains(); len(chains) != 1 || chains[0] != pinnedChain {
+		t.Fatalf("expected only pinned endpoint chain %s in load balancing after resync, got %v", pinnedChain, chains)
+	}
+	// Service Port is load balanced to all endpoints while pinned endpoint is gone
+	p.endpointsMap[svcPortName] = []Endpoint{eps[0], eps[2]}
+	if chains := lbChains(); len(chains) != 2 {
+		t.Fatalf("expected all endpoints in load balancing while pinned endpoint is gone, got %v", chains)
+	}
+	p.endpointsMap[svcPortName] = eps
+	if err := p.UnpinService(svcPortName); err != nil {
+		t.Fatalf("failed to unpin service with error: %+v", err)
+	}
+	if chains := lbChains(); len(chains) != 3 {
+		t.Fatalf("expected all endpoints in load balancing after unpin, got %v", chains)
+	}
+}
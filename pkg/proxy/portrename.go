@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+// migrateServicePortEndpoints moves endpoints of a Service Port renamed in place, keeping its port number and
+// protocol, to the new Service Port Name. Endpoints become pending under the new name, so they are programmed
+// together with the new Service Port instead of waiting for Endpoints or EndpointSlice update, which would leave
+// the renamed Service Port without endpoints meanwhile. The old Service Port must already be deleted, so its
+// service chain does not reference endpoints' old chains which are deleted.
+func (p *proxy) migrateServicePortEndpoints(oldSvcPortName, newSvcPortName ServicePortName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	eps, ok := p.endpointsMap[oldSvcPortName]
+	if !ok {
+		return
+	}
+	delete(p.endpointsMap, oldSvcPortName)
+	klog.V(5).Infof("migrating %d endpoint(s) of renamed service port %s to %s", len(eps), oldSvcPortName.String(), newSvcPortName.String())
+	for _, ep := range eps {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok {
+			continue
+		}
+		p.stopEndpointWarmup(epInfo)
+		for tableFamily, rule := range epInfo.epnft.Rule {
+			p.deleteMigratedEndpointChain(oldSvcPortName, tableFamily, epInfo, *rule)
+		}
+		if p.findEndpoint(newSvcPortName, epInfo.Endpoint) != nil {
+			// Endpoint is already known under the new name, for example EndpointSlice was updated first
+			continue
+		}
+		rules := make(map[utilnftables.TableFamily]*nftables.EPRule, len(epInfo.epnft.Rule))
+		for tableFamily := range epInfo.epnft.Rule {
+			rules[tableFamily] = &nftables.EPRule{
+				Rule: nftables.Rule{
+					Chain: p.sepNamer.allocate(newSvcPortName.String(), string(epInfo.protocol), epInfo.Endpoint),
+				},
+				EpIndex: len(p.endpointsMap[newSvcPortName]),
+			}
+		}
+		epInfo.epnft = &nftables.EPnft{
+			Interface: epInfo.epnft.Interface,
+			Rule:      rules,
+		}
+		epInfo.pendingService = true
+		p.endpointsMap[newSvcPortName] = append(p.endpointsMap[newSvcPortName], epInfo)
+	}
+}
+
+// deleteMigratedEndpointChain deletes endpoint's chain of the old Service Port Name, the chain of an endpoint which
+// rules are still being programmed is cleaned up by addEndpoint. It must be called with p.mu held.
+func (p *proxy) deleteMigratedEndpointChain(svcPortName ServicePortName, tableFamily utilnftables.TableFamily, epInfo *endpointsInfo, rule nftables.EPRule) {
+	if rule.RuleID == nil {
+		if epInfo.pendingService {
+			p.sepNamer.release(rule.Chain, svcPortName.String(), string(epInfo.protocol), epInfo.Endpoint)
+		}
+		return
+	}
+	// Affinity map of the old Service Port is deleted with the Service Port, there are no entries to purge
+	rule.WithAffinity = false
+	if err := p.deleteEndpointRules(svcPortName, tableFamily, &rule); err != nil {
+		klog.Errorf("failed to delete chain %s of migrated endpoint %s with error: %+v", rule.Chain, epInfo.Endpoint, err)
+		p.queueEndpointDeletion(&endpointDeletion{svcPortName: svcPortName, tableFamily: tableFamily, ep: epInfo, rule: rule, serviceUpdated: true})
+		return
+	}
+	p.sepNamer.release(rule.Chain, svcPortName.String(), string(epInfo.protocol), epInfo.Endpoint)
+}
+
+// renamedSlicePort returns Service Port Name an endpoint's port of EndpointSlice was renamed to, the port is
+// correlated with new endpoints' ports by address, port number and protocol.
+func renamedSlicePort(e epInfo, info []epInfo) (ServicePortName, bool) {
+	for _, n := range info {
+		if n.name.serviceName() == e.name.serviceName() && n.name.Port != e.name.Port && n.addr.IP == e.addr.IP &&
+			n.port.Port == e.port.Port && n.port.Protocol == e.port.Protocol {
+			return n.name, true
+		}
+	}
+
+	return ServicePortName{}, false
+}
+
+// awaitsServicePortRename returns true if endpoints of a port renamed in EndpointSlice must be kept under the old
+// Service Port Name, the old Service Port is still programmed and the new one is not, the service update renaming
+// the port migrates the endpoints.
+func (p *proxy) awaitsServicePortRename(oldSvcPortName, newSvcPortName ServicePortName) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, oldProgrammed := p.serviceMap[oldSvcPortName]
+	_, newProgrammed := p.serviceMap[newSvcPortName]
+
+	return oldProgrammed && !newProgrammed
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newPortRenameTestProxy returns proxy with programmed "http" Service Port of a multi port service and its two
+// endpoints recorded in the EndpointSlice.
+func newPortRenameTestProxy() (*proxy, *discovery.EndpointSlice, *fakeEndpointRulesDeleter) {
+	p := newTestProxy()
+	p.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
+	deleter := &fakeEndpointRulesDeleter{}
+	p.epRules = deleter
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+				{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}
+	p.cache.storeSvcInCache(svc)
+	httpPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "svcid")
+	p.serviceMap[httpPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	p.endpointsMap[httpPortName] = []Endpoint{
+		newTestEndpoint(httpPortName, "10.1.1.1", 8080, false, 0),
+		newTestEndpoint(httpPortName, "10.1.1.2", 8080, false, 1),
+	}
+	ready := true
+	name, port, proto := "http", int32(8080), v1.ProtocolTCP
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-abcde",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{Addresses: []string{"10.1.1.1", "10.1.1.2"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+		},
+		Ports: []discovery.EndpointPort{{Name: &name, Port: &port, Protocol: &proto}},
+	}
+	p.cache.storeEpSlInCache(epsl)
+
+	return p, epsl, deleter
+}
+
+// renamedSlice returns a copy of EndpointSlice with its port renamed, keeping port number and protocol.
+func renamedSlice(epsl *discovery.EndpointSlice, name string) *discovery.EndpointSlice {
+	renamed := epsl.DeepCopy()
+	renamed.ResourceVersion = "2"
+	renamed.Ports[0].Name = &name
+
+	return renamed
+}
+
+func TestPortRenameSliceFirst(t *testing.T) {
+	p, epsl, deleter := newPortRenameTestProxy()
+	httpPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	webPortName := getSvcPortName("app", "default", "web", v1.ProtocolTCP)
+
+	// EndpointSlice renames the port before the service, the programmed Service Port keeps its endpoints
+	p.UpdateEndpointSlice(epsl, renamedSlice(epsl, "web"))
+	if n := len(p.endpointsMap[httpPortName]); n != 2 {
+		t.Fatalf("expected service port %s to keep 2 endpoints until the service is renamed, got %d", httpPortName.String(), n)
+	}
+	if len(deleter.deleted) != 0 {
+		t.Fatalf("expected no endpoint chains to be deleted, got %v", deleter.deleted)
+	}
+	for _, ep := range p.endpointsMap[webPortName] {
+		if !ep.(*endpointsInfo).pendingService {
+			t.Fatalf("expected endpoint %s of not yet programmed %s to be pending", ep.String(), webPortName.String())
+		}
+	}
+	if n := len(p.endpointsMap[webPortName]); n != 2 {
+		t.Fatalf("expected 2 pending endpoints of %s, got %d", webPortName.String(), n)
+	}
+
+	// Service renames the port, the old Service Port is deleted and its endpoints are migrated
+	oldChains := []string{
+		p.endpointsMap[httpPortName][0].(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain,
+		p.endpointsMap[httpPortName][1].(*endpointsInfo).epnft.Rule[utilnftables.TableFamilyIPv4].Chain,
+	}
+	delete(p.serviceMap, httpPortName)
+	p.migrateServicePortEndpoints(httpPortName, webPortName)
+	if _, ok := p.endpointsMap[httpPortName]; ok {
+		t.Errorf("expected endpoints of %s to be migrated", httpPortName.String())
+	}
+	if n := len(p.endpointsMap[webPortName]); n != 2 {
+		t.Errorf("expected endpoints known under both names not to be duplicated, got %d endpoints", n)
+	}
+	if len(deleter.deleted) != 2 || deleter.deleted[0] != oldChains[0] || deleter.deleted[1] != oldChains[1] {
+		t.Errorf("expected chains %v of the old service port to be deleted, got %v", oldChains, deleter.deleted)
+	}
+}
+
+func TestPortRenameServiceFirst(t *testing.T) {
+	p, epsl, deleter := newPortRenameTestProxy()
+	httpPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	webPortName := getSvcPortName("app", "default", "web", v1.ProtocolTCP)
+
+	// Service renames the port, endpoints are pending under the new name, so they are programmed together with
+	// the new Service Port instead of waiting for the EndpointSlice update
+	delete(p.serviceMap, httpPortName)
+	p.migrateServicePortEndpoints(httpPortName, webPortName)
+	migrated := p.endpointsMap[webPortName]
+	if len(migrated) != 2 {
+		t.Fatalf("expected 2 endpoints migrated to %s, got %d", webPortName.String(), len(migrated))
+	}
+	for i, ep := range migrated {
+		epInfo := ep.(*endpointsInfo)
+		rule := epInfo.epnft.Rule[utilnftables.TableFamilyIPv4]
+		if !epInfo.pendingService || rule.RuleID != nil || rule.EpIndex != i {
+			t.Errorf("expected migrated endpoint %s to be pending with index %d, got pending %t index %d", ep.String(), i, epInfo.pendingService, rule.EpIndex)
+		}
+		if rule.Chain != p.sepNamer.name(webPortName.String(), string(v1.ProtocolTCP), epInfo.Endpoint) {
+			t.Errorf("expected migrated endpoint %s to get chain of %s, got %s", ep.String(), webPortName.String(), rule.Chain)
+		}
+	}
+	if len(deleter.deleted) != 2 {
+		t.Errorf("expected chains of the old service port to be deleted, got %v", deleter.deleted)
+	}
+
+	// EndpointSlice follows, nothing changes for the migrated endpoints
+	p.UpdateEndpointSlice(epsl, renamedSlice(epsl, "web"))
+	if eps := p.endpointsMap[webPortName]; len(eps) != 2 || eps[0] != migrated[0] || eps[1] != migrated[1] {
+		t.Errorf("expected EndpointSlice update to keep migrated endpoints, got %v", eps)
+	}
+	if _, ok := p.endpointsMap[httpPortName]; ok {
+		t.Errorf("expected no endpoints of %s after EndpointSlice update", httpPortName.String())
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+// errProgrammingTimeout is returned by nftables programming calls abandoned after programming timeout.
+var errProgrammingTimeout = errors.New("programming timeout expired")
+
+// abandonedCall is returned by nftables programming calls abandoned after programming timeout, the call keeps
+// running in the background and might still succeed.
+type abandonedCall struct {
+	operation string
+	// done is closed once the call completes, err is the call's result.
+	done chan struct{}
+	err  error
+}
+
+func (c *abandonedCall) Error() string {
+	return fmt.Sprintf("%s: %s", c.operation, errProgrammingTimeout)
+}
+
+func (c *abandonedCall) Unwrap() error {
+	return errProgrammingTimeout
+}
+
+// wait blocks until the abandoned call completes and returns its result.
+func (c *abandonedCall) wait() error {
+	<-c.done
+	return c.err
+}
+
+// programNFT runs nftables programming call, if the call does not complete within programming timeout, it is
+// abandoned and *abandonedCall is returned, so a slow kernel does not stall processing of other events.
+// Abandoned call keeps running in the background, its result is logged and kept in *abandonedCall.
+// Without timeout the call is run directly.
+func (p *proxy) programNFT(operation string, call func() error) error {
+	if p.programTimeout == 0 {
+		return call()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.programTimeout)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- call()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		programmingTimeouts.WithLabelValues(operation).Inc()
+		klog.Errorf("%s did not complete within %s, abandoning it", operation, p.programTimeout)
+		abandoned := &abandonedCall{operation: operation, done: make(chan struct{})}
+		go func() {
+			abandoned.err = <-result
+			if abandoned.err != nil {
+				klog.Errorf("abandoned %s failed with error: %+v", operation, abandoned.err)
+			}
+			close(abandoned.done)
+		}()
+		return abandoned
+	}
+}
+
+// isProgrammingTimeout returns true if the error, or any of aggregated errors, is caused by programming timeout.
+func isProgrammingTimeout(err error) bool {
+	if _, ok := err.(*abandonedStepsError); ok {
+		return true
+	}
+	if agg, ok := err.(utilerrors.Aggregate); ok {
+		for _, e := range agg.Errors() {
+			if isProgrammingTimeout(e) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return errors.Is(err, errProgrammingTimeout)
+}
+
+// retryOnProgrammingTimeout queues Service Port for retry if its programming failed because of programming timeout,
+// the retry programs it from the last known state of its service.
+func (p *proxy) retryOnProgrammingTimeout(svcPortName ServicePortName, err error) {
+	if !isProgrammingTimeout(err) {
+		return
+	}
+	klog.Warningf("programming of service port %s timed out, queueing it for retry", svcPortName.String())
+	p.retries.AddRateLimited(svcPortName)
+}
+
+// rollbackAbandoned rolls back steps of a Service Port once the abandoned call of its programming completes, own
+// steps applied before the abandoned ones are rolled back after them and cleanup is called last. Until then the
+// Service Port is kept in flight, so it is neither added again nor programmed by a retry while the abandoned call
+// runs, then it is queued for retry. Rollback is done with p.mu released, only locked steps and cleanup hold it.
+// p.mu must be held by the caller.
+func (p *proxy) rollbackAbandoned(svcPortName ServicePortName, abandoned *abandonedStepsError, ownSteps []programStep, cleanup func()) {
+	p.servicePortsInFlight[svcPortName] = true
+	go func() {
+		abandoned.wait()
+		rollbackStepsLocking(append(append([]programStep(nil), ownSteps...), abandoned.steps()...), &p.mu)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		cleanup()
+		p.doneServicePortInFlight(svcPortName)
+		p.retryOnProgrammingTimeout(svcPortName, abandoned)
+	}()
+}
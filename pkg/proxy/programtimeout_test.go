@@ -0,0 +1,193 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestProgrammingTimeout(t *testing.T) {
+	registry := metrics.NewKubeRegistry()
+	registry.MustRegister(programmingTimeouts)
+	defer programmingTimeouts.Reset()
+	p := newTestProxy()
+	p.programTimeout = 50 * time.Millisecond
+	p.retries = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer p.retries.ShutDown()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+
+	// Slow nftables call is abandoned once the timeout expires
+	release := make(chan struct{})
+	var rolledBack []string
+	steps := []programStep{
+		{
+			name: "adding service chains",
+			apply: func() error {
+				return p.programNFT("adding service chains", func() error { return nil })
+			},
+			rollback: func() error {
+				rolledBack = append(rolledBack, "service chains")
+				return nil
+			},
+		},
+		{
+			name: "adding to set cluster-ip",
+			apply: func() error {
+				return p.programNFT("adding to set cluster-ip", func() error {
+					<-release
+					return nil
+				})
+			},
+			rollback: func() error {
+				rolledBack = append(rolledBack, "cluster-ip")
+				return nil
+			},
+		},
+	}
+	start := time.Now()
+	err := applySteps(steps)
+	if err == nil || !isProgrammingTimeout(err) {
+		t.Fatalf("expected programming timeout error, got: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected slow call to be abandoned after the timeout, it blocked for %s", elapsed)
+	}
+	abandoned, ok := err.(*abandonedStepsError)
+	if !ok {
+		t.Fatalf("expected abandoned steps error, got: %+v", err)
+	}
+	if len(rolledBack) != 0 {
+		t.Errorf("expected no rollback while abandoned call runs, got %v", rolledBack)
+	}
+	// Abandoned call completes successfully, its step is rolled back together with applied steps
+	close(release)
+	abandoned.wait()
+	abandoned.rollback()
+	if want := []string{"cluster-ip", "service chains"}; !reflect.DeepEqual(rolledBack, want) {
+		t.Errorf("expected steps %v to be rolled back, got %v", want, rolledBack)
+	}
+	expected := `
+# HELP nfproxy_programming_timeouts_total [ALPHA] Number of nftables programming calls abandoned after programming timeout, by operation.
+# TYPE nfproxy_programming_timeouts_total counter
+nfproxy_programming_timeouts_total{operation="adding to set cluster-ip"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "nfproxy_programming_timeouts_total"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Service Port which programming timed out is queued for retry, other failures are not
+	p.retryOnProgrammingTimeout(svcPortName, fmt.Errorf("adding to set cluster-ip failed"))
+	if p.retries.Len() != 0 {
+		t.Fatalf("expected no retry for failure other than timeout")
+	}
+	p.retryOnProgrammingTimeout(svcPortName, err)
+	item, _ := p.retries.Get()
+	if item != svcPortName {
+		t.Errorf("expected service port %s to be queued for retry, got %+v", svcPortName.String(), item)
+	}
+	p.retries.Done(item)
+}
+
+// blockingSetElementProgrammer blocks adding to cluster ip set until released.
+type blockingSetElementProgrammer struct {
+	fakeSetElementProgrammer
+	release chan struct{}
+}
+
+func (b *blockingSetElementProgrammer) add(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error {
+	if set == nftables.K8sClusterIPSet {
+		<-b.release
+	}
+	return b.fakeSetElementProgrammer.add(tableFamily, proto, addr, port, set, chain)
+}
+
+func TestAbandonedServicePortRollback(t *testing.T) {
+	p, conn := newFakeNFTProxy(t, false)
+	p.programTimeout = 50 * time.Millisecond
+	defer programmingTimeouts.Reset()
+	elements := &blockingSetElementProgrammer{
+		fakeSetElementProgrammer: fakeSetElementProgrammer{added: sets.NewString(), removed: sets.NewString()},
+		release:                  make(chan struct{}),
+	}
+	p.setElements = elements
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	chains := func() int {
+		conn.Lock()
+		defer conn.Unlock()
+		n := 0
+		for _, ch := range conn.Chains {
+			if strings.HasPrefix(ch.Name, nftables.K8sSvcPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	if err := p.addServicePort(svcPortName, &svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc)); !isProgrammingTimeout(err) {
+		t.Fatalf("expected programming timeout error, got: %+v", err)
+	}
+	// While the abandoned call runs, the Service Port is neither rolled back nor added again nor retried
+	if chains() == 0 {
+		t.Errorf("expected service chains to be kept while abandoned call runs")
+	}
+	if err := p.addServicePort(svcPortName, &svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc)); err != nil {
+		t.Errorf("expected in flight service port not to be added again, got error: %+v", err)
+	}
+	if p.retries.Len() != 0 {
+		t.Errorf("expected no retry while abandoned call runs")
+	}
+
+	// Abandoned call completes, the element it added and service chains are removed, then the Service Port is
+	// no longer in flight and is retried
+	close(elements.release)
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return !p.servicePortsInFlight[svcPortName], nil
+	}); err != nil {
+		t.Fatalf("expected service port to be rolled back once abandoned call completes")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !elements.removed.Has(nftables.K8sClusterIPSet + " 10.96.0.10") {
+		t.Errorf("expected cluster ip added by abandoned call to be removed, removed: %v", elements.removed.List())
+	}
+	if n := chains(); n != 0 {
+		t.Errorf("expected service chains to be rolled back, %d left", n)
+	}
+}
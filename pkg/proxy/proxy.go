@@ -17,14 +17,20 @@ limitations under the License.
 package proxy
 
 import (
+	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	utilnftables "github.com/google/nftables"
 	"github.com/sbezverk/nfproxy/pkg/nftables"
 	v1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
@@ -39,41 +45,225 @@ type Proxy interface {
 	AddEndpointSlice(epsl *discovery.EndpointSlice)
 	DeleteEndpointSlice(epsl *discovery.EndpointSlice)
 	UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice)
+	Endpoints(svcPortName ServicePortName) []EndpointSnapshot
+	Service(svcPortName ServicePortName) (ServiceSnapshot, bool)
+	Chains(svcPortName ServicePortName) map[utilnftables.TableFamily][]string
+	EffectiveEndpoints(svcPortName ServicePortName, path TrafficPath) []string
+	PinService(svcPortName ServicePortName, endpointIP string) error
+	UnpinService(svcPortName ServicePortName) error
+	StartDraining() <-chan struct{}
+	IsRejecting(ip string, port uint16, proto v1.Protocol) bool
+	SetSynced()
+	NamespaceTerminating(ns string)
+	SetNodeInfo(hostname, zone string)
+	OnNodeUpdate(node *v1.Node)
+	Counters(svcPortName ServicePortName) (ServicePortCounters, error)
+	ProgramService(spec ServiceSpec) error
+	RenderRuleset() (string, error)
+	ServiceHealth(svcPortName ServicePortName) (ServiceHealthStatus, bool)
+	SetStandby(standby bool)
 }
 
 type proxy struct {
 	hostname     string
 	nfti         *nftables.NFTInterface
-	mu           sync.Mutex // protects the following fields
+	recorder     record.EventRecorder
+	mu           sync.RWMutex // protects the following fields, read only accessors take read lock
 	serviceMap   ServiceMap
 	endpointsMap EndpointsMap
 	cache        cache
+	fqdnTargets  map[objectName]*fqdnTarget
+	resolver     resolver
+	debouncer    *debouncer
+	sepNamer     *endpointChainNamer
+	lbClasses    sets.String
+	// servicePortsInFlight tracks Service Ports which own chains are being programmed with mu released,
+	// inFlightDone is broadcast whenever a Service Port stops being in flight, its lock is mu
+	servicePortsInFlight map[ServicePortName]bool
+	inFlightDone         *sync.Cond
+	// pins maps Service Ports pinned by PinService to the address of the only endpoint they are load balanced to
+	pins map[ServicePortName]string
+	// failedServicePorts maps Service Ports which programming failed and was rolled back to the error
+	failedServicePorts map[ServicePortName]error
+	// preferLocal makes services use only node local endpoints when there are any and remote ones otherwise
+	preferLocal bool
+	// maxEndpoints limits the number of endpoints in a service's load balancing, 0 is no limit
+	maxEndpoints int
+	// endpointsOverflow tracks numbers of eligible endpoints left out of services' load balancing by maxEndpoints
+	endpointsOverflow map[serviceChainKey]int
+	// localDetector detects locality of endpoints without NodeName, when nil such endpoints are not local
+	localDetector LocalDetector
+	// readinessGate is an optional gate endpoints of EndpointSlices must satisfy in addition to Ready condition
+	readinessGate string
+	// readinessHold is for how long an endpoint of EndpointSlice must keep a changed readiness before the change
+	// is applied, readinessPending tracks changes waiting for the hold period by endpoints' keys
+	readinessHold    time.Duration
+	readinessPending map[string]*readinessChange
+	// resolveSliceFQDN enables resolution of FQDN addresses of EndpointSlices
+	resolveSliceFQDN bool
+	// zone is the zone of the node, services with PreferClose traffic distribution prefer endpoints in this zone
+	zone string
+	// zoneWeight is the share in percent of PreferClose services' load balancing given to endpoints in the zone
+	zoneWeight int
+	// terminatingNamespaces tracks namespaces being deleted, their services reject traffic until deleted
+	terminatingNamespaces sets.String
+	// excludeCordoned keeps endpoints on cordonedNodes out of services' load balancing
+	excludeCordoned bool
+	cordonedNodes   sets.String
+	// chains gives access to chains programmed in nftables, used by endpoint chains garbage collection
+	chains     chainStore
+	gcInterval time.Duration
+	// tables reads back nfproxy tables from the kernel for metrics, updated every tableMetricsInterval
+	tables               tableCounter
+	tableMetricsInterval time.Duration
+	// counters reads back traffic counters of service and endpoint chains
+	counters counterReader
+	// verifyRules enables reading back rules of programmed Service Ports, verifier reads them back and
+	// Service Ports failing verification are rolled back and queued in retries
+	verifyRules bool
+	verifier    ruleVerifier
+	retries     workqueue.RateLimitingInterface
+	// programTimeout abandons nftables programming calls of Service Ports which take longer, such Service Ports
+	// are queued in retries, 0 is no timeout
+	programTimeout time.Duration
+	// epRules deletes endpoints' rules, endpointDeletions tracks endpoint deletions which failed part way
+	// and are queued in retries
+	epRules           endpointRulesDeleter
+	endpointDeletions map[string]*endpointDeletion
+	// hooks are callbacks of external controllers, notifier invokes them when any is set
+	hooks    Hooks
+	notifier *hookNotifier
+	// noEndpointsAction defines how traffic to services without endpoints is terminated
+	noEndpointsAction nftables.NoEndpointsAction
+	// nodePortCIDRs restrict nodeports to node's addresses within them, nodePortAddrs are the addresses nodeports
+	// are currently restricted to and nodePorts programs them
+	nodePortCIDRs []*net.IPNet
+	nodePortAddrs map[utilnftables.TableFamily][]string
+	nodePorts     nodePortAddressSetter
+	// nodePortRules adds and removes nodeports of Service Ports which NodePort changes
+	nodePortRules nodePortProgrammer
+	// lbMark, when set, replaces masquerading of loadbalancer traffic with the mark, traffic keeps its source address
+	lbMark uint32
+	// masqueradeSource is per ip family address or range of addresses masqueraded traffic is SNATed to
+	masqueradeSource map[utilnftables.TableFamily]string
+	// healthCheckNodePorts enables serving health check node ports of services with externalTrafficPolicy Local,
+	// healthChecks are servers of the ports by port and listen opens their listeners
+	healthCheckNodePorts bool
+	healthChecks         map[int]*healthCheckServer
+	listen               func(port int) (net.Listener, error)
+	// draining is set to 1 by StartDraining, accessed atomically, external paths of services with
+	// externalTrafficPolicy Local are removed after drainGracePeriod and externalPathsDrained is set
+	draining             int32
+	drainGracePeriod     time.Duration
+	externalPathsDrained bool
+	drained              chan struct{}
+	// audit records nftables mutations of services' and endpoints' chains, nil when disabled
+	audit *auditLog
+	// unmatchedLog appends to service chains a rule logging traffic no endpoint rule matched
+	unmatchedLog bool
+	// identityComments comments endpoints' rules with endpoint's address and Service Port Name
+	identityComments bool
+	// headlessNodePorts programs node ports of headless services, their ClusterIP is skipped
+	headlessNodePorts bool
+	// vipDefaultDeny rejects traffic to ClusterIPs on ports not defined by their services
+	vipDefaultDeny bool
+	// managedCIDRs restrict services managed by the proxy to services with ClusterIP within them, empty manages all
+	managedCIDRs []*net.IPNet
+	// setElements adds and removes Service Ports' elements to and from sets
+	setElements setElementProgrammer
+	// synced is set to 1 once informers' initial sync is completed, accessed atomically
+	synced int32
+	// standby is set to 1 while the instance is not the leader, accessed atomically, background programming is paused
+	standby int32
 }
 
 // NewProxy return a new instance of nfproxy
-func NewProxy(nfti *nftables.NFTInterface, hostname string, recorder record.EventRecorder, endpointSlice bool) Proxy {
+func NewProxy(nfti *nftables.NFTInterface, hostname string, recorder record.EventRecorder, endpointSlice bool, opts ...Option) Proxy {
 	proxy := &proxy{
 		hostname:     hostname,
 		nfti:         nfti,
+		recorder:     recorder,
 		serviceMap:   make(ServiceMap),
 		endpointsMap: make(EndpointsMap),
 		cache: cache{
-			svcCache: make(map[types.NamespacedName]*v1.Service),
+			svcCache: make(map[objectName]*v1.Service),
 		},
+		fqdnTargets:           make(map[objectName]*fqdnTarget),
+		resolver:              net.DefaultResolver,
+		sepNamer:              newEndpointChainNamer(defaultEndpointChainPrefix, defaultEndpointChainLength),
+		servicePortsInFlight:  make(map[ServicePortName]bool),
+		terminatingNamespaces: sets.NewString(),
 	}
+	proxy.inFlightDone = sync.NewCond(&proxy.mu)
 	if endpointSlice {
-		proxy.cache.epslCache = make(map[types.NamespacedName]*discovery.EndpointSlice)
+		proxy.cache.epslCache = make(map[objectName]*discovery.EndpointSlice)
 	} else {
-		proxy.cache.epCache = make(map[types.NamespacedName]*v1.Endpoints)
+		proxy.cache.epCache = make(map[objectName]*v1.Endpoints)
+	}
+	proxy.chains = &nftChainStore{nfti: nfti}
+	proxy.tables = &nftTableCounter{nfti: nfti}
+	proxy.counters = &nftCounterReader{nfti: nfti}
+	proxy.epRules = &nftEndpointRulesDeleter{nfti: nfti}
+	proxy.nodePorts = &nftNodePortAddressSetter{nfti: nfti}
+	proxy.nodePortRules = &nftNodePortProgrammer{nfti: nfti}
+	proxy.setElements = &nftSetElementProgrammer{nfti: nfti}
+	proxy.listen = listenHealthCheck
+	proxy.drained = make(chan struct{})
+	proxy.retries = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "nfproxy-retries")
+	for _, opt := range opts {
+		opt(proxy)
+	}
+	if proxy.noEndpointsAction != "" && proxy.noEndpointsAction != nftables.NoEndpointsReject {
+		if err := nftables.SetNoEndpointsAction(nfti, proxy.noEndpointsAction); err != nil {
+			klog.Errorf("failed to set action %s for services without endpoints, traffic is rejected, error: %+v", proxy.noEndpointsAction, err)
+		}
+	}
+	if proxy.lbMark != 0 {
+		if err := nftables.SetLoadBalancerMark(nfti, proxy.lbMark); err != nil {
+			klog.Errorf("failed to set loadbalancer mark 0x%x, loadbalancer traffic is marked with 0x%x, error: %+v", proxy.lbMark, nftables.DefaultLoadBalancerMark, err)
+		}
+	}
+	for tableFamily, source := range proxy.masqueradeSource {
+		if err := nftables.SetMasqueradeSource(nfti, tableFamily, source); err != nil {
+			klog.Errorf("failed to set source %s of masqueraded traffic, traffic is masqueraded, error: %+v", source, err)
+		}
+	}
+	if proxy.verifyRules {
+		proxy.verifier = &nftRuleVerifier{nfti: nfti}
+	}
+	if proxy.hooks.OnServiceProgrammed != nil || proxy.hooks.OnServiceUnprogrammed != nil || proxy.hooks.OnEndpointProgrammed != nil {
+		proxy.notifier = newHookNotifier(proxy.hooks)
+	}
+	go wait.Until(proxy.runRetryWorker, time.Second, wait.NeverStop)
+	if proxy.gcInterval > 0 {
+		go wait.Forever(proxy.collectEndpointChains, proxy.gcInterval)
+	}
+	if proxy.tableMetricsInterval > 0 {
+		go wait.Forever(proxy.updateTableMetrics, proxy.tableMetricsInterval)
 	}
 
 	return proxy
 }
 
+// SetSynced is called once controllers completed initial sync of services and endpoints
+func (p *proxy) SetSynced() {
+	atomic.StoreInt32(&p.synced, 1)
+	klog.Info("nfproxy completed initial sync")
+}
+
+func (p *proxy) isSynced() bool {
+	return atomic.LoadInt32(&p.synced) == 1
+}
+
 // addAffinityEndpoint is called when Service Update handler detects change in Service's Session Affinity, specifically
 // Session Affinity gets added to the service. This function will insert Update rule to every endpoint associated with a Service Port.
 func (p *proxy) addAffinityEndpoint(eps []Endpoint, tableFamily utilnftables.TableFamily, svcID string, maxAgeSeconds int) error {
 	for _, ep := range eps {
+		if rule, ok := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily]; !ok || rule.RuleID == nil {
+			// Endpoint of a different ip family or the endpoint's rules are still being programmed,
+			// in the latter case addEndpoint reconciles Session Affinity once programming is completed.
+			continue
+		}
 		chain := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily].Chain
 		index := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily].EpIndex
 		ruleID, err := nftables.AddEndpointUpdateRule(p.nfti, tableFamily, chain, index, svcID, maxAgeSeconds)
@@ -93,6 +283,11 @@ func (p *proxy) addAffinityEndpoint(eps []Endpoint, tableFamily utilnftables.Tab
 // this function will remove Update rule from all endpoints associated with a Service Port.
 func (p *proxy) deleteAffinityEndpoint(eps []Endpoint, tableFamily utilnftables.TableFamily) error {
 	for _, ep := range eps {
+		if rule, ok := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily]; !ok || rule.RuleID == nil {
+			// Endpoint of a different ip family or the endpoint's rules are still being programmed,
+			// in the latter case addEndpoint reconciles Session Affinity once programming is completed.
+			continue
+		}
 		chain := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily].Chain
 		// If Session Affinity is enabled Update rule always has index 0 in am endpoint's chain rules slice
 		ruleID := ep.(*endpointsInfo).BaseEndpointInfo.epnft.Rule[tableFamily].RuleID[0]
@@ -110,48 +305,155 @@ func (p *proxy) deleteAffinityEndpoint(eps []Endpoint, tableFamily utilnftables.
 }
 
 // getServicePortEndpointChains return a slice of strings containing a specific ServicePortName all endpoints chains
+// eligible for the service's load balancing.
 func (p *proxy) getServicePortEndpointChains(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) []*nftables.EPRule {
-	servicePortEndpoints := []*nftables.EPRule{}
+	eps := p.selectEndpoints(svcPortName, tableFamily)
+	servicePortEndpoints := make([]*nftables.EPRule, 0, len(eps))
+	for _, ep := range eps {
+		servicePortEndpoints = append(servicePortEndpoints, ep.epnft.Rule[tableFamily])
+	}
+
+	return servicePortEndpoints
+}
+
+// selectEndpoints returns Service Port's endpoints of a specific ip family which are eligible for the service's
+// load balancing, limited to maxEndpoints when it is set.
+func (p *proxy) selectEndpoints(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) []*endpointsInfo {
+	eps := p.eligibleEndpoints(svcPortName, tableFamily)
+	if p.maxEndpoints > 0 && len(eps) > p.maxEndpoints {
+		// Endpoints are sorted by chain name, the same subset is selected for the same set of endpoints
+		eps = eps[:p.maxEndpoints]
+	}
+
+	return eps
+}
+
+// eligibleEndpoints returns all Service Port's endpoints of a specific ip family which are eligible for the service's
+// load balancing, sorted by endpoint chain name.
+func (p *proxy) eligibleEndpoints(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) []*endpointsInfo {
+	eps := []*endpointsInfo{}
+	if svcPortName.Cluster == "" && p.terminatingNamespaces.Has(svcPortName.NamespacedName.Namespace) {
+		// Services of a terminating namespace reject traffic until they are deleted
+		return eps
+	}
 	for _, ep := range p.endpointsMap[svcPortName] {
 		epBase, ok := ep.(*endpointsInfo)
 		if !ok {
 			// Not recognize, skipping it
 			continue
 		}
-		servicePortEndpoints = append(servicePortEndpoints, epBase.epnft.Rule[tableFamily])
+		rule, ok := epBase.epnft.Rule[tableFamily]
+		if !ok {
+			// Endpoint of a different ip family
+			continue
+		}
+		if rule.RuleID == nil {
+			// Endpoint's rules are not programmed yet
+			continue
+		}
+		if epBase.warmup != nil {
+			// Endpoint is still warming up, it will be added to the service's load balancing once warmup expires
+			continue
+		}
+		if p.cordonedNodes.Has(epBase.nodeName) {
+			// Node of the endpoint is cordoned, new traffic is not sent to it
+			continue
+		}
+		eps = append(eps, epBase)
+	}
+	// Endpoints map carries endpoints of all EndpointSlices of the service, their order depends on add/delete
+	// history and on slices' arrival order, sorting by chain name makes the same set of endpoints always produce
+	// the same service rules.
+	sort.Slice(eps, func(i, j int) bool {
+		return eps[i].epnft.Rule[tableFamily].Chain < eps[j].epnft.Rule[tableFamily].Chain
+	})
+	// Pinned Service Port is load balanced only to the pinned endpoint, regardless of other endpoints' preference
+	eps = p.pinnedEndpoints(svcPortName, tableFamily, eps)
+	svc, ok := p.serviceMap[svcPortName]
+	// Services with weighted zone split keep all endpoints, the split is applied to load balancing slots
+	if ok && baseServiceInfo(svc).preferClose && p.zone != "" && p.serviceZoneWeight(svc) == 0 {
+		eps = preferZoneEndpoints(eps, p.zone)
+	}
+	if p.preferLocal || ok && baseServiceInfo(svc).preferNodeLocal {
+		eps = preferLocalEndpoints(eps)
 	}
 
-	return servicePortEndpoints
+	return eps
 }
 
-func (p *proxy) addEndpointRules(epRule *nftables.EPRule, tableFamily utilnftables.TableFamily, cn string, svcPortName ServicePortName, key *epKey) error {
+// preferZoneEndpoints returns only endpoints in the zone if there are any, otherwise all endpoints are returned.
+func preferZoneEndpoints(eps []*endpointsInfo, zone string) []*endpointsInfo {
+	sameZone := make([]*endpointsInfo, 0, len(eps))
+	for _, ep := range eps {
+		if endpointZone(ep) == zone {
+			sameZone = append(sameZone, ep)
+		}
+	}
+	if len(sameZone) == 0 {
+		return eps
+	}
+
+	return sameZone
+}
+
+// endpointZone returns the zone from endpoint's topology, empty string if the zone is not known.
+func endpointZone(ep *endpointsInfo) string {
+	if zone, ok := ep.GetTopology()[v1.LabelZoneFailureDomainStable]; ok {
+		return zone
+	}
+
+	return ep.GetTopology()[v1.LabelZoneFailureDomain]
+}
+
+// preferLocalEndpoints returns only node local endpoints if there are any, otherwise all endpoints are returned,
+// so the service falls back to remote endpoints instead of dropping traffic.
+func preferLocalEndpoints(eps []*endpointsInfo) []*endpointsInfo {
+	local := make([]*endpointsInfo, 0, len(eps))
+	for _, ep := range eps {
+		if ep.GetIsLocal() {
+			local = append(local, ep)
+		}
+	}
+	if len(local) == 0 {
+		return eps
+	}
+
+	return local
+}
+
+// addEndpointRules programs endpoint's chain and rules and returns rule ids, it does not access proxy's maps
+// and does not require p.mu to be held.
+func (p *proxy) addEndpointRules(epRule *nftables.EPRule, tableFamily utilnftables.TableFamily, cn string, svcPortName ServicePortName, key *epKey,
+	appProtocol string) ([]uint64, error) {
 	var ruleIDs []uint64
-	var err error
 
 	// If Corresponding Service Port has Affinity configured, then endpoint must have Update rule which will refresh Service Port
 	// affinity map for an endpoint specific source address and index.
 	if epRule.WithAffinity {
-		ruleIDs, err = nftables.AddEndpointUpdateRule(p.nfti, tableFamily, cn, epRule.EpIndex, epRule.ServiceID, epRule.MaxAgeSeconds)
+		updateIDs, err := nftables.AddEndpointUpdateRule(p.nfti, tableFamily, cn, epRule.EpIndex, epRule.ServiceID, epRule.MaxAgeSeconds)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		epRule.RuleID = ruleIDs
+		ruleIDs = updateIDs
 	}
-	ruleIDs, err = nftables.AddEndpointRules(p.nfti, tableFamily, cn, key.ipaddr, key.proto, key.port, epRule.ServiceID)
-	if err != nil {
-		return err
+	var identity string
+	if p.identityComments {
+		identity = svcPortName.String()
 	}
-	if epRule.RuleID == nil {
-		epRule.RuleID = ruleIDs
-	} else {
-		epRule.RuleID = append(epRule.RuleID, ruleIDs...)
+	ids, err := nftables.AddEndpointRules(p.nfti, tableFamily, cn, key.ipaddr, key.proto, key.port, epRule.ServiceID, identity, appProtocol)
+	if err != nil {
+		return nil, err
 	}
+	endpointsProgrammed.WithLabelValues(appProtocolLabel(appProtocol)).Inc()
+	ruleIDs = append(ruleIDs, ids...)
+	p.audit.record(auditAddEndpoint, svcPortName, tableFamily, cn, ruleIDs, nil)
 
-	return nil
+	return ruleIDs, nil
 }
 
 // updateServiceChain programs rules for a specific ServicePortName, it is called for every endpoint add/delete
-// event.
+// event. Only the service chain of tableFamily, the family of the changed endpoint, is rebuilt, chains of the other
+// family are not touched.
 func (p *proxy) updateServiceChain(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) error {
 	klog.V(6).Infof("updating service chain for service %s address family %v", svcPortName.String(), tableFamily)
 	svc, ok := p.serviceMap[svcPortName]
@@ -159,47 +461,87 @@ func (p *proxy) updateServiceChain(svcPortName ServicePortName, tableFamily util
 		return nil
 	}
 	entry := svc.(*serviceInfo)
-	if len(p.endpointsMap[svcPortName]) == 0 {
-		if entry.svcnft.WithEndpoints {
-			if err := p.addToNoEndpointsList(svc, tableFamily); err != nil {
-				klog.Errorf("failed to add %s to No Endpoints Set with error: %+v", svcPortName.String(), err)
-			}
-		}
-		entry.svcnft.WithEndpoints = false
-	} else {
-		if !entry.svcnft.WithEndpoints {
-			// ServicePort did not have any endpoints until now, removing from no endpoint set
-			if err := p.removeFromNoEndpointsList(entry, tableFamily); err != nil {
-				klog.Errorf("failed to remove %s from \"No Endpoints Set\" with error: %+v", svcPortName.String(), err)
-			}
-		}
-		entry.svcnft.WithEndpoints = true
+	p.updateEndpointsOverflow(svcPortName, tableFamily)
+	// Endpoints eligible for the service's load balancing
+	epsChains := p.getServicePortEndpointChains(svcPortName, tableFamily)
+	// No Endpoints set membership is managed per ip family, only addresses of tableFamily are affected.
+	p.updateNoEndpointsList(svc, svcPortName, tableFamily, len(epsChains) != 0)
+	if _, family := getIPFamily(entry.ClusterIP().String()); family == tableFamily {
+		entry.svcnft.WithEndpoints = len(epsChains) != 0
+	}
+	svcChains, ok := entry.svcnft.Chains[tableFamily]
+	if !ok {
+		// In dual-stack clusters endpoints of both families are received, the Service Port's chains exist only
+		// in the table of its family, endpoints of the other family have nothing to load balance.
+		klog.V(5).Infof("service %s has no chains in address family %v, skipping service chain update", svcPortName.String(), tableFamily)
+		return nil
 	}
 	// Programming rules for existing endpoints
-	epsChains := p.getServicePortEndpointChains(svcPortName, tableFamily)
-	svcRules := entry.svcnft.Chains[tableFamily].Chain[nftables.K8sSvcPrefix+entry.svcnft.ServiceID]
+	svcRules := svcChains.Chain[nftables.K8sSvcPrefix+entry.svcnft.ServiceID]
 	if svcRules == nil {
 		klog.Errorf("updating service chain for service %s address family %v failed as Rules array is nil, it is a bug, please file an issue.", svcPortName.String(), tableFamily)
 		return nil
 	}
 	// Check if the service still has any backends
 	if len(epsChains) != 0 {
-		rules, err := nftables.ProgramServiceEndpoints(p.nfti, tableFamily, entry.svcnft.ServiceID, epsChains, svcRules.RuleID, entry.svcnft.WithAffinity, svcPortName.String())
+		lbChains := p.getServicePortLoadBalancingChains(svcPortName, tableFamily)
+		rules, err := nftables.ProgramServiceEndpoints(p.nfti, tableFamily, entry.svcnft.ServiceID, lbChains, svcRules.RuleID, entry.svcnft.WithAffinity, svcPortName.String(), p.unmatchedLog)
 		if err != nil {
 			klog.Errorf("failed to program endpoints rules for service %s with error: %+v", svcPortName.String(), err)
+			entry.lastError = err
 			return err
 		}
+		p.audit.record(auditUpdateService, svcPortName, tableFamily, svcRules.Chain, rules, svcRules.RuleID)
 		// Storing Service's rule id so it can be used later for modification or deletion.
 		// cn carries service's name of chain, a connecion point with endpoints backending the service.
 		svcRules.RuleID = rules
+		entry.lastProgrammed = time.Now()
+		entry.lastError = nil
 	} else {
 		// Service has no endpoints left needs to remove the rule if any
 		if err := nftables.DeleteServiceRules(p.nfti, tableFamily, nftables.K8sSvcPrefix+entry.svcnft.ServiceID, svcRules.RuleID); err != nil {
 			klog.Errorf("failed to remove rule for service %s with error: %+v", svcPortName.String(), err)
+			entry.lastError = err
 			return err
 		}
+		if len(svcRules.RuleID) != 0 {
+			p.audit.record(auditUpdateService, svcPortName, tableFamily, svcRules.Chain, nil, svcRules.RuleID)
+		}
 		svcRules.RuleID = svcRules.RuleID[:0]
+		entry.lastProgrammed = time.Now()
+		entry.lastError = nil
 	}
 
 	return nil
 }
+
+// startEndpointWarmup keeps an endpoint out of the service's load balancing for the warmup period, once the period
+// expires the service chain is reprogrammed to include the endpoint. It must be called with p.mu held.
+func (p *proxy) startEndpointWarmup(svcPortName ServicePortName, ep *endpointsInfo, tableFamily utilnftables.TableFamily, warmup time.Duration) {
+	klog.V(5).Infof("endpoint %s of service port %s is warming up for %v", ep.String(), svcPortName.String(), warmup)
+	ep.warmup = time.AfterFunc(warmup, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if ep.warmup == nil {
+			// Endpoint was deleted while warming up, nothing to do
+			return
+		}
+		ep.warmup = nil
+		if p.isStandby() {
+			return
+		}
+		klog.V(5).Infof("endpoint %s of service port %s completed warmup", ep.String(), svcPortName.String())
+		if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
+			klog.Errorf("failed to update service %s chain after endpoint %s warmup with error: %+v", svcPortName.String(), ep.String(), err)
+		}
+	})
+}
+
+// stopEndpointWarmup cancels endpoint's warmup if it is still in progress. It must be called with p.mu held.
+func (p *proxy) stopEndpointWarmup(ep *endpointsInfo) {
+	if ep.warmup == nil {
+		return
+	}
+	ep.warmup.Stop()
+	ep.warmup = nil
+}
@@ -18,11 +18,14 @@ package proxy
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 
 	utilnftables "github.com/google/nftables"
 	"github.com/sbezverk/nfproxy/pkg/nftables"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
 )
 
@@ -42,27 +45,44 @@ func (p *proxy) AddEndpoints(ep *v1.Endpoints) {
 		klog.Errorf("failed to add Endpoint %s/%s with error: %+v", ep.Namespace, ep.Name, err)
 		return
 	}
-	for _, e := range info {
+	p.matchSingleServicePort(info)
+	for _, e := range p.selectSubsetsAddresses(info) {
 		klog.V(5).Infof("adding Endpoint %s/%s Service Port Name: %+v", ep.Namespace, ep.Name, e.name)
-		if err := p.addEndpoint(e.name, e.addr, e.port); err != nil {
+		if err := p.addEndpoint(e.name, e.addr, e.port, endpointAttributes{}); err != nil {
 			klog.Errorf("failed to add Endpoint %s/%s port %+v with error: %+v", ep.Namespace, ep.Name, e.port, err)
 			return
 		}
 	}
 }
 
-func (p *proxy) addEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddress, port *v1.EndpointPort) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	isLocal := addr.NodeName != nil && *addr.NodeName == p.hostname
+// addEndpoint adds an endpoint to a Service Port. The endpoint is added to the endpoints map and its chain name
+// gets allocated under the lock, the endpoint's own chain and rules are programmed without holding the lock,
+// then the service chain is updated under the lock. Until its rules are programmed, the endpoint's RuleID is nil
+// and the endpoint is not eligible for the service's load balancing. attrs carries optional endpoint's attributes.
+func (p *proxy) addEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddress, port *v1.EndpointPort, attrs endpointAttributes) error {
 	ipFamily, ipTableFamily := getIPFamily(addr.IP)
-	baseEndpointInfo := newBaseEndpointInfo(ipFamily, port.Protocol, addr.IP, int(port.Port), isLocal, nil)
+	p.mu.Lock()
+	isLocal := false
+	if !attrs.resolved {
+		isLocal = p.isLocalEndpoint(svcPortName, addr)
+	}
+	baseEndpointInfo := newBaseEndpointInfo(ipFamily, port.Protocol, addr.IP, int(port.Port), isLocal, attrs.topology)
+	if p.findEndpoint(svcPortName, baseEndpointInfo.Endpoint) != nil {
+		// Informer's resync delivers already processed objects again, the endpoint is already programmed
+		// or being programmed.
+		p.mu.Unlock()
+		klog.V(5).Infof("endpoint %s of Service Port Name %s already exists, skipping", baseEndpointInfo.Endpoint, svcPortName.String())
+		return nil
+	}
+	baseEndpointInfo.appProtocol = attrs.appProtocol
+	baseEndpointInfo.nodeName = nodeNameOf(addr)
+	baseEndpointInfo.resolved = attrs.resolved
 	// Adding to endpoint base information, structures to carry nftables related info
 	baseEndpointInfo.epnft = &nftables.EPnft{
 		Interface: p.nfti,
 		Rule:      make(map[utilnftables.TableFamily]*nftables.EPRule),
 	}
-	cn := servicePortEndpointChainName(svcPortName.String(), string(port.Protocol), baseEndpointInfo.Endpoint)
+	cn := p.sepNamer.allocate(svcPortName.String(), string(port.Protocol), baseEndpointInfo.Endpoint)
 	// Initializing ip table family depending on endpoint's family ipv4 or ipv6
 	epRule := nftables.EPRule{
 		EpIndex: len(p.endpointsMap[svcPortName]),
@@ -73,24 +93,348 @@ func (p *proxy) addEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddres
 	epRule.RuleID = nil
 	// Check if corresponding ServicePort has Service Affinity set and copy parameters to endpoint rule struct
 	epRule.WithAffinity = false
-	if svc, ok := p.serviceMap[svcPortName]; ok {
-		epRule.WithAffinity = svc.(*serviceInfo).svcnft.WithAffinity
-		epRule.MaxAgeSeconds = svc.(*serviceInfo).svcnft.MaxAgeSeconds
-		epRule.ServiceID = svc.(*serviceInfo).svcnft.ServiceID
+	var warmup time.Duration
+	// dport is the port endpoint's DNAT rewrites destination port to, 0 keeps the original service port.
+	dport := port.Port
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		// Service Port is not known yet, the endpoint is recorded as pending and its rules get programmed
+		// when the Service Port is added.
+		baseEndpointInfo.pendingService = true
+		baseEndpointInfo.epnft.Rule[ipTableFamily] = &epRule
+		p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], newEndpointInfo(baseEndpointInfo, port.Protocol))
+		p.mu.Unlock()
+		endpointsPendingService.Inc()
+		klog.V(5).Infof("Service Port Name %s is not known, endpoint %s is pending until the service is added", svcPortName.String(), baseEndpointInfo.Endpoint)
+		return nil
+	}
+	epRule.WithAffinity = svc.(*serviceInfo).svcnft.WithAffinity
+	epRule.MaxAgeSeconds = svc.(*serviceInfo).svcnft.MaxAgeSeconds
+	epRule.ServiceID = svc.(*serviceInfo).svcnft.ServiceID
+	warmup = svc.(*serviceInfo).endpointWarmup
+	if attrs.move {
+		// Endpoint replaces the same backend at a new address, it is not warmed up
+		warmup = 0
+	}
+	if !p.isSynced() {
+		// Endpoints of the initial sync are already serving, only endpoints becoming ready later are warmed up
+		warmup = 0
+	}
+	if svc.(*serviceInfo).preserveDstPort {
+		dport = 0
 	}
 	baseEndpointInfo.epnft.Rule[ipTableFamily] = &epRule
-	if err := p.addEndpointRules(&epRule, ipTableFamily, cn, svcPortName, &epKey{port.Protocol, addr.IP, port.Port}); err != nil {
+	ep := newEndpointInfo(baseEndpointInfo, port.Protocol)
+	p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], ep)
+	// Endpoint's rules are programmed from a copy, the endpoint is visible to other goroutines from now on.
+	rule := epRule
+	p.mu.Unlock()
+
+	ruleIDs, err := p.addEndpointRules(&rule, ipTableFamily, cn, svcPortName, &epKey{port.Protocol, addr.IP, dport}, attrs.appProtocol)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.isEndpointInMap(svcPortName, ep) {
+		// Endpoint was deleted while its rules were programmed, deleteEndpoint leaves not yet programmed
+		// endpoint's rules for addEndpoint to clean up.
+		if err == nil {
+			rule.RuleID = ruleIDs
+			if err := p.deleteEndpointRules(svcPortName, ipTableFamily, &rule); err != nil {
+				klog.Errorf("failed to delete rules of endpoint %s removed during programming with error: %+v", ep.String(), err)
+			}
+		}
+		p.sepNamer.release(cn, svcPortName.String(), string(port.Protocol), baseEndpointInfo.Endpoint)
+		return nil
+	}
+	if err != nil {
 		klog.Errorf("failed to add endpoint rules for Service Port Name: %+v with error: %+v", svcPortName, err)
+		p.removeEndpointFromMap(svcPortName, ep)
+		p.sepNamer.release(cn, svcPortName.String(), string(port.Protocol), baseEndpointInfo.Endpoint)
 		return err
 	}
-	p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], newEndpointInfo(baseEndpointInfo, port.Protocol))
-	if err := p.updateServiceChain(svcPortName, ipTableFamily); err != nil {
+	epRule.RuleID = ruleIDs
+	baseEndpointInfo.lastProgrammed = time.Now()
+	p.endpointProgrammed(svcPortName, ep.String())
+	p.reconcileEndpointAffinity(svcPortName, ep, ipTableFamily, rule.WithAffinity)
+	p.reconcileEndpointDstPort(svcPortName, ep.(*endpointsInfo), ipTableFamily, dport == 0)
+	if warmup != 0 {
+		// Endpoint's chain is ready, but the endpoint joins the service's load balancing only after warmup
+		p.startEndpointWarmup(svcPortName, ep.(*endpointsInfo), ipTableFamily, warmup)
+	}
+	if attrs.move {
+		// The service chain must include the endpoint before its old address gets removed, the update is not debounced
+		if p.debouncer != nil {
+			p.debouncer.cancel(serviceChainKey{svcPortName: svcPortName, tableFamily: ipTableFamily})
+		}
+		if err := p.updateServiceChain(svcPortName, ipTableFamily); err != nil {
+			klog.Errorf("failed to update service %s chain with moved endpoint rule with error: %+v", svcPortName.String(), err)
+			return err
+		}
+		return nil
+	}
+	if err := p.scheduleServiceChainUpdate(svcPortName, ipTableFamily); err != nil {
 		klog.Errorf("failed to update service %s chain with endpoint rule with error: %+v", svcPortName.String(), err)
 		return err
 	}
 	return nil
 }
 
+// pendingEndpoint is a rule of an endpoint recorded before its Service Port was added, the rule is programmed
+// from a copy with p.mu released.
+type pendingEndpoint struct {
+	ep          *endpointsInfo
+	tableFamily utilnftables.TableFamily
+	rule        nftables.EPRule
+	// dport is the port endpoint's DNAT rewrites destination port to, 0 keeps the original service port.
+	dport int32
+}
+
+// pendingEndpointRetry is the item of retries queue for a pending endpoint which rules failed to be programmed.
+type pendingEndpointRetry struct {
+	svcPortName ServicePortName
+	endpoint    string
+}
+
+// takePendingEndpoints returns copies of not programmed rules of pending endpoints among eps, the endpoints
+// are marked as being programmed, so they are cleaned up by wirePendingEndpoints if they are deleted meanwhile.
+// It must be called with p.mu held.
+func (p *proxy) takePendingEndpoints(svc *serviceInfo, eps []Endpoint) []pendingEndpoint {
+	var pending []pendingEndpoint
+	for _, ep := range eps {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok || !epInfo.pendingService {
+			continue
+		}
+		dport := int32(epInfo.port)
+		if svc.preserveDstPort {
+			dport = 0
+		}
+		for tableFamily, epRule := range epInfo.epnft.Rule {
+			if epRule.RuleID != nil {
+				continue
+			}
+			epRule.WithAffinity = svc.svcnft.WithAffinity
+			epRule.MaxAgeSeconds = svc.svcnft.MaxAgeSeconds
+			epRule.ServiceID = svc.svcnft.ServiceID
+			pending = append(pending, pendingEndpoint{ep: epInfo, tableFamily: tableFamily, rule: *epRule, dport: dport})
+		}
+		epInfo.pendingService = false
+	}
+
+	return pending
+}
+
+// wirePendingEndpoints programs rules of endpoints recorded before the Service Port was added, it is called
+// once the Service Port is added to serviceMap. Rules are programmed with p.mu released, as addEndpoint does,
+// endpoints which rules fail to be programmed are kept pending and queued for retry.
+func (p *proxy) wirePendingEndpoints(svcPortName ServicePortName, pending []pendingEndpoint) {
+	families := make(map[utilnftables.TableFamily]bool)
+	for i := range pending {
+		pe := &pending[i]
+		ruleIDs, err := p.addEndpointRules(&pe.rule, pe.tableFamily, pe.rule.Chain, svcPortName, &epKey{pe.ep.protocol, pe.ep.ip, pe.dport}, pe.ep.appProtocol)
+		p.mu.Lock()
+		if p.pendingEndpointProgrammed(svcPortName, pe, ruleIDs, err) {
+			families[pe.tableFamily] = true
+		}
+		p.mu.Unlock()
+	}
+	if len(families) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.serviceMap[svcPortName]; !ok {
+		return
+	}
+	for family := range families {
+		if err := p.scheduleServiceChainUpdate(svcPortName, family); err != nil {
+			klog.Errorf("failed to update service %s chain with pending endpoint rules with error: %+v", svcPortName.String(), err)
+		}
+	}
+}
+
+// pendingEndpointProgrammed records the result of programming a pending endpoint's rule, true is returned if
+// the endpoint's rule is programmed and the endpoint is eligible for the service's load balancing. It must be
+// called with p.mu held.
+func (p *proxy) pendingEndpointProgrammed(svcPortName ServicePortName, pe *pendingEndpoint, ruleIDs []uint64, err error) bool {
+	inMap := p.isEndpointInMap(svcPortName, pe.ep)
+	_, svcKnown := p.serviceMap[svcPortName]
+	if !inMap || !svcKnown || pe.ep.pendingService {
+		// Endpoint was deleted or its Service Port was removed while its rules were programmed
+		if err == nil {
+			pe.rule.RuleID = ruleIDs
+			if err := p.deleteEndpointRules(svcPortName, pe.tableFamily, &pe.rule); err != nil {
+				klog.Errorf("failed to delete rules of pending endpoint %s removed during programming with error: %+v", pe.ep.Endpoint, err)
+			}
+		}
+		if !inMap {
+			p.sepNamer.release(pe.rule.Chain, svcPortName.String(), string(pe.ep.protocol), pe.ep.Endpoint)
+			return false
+		}
+		// Endpoint of removed Service Port stays pending until the Service Port is added again
+		pe.ep.pendingService = true
+		return false
+	}
+	if err != nil {
+		klog.Errorf("failed to add rules of pending endpoint %s for Service Port Name: %s with error: %+v", pe.ep.Endpoint, svcPortName.String(), err)
+		pe.ep.pendingService = true
+		p.retries.AddRateLimited(pendingEndpointRetry{svcPortName: svcPortName, endpoint: pe.ep.String()})
+		return false
+	}
+	pe.ep.epnft.Rule[pe.tableFamily].RuleID = ruleIDs
+	pe.ep.lastProgrammed = time.Now()
+	p.reconcileEndpointDstPort(svcPortName, pe.ep, pe.tableFamily, pe.dport == 0)
+	p.retries.Forget(pendingEndpointRetry{svcPortName: svcPortName, endpoint: pe.ep.String()})
+	klog.V(5).Infof("pending endpoint %s of Service Port Name %s has been programmed", pe.ep.Endpoint, svcPortName.String())
+
+	return true
+}
+
+// retryPendingEndpoint programs rules of a pending endpoint queued for retry, the retry is dropped if either
+// the endpoint or its Service Port is gone.
+func (p *proxy) retryPendingEndpoint(item pendingEndpointRetry) {
+	p.mu.Lock()
+	svc, ok := p.serviceMap[item.svcPortName]
+	ep := p.findEndpoint(item.svcPortName, item.endpoint)
+	if !ok || ep == nil {
+		p.mu.Unlock()
+		p.retries.Forget(item)
+		return
+	}
+	pending := p.takePendingEndpoints(svc.(*serviceInfo), []Endpoint{ep})
+	p.mu.Unlock()
+	if len(pending) == 0 {
+		p.retries.Forget(item)
+		return
+	}
+	p.wirePendingEndpoints(item.svcPortName, pending)
+}
+
+// findEndpoint returns Service Port's endpoint identified by its address, port and protocol, nil is returned
+// if the Service Port does not have such endpoint. It must be called with p.mu held.
+func (p *proxy) findEndpoint(svcPortName ServicePortName, endpoint string) Endpoint {
+	for _, e := range p.endpointsMap[svcPortName] {
+		if e.String() == endpoint {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// isEndpointInMap returns true if the endpoint is one of Service Port's endpoints. It must be called with p.mu held.
+func (p *proxy) isEndpointInMap(svcPortName ServicePortName, ep Endpoint) bool {
+	for _, e := range p.endpointsMap[svcPortName] {
+		if e == ep {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeEndpointFromMap removes the endpoint from Service Port's endpoints, false is returned if the endpoint
+// is not found. It must be called with p.mu held.
+func (p *proxy) removeEndpointFromMap(svcPortName ServicePortName, ep Endpoint) bool {
+	eps := p.endpointsMap[svcPortName]
+	for i := range eps {
+		if eps[i] != ep {
+			continue
+		}
+		p.endpointsMap[svcPortName] = append(eps[:i:i], eps[i+1:]...)
+		if len(p.endpointsMap[svcPortName]) == 0 {
+			klog.V(5).Infof("no more endpoints found for %s", svcPortName.String())
+			delete(p.endpointsMap, svcPortName)
+		}
+		return true
+	}
+
+	return false
+}
+
+// reconcileEndpointAffinity brings endpoint's Update rule in line with the service's Session Affinity, in case
+// the affinity changed while the endpoint's rules were programmed. It must be called with p.mu held.
+func (p *proxy) reconcileEndpointAffinity(svcPortName ServicePortName, ep Endpoint, tableFamily utilnftables.TableFamily, withAffinity bool) {
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok || svc.(*serviceInfo).svcnft.WithAffinity == withAffinity {
+		return
+	}
+	var err error
+	if svc.(*serviceInfo).svcnft.WithAffinity {
+		err = p.addAffinityEndpoint([]Endpoint{ep}, tableFamily, svc.(*serviceInfo).svcnft.ServiceID, svc.(*serviceInfo).svcnft.MaxAgeSeconds)
+	} else {
+		err = p.deleteAffinityEndpoint([]Endpoint{ep}, tableFamily)
+	}
+	if err != nil {
+		klog.Errorf("failed to reconcile Session Affinity of endpoint %s of Service Port Name %s with error: %+v", ep.String(), svcPortName.String(), err)
+	}
+}
+
+// reconcileEndpointDstPort brings endpoint's DNAT rule in line with the service's destination port preservation,
+// in case it changed while the endpoint's rules were programmed, preserved tells whether endpoint's DNAT rule keeps
+// the original destination port. DNAT rule is the last rule of the endpoint's chain. It must be called with p.mu held.
+func (p *proxy) reconcileEndpointDstPort(svcPortName ServicePortName, epInfo *endpointsInfo, tableFamily utilnftables.TableFamily, preserved bool) {
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok || svc.(*serviceInfo).preserveDstPort == preserved {
+		return
+	}
+	rule, ok := epInfo.epnft.Rule[tableFamily]
+	if !ok || len(rule.RuleID) == 0 {
+		// Endpoint of a different ip family or the endpoint's rules are not programmed yet
+		return
+	}
+	dport := int32(epInfo.port)
+	if svc.(*serviceInfo).preserveDstPort {
+		dport = 0
+	}
+	last := len(rule.RuleID) - 1
+	id, err := nftables.ReplaceEndpointDNATRule(p.nfti, tableFamily, rule.Chain, rule.RuleID[last], epInfo.ip, dport)
+	if err != nil {
+		klog.Errorf("failed to reprogram DNAT rule of endpoint %s of Service Port Name %s with error: %+v", epInfo.Endpoint, svcPortName.String(), err)
+		return
+	}
+	rule.RuleID = append(append([]uint64(nil), rule.RuleID[:last]...), id)
+}
+
+// isLocalEndpoint returns true if the endpoint runs on the local node. Locality of endpoints without NodeName
+// is detected by the local detector, without it such endpoints cannot be classified and are considered remote,
+// services with Local traffic policy will not use them, since it might leave such service without usable
+// local endpoints, the condition is logged and counted.
+func (p *proxy) isLocalEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddress) bool {
+	isLocal, known := p.endpointLocality(svcPortName.Cluster, nodeNameOf(addr), addr.IP)
+	if !known {
+		endpointsMissingNodeName.Inc()
+		klog.Warningf("endpoint %s of Service Port Name %s has no NodeName, it is considered not local", addr.IP, svcPortName.String())
+	}
+
+	return isLocal
+}
+
+// endpointLocality returns true if the endpoint on the node nodeName with address ip runs on the local node,
+// NodeName takes precedence over the local detector. The second value is false when the locality cannot be
+// detected. Endpoints of remote clusters never run on the local node. It must be called with p.mu held.
+func (p *proxy) endpointLocality(cluster, nodeName, ip string) (bool, bool) {
+	if cluster != "" {
+		return false, true
+	}
+	if nodeName != "" {
+		return nodeName == p.hostname, true
+	}
+	if p.localDetector != nil {
+		return p.localDetector.IsLocal(ip), true
+	}
+
+	return false, false
+}
+
+func nodeNameOf(addr *v1.EndpointAddress) string {
+	if addr.NodeName == nil {
+		return ""
+	}
+
+	return *addr.NodeName
+}
+
 func (p *proxy) DeleteEndpoints(ep *v1.Endpoints) {
 	s := time.Now()
 	defer klog.V(5).Infof("DeleteEndpoints for %s/%s ran for: %d nanoseconds", ep.Namespace, ep.Name, time.Since(s))
@@ -100,73 +444,159 @@ func (p *proxy) DeleteEndpoints(ep *v1.Endpoints) {
 		klog.Errorf("failed to delete Endpoint %s/%s with error: %+v", ep.Namespace, ep.Name, err)
 		return
 	}
+	p.matchSingleServicePort(info)
 	for _, e := range info {
-		p.mu.Lock()
-		eps, ok := p.endpointsMap[e.name]
-		p.mu.Unlock()
-		if !ok {
-			continue
-		}
 		klog.V(5).Infof("Removing Endpoint %s/%s port %+v", ep.Namespace, ep.Name, e.port)
-		if err := p.deleteEndpoint(e.name, e.addr, e.port, eps); err != nil {
+		if err := p.deleteEndpoint(e.name, e.addr, e.port); err != nil {
 			klog.Errorf("failed to remove Endpoint %s/%s port %+v with error: %+v", ep.Namespace, ep.Name, e.port, err)
 			continue
 		}
 	}
-	p.cache.removeEpFromCache(ep.Name, ep.Namespace)
+	p.cache.removeEpFromCache(nameOf(&ep.ObjectMeta))
 }
 
-func (p *proxy) deleteEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddress, port *v1.EndpointPort, eps []Endpoint) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	isLocal := addr.NodeName != nil && *addr.NodeName == p.hostname
+// deleteEndpoint removes an endpoint from a Service Port. The endpoint is removed from the endpoints map and
+// the service chain is updated under the lock, the endpoint's own chain and rules are deleted without holding the lock.
+func (p *proxy) deleteEndpoint(svcPortName ServicePortName, addr *v1.EndpointAddress, port *v1.EndpointPort) error {
 	ipFamily, ipTableFamily := getIPFamily(addr.IP)
+	p.mu.Lock()
+	// hostname can be changed by SetNodeInfo, it is read under the lock
+	isLocal, _ := p.endpointLocality(svcPortName.Cluster, nodeNameOf(addr), addr.IP)
 	ep2d := newBaseEndpointInfo(ipFamily, port.Protocol, addr.IP, int(port.Port), isLocal, nil)
-	for i, ep := range eps {
-		ep2c, ok := ep.(*endpointsInfo)
-		if !ok {
-			// Not recognize, skipping it
-			continue
-		}
-		if ep2c.Equal(ep2d) {
-			// Update eps by removing endpoint entry for port.Protocol, addr.IP, port.Port
-			p.endpointsMap[svcPortName] = eps[:i]
-			p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], eps[i+1:]...)
-			cn := ep2c.BaseEndpointInfo.epnft.Rule[ipTableFamily].Chain
-			ruleID := ep2c.BaseEndpointInfo.epnft.Rule[ipTableFamily].RuleID
-			// Update the service's rule to exclude deleted endpoint
-			if err := p.updateServiceChain(svcPortName, ipTableFamily); err != nil {
-				klog.Errorf("failed to update service %s chain with endpoint rule with error: %+v", svcPortName.String(), err)
-				return err
-			}
-			if err := p.deleteEndpointRules(ipTableFamily, cn, ruleID, svcPortName, &epKey{port.Protocol, addr.IP, port.Port}); err != nil {
-				klog.Errorf("failed to delete endpoint rules service port name %+v with error: %+v", svcPortName, err)
-				return err
-			}
+	var ep2c *endpointsInfo
+	for _, ep := range p.endpointsMap[svcPortName] {
+		if e, ok := ep.(*endpointsInfo); ok && (e.Equal(ep2d) || e.resolved && e.String() == ep2d.String()) {
+			ep2c = e
+			break
 		}
 	}
+	if ep2c == nil {
+		p.mu.Unlock()
+		return nil
+	}
+	p.removeEndpointFromMap(svcPortName, ep2c)
+	p.stopEndpointWarmup(ep2c)
+	if ep2c.pendingService {
+		// Rules of the endpoint pending its service have never been programmed
+		p.sepNamer.release(ep2c.epnft.Rule[ipTableFamily].Chain, svcPortName.String(), string(port.Protocol), ep2c.Endpoint)
+		p.mu.Unlock()
+		return nil
+	}
+	// Endpoint's rule is copied, as rule ids are not safe to access once the lock is released.
+	epRule := *ep2c.BaseEndpointInfo.epnft.Rule[ipTableFamily]
+	if epRule.RuleID == nil {
+		// Endpoint's rules are still being programmed, addEndpoint cleans them up once it finds the endpoint is gone.
+		p.mu.Unlock()
+		return nil
+	}
+	// Update the service's rule to exclude deleted endpoint, it cannot be debounced as the endpoint's chain
+	// is about to be deleted and must not be referenced by the service's rule.
+	if p.debouncer != nil {
+		p.debouncer.cancel(serviceChainKey{svcPortName: svcPortName, tableFamily: ipTableFamily})
+	}
+	deletion := &endpointDeletion{svcPortName: svcPortName, tableFamily: ipTableFamily, ep: ep2c, rule: epRule}
+	if err := p.updateServiceChain(svcPortName, ipTableFamily); err != nil {
+		// Endpoint is still in the service's load balancing, keeping it in endpoints map until the retry succeeds
+		p.queueEndpointDeletion(deletion)
+		p.mu.Unlock()
+		klog.Errorf("failed to update service %s chain with endpoint rule with error: %+v", svcPortName.String(), err)
+		return err
+	}
+	deletion.serviceUpdated = true
+	p.mu.Unlock()
+
+	if err := p.deleteEndpointRules(svcPortName, ipTableFamily, &epRule); err != nil {
+		// Endpoint is out of the service's load balancing, its leaked chain is deleted by the retry
+		p.mu.Lock()
+		p.queueEndpointDeletion(deletion)
+		p.mu.Unlock()
+		klog.Errorf("failed to delete endpoint rules service port name %+v with error: %+v", svcPortName, err)
+		return err
+	}
+	p.mu.Lock()
+	p.sepNamer.release(epRule.Chain, svcPortName.String(), string(port.Protocol), ep2c.Endpoint)
+	p.mu.Unlock()
 
 	return nil
 }
 
-func (p *proxy) deleteEndpointRules(ipTableFamily utilnftables.TableFamily, cn string, ruleID []uint64, svcPortName ServicePortName, key *epKey) error {
-	if err := nftables.DeleteEndpointRules(p.nfti, ipTableFamily, cn, ruleID); err != nil {
+// deleteEndpointRules deletes endpoint's rules and chain, it does not access proxy's maps and does not
+// require p.mu to be held.
+func (p *proxy) deleteEndpointRules(svcPortName ServicePortName, ipTableFamily utilnftables.TableFamily, epRule *nftables.EPRule) error {
+	if err := p.epRules.deleteEndpointRules(ipTableFamily, epRule); err != nil {
 		return err
 	}
-	// Deleting endpoint's chain
-	if err := nftables.DeleteChain(p.nfti, ipTableFamily, cn); err != nil {
-		klog.Errorf("failed to delete endpoint chain: %s with error: %+v", cn, err)
-		return err
+	p.audit.record(auditDeleteEndpoint, svcPortName, ipTableFamily, epRule.Chain, nil, epRule.RuleID)
+
+	return nil
+}
+
+// matchSingleServicePort maps endpoints' ports to the sole port of a single port service when their names differ.
+// Endpoint port of a single port service is often unnamed, or named differently than the service port during
+// a transition, endpoints must be wired to the service regardless. Endpoints of multiple ports and services
+// of multiple ports or not yet known are matched by name.
+func (p *proxy) matchSingleServicePort(info []epInfo) {
+	if len(info) == 0 {
+		return
+	}
+	name := info[0].name
+	for _, e := range info[1:] {
+		if e.name != name {
+			return
+		}
 	}
-	// Check if it was last endpoint for a service port name
-	if len(p.endpointsMap[svcPortName]) == 0 {
-		klog.V(5).Infof("no more endpoints found for %s", svcPortName.String())
-		// No endpoints for svcPortName key is available, need to add svcPortName to No Endpoint Set
-		delete(p.endpointsMap, svcPortName)
+	svc, err := p.cache.getLastKnownSvcFromCache(name.serviceName())
+	if err != nil || len(svc.Spec.Ports) != 1 {
+		return
+	}
+	servicePort := svc.Spec.Ports[0]
+	if servicePort.Name == name.Port || servicePort.Protocol != name.Protocol {
+		return
+	}
+	klog.V(5).Infof("endpoint port %q of single port service %s/%s is matched to service port %q", name.Port, svc.Namespace, svc.Name, servicePort.Name)
+	matched := getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)
+	for i := range info {
+		info[i].name = matched
 	}
-	return nil
 }
 
+// selectSubsetsAddresses returns endpoints' ports to be programmed, ports of ready addresses are always programmed.
+// Ports of not ready addresses are programmed if the service publishes not ready addresses, or as the last resort
+// when a Service Port has no ready addresses.
+func (p *proxy) selectSubsetsAddresses(info []epInfo) []epInfo {
+	withReady := make(map[ServicePortName]bool)
+	for _, e := range info {
+		if e.ready {
+			withReady[e.name] = true
+		}
+	}
+	selected := make([]epInfo, 0, len(info))
+	for _, e := range info {
+		if !e.ready && withReady[e.name] && !p.publishesNotReadyAddresses(e.name) {
+			continue
+		}
+		selected = append(selected, e)
+	}
+
+	return selected
+}
+
+// publishesNotReadyAddresses returns true if the last known service of a Service Port publishes not ready addresses.
+func (p *proxy) publishesNotReadyAddresses(svcPortName ServicePortName) bool {
+	svc, err := p.cache.getLastKnownSvcFromCache(svcPortName.serviceName())
+	if err != nil {
+		return false
+	}
+
+	return svc.Spec.PublishNotReadyAddresses
+}
+
+// epPortKey returns a key identifying endpoint's port by Service Port Name, address and port.
+func epPortKey(e epInfo) string {
+	return e.name.String() + "/" + net.JoinHostPort(e.addr.IP, strconv.Itoa(int(e.port.Port)))
+}
+
+// processEpSubsets returns ports of Endpoints' ready and not ready addresses, ready field tells them apart.
 func processEpSubsets(ep *v1.Endpoints) ([]epInfo, error) {
 	var ports []epInfo
 	for i := range ep.Subsets {
@@ -176,7 +606,7 @@ func processEpSubsets(ep *v1.Endpoints) ([]epInfo, error) {
 			if port.Port == 0 {
 				return nil, fmt.Errorf("found invalid endpoint port %s", port.Name)
 			}
-			svcPortName := getSvcPortName(ep.Name, ep.Namespace, port.Name, port.Protocol)
+			svcPortName := getObjSvcPortName(ep, port.Name, port.Protocol)
 			if len(ss.Addresses) == 0 {
 			}
 			for i := range ss.Addresses {
@@ -184,7 +614,7 @@ func processEpSubsets(ep *v1.Endpoints) ([]epInfo, error) {
 				if addr.IP == "" {
 					return nil, fmt.Errorf("found invalid endpoint port %s with empty host", port.Name)
 				}
-				ports = append(ports, epInfo{name: svcPortName, addr: addr, port: port})
+				ports = append(ports, epInfo{name: svcPortName, addr: addr, port: port, ready: true})
 			}
 			for i := range ss.NotReadyAddresses {
 				addr := &ss.NotReadyAddresses[i]
@@ -211,7 +641,7 @@ func (p *proxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
 	// Check if the version of Last Known Endpoint's version matches with epOld version
 	// mismatch would indicate lost update.
 	var storedEp *v1.Endpoints
-	ver, err := p.cache.getCachedEpVersion(epNew.Name, epNew.Namespace)
+	ver, err := p.cache.getCachedEpVersion(nameOf(&epNew.ObjectMeta))
 	if err != nil {
 		klog.Errorf("UpdateEndpoint did not find Endpoint %s/%s in cache, it is a bug, please file an issue", epNew.Namespace, epNew.Name)
 		storedEp = epOld
@@ -222,7 +652,7 @@ func (p *proxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
 			klog.Warningf("mismatch version detected between old Endpoint %s/%s and last known stored in cache %s/%s",
 				epNew.Namespace, epNew.Name, oldVer, ver)
 		}
-		storedEp, _ = p.cache.getLastKnownEpFromCache(epNew.Name, epNew.Namespace)
+		storedEp, _ = p.cache.getLastKnownEpFromCache(nameOf(&epNew.ObjectMeta))
 	}
 	// Check for new Endpoint's ports, if found adding them into EndpointMap and corresponding programming rules.
 	info, err := processEpSubsets(epNew)
@@ -230,27 +660,32 @@ func (p *proxy) UpdateEndpoints(epOld, epNew *v1.Endpoints) {
 		klog.Errorf("failed to update Endpoint %s/%s with error: %+v", epNew.Namespace, epNew.Name, err)
 		return
 	}
+	p.matchSingleServicePort(info)
+	info = p.selectSubsetsAddresses(info)
+	storedInfo, _ := processEpSubsets(storedEp)
+	p.matchSingleServicePort(storedInfo)
+	storedInfo = p.selectSubsetsAddresses(storedInfo)
+	newKeys, storedKeys := sets.NewString(), sets.NewString()
+	for _, e := range info {
+		newKeys.Insert(epPortKey(e))
+	}
+	for _, e := range storedInfo {
+		storedKeys.Insert(epPortKey(e))
+	}
 	for _, e := range info {
-		if !isPortInSubset(storedEp.Subsets, e.port, e.addr) {
+		if !storedKeys.Has(epPortKey(e)) {
 			klog.V(5).Infof("updating Endpoint %s/%s Service Port name: %+v", epNew.Namespace, epNew.Name, e.name)
-			if err := p.addEndpoint(e.name, e.addr, e.port); err != nil {
+			if err := p.addEndpoint(e.name, e.addr, e.port, endpointAttributes{}); err != nil {
 				klog.Errorf("failed to update Endpoint %s/%s port %+v with error: %+v", epNew.Namespace, epNew.Name, *e.port, err)
 				return
 			}
 		}
 	}
 	// Check for removed endpoint's ports, if found, remvoing all entries from EndpointMap
-	info, _ = processEpSubsets(storedEp)
-	for _, e := range info {
-		p.mu.Lock()
-		eps, ok := p.endpointsMap[e.name]
-		p.mu.Unlock()
-		if !ok {
-			continue
-		}
-		if !isPortInSubset(epNew.Subsets, e.port, e.addr) {
+	for _, e := range storedInfo {
+		if !newKeys.Has(epPortKey(e)) {
 			klog.V(5).Infof("removing Endpoint %s/%s port %+v", epNew.Namespace, epNew.Name, *e.port)
-			if err := p.deleteEndpoint(e.name, e.addr, e.port, eps); err != nil {
+			if err := p.deleteEndpoint(e.name, e.addr, e.port); err != nil {
 				klog.Errorf("failed to remove Endpoint %s/%s port %+v with error: %+v", epNew.Namespace, epNew.Name, *e.port, err)
 				continue
 			}
@@ -17,12 +17,17 @@ limitations under the License.
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
+	utilnet "k8s.io/utils/net"
 )
 
 func getServiceNameFromServiceNameLabel(labels map[string]string) (string, bool) {
@@ -34,7 +39,49 @@ func getServiceNameFromServiceNameLabel(labels map[string]string) (string, bool)
 	return name, true
 }
 
-func processEpSlice(epsl *discovery.EndpointSlice) ([]epInfo, error) {
+// isStaleEndpointSlice returns true if Endpoint Slice is owned by a service which is not the current service of
+// the name, for example a slice left behind by a deleted service which got recreated with the same name.
+// Slices without Service owner or of a service which is not known yet are not stale.
+func (p *proxy) isStaleEndpointSlice(epsl *discovery.EndpointSlice) bool {
+	svcName, found := getServiceNameFromServiceNameLabel(epsl.ObjectMeta.Labels)
+	if !found {
+		return false
+	}
+	svc, err := p.cache.getLastKnownSvcFromCache(objectName{
+		NamespacedName: types.NamespacedName{Namespace: epsl.Namespace, Name: svcName},
+		Cluster:        clusterOf(epsl),
+	})
+	if err != nil {
+		return false
+	}
+	for _, owner := range epsl.OwnerReferences {
+		if owner.Kind == "Service" && owner.Name == svcName && owner.UID != svc.UID {
+			klog.Warningf("Endpoint Slice %s/%s is owned by service %s/%s uid %s, current service uid is %s, ignoring stale slice",
+				epsl.Namespace, epsl.Name, epsl.Namespace, svcName, owner.UID, svc.UID)
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEndpointReady returns true if the endpoint is Ready and, if readiness gate is configured, the gate is satisfied.
+// The gate is a key in endpoint's topology which must carry "true" value, as EndpointSlice does not offer other
+// per endpoint extensible fields. Endpoint with unknown Ready condition is considered Ready.
+func isEndpointReady(e *discovery.Endpoint, gate string) bool {
+	if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+		return false
+	}
+	if gate == "" {
+		return true
+	}
+
+	return e.Topology[gate] == "true"
+}
+
+// processEpSlice returns endpoints' ports of EndpointSlice, gate is an optional readiness gate
+// an endpoint must satisfy in addition to Ready condition.
+func processEpSlice(epsl *discovery.EndpointSlice, gate string) ([]epInfo, error) {
 	var ports []epInfo
 	svcName, found := getServiceNameFromServiceNameLabel(epsl.ObjectMeta.Labels)
 	if !found {
@@ -44,11 +91,37 @@ func processEpSlice(epsl *discovery.EndpointSlice) ([]epInfo, error) {
 	for _, e := range epsl.Endpoints {
 		var svcPortName ServicePortName
 		for _, p := range epsl.Ports {
-			if *p.Port == 0 {
-				return nil, fmt.Errorf("found invalid endpoint slice port %s", *p.Name)
+			// Port's name and protocol are optional, unnamed port and TCP protocol are defaults
+			var name string
+			if p.Name != nil {
+				name = *p.Name
+			}
+			protocol := v1.ProtocolTCP
+			if p.Protocol != nil {
+				protocol = *p.Protocol
+			}
+			if p.Port == nil || *p.Port == 0 {
+				return nil, fmt.Errorf("found invalid endpoint slice port %s/%s", name, protocol)
 			}
-			svcPortName = getSvcPortName(svcName, epsl.Namespace, *p.Name, *p.Protocol)
+			if !isSupportedProtocol(protocol) {
+				// Service Port of the protocol is never programmed, the port is reported by warnUnsupportedSlicePorts
+				continue
+			}
+			// Ports with the same number and different protocols, like DNS 53/TCP and 53/UDP, are distinct
+			// Service Ports, endpoint's protocol is always the protocol of its slice port.
+			svcPortName = getSvcPortName(svcName, epsl.Namespace, name, protocol)
+			svcPortName.Cluster = clusterOf(epsl)
 			for _, addr := range e.Addresses {
+				if net.ParseIP(addr) == nil {
+					// Not resolved FQDN address or invalid address, it cannot be programmed
+					klog.Warningf("Skip address %s which is not ip address in Endpoint Slice %s/%s", addr, epsl.Namespace, epsl.Name)
+					continue
+				}
+				if !isAddressOfType(addr, epsl.AddressType) {
+					// Malformed slice, programming the address would put it in the table of a wrong ip family
+					klog.Warningf("Skip address %s which does not match address type %s of Endpoint Slice %s/%s", addr, epsl.AddressType, epsl.Namespace, epsl.Name)
+					continue
+				}
 				port := epInfo{
 					name: svcPortName,
 					addr: &v1.EndpointAddress{
@@ -56,23 +129,20 @@ func processEpSlice(epsl *discovery.EndpointSlice) ([]epInfo, error) {
 						TargetRef: e.TargetRef,
 						NodeName:  e.Hostname,
 					},
-					port: &v1.EndpointPort{},
+					port: &v1.EndpointPort{
+						Name:     name,
+						Port:     *p.Port,
+						Protocol: protocol,
+					},
+					attrs: endpointAttributes{topology: e.Topology},
 				}
 				if e.Hostname != nil {
 					port.addr.Hostname = *e.Hostname
 				}
-				if p.Name != nil {
-					port.port.Name = *p.Name
-				}
-				if p.Port != nil {
-					port.port.Port = *p.Port
-				}
-				if p.Protocol != nil {
-					port.port.Protocol = *p.Protocol
-				}
-				if *e.Conditions.Ready {
-					port.ready = true
+				if p.AppProtocol != nil {
+					port.attrs.appProtocol = *p.AppProtocol
 				}
+				port.ready = isEndpointReady(&e, gate)
 				ports = append(ports, port)
 			}
 		}
@@ -81,18 +151,42 @@ func processEpSlice(epsl *discovery.EndpointSlice) ([]epInfo, error) {
 	return ports, nil
 }
 
+// warnUnsupportedSlicePorts logs and records an event for each port of Endpoint Slice skipped because of its protocol.
+func (p *proxy) warnUnsupportedSlicePorts(epsl *discovery.EndpointSlice) {
+	for _, port := range epsl.Ports {
+		if port.Protocol == nil || isSupportedProtocol(*port.Protocol) {
+			continue
+		}
+		var name string
+		if port.Name != nil {
+			name = *port.Name
+		}
+		klog.Warningf("Endpoint Slice %s/%s port %s has unsupported protocol %q, skipping the port", epsl.Namespace, epsl.Name, name, *port.Protocol)
+		if p.recorder != nil {
+			p.recorder.Eventf(epsl, v1.EventTypeWarning, "UnsupportedProtocol", "Port %s is not programmed, protocol %q is not supported", name, *port.Protocol)
+		}
+	}
+}
+
 func (p *proxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
 	s := time.Now()
 	defer klog.V(5).Infof("AddEndpointSlice for a EndpointSlice %s/%s ran for: %d nanoseconds", epsl.Namespace, epsl.Name, time.Since(s))
+	if p.isStaleEndpointSlice(epsl) {
+		return
+	}
+	// Resolved EndpointSlice is stored in the cache, so updates and deletion operate on programmed addresses
+	epsl = p.resolveEndpointSlice(epsl)
 	p.cache.storeEpSlInCache(epsl)
 	klog.V(5).Infof("AddEndpointSlice for a EndpointSlice %s/%s", epsl.Namespace, epsl.Name)
 	klog.V(6).Infof("Endpoints: %+v Ports: %+v Address type: %+v", epsl.Endpoints, epsl.Ports, epsl.AddressType)
 
-	info, err := processEpSlice(epsl)
+	info, err := processEpSlice(epsl, p.readinessGate)
 	if err != nil {
 		klog.Errorf("failed to process Endpoint slice %s/%s with error: %+v", epsl.Namespace, epsl.Name, err)
 		return
 	}
+	p.warnUnsupportedSlicePorts(epsl)
+	p.matchSingleServicePort(info)
 
 	for _, e := range info {
 		// Skipping not ready port, will program chains/rules once it becomes ready.
@@ -101,7 +195,7 @@ func (p *proxy) AddEndpointSlice(epsl *discovery.EndpointSlice) {
 			continue
 		}
 		klog.V(5).Infof("adding Endpoint Slice %s/%s port %+v", epsl.Namespace, epsl.Name, e.port)
-		if err := p.addEndpoint(e.name, e.addr, e.port); err != nil {
+		if err := p.addEndpoint(e.name, e.addr, e.port, e.attrs); err != nil {
 			klog.Errorf("failed to add Endpoint Slice %s/%s port %+v with error: %+v", epsl.Namespace, epsl.Name, e.port, err)
 			return
 		}
@@ -113,31 +207,39 @@ func (p *proxy) DeleteEndpointSlice(epsl *discovery.EndpointSlice) {
 	defer klog.V(5).Infof("DeleteEndpointSlice for a EndpointSlice %s/%s ran for: %d nanoseconds", epsl.Namespace, epsl.Name, time.Since(s))
 	klog.V(5).Infof("DeleteEndpointSlice for a EndpointSlice %s/%s", epsl.Namespace, epsl.Name)
 	klog.V(6).Infof("Endpoints: %+v Ports: %+v Address type: %+v", epsl.Endpoints, epsl.Ports, epsl.AddressType)
-	info, err := processEpSlice(epsl)
+	if _, err := p.cache.getLastKnownEpSlFromCache(nameOf(&epsl.ObjectMeta)); err != nil && p.isStaleEndpointSlice(epsl) {
+		// Stale slice has been ignored, its endpoints have never been programmed
+		return
+	}
+	if epsl.AddressType == discovery.AddressTypeFQDN {
+		// Removing addresses FQDNs were resolved to when the slice was added or last updated
+		if storedEpSl, err := p.cache.getLastKnownEpSlFromCache(nameOf(&epsl.ObjectMeta)); err == nil {
+			epsl = storedEpSl
+		} else {
+			epsl = p.resolveEndpointSlice(epsl)
+		}
+	}
+	info, err := processEpSlice(epsl, p.readinessGate)
 	if err != nil {
 		klog.Errorf("failed to process Endpoint slice %s/%s with error: %+v", epsl.Namespace, epsl.Name, err)
 		return
 	}
+	p.matchSingleServicePort(info)
 	for _, e := range info {
 		// Skip ping not ready port, all related chains/rules were either never created, if port has never been ready
-		// or during EndpointSlice update when port went from Ready to Not Ready.
-		if !e.ready {
+		// or during EndpointSlice update when port went from Ready to Not Ready. Port with a pending readiness change
+		// is programmed as per its previous readiness.
+		if e.ready == p.cancelReadinessChange(e) {
 			klog.V(5).Infof("Skip not Ready port %+v in Endpoint Slice %s/%s", e.port, epsl.Namespace, epsl.Name)
 			continue
 		}
-		p.mu.Lock()
-		eps, ok := p.endpointsMap[e.name]
-		p.mu.Unlock()
-		if !ok {
-			continue
-		}
 		klog.V(5).Infof("Removing Endpoint Slice %s/%s port %+v", epsl.Namespace, epsl.Name, e.port)
-		if err := p.deleteEndpoint(e.name, e.addr, e.port, eps); err != nil {
+		if err := p.deleteEndpoint(e.name, e.addr, e.port); err != nil {
 			klog.Errorf("failed to remove Endpoint Slice %s/%s port %+v with error: %+v", epsl.Namespace, epsl.Name, e.port, err)
 			continue
 		}
 	}
-	p.cache.removeEpSlFromCache(epsl.Name, epsl.Namespace)
+	p.cache.removeEpSlFromCache(nameOf(&epsl.ObjectMeta))
 }
 
 func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
@@ -146,11 +248,15 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 	klog.V(5).Infof("UpdateEndpointSlice for a EndpointSlice %s/%s Address type: %+v", epslNew.Namespace, epslNew.Name, epslNew.AddressType)
 	klog.V(6).Infof("Endpoints Old: %+v Endpoints New: %+v", epslOld.Endpoints, epslNew.Endpoints)
 	klog.V(6).Infof("Ports Old: %+v Ports New: %+v", epslOld.Ports, epslNew.Ports)
+	if p.isStaleEndpointSlice(epslNew) {
+		return
+	}
 	var storedEpSl *discovery.EndpointSlice
-	ver, err := p.cache.getCachedEpSlVersion(epslNew.Name, epslNew.Namespace)
+	epslNew = p.resolveEndpointSlice(epslNew)
+	ver, err := p.cache.getCachedEpSlVersion(nameOf(&epslNew.ObjectMeta))
 	if err != nil {
-		klog.Errorf("UpdateEndpoint did not find Endpoint Slice %s/%s in cache, it is a bug, please file an issue", epslNew.Namespace, epslNew.Name)
-		storedEpSl = epslOld
+		p.logCacheMiss("Endpoint Slice", epslNew.Namespace, epslNew.Name)
+		storedEpSl = p.resolveEndpointSlice(epslOld)
 	} else {
 		// TODO add logic to check version, if oldEp's version more recent than storedEp, then use oldEp as the most current old object.
 		oldVer := epslOld.ObjectMeta.GetResourceVersion()
@@ -158,21 +264,29 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 			klog.Warningf("mismatch version detected between old Endpoint Slice %s/%s and last known stored in cache %s/%s",
 				epslNew.Namespace, epslNew.Name, oldVer, ver)
 		}
-		storedEpSl, _ = p.cache.getLastKnownEpSlFromCache(epslNew.Name, epslNew.Namespace)
+		storedEpSl, _ = p.cache.getLastKnownEpSlFromCache(nameOf(&epslNew.ObjectMeta))
 	}
 
 	// Check for new Endpoint's ports, if found adding them into EndpointMap and corresponding programming rules.
-	info, err := processEpSlice(epslNew)
+	info, err := processEpSlice(epslNew, p.readinessGate)
 	if err != nil {
 		klog.Errorf("failed to update Endpoint Slice %s/%s with error: %+v", epslNew.Namespace, epslNew.Name, err)
 		return
 	}
+	p.warnUnsupportedSlicePorts(epslNew)
+	p.matchSingleServicePort(info)
+	// Endpoints which changed address but kept TargetRef are added before their old addresses are removed,
+	// so the service does not go through a window without the endpoint.
+	storedInfo, _ := processEpSlice(storedEpSl, p.readinessGate)
+	p.matchSingleServicePort(storedInfo)
+	moves := targetRefMoves(storedInfo, info)
 	for _, e := range info {
-		oldReady, found := isPortInEndpointSlice(storedEpSl, e.port, e.addr)
+		e.attrs.move = moves.Has(epInfoKey(e))
+		oldReady, found := isPortInEndpointSlice(storedEpSl, e.port, e.addr, p.readinessGate)
 		if !found && e.ready {
 			// Case when port and address are not in the cache and new endpoint is in Ready state, so add new port
 			klog.V(5).Infof("adding Endpoint Slice %s/%s port: %+v", epslNew.Namespace, epslNew.Name, *e.port)
-			if err := p.addEndpoint(e.name, e.addr, e.port); err != nil {
+			if err := p.addEndpoint(e.name, e.addr, e.port, e.attrs); err != nil {
 				klog.Errorf("failed to update Endpoint Slice %s/%s port %+v with error: %+v", epslNew.Namespace, epslNew.Name, *e.port, err)
 			}
 			continue
@@ -187,14 +301,9 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 		}
 		if found && !e.ready && oldReady {
 			// Case when existing Endpoint state got changed from Ready to NOT Ready
-			p.mu.Lock()
-			eps, ok := p.endpointsMap[e.name]
-			p.mu.Unlock()
-			if !ok {
-				continue
-			}
 			klog.V(5).Infof("removing Endpoint Slice %s/%s port: %+v", epslNew.Namespace, epslNew.Name, *e.port)
-			if err := p.deleteEndpoint(e.name, e.addr, e.port, eps); err != nil {
+			endpointReadinessTransitions.WithLabelValues("to_notready").Inc()
+			if err := p.scheduleReadinessChange(e); err != nil {
 				klog.Errorf("failed to remove Endpoint Slice %s/%s port %+v with error: %+v", epslNew.Namespace, epslNew.Name, *e.port, err)
 			}
 			continue
@@ -202,7 +311,8 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 		if found && e.ready && !oldReady {
 			// Case when Endpoint for port and address pair changed state from NOT Ready to Ready, so add a new port
 			klog.V(5).Infof("adding Endpoint Slice %s/%s port: %+v", epslNew.Namespace, epslNew.Name, *e.port)
-			if err := p.addEndpoint(e.name, e.addr, e.port); err != nil {
+			endpointReadinessTransitions.WithLabelValues("to_ready").Inc()
+			if err := p.scheduleReadinessChange(e); err != nil {
 				klog.Errorf("failed to update Endpoint Slice %s/%s port %+v with error: %+v", epslNew.Namespace, epslNew.Name, *e.port, err)
 			}
 			continue
@@ -213,19 +323,22 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 		}
 	}
 	// Check for removed endpoint's ports, if found, remvoing all entries from EndpointMap
-	info, _ = processEpSlice(storedEpSl)
-	for _, e := range info {
-		_, found := isPortInEndpointSlice(epslNew, e.port, e.addr)
-		if !found && e.ready {
-			// Case when Endpoint for port/address was in Ready state but then was deleted
-			p.mu.Lock()
-			eps, ok := p.endpointsMap[e.name]
-			p.mu.Unlock()
-			if !ok {
+	for _, e := range storedInfo {
+		_, found := isPortInEndpointSlice(epslNew, e.port, e.addr, p.readinessGate)
+		if !found {
+			if newName, renamed := renamedSlicePort(e, info); renamed && p.awaitsServicePortRename(e.name, newName) {
+				// Port was renamed before the service, endpoints keep serving the old Service Port until
+				// the service update migrates them to the new name.
+				klog.V(5).Infof("keeping Endpoint Slice %s/%s port: %+v until service port %s is renamed to %s",
+					epslNew.Namespace, epslNew.Name, *e.port, e.name.String(), newName.String())
 				continue
 			}
+		}
+		if !found && e.ready != p.cancelReadinessChange(e) {
+			// Case when Endpoint for port/address was in Ready state but then was deleted, a pending readiness change
+			// of the deleted Endpoint is dropped
 			klog.V(5).Infof("removing Endpoint Slice %s/%s port: %+v", epslNew.Namespace, epslNew.Name, *e.port)
-			if err := p.deleteEndpoint(e.name, e.addr, e.port, eps); err != nil {
+			if err := p.deleteEndpoint(e.name, e.addr, e.port); err != nil {
 				klog.Errorf("failed to remove Endpoint Slice %s/%s port %+v with error: %+v", epslNew.Namespace, epslNew.Name, *e.port, err)
 				continue
 			}
@@ -233,3 +346,115 @@ func (p *proxy) UpdateEndpointSlice(epslOld, epslNew *discovery.EndpointSlice) {
 	}
 	p.cache.storeEpSlInCache(epslNew)
 }
+
+// epInfoKey returns a key identifying endpoint's port by Service Port Name and address.
+func epInfoKey(e epInfo) string {
+	return e.name.String() + "/" + e.addr.IP
+}
+
+// targetRefKey returns a key identifying endpoint's TargetRef, empty string if the endpoint does not have one.
+func targetRefKey(e epInfo) string {
+	ref := e.addr.TargetRef
+	if ref == nil {
+		return ""
+	}
+	if ref.UID != "" {
+		return string(ref.UID)
+	}
+
+	return ref.Kind + "/" + ref.Namespace + "/" + ref.Name
+}
+
+// targetRefMoves returns keys of ready new endpoints' ports which replace ready old endpoints' ports of the same
+// Service Port Name and TargetRef but with a different address.
+func targetRefMoves(oldInfo, newInfo []epInfo) sets.String {
+	moves := sets.NewString()
+	oldRefs := make(map[string]sets.String)
+	for _, e := range oldInfo {
+		ref := targetRefKey(e)
+		if ref == "" || !e.ready {
+			continue
+		}
+		key := e.name.String() + "/" + ref
+		if oldRefs[key] == nil {
+			oldRefs[key] = sets.NewString()
+		}
+		oldRefs[key].Insert(e.addr.IP)
+	}
+	for _, e := range newInfo {
+		ref := targetRefKey(e)
+		if ref == "" || !e.ready {
+			continue
+		}
+		ips, ok := oldRefs[e.name.String()+"/"+ref]
+		if !ok || ips.Has(e.addr.IP) {
+			continue
+		}
+		moves.Insert(epInfoKey(e))
+	}
+
+	return moves
+}
+
+// resolveEndpointSlice returns a copy of FQDN EndpointSlice with FQDNs replaced by addresses they resolve to,
+// if FQDN resolution is not enabled, the slice is returned as is and its FQDN addresses are skipped.
+// EndpointSlices of other address types are returned as is.
+func (p *proxy) resolveEndpointSlice(epsl *discovery.EndpointSlice) *discovery.EndpointSlice {
+	if epsl.AddressType != discovery.AddressTypeFQDN {
+		return epsl
+	}
+	if !p.resolveSliceFQDN {
+		klog.Warningf("Endpoint Slice %s/%s has %s address type and FQDN resolution is not enabled, its endpoints are skipped",
+			epsl.Namespace, epsl.Name, epsl.AddressType)
+		return epsl
+	}
+	resolved := epsl.DeepCopy()
+	for i := range resolved.Endpoints {
+		var ips []string
+		for _, fqdn := range resolved.Endpoints[i].Addresses {
+			ctx, cancel := context.WithTimeout(context.Background(), fqdnResolveTimeout)
+			addrs, err := resolveFQDN(ctx, p.resolver, fqdn)
+			cancel()
+			if err != nil {
+				klog.Warningf("failed to resolve %s of Endpoint Slice %s/%s with error: %+v", fqdn, epsl.Namespace, epsl.Name, err)
+				continue
+			}
+			ips = append(ips, addrs...)
+		}
+		resolved.Endpoints[i].Addresses = ips
+	}
+
+	return resolved
+}
+
+type logSeverity int
+
+const (
+	severityInfo logSeverity = iota
+	severityError
+)
+
+// logCacheMiss logs an object not found in the cache during update, before initial sync is completed, for example
+// after a restart, the cache is cold and misses are expected, once synced a miss indicates a bug.
+func (p *proxy) logCacheMiss(kind, namespace, name string) logSeverity {
+	if !p.isSynced() {
+		klog.Infof("Update did not find %s %s/%s in cache before initial sync is completed, using old object", kind, namespace, name)
+		return severityInfo
+	}
+	klog.Errorf("Update did not find %s %s/%s in cache, it is a bug, please file an issue", kind, namespace, name)
+
+	return severityError
+}
+
+// isAddressOfType returns false if ip address's family disagrees with ip family declared by EndpointSlice's
+// address type. Address types not declaring ip family, like resolved FQDN, accept addresses of any family.
+func isAddressOfType(addr string, addressType discovery.AddressType) bool {
+	switch addressType {
+	case discovery.AddressTypeIPv4:
+		return !utilnet.IsIPv6String(addr)
+	case discovery.AddressTypeIPv6:
+		return utilnet.IsIPv6String(addr)
+	}
+
+	return true
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package proxy
 
 import (
+	"fmt"
+	"net"
 	"time"
 
 	utilnftables "github.com/google/nftables"
@@ -24,13 +26,19 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
-	utilproxy "k8s.io/kubernetes/pkg/proxy/util"
 	utilnet "k8s.io/utils/net"
 )
 
 func (p *proxy) AddService(svc *v1.Service) {
 	s := time.Now()
 	defer klog.V(5).Infof("AddService for a service %s/%s ran for: %d nanoseconds", svc.Namespace, svc.Name, time.Since(s))
+	// Add of already programmed service, for example re-sent on informer resync, might carry changes,
+	// it is processed as an update against the last known service.
+	if storedSvc, ok := p.duplicateAdd(svc); ok {
+		klog.V(5).Infof("AddService for already existing service %s/%s, processing it as an update", svc.Namespace, svc.Name)
+		p.UpdateService(storedSvc, svc)
+		return
+	}
 	// Storing new service in the cache for later reference
 	p.cache.storeSvcInCache(svc)
 	klog.V(5).Infof("AddService for a service %s/%s", svc.Namespace, svc.Name)
@@ -44,84 +52,297 @@ func (p *proxy) AddService(svc *v1.Service) {
 		stickySeconds := int(*svc.Spec.SessionAffinityConfig.ClientIP.TimeoutSeconds)
 		klog.V(5).Infof("Service %s/%s has SessionAffinity set for %d seconds", svc.Namespace, svc.Name, stickySeconds)
 	}
-	svcName := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
-	if utilproxy.ShouldSkipService(svcName, svc) {
+	svcName := nameOf(&svc.ObjectMeta)
+	if shouldSkipService(svcName.NamespacedName, svc, p.headlessNodePorts) {
 		return
 	}
+	if reason := p.unmanagedReason(svc); reason != "" {
+		// Service is kept in the cache, it is programmed if an update makes it managed
+		klog.Infof("service %s is not managed: %s, skipping the service", svcName.String(), reason)
+		return
+	}
+	p.addServicePorts(svc)
+}
+
+// addServicePorts programs Service Ports of a service which is not skipped.
+func (p *proxy) addServicePorts(svc *v1.Service) {
+	// Service with invalid ClusterIP gets its other addresses and NodePorts programmed, headless service
+	// has no ClusterIP by design
+	if err := validateClusterIP(svc); err != nil && svc.Spec.ClusterIP != v1.ClusterIPNone {
+		p.warnInvalidClusterIP(svc, err)
+	}
+	if len(svc.Spec.Ports) == 0 {
+		// Service is kept in the cache, ports added by a later update will be processed as new ports.
+		klog.V(5).Infof("service %s/%s has no ports, nothing to program", svc.Namespace, svc.Name)
+	}
 	for i := range svc.Spec.Ports {
 		servicePort := &svc.Spec.Ports[i]
-		svcPortName := getSvcPortName(svc.Name, svc.Namespace, servicePort.Name, servicePort.Protocol)
+		if !isSupportedProtocol(servicePort.Protocol) {
+			p.warnUnsupportedProtocol(svc, servicePort)
+			continue
+		}
+		svcPortName := getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)
 		baseSvcInfo := newBaseServiceInfo(servicePort, svc)
 		p.addServicePort(svcPortName, servicePort, svc, baseSvcInfo)
 	}
+	// If the service forwards to a FQDN, its endpoints are programmed from resolved addresses
+	p.startFQDNResolver(svc)
 }
 
-func (p *proxy) addServicePort(svcPortName ServicePortName, servicePort *v1.ServicePort, svc *v1.Service, baseSvcInfo *BaseServiceInfo) {
-	klog.V(5).Infof("add Service Port Name: %+v", svcPortName)
+// duplicateAdd returns the last known service and true if any of the service's ports, either new or last known,
+// is already programmed.
+func (p *proxy) duplicateAdd(svc *v1.Service) (*v1.Service, bool) {
+	storedSvc, err := p.cache.getLastKnownSvcFromCache(nameOf(&svc.ObjectMeta))
+	if err != nil {
+		return nil, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, ports := range [][]v1.ServicePort{storedSvc.Spec.Ports, svc.Spec.Ports} {
+		for _, servicePort := range ports {
+			if _, ok := p.serviceMap[getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)]; ok {
+				return storedSvc, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// waitServicePortInFlight blocks until the Service Port is not in flight, so it is not changed while its own chains
+// are programmed with p.mu released. p.mu must be held by the caller.
+func (p *proxy) waitServicePortInFlight(svcPortName ServicePortName) {
+	for p.servicePortsInFlight[svcPortName] {
+		p.inFlightDone.Wait()
+	}
+}
+
+// waitServiceInFlight blocks until none of the services' Service Ports is in flight.
+func (p *proxy) waitServiceInFlight(svcs ...*v1.Service) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	for _, svc := range svcs {
+		if svc == nil {
+			continue
+		}
+		for _, servicePort := range svc.Spec.Ports {
+			p.waitServicePortInFlight(getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol))
+		}
+	}
+}
 
-	if _, ok := p.serviceMap[svcPortName]; ok {
-		klog.Warningf("Service port name %+v already exists", svcPortName)
-		return
+// doneServicePortInFlight marks the Service Port as no longer in flight and wakes up changes waiting for it.
+// p.mu must be held by the caller.
+func (p *proxy) doneServicePortInFlight(svcPortName ServicePortName) {
+	delete(p.servicePortsInFlight, svcPortName)
+	p.inFlightDone.Broadcast()
+}
+
+// addServicePort programs a Service Port, failures are logged and returned.
+func (p *proxy) addServicePort(svcPortName ServicePortName, servicePort *v1.ServicePort, svc *v1.Service, baseSvcInfo *BaseServiceInfo) error {
+	klog.V(5).Infof("add Service Port Name: %+v", svcPortName)
+	p.mu.Lock()
+	var pending []pendingEndpoint
+	defer func() {
+		p.mu.Unlock()
+		// Endpoints which arrived before the service get their rules programmed with p.mu released
+		p.wirePendingEndpoints(svcPortName, pending)
+	}()
+
+	if _, ok := p.serviceMap[svcPortName]; ok || p.servicePortsInFlight[svcPortName] {
+		warnings.warningf(warnAlreadyExists, "Service port name %+v already exists", svcPortName)
+		return nil
 	}
 	// TODO, Consider moving it to newBaseServiceInfo
 	tableFamily := utilnftables.TableFamilyIPv4
 	if utilnet.IsIPv6String(svc.Spec.ClusterIP) {
 		tableFamily = utilnftables.TableFamilyIPv6
 	}
-	svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), baseSvcInfo.String())
+	svcID := p.sepNamer.allocateServiceID(svcPortName.String(), string(servicePort.Protocol), baseSvcInfo.String())
 	baseSvcInfo.svcnft.Interface = p.nfti
 	baseSvcInfo.svcnft.ServiceID = svcID
 	baseSvcInfo.svcnft.Chains = nftables.GetSvcChain(tableFamily, svcID)
+	// External IPs of the other ip family need the Service Port's chains in the table of their family
+	extFamilies := externalIPFamilies(baseSvcInfo, tableFamily)
+	for _, family := range extFamilies {
+		baseSvcInfo.svcnft.Chains[family] = nftables.GetSvcChain(family, svcID)[family]
+	}
+	// LoadBalancer of a class not managed by the proxy is skipped
+	p.applyLoadBalancerClass(svc, baseSvcInfo)
+	// Once the node drained external paths, new services with externalTrafficPolicy Local get none
+	baseSvcInfo.externalDrained = p.externalPathsDrained && baseSvcInfo.onlyNodeLocalEndpoints
 	// Check if new ServicePort requests Affinity, get the timeout then
 	if svc.Spec.SessionAffinity == v1.ServiceAffinityClientIP {
 		baseSvcInfo.svcnft.WithAffinity = true
 		baseSvcInfo.svcnft.MaxAgeSeconds = int(*svc.Spec.SessionAffinityConfig.ClientIP.TimeoutSeconds)
 	}
-	// Check if new ServicePort already has or not corresponding endpoints entries, if not then
-	// ServicePort is added to No Endpoint set.
-	if len(p.endpointsMap[svcPortName]) == 0 {
-		klog.V(5).Infof("Service Port Name: %+v has no endpoints", svcPortName)
-		if err := p.addToNoEndpointsList(baseSvcInfo, tableFamily); err != nil {
-			klog.Errorf("failed to add %s to No Endpoints Set with error: %+v", svcPortName.String(), err)
-		}
-		baseSvcInfo.svcnft.WithEndpoints = false
-	} else {
-		klog.V(5).Infof("Service Port Name: %+v has %d endpoints", svcPortName, len(p.endpointsMap[svcPortName]))
-		baseSvcInfo.svcnft.WithEndpoints = true
+	// Programming of the Service Port is done in steps, if any of them fails, all completed steps are rolled back
+	// and Service Port is not recorded in serviceMap, leaving nothing half-programmed.
+	// Service Port's own chains and affinity map are not shared with other Service Ports, they are programmed
+	// with p.mu released, so Service Ports can be programmed in parallel.
+	ownSteps := []programStep{
+		{
+			// Creating a set of chains (k8s-nfproxy-svc-{svcID}, k8s-nfproxy-fw-{svcID}, k8s-nfproxy-xlb-{svcID}) for a service port
+			name: "adding service chains",
+			apply: func() error {
+				return p.programNFT("adding service chains", func() error {
+					return nftables.AddServiceChains(p.nfti, tableFamily, svcID)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("deleting service chains", func() error {
+					return nftables.DeleteServiceChains(p.nfti, tableFamily, svcID)
+				})
+			},
+			prerequisite: true,
+		},
 	}
-	// Creating a set of chains (k8s-nfproxy-svc-{svcID}, k8s-nfproxy-fw-{svcID}, k8s-nfproxy-xlb-{svcID}) for a service port
-	if err := nftables.AddServiceChains(p.nfti, tableFamily, svcID); err != nil {
-		klog.Errorf("failed to add service port %s chains with error: %+v", svcPortName.String(), err)
-		return
+	for _, family := range extFamilies {
+		family := family
+		ownSteps = append(ownSteps, programStep{
+			name: fmt.Sprintf("adding %s service chains", tableFamilyLabel(family)),
+			apply: func() error {
+				return p.programNFT("adding service chains", func() error {
+					return nftables.AddServiceChains(p.nfti, family, svcID)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("deleting service chains", func() error {
+					return nftables.DeleteServiceChains(p.nfti, family, svcID)
+				})
+			},
+			prerequisite: true,
+		})
 	}
 	if baseSvcInfo.svcnft.WithAffinity {
 		klog.V(6).Infof("Service Port: %+v needs Session Affinity rules", svcPortName)
-		if err := nftables.AddServiceAffinityMap(p.nfti, tableFamily, svcID, baseSvcInfo.svcnft.MaxAgeSeconds); err != nil {
-			klog.Errorf("failed to add service affinity map for port %s with error: %+v", svcPortName.String(), err)
-			return
-		}
+		ownSteps = append(ownSteps, programStep{
+			name: "adding service affinity map",
+			apply: func() error {
+				return p.programNFT("adding service affinity map", func() error {
+					return nftables.AddServiceAffinityMap(p.nfti, tableFamily, svcID, baseSvcInfo.svcnft.MaxAgeSeconds)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("deleting service affinity map", func() error {
+					return nftables.DeleteServiceAffinityMap(p.nfti, tableFamily, svcID)
+				})
+			},
+			prerequisite: true,
+		})
+	}
+	// Service Port is marked in flight, so it is not added again while p.mu is released, its deletion and updates
+	// wait for the add to complete.
+	p.servicePortsInFlight[svcPortName] = true
+	p.mu.Unlock()
+	err := applySteps(ownSteps)
+	p.mu.Lock()
+	p.doneServicePortInFlight(svcPortName)
+	releaseServiceID := func() {
+		p.sepNamer.releaseServiceID(svcID, svcPortName.String(), string(servicePort.Protocol), baseSvcInfo.String())
+	}
+	if abandoned, ok := err.(*abandonedStepsError); ok {
+		klog.Errorf("failed to add service port %s, changes are rolled back once abandoned call completes, error: %+v", svcPortName.String(), err)
+		p.rollbackAbandoned(svcPortName, abandoned, nil, releaseServiceID)
+		p.recordServicePortFailure(svcPortName, err)
+		return err
+	}
+	if err != nil {
+		klog.Errorf("failed to add service port %s, all changes were rolled back, error: %+v", svcPortName.String(), err)
+		releaseServiceID()
+		p.retryOnProgrammingTimeout(svcPortName, err)
+		p.recordServicePortFailure(svcPortName, err)
+		return err
+	}
+	for family := range baseSvcInfo.svcnft.Chains {
+		p.audit.record(auditAddService, svcPortName, family, nftables.K8sSvcPrefix+svcID, nil, nil)
+	}
+	// Endpoints might have changed while p.mu was released
+	baseSvcInfo.svcnft.WithEndpoints = len(p.getServicePortEndpointChains(svcPortName, tableFamily)) != 0
+	klog.V(5).Infof("Service Port Name: %+v has %d endpoints", svcPortName, len(p.endpointsMap[svcPortName]))
+	steps := []programStep{
+		{
+			// Check if new ServicePort already has or not corresponding endpoints entries, if not then
+			// ServicePort's addresses of the family without endpoints are added to No Endpoint set.
+			name: "updating no endpoints set",
+			apply: func() error {
+				for family := range serviceAddressesByFamily(baseSvcInfo) {
+					p.updateNoEndpointsList(baseSvcInfo, svcPortName, family, len(p.getServicePortEndpointChains(svcPortName, family)) != 0)
+				}
+				return nil
+			},
+			rollback: func() error {
+				for family := range baseSvcInfo.noEndpoints {
+					if err := p.removeFromNoEndpointsList(baseSvcInfo, family); err != nil {
+						return err
+					}
+					delete(baseSvcInfo.noEndpoints, family)
+				}
+				return nil
+			},
+		},
+	}
+	if baseSvcInfo.svcnft.WithAffinity {
 		// Since ServicePort now has Service Affinity configuration, need to check if it has already Endpoints and if it is the case
 		// each Endpoint needs "Update" rule to be inserted as a very first rule.
 		if baseSvcInfo.svcnft.WithEndpoints {
 			eps, _ := p.endpointsMap[svcPortName]
 			klog.V(6).Infof("Service Port %+v needs its %d endpoint(s) to be programmed with update rule", svcPortName, len(eps))
-			if err := p.addAffinityEndpoint(eps, tableFamily, svcID, baseSvcInfo.svcnft.MaxAgeSeconds); err != nil {
-				klog.Errorf("failed to add endpoint affinity update rule for port %s with error: %+v", svcPortName.String(), err)
-			}
+			steps = append(steps, programStep{
+				name: "adding endpoints affinity update rules",
+				apply: func() error {
+					return p.addAffinityEndpoint(eps, tableFamily, svcID, baseSvcInfo.svcnft.MaxAgeSeconds)
+				},
+				rollback: func() error {
+					return p.deleteAffinityEndpoint(eps, tableFamily)
+				},
+				// Endpoints' rules are shared with the endpoints map
+				locked: true,
+			})
 		}
 	}
 	// Populting cluster, external and loadbalancer sets with Service Port information
-	if err := p.addServicePortToSets(baseSvcInfo, tableFamily, svcID); err != nil {
-		klog.Errorf("failed to add service port %s to sets with error: %+v", svcPortName.String(), err)
-		return
+	steps = append(steps, p.servicePortSetsSteps(baseSvcInfo, tableFamily, svcID)...)
+	err = applySteps(steps)
+	if abandoned, ok := err.(*abandonedStepsError); ok {
+		klog.Errorf("failed to add service port %s, changes are rolled back once abandoned call completes, error: %+v", svcPortName.String(), err)
+		p.rollbackAbandoned(svcPortName, abandoned, ownSteps, releaseServiceID)
+		p.recordServicePortFailure(svcPortName, err)
+		return err
+	}
+	if err != nil {
+		klog.Errorf("failed to add service port %s, all changes were rolled back, error: %+v", svcPortName.String(), err)
+		rollbackSteps(ownSteps)
+		releaseServiceID()
+		p.retryOnProgrammingTimeout(svcPortName, err)
+		p.recordServicePortFailure(svcPortName, err)
+		return err
 	}
 	// All services chains/rules are ready, safe to add svcPortName th serviceMap
 	p.serviceMap[svcPortName] = newServiceInfo(servicePort, svc, baseSvcInfo)
-	if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
-		klog.Errorf("failed to update service %s chain with endpoint rule with error: %+v", svcPortName.String(), err)
+	p.clearServicePortFailure(svcPortName)
+	pending = p.takePendingEndpoints(p.serviceMap[svcPortName].(*serviceInfo), p.endpointsMap[svcPortName])
+	for _, family := range append([]utilnftables.TableFamily{tableFamily}, extFamilies...) {
+		if err := p.updateServiceChain(svcPortName, family); err != nil {
+			klog.Errorf("failed to update service %s chain with endpoint rule with error: %+v", svcPortName.String(), err)
+			return err
+		}
+	}
+	rollback := func() {
+		if err := p.unprogramServicePort(svcPortName, baseSvcInfo); err != nil {
+			klog.Errorf("failed to roll back not verified service port %s with error: %+v", svcPortName.String(), err)
+		}
+		delete(p.serviceMap, svcPortName)
+		p.sepNamer.releaseServiceID(svcID, svcPortName.String(), string(servicePort.Protocol), baseSvcInfo.String())
 	}
+	if err := p.verifyServicePort(svcPortName, tableFamily, rollback); err != nil {
+		p.recordServicePortFailure(svcPortName, err)
+		return err
+	}
+	p.startHealthCheck(svcPortName, baseSvcInfo)
+	p.serviceProgrammed(svcPortName)
+
+	return nil
 }
 
 func (p *proxy) DeleteService(svc *v1.Service) {
@@ -131,21 +352,29 @@ func (p *proxy) DeleteService(svc *v1.Service) {
 	if svc == nil {
 		return
 	}
+	// Endpoints programmed by FQDN resolver are removed together with the rest of the service's endpoints
+	p.stopFQDNResolver(nameOf(&svc.ObjectMeta), false)
 	for i := range svc.Spec.Ports {
 		servicePort := &svc.Spec.Ports[i]
-		svcPortName := getSvcPortName(svc.Name, svc.Namespace, servicePort.Name, servicePort.Protocol)
+		svcPortName := getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)
 		p.deleteServicePort(svcPortName, servicePort, svc)
+		// Endpoints delete event might arrive after the service is gone or not arrive at all,
+		// endpoints chains of the deleted service port must not be left behind.
+		p.deleteServicePortEndpoints(svcPortName)
 	}
 	// removing deleted service from cache
-	p.cache.removeSvcFromCache(svc.Name, svc.Namespace)
+	p.cache.removeSvcFromCache(nameOf(&svc.ObjectMeta))
 }
 
 func (p *proxy) deleteServicePort(svcPortName ServicePortName, servicePort *v1.ServicePort, svc *v1.Service) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	// Service Port being added is deleted once the add completes, otherwise the add would record the deleted port
+	p.waitServicePortInFlight(svcPortName)
+	p.clearServicePortFailure(svcPortName)
 	svcInfo, ok := p.serviceMap[svcPortName]
 	if !ok {
-		klog.Warningf("Service port name %+v does not exist", svcPortName)
+		warnings.warningf(warnNotFound, "Service port name %+v does not exist", svcPortName)
 		return
 	}
 	klog.V(6).Infof("deleting service port: %s for service: %s/%s", svcPortName.String(), svc.Namespace, svc.Name)
@@ -158,11 +387,31 @@ func (p *proxy) deleteServicePort(svcPortName ServicePortName, servicePort *v1.S
 	//	baseInfo.svcnft = svcInfo.(*serviceInfo).BaseServiceInfo.svcnft
 	//	baseInfo.svcName = svcInfo.(*serviceInfo).BaseServiceInfo.svcName
 	//	baseInfo.svcNamespace = svcInfo.(*serviceInfo).BaseServiceInfo.svcNamespace
+	if err := p.unprogramServicePort(svcPortName, baseInfo); err != nil {
+		return
+	}
+
+	// Delete svcPortName from known svcPortName map
+	delete(p.serviceMap, svcPortName)
+	p.sepNamer.releaseServiceID(baseInfo.svcnft.ServiceID, svcPortName.String(), string(baseInfo.protocol), baseInfo.String())
+	p.releaseTerminatingNamespace(svcPortName.NamespacedName.Namespace)
+	p.clearEndpointsOverflow(svcPortName)
+	delete(p.pins, svcPortName)
+	p.stopHealthCheck(svcPortName, baseInfo)
+	p.serviceUnprogrammed(svcPortName)
+}
+
+// unprogramServicePort removes Service Port's addresses from sets, its chains and rules, failures to remove
+// affinity rules and map are returned. It must be called with p.mu held.
+func (p *proxy) unprogramServicePort(svcPortName ServicePortName, baseInfo *BaseServiceInfo) error {
 	_, tableFamily := getIPFamily(baseInfo.ClusterIP().String())
 
-	if !baseInfo.svcnft.WithEndpoints {
-		// svcPortName does not have any endpoints, need to remove service entry from "No endpointd Set"
-		if err := p.removeFromNoEndpointsList(baseInfo, tableFamily); err != nil {
+	for family, inList := range baseInfo.noEndpoints {
+		if !inList {
+			continue
+		}
+		// svcPortName does not have any endpoints of the family, need to remove service entry from "No endpointd Set"
+		if err := p.removeFromNoEndpointsList(baseInfo, family); err != nil {
 			klog.Errorf("failed to remove %s from \"No Endpoints Set\" with error: %+v", svcPortName.String(), err)
 		}
 	}
@@ -171,12 +420,15 @@ func (p *proxy) deleteServicePort(svcPortName ServicePortName, servicePort *v1.S
 	if err := p.removeServicePortFromSets(baseInfo, tableFamily, baseInfo.svcnft.ServiceID); err != nil {
 		klog.Errorf("failed to remove service port %s from sets with error: %+v", svcPortName.String(), err)
 	}
-	// Remove svcPortName related chains and rules
-	for chain, rules := range baseInfo.svcnft.Chains[tableFamily].Chain {
-		if len(rules.RuleID) != 0 {
-			if err := nftables.DeleteServiceRules(p.nfti, tableFamily, chain, rules.RuleID); err != nil {
-				klog.Errorf("failed to delete rules chain: %s service port name: %s with error: %+v", chain, svcPortName.String(), err)
-			}
+	// Remove svcPortName related chains and rules, all at once and if it fails one by one. Besides chains in the table
+	// of Service Port's family, chains in the table of the other ip family carry external IPs of that family.
+	for family, chains := range baseInfo.svcnft.Chains {
+		if err := nftables.DeleteServiceChainsBatch(p.nfti, family, chains); err != nil {
+			klog.Warningf("failed to delete %s chains of service port name: %s in a single transaction, deleting them one by one, error: %+v", tableFamilyLabel(family), svcPortName.String(), err)
+			p.deleteServicePortChains(svcPortName, baseInfo, family)
+		}
+		for chain, rules := range chains.Chain {
+			p.audit.record(auditDeleteService, svcPortName, family, chain, nil, rules.RuleID)
 		}
 	}
 	if baseInfo.svcnft.WithAffinity {
@@ -184,21 +436,65 @@ func (p *proxy) deleteServicePort(svcPortName ServicePortName, servicePort *v1.S
 			eps, _ := p.endpointsMap[svcPortName]
 			if err := p.deleteAffinityEndpoint(eps, tableFamily); err != nil {
 				klog.Errorf("failed to delete endpoint affinity update rule for port %s with error: %+v", svcPortName.String(), err)
-				return
+				return err
 			}
 		}
 		if err := nftables.DeleteServiceAffinityMap(p.nfti, tableFamily, baseInfo.svcnft.ServiceID); err != nil {
 			klog.Errorf("failed to delete service affinity map for port %s with error: %+v", svcPortName.String(), err)
-			return
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteServicePortChains deletes rules and then chains of a Service Port one by one.
+func (p *proxy) deleteServicePortChains(svcPortName ServicePortName, baseInfo *BaseServiceInfo, tableFamily utilnftables.TableFamily) {
+	for chain, rules := range baseInfo.svcnft.Chains[tableFamily].Chain {
+		if len(rules.RuleID) != 0 {
+			if err := nftables.DeleteServiceRules(p.nfti, tableFamily, chain, rules.RuleID); err != nil {
+				klog.Errorf("failed to delete rules chain: %s service port name: %s with error: %+v", chain, svcPortName.String(), err)
+			}
 		}
 	}
 	// Removing service port specific chains
 	if err := nftables.DeleteServiceChains(p.nfti, tableFamily, baseInfo.svcnft.ServiceID); err != nil {
 		klog.Errorf("failed to delete chains for service port name: %s with error: %+v", svcPortName.String(), err)
 	}
+}
 
-	// Delete svcPortName from known svcPortName map
-	delete(p.serviceMap, svcPortName)
+// deleteServicePortEndpoints removes rules and chains of all endpoints of a deleted Service Port and
+// clears Service Port's entry in endpointsMap.
+func (p *proxy) deleteServicePortEndpoints(svcPortName ServicePortName) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	eps, ok := p.endpointsMap[svcPortName]
+	if !ok {
+		return
+	}
+	klog.V(5).Infof("removing %d endpoint(s) of deleted service port: %s", len(eps), svcPortName.String())
+	for _, ep := range eps {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok {
+			// Not recognize, skipping it
+			continue
+		}
+		p.stopEndpointWarmup(epInfo)
+		for tableFamily, rule := range epInfo.epnft.Rule {
+			if rule.RuleID == nil {
+				// Endpoint's rules are either pending or still being programmed, in the latter case
+				// addEndpoint cleans them up once it finds the endpoint is gone.
+				p.sepNamer.release(rule.Chain, svcPortName.String(), string(svcPortName.Protocol), epInfo.Endpoint)
+				continue
+			}
+			if err := p.epRules.deleteEndpointRules(tableFamily, rule); err != nil {
+				klog.Errorf("failed to delete endpoint rules and chain: %s service port name: %s with error: %+v", rule.Chain, svcPortName.String(), err)
+				continue
+			}
+			p.sepNamer.release(rule.Chain, svcPortName.String(), string(svcPortName.Protocol), epInfo.Endpoint)
+		}
+	}
+	delete(p.endpointsMap, svcPortName)
 }
 
 // TODO (sbezverk) Add update logic when Spec's fields example ExternalIPs, LoadbalancerIP etc are updated.
@@ -211,7 +507,7 @@ func (p *proxy) UpdateService(svcOld, svcNew *v1.Service) {
 	// Check if the version of Last Known Service's version matches with svcOld version
 	// mismatch would indicate lost update.
 	var storedSvc *v1.Service
-	ver, err := p.cache.getCachedSvcVersion(svcNew.Name, svcNew.Namespace)
+	ver, err := p.cache.getCachedSvcVersion(nameOf(&svcNew.ObjectMeta))
 	if err != nil {
 		klog.Errorf("UpdateService did not find service %s/%s in cache, it is a bug, please file an issue", svcNew.Namespace, svcNew.Name)
 		// Since cache does not have old known service entry, use svcOld
@@ -223,7 +519,20 @@ func (p *proxy) UpdateService(svcOld, svcNew *v1.Service) {
 		} else {
 			klog.V(5).Infof("old service %s/%s and last known stored in cache are in sync, version: %s", svcNew.Namespace, svcNew.Name, ver)
 		}
-		storedSvc, _ = p.cache.getLastKnownSvcFromCache(svcNew.Name, svcNew.Namespace)
+		storedSvc, _ = p.cache.getLastKnownSvcFromCache(nameOf(&svcNew.ObjectMeta))
+	}
+	// Service Ports being added are updated once the add completes
+	p.waitServiceInFlight(storedSvc, svcNew)
+	// Service which ClusterIP moved in or out of managed CIDRs, or which skip annotation changed, is added or removed as a whole
+	if p.processManagedChange(svcNew, storedSvc) {
+		p.cache.storeSvcInCache(svcNew)
+		return
+	}
+	// Service which ClusterIP changed ip family gets its Service Ports rebuilt in the table of the new family
+	if p.processClusterIPFamilyChange(svcNew, storedSvc) {
+		p.cache.storeSvcInCache(svcNew)
+		p.markServicePortsProgrammed(svcNew)
+		return
 	}
 	// Step 1 is to detect all changes with ServicePorts
 	p.processServicePortChanges(svcNew, storedSvc)
@@ -235,11 +544,35 @@ func (p *proxy) UpdateService(svcOld, svcNew *v1.Service) {
 	p.processLoadBalancerIPChange(svcNew, storedSvc)
 	// Step 5 is to detect changes in Service Affinity
 	p.processAffinityChange(svcNew, storedSvc)
+	// Step 6 is to detect changes of FQDN target, resolver gets restarted with the new target
+	if isFQDNTargetChanged(svcNew, storedSvc) {
+		p.stopFQDNResolver(nameOf(&svcNew.ObjectMeta), true)
+		p.startFQDNResolver(svcNew)
+	}
+	// Step 7 is to detect changes of traffic distribution, service chains get reprogrammed with the new endpoints selection
+	p.processTrafficDistributionChange(svcNew, storedSvc)
+	// Step 8 is to detect changes of destination port preservation, endpoints' DNAT rules get reprogrammed
+	p.processPreserveDstPortChange(svcNew, storedSvc)
+	// Step 9 is to detect changes of endpoint warmup, it applies to endpoints becoming ready from now on
+	p.processEndpointWarmupChange(svcNew, storedSvc)
 
 	// TODO (sbezverk) Check for changes for ServicePort's NodePort.
 
 	// Update service in cache after applying all changes
 	p.cache.storeSvcInCache(svcNew)
+	p.markServicePortsProgrammed(svcNew)
+}
+
+// markServicePortsProgrammed records the time of programming of the service's Service Ports.
+func (p *proxy) markServicePortsProgrammed(svc *v1.Service) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, servicePort := range svc.Spec.Ports {
+		if svcInfo, ok := p.serviceMap[getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)]; ok {
+			baseServiceInfo(svcInfo).lastProgrammed = now
+		}
+	}
 }
 
 // processServicePortChanges is called from the service Update handler, it checks for any changes in
@@ -256,14 +589,18 @@ func (p *proxy) processServicePortChanges(svcNew *v1.Service, storedSvc *v1.Serv
 	//	}
 	for i := range svcNew.Spec.Ports {
 		servicePort := &svcNew.Spec.Ports[i]
-		svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
+		if !isSupportedProtocol(servicePort.Protocol) {
+			p.warnUnsupportedProtocol(svcNew, servicePort)
+			continue
+		}
+		svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
 		baseSvcInfo := newBaseServiceInfo(servicePort, svcNew)
 		id, found := isServicePortInPorts(storedSvc.Spec.Ports, servicePort)
 		// if new servicePort is not found in the stored last known service and svcPortName does not already exist in ServiceMap
 		// then it is genuine new port, so addig it and then move to next
-		p.mu.Lock()
+		p.mu.RLock()
 		_, ok := p.serviceMap[svcPortName]
-		p.mu.Unlock()
+		p.mu.RUnlock()
 		if !found && !ok {
 			// Adding new service port
 			p.addServicePort(svcPortName, servicePort, svcNew, baseSvcInfo)
@@ -274,11 +611,13 @@ func (p *proxy) processServicePortChanges(svcNew *v1.Service, storedSvc *v1.Serv
 		// otherwise ServicePort would not have been found.
 		// Changes of Port.Name or Port.Protocol result in a new ServicePortName generated, hence the old one
 		// needs to be replaced.
-		oldServicePortName := getSvcPortName(storedSvc.Name, storedSvc.Namespace, storedSvc.Spec.Ports[id].Name, storedSvc.Spec.Ports[id].Protocol)
+		oldServicePortName := getObjSvcPortName(storedSvc, storedSvc.Spec.Ports[id].Name, storedSvc.Spec.Ports[id].Protocol)
 		if storedSvc.Spec.Ports[id].Name != servicePort.Name {
 			// ServicePortName change is a major change as ServicePortName is used to generate chain names
 			// it is safer to remove it and add a new one after.
+			// Endpoints of the old name are migrated, so the renamed Service Port is programmed with them.
 			p.deleteServicePort(oldServicePortName, &storedSvc.Spec.Ports[id], storedSvc)
+			p.migrateServicePortEndpoints(oldServicePortName, svcPortName)
 			p.addServicePort(svcPortName, servicePort, svcNew, baseSvcInfo)
 			klog.V(6).Infof("Service Port Name was changed from %s to %s and old %s was removed.", oldServicePortName, svcPortName, oldServicePortName)
 			continue
@@ -289,42 +628,103 @@ func (p *proxy) processServicePortChanges(svcNew *v1.Service, storedSvc *v1.Serv
 			storedSvc.Spec.Ports[id].Port != servicePort.Port {
 			// Deleting old ServicePort
 			p.deleteServicePort(oldServicePortName, &storedSvc.Spec.Ports[id], storedSvc)
-			// Add updated ServicePort
+			// Add updated ServicePort, it is programmed with its current NodePort
 			p.addServicePort(svcPortName, servicePort, svcNew, baseSvcInfo)
 			klog.V(6).Infof("Service Port Name was changed from %s to %s and old %s was removed.", oldServicePortName, svcPortName, oldServicePortName)
+			continue
 		}
 		// Check if there is a change in NodePort, if there is, then update NodePort set with new value.
-		if storedSvc.Spec.Ports[id].NodePort != svcNew.Spec.Ports[i].NodePort {
-			svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-			svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svc)
-			// Adding new NodePort if it is not 0, NodePort of 0 in svcNew.Spec.Ports[i].NodePort indicates the removal of NodePort
-			// from Service Port completely, in this case operation of addition is skipped.
-			if svcNew.Spec.Ports[i].NodePort != 0 {
-				if err := nftables.AddToNodeportSet(p.nfti, tableFamily, servicePort.Protocol, uint16(svcNew.Spec.Ports[i].NodePort), nftables.K8sSvcPrefix+svcID); err != nil {
-					klog.Errorf("update/add of NodePort %d for Service Port name: %+v failed with error %w", svcNew.Spec.Ports[i].NodePort, svcPortName, err)
-				}
-			}
-			// Removing old NodePort if it is not 0, NodePort of 0 in storedSvc.Spec.Ports[i].NodePort indicates the addition of NodePort
-			// to the Service Port which did not have NodePort before, in this case operation of removal is skipped.
-			if storedSvc.Spec.Ports[i].NodePort != 0 {
-				if err := nftables.RemoveFromNodeportSet(p.nfti, tableFamily, servicePort.Protocol, uint16(storedSvc.Spec.Ports[id].NodePort), nftables.K8sSvcPrefix+svcID); err != nil {
-					klog.Errorf("update/remove of NodePort %d for Service Port name: %+v failed with error %w", storedSvc.Spec.Ports[id].NodePort, svcPortName, err)
-				}
-			}
-			klog.V(5).Infof("NodePort changed from %d to %d for Service Port name: %+v", storedSvc.Spec.Ports[id].NodePort, svcNew.Spec.Ports[i].NodePort, svcPortName)
+		if storedSvc.Spec.Ports[id].NodePort != servicePort.NodePort {
+			p.processNodePortChange(svcPortName, tableFamily, servicePort.Protocol, storedSvc.Spec.Ports[id].NodePort, servicePort.NodePort)
 		}
 	}
 	// Processing deleted or undiscoverably changed ServicePorts, if ServicePort exists in storedSvc.Spec.Ports but
-	// does not exist in svcNew.Spec.Ports delete it.
+	// does not exist in svcNew.Spec.Ports delete it. A service which lost all its ports gets all of them removed.
+	for _, servicePort := range removedServicePorts(svcNew, storedSvc) {
+		svcPortName := getObjSvcPortName(storedSvc, servicePort.Name, servicePort.Protocol)
+		p.deleteServicePort(svcPortName, servicePort, storedSvc)
+		klog.V(5).Infof("removed Service port %+v", svcPortName)
+	}
+}
+
+// processNodePortChange updates NodePort of a programmed Service Port. NodePort of 0 means NodePort is not allocated,
+// for example while API server has not allocated it yet, so NodePort going from 0 to a value is only added and NodePort
+// going from a value to 0 is only removed.
+func (p *proxy) processNodePortChange(svcPortName ServicePortName, tableFamily utilnftables.TableFamily, proto v1.Protocol, oldNodePort, newNodePort int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		// Service Port has not been programmed, nothing to update
+		return
+	}
+	chain := nftables.K8sSvcPrefix + baseServiceInfo(svc).svcnft.ServiceID
+	if newNodePort != 0 {
+		if err := p.nodePortRules.add(tableFamily, proto, uint16(newNodePort), chain); err != nil {
+			klog.Errorf("update/add of NodePort %d for Service Port name: %+v failed with error %+v", newNodePort, svcPortName, err)
+			return
+		}
+	}
+	if oldNodePort != 0 {
+		if err := p.nodePortRules.remove(tableFamily, proto, uint16(oldNodePort), chain); err != nil {
+			klog.Errorf("update/remove of NodePort %d for Service Port name: %+v failed with error %+v", oldNodePort, svcPortName, err)
+		}
+	}
+	baseServiceInfo(svc).nodePort = int(newNodePort)
+	klog.V(5).Infof("NodePort changed from %d to %d for Service Port name: %+v", oldNodePort, newNodePort, svcPortName)
+}
+
+// removedServicePorts returns ServicePorts of storedSvc which do not exist in svcNew.
+func removedServicePorts(svcNew *v1.Service, storedSvc *v1.Service) []*v1.ServicePort {
+	var removed []*v1.ServicePort
 	for i := range storedSvc.Spec.Ports {
 		servicePort := &storedSvc.Spec.Ports[i]
-		svcPortName := getSvcPortName(storedSvc.Name, storedSvc.Namespace, servicePort.Name, servicePort.Protocol)
 		if _, found := isServicePortInPorts(svcNew.Spec.Ports, servicePort); !found {
-			p.deleteServicePort(svcPortName, servicePort, storedSvc)
-			klog.V(5).Infof("removed Service port %+v", svcPortName)
+			removed = append(removed, servicePort)
 		}
 	}
 
+	return removed
+}
+
+// getServicePortSvcID returns service ID of a programmed Service Port, false is returned if
+// the Service Port is not found in serviceMap.
+func (p *proxy) getServicePortSvcID(svcPortName ServicePortName) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return "", false
+	}
+
+	return svc.(*serviceInfo).svcnft.ServiceID, true
+}
+
+// externalIPServiceChains returns Service Port's ID making sure the Service Port has its chains in the table
+// of an external IP's family, the chains are created when the Service Port gets its first external IP of the other
+// family and kept until the Service Port is deleted.
+func (p *proxy) externalIPServiceChains(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return "", false
+	}
+	entry := svc.(*serviceInfo)
+	svcID := entry.svcnft.ServiceID
+	if _, ok := entry.svcnft.Chains[tableFamily]; ok {
+		return svcID, true
+	}
+	if err := nftables.AddServiceChains(p.nfti, tableFamily, svcID); err != nil {
+		klog.Errorf("failed to add %s chains of service port %s with error: %+v", tableFamilyLabel(tableFamily), svcPortName.String(), err)
+		return "", false
+	}
+	entry.svcnft.Chains[tableFamily] = nftables.GetSvcChain(tableFamily, svcID)[tableFamily]
+	if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
+		klog.Errorf("failed to update %s service %s chain with endpoint rule with error: %+v", tableFamilyLabel(tableFamily), svcPortName.String(), err)
+	}
+
+	return svcID, true
 }
 
 // processClusterIPChanges is called from the service Update handler, it checks for achange in
@@ -333,7 +733,9 @@ func (p *proxy) processClusterIPChanges(svcNew *v1.Service, storedSvc *v1.Servic
 	if storedSvc.Spec.ClusterIP == svcNew.Spec.ClusterIP {
 		return
 	}
-	if svcNew.Spec.ClusterIP != "" {
+	if err := validateClusterIP(svcNew); err != nil {
+		p.warnInvalidClusterIP(svcNew, err)
+	} else {
 		addr := svcNew.Spec.ClusterIP
 		klog.V(5).Infof("detected a new ClusterIP %s", addr)
 		tableFamily := utilnftables.TableFamilyIPv4
@@ -341,28 +743,136 @@ func (p *proxy) processClusterIPChanges(svcNew *v1.Service, storedSvc *v1.Servic
 			tableFamily = utilnftables.TableFamilyIPv6
 		}
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-			svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svc)
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcID, ok := p.getServicePortSvcID(svcPortName)
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
 			nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sClusterIPSet, nftables.K8sSvcPrefix+svcID)
 			//			nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+			if p.vipDefaultDeny {
+				if err := p.addVIPPort(svcPortName, tableFamily, addr); err != nil {
+					klog.Errorf("failed to add new ClusterIP %s of service port %s to VIPs with default deny with error: %+v", addr, svcPortName.String(), err)
+				}
+			}
 		}
 	}
-	if storedSvc.Spec.ClusterIP != "" {
+	if validateClusterIP(storedSvc) == nil {
 		addr := storedSvc.Spec.ClusterIP
 		klog.V(5).Infof("detected deleted ClusterIP %s", addr)
 		tableFamily := utilnftables.TableFamilyIPv4
 		if utilnet.IsIPv6String(addr) {
 			tableFamily = utilnftables.TableFamilyIPv6
 		}
+		if p.vipDefaultDeny {
+			// All Service Ports of the service move to the new ClusterIP
+			if err := p.programNFT("removing from set "+nftables.K8sVIPSet, func() error {
+				return nftables.RemoveVIP(p.nfti, tableFamily, addr)
+			}); err != nil {
+				klog.Errorf("failed to remove old ClusterIP %s of service %s/%s from VIPs with default deny with error: %+v", addr, svcNew.Namespace, svcNew.Name, err)
+			}
+		}
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svcBaseInfoString := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-			svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svcBaseInfoString)
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcID, ok := p.getServicePortSvcID(svcPortName)
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
+			if p.vipDefaultDeny {
+				proto, port := servicePort.Protocol, uint16(servicePort.Port)
+				if err := p.programNFT("removing from set "+nftables.K8sVIPPortsSet, func() error {
+					return nftables.RemoveFromVIPPortsSet(p.nfti, tableFamily, proto, addr, port)
+				}); err != nil {
+					klog.Errorf("failed to remove port %d of old ClusterIP %s of service port %s from defined ports with error: %+v", port, addr, svcPortName.String(), err)
+				}
+			}
 			nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sClusterIPSet, nftables.K8sSvcPrefix+svcID)
 			//			nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
 		}
 	}
+	// Service Ports follow the new ClusterIP, so No Endpoints set entries of backend-less Service Ports move with it
+	for _, servicePort := range svcNew.Spec.Ports {
+		p.updateServicePortClusterIP(getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol), storedSvc, svcNew)
+	}
+}
+
+// updateServicePortClusterIP records the new ClusterIP of a programmed Service Port. No Endpoints set is keyed by
+// addresses, if the Service Port is in the set, the entry of the old ClusterIP is replaced by the new ClusterIP,
+// otherwise the old ClusterIP would stay rejected and the new one would not be.
+func (p *proxy) updateServicePortClusterIP(svcPortName ServicePortName, storedSvc *v1.Service, svcNew *v1.Service) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return
+	}
+	base := baseServiceInfo(svc)
+	proto := base.Protocol()
+	port := uint16(base.Port())
+	if validateClusterIP(storedSvc) == nil {
+		addr := storedSvc.Spec.ClusterIP
+		if _, tableFamily := getIPFamily(addr); base.noEndpoints[tableFamily] {
+			klog.V(5).Infof("removing old ClusterIP %s of service port %s from No Endpoints set", addr, svcPortName.String())
+			if err := p.setElements.remove(tableFamily, proto, addr, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
+				klog.Errorf("failed to remove old ClusterIP %s of service port %s from No Endpoints set with error: %+v", addr, svcPortName.String(), err)
+			}
+		}
+	}
+	// Service ID is allocated for the Service Port's description which carries the ClusterIP
+	oldService := base.String()
+	base.clusterIP = net.ParseIP(svcNew.Spec.ClusterIP)
+	p.sepNamer.reownServiceID(base.svcnft.ServiceID, svcPortName.String(), string(base.protocol), oldService, base.String())
+	if validateClusterIP(svcNew) != nil {
+		return
+	}
+	addr := svcNew.Spec.ClusterIP
+	_, tableFamily := getIPFamily(addr)
+	if !base.noEndpoints[tableFamily] {
+		// Service Port which had no addresses of the family to reject gets the new ClusterIP rejected if it has no endpoints
+		p.updateNoEndpointsList(svc, svcPortName, tableFamily, len(p.getServicePortEndpointChains(svcPortName, tableFamily)) != 0)
+		return
+	}
+	klog.V(5).Infof("adding new ClusterIP %s of service port %s to No Endpoints set", addr, svcPortName.String())
+	if err := p.setElements.add(tableFamily, proto, addr, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
+		klog.Errorf("failed to add new ClusterIP %s of service port %s to No Endpoints set with error: %+v", addr, svcPortName.String(), err)
+	}
+}
+
+// clusterIPFamilyChange returns table families of the old and the new ClusterIP and true if both ClusterIPs
+// are valid and of different ip families, for example when a service is recreated with IPv6 ClusterIP.
+func clusterIPFamilyChange(svcNew *v1.Service, storedSvc *v1.Service) (utilnftables.TableFamily, utilnftables.TableFamily, bool) {
+	if validateClusterIP(svcNew) != nil || validateClusterIP(storedSvc) != nil {
+		return 0, 0, false
+	}
+	_, oldFamily := getIPFamily(storedSvc.Spec.ClusterIP)
+	_, newFamily := getIPFamily(svcNew.Spec.ClusterIP)
+
+	return oldFamily, newFamily, oldFamily != newFamily
+}
+
+// processClusterIPFamilyChange is called from the service Update handler, when ClusterIP changes ip family, Service Ports'
+// chains are removed from the table of the old family and created in the table of the new family. Endpoints are kept
+// with their rules, endpoints of the new family get wired to the new service chains, true is returned if the service
+// was rebuilt and needs no further processing.
+func (p *proxy) processClusterIPFamilyChange(svcNew *v1.Service, storedSvc *v1.Service) bool {
+	oldFamily, newFamily, changed := clusterIPFamilyChange(svcNew, storedSvc)
+	if !changed {
+		return false
+	}
+	svcName := nameOf(&svcNew.ObjectMeta)
+	klog.Infof("ClusterIP of service %s changed from %s %s to %s %s, rebuilding the service", svcName.String(),
+		tableFamilyLabel(oldFamily), storedSvc.Spec.ClusterIP, tableFamilyLabel(newFamily), svcNew.Spec.ClusterIP)
+	p.stopFQDNResolver(svcName, true)
+	for i := range storedSvc.Spec.Ports {
+		servicePort := &storedSvc.Spec.Ports[i]
+		svcPortName := getObjSvcPortName(storedSvc, servicePort.Name, servicePort.Protocol)
+		p.deleteServicePort(svcPortName, servicePort, storedSvc)
+	}
+	p.addServicePorts(svcNew)
+
+	return true
 }
 
 // processExternalIPChanges is called from the service Update handler, it checks for any changes in
@@ -382,9 +892,12 @@ func (p *proxy) processExternalIPChanges(svcNew *v1.Service, storedSvc *v1.Servi
 			tableFamily = utilnftables.TableFamilyIPv6
 		}
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-			svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svc)
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcID, ok := p.externalIPServiceChains(svcPortName, tableFamily)
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
 			nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID)
 			nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
 		}
@@ -400,9 +913,12 @@ func (p *proxy) processExternalIPChanges(svcNew *v1.Service, storedSvc *v1.Servi
 			tableFamily = utilnftables.TableFamilyIPv6
 		}
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svcBaseInfoString := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-			svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svcBaseInfoString)
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcID, ok := p.getServicePortSvcID(svcPortName)
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
 			nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID)
 			nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
 		}
@@ -416,6 +932,11 @@ func (p *proxy) processLoadBalancerIPChange(svcNew *v1.Service, storedSvc *v1.Se
 	if isIngressEqual(svcNew.Status.LoadBalancer.Ingress, storedSvc.Status.LoadBalancer.Ingress) {
 		return
 	}
+	if !p.isManagedLoadBalancer(svcNew) {
+		klog.V(5).Infof("service %s/%s has load balancer class %s which is not managed, skipping LoadBalancer IP changes",
+			svcNew.Namespace, svcNew.Name, getLoadBalancerClass(svcNew))
+		return
+	}
 	// Check new Service Loadbalancer status for entries missing in stored Service
 	for _, lbingress := range svcNew.Status.LoadBalancer.Ingress {
 		// TODO figure out what to do if addr.Host is used
@@ -427,11 +948,15 @@ func (p *proxy) processLoadBalancerIPChange(svcNew *v1.Service, storedSvc *v1.Se
 				tableFamily = utilnftables.TableFamilyIPv6
 			}
 			for _, servicePort := range svcNew.Spec.Ports {
-				svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-				svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-				svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svc)
+				svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+				svcID, ok := p.getServicePortSvcID(svcPortName)
+				if !ok {
+					// Service Port has not been programmed, nothing to update
+					continue
+				}
+				markSet, markChain := p.loadBalancerMarkSet()
 				nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sLoadbalancerIPSet, nftables.K8sSvcPrefix+svcID)
-				nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+				nftables.AddToSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), markSet, markChain)
 			}
 		}
 	}
@@ -447,11 +972,114 @@ func (p *proxy) processLoadBalancerIPChange(svcNew *v1.Service, storedSvc *v1.Se
 				tableFamily = utilnftables.TableFamilyIPv6
 			}
 			for _, servicePort := range svcNew.Spec.Ports {
-				svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-				svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.String()
-				svcID := servicePortSvcID(svcPortName.String(), string(servicePort.Protocol), svc)
+				svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+				svcID, ok := p.getServicePortSvcID(svcPortName)
+				if !ok {
+					// Service Port has not been programmed, nothing to update
+					continue
+				}
+				markSet, markChain := p.loadBalancerMarkSet()
 				nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sLoadbalancerIPSet, nftables.K8sSvcPrefix+svcID)
-				nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+				nftables.RemoveFromSet(p.nfti, tableFamily, servicePort.Protocol, addr, uint16(servicePort.Port), markSet, markChain)
+			}
+		}
+	}
+}
+
+// processTrafficDistributionChange is called from the service Update handler, it checks for changes in
+// traffic distribution, zone weight or node local preference and re-programs service chains of all ServicePorts
+// of the changed service.
+func (p *proxy) processTrafficDistributionChange(svcNew *v1.Service, storedSvc *v1.Service) {
+	preferClose := isPreferClose(svcNew)
+	zoneWeight := getZoneWeight(svcNew)
+	preferNodeLocal := isPreferNodeLocal(svcNew)
+	if preferClose == isPreferClose(storedSvc) && zoneWeight == getZoneWeight(storedSvc) && preferNodeLocal == isPreferNodeLocal(storedSvc) {
+		return
+	}
+	klog.V(5).Infof("Change in traffic distribution of service %s/%s detected", svcNew.Namespace, svcNew.Name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, servicePort := range svcNew.Spec.Ports {
+		svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+		svcInfo, ok := p.serviceMap[svcPortName]
+		if !ok {
+			continue
+		}
+		svcInfo.(*serviceInfo).preferClose = preferClose
+		svcInfo.(*serviceInfo).zoneWeight = zoneWeight
+		svcInfo.(*serviceInfo).preferNodeLocal = preferNodeLocal
+		for tableFamily := range svcInfo.(*serviceInfo).svcnft.Chains {
+			if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
+				klog.Errorf("failed to update service %s chain after traffic distribution change with error: %+v", svcPortName.String(), err)
+			}
+		}
+	}
+}
+
+// processPreserveDstPortChange is called from the service Update handler, it checks for changes in destination
+// port preservation and re-programs DNAT rules of endpoints of all ServicePorts of the changed service.
+func (p *proxy) processPreserveDstPortChange(svcNew *v1.Service, storedSvc *v1.Service) {
+	preserve := isPreserveDstPort(svcNew)
+	if preserve == isPreserveDstPort(storedSvc) {
+		return
+	}
+	klog.V(5).Infof("Change in destination port preservation of service %s/%s detected", svcNew.Namespace, svcNew.Name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, servicePort := range svcNew.Spec.Ports {
+		svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+		svcInfo, ok := p.serviceMap[svcPortName]
+		if !ok {
+			continue
+		}
+		svcInfo.(*serviceInfo).preserveDstPort = preserve
+		for _, ep := range p.endpointsMap[svcPortName] {
+			epInfo, ok := ep.(*endpointsInfo)
+			if !ok {
+				continue
+			}
+			for tableFamily := range epInfo.epnft.Rule {
+				p.reconcileEndpointDstPort(svcPortName, epInfo, tableFamily, !preserve)
+			}
+		}
+	}
+}
+
+// processEndpointWarmupChange is called from the service Update handler, it checks for changes in endpoint warmup
+// of the service and records the new period for all ServicePorts of the changed service. Once warmup is removed,
+// endpoints still warming up are added to the service's load balancing right away.
+func (p *proxy) processEndpointWarmupChange(svcNew *v1.Service, storedSvc *v1.Service) {
+	warmup := getEndpointWarmup(svcNew)
+	if warmup == getEndpointWarmup(storedSvc) {
+		return
+	}
+	klog.V(5).Infof("Change in endpoint warmup of service %s/%s detected", svcNew.Namespace, svcNew.Name)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, servicePort := range svcNew.Spec.Ports {
+		svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+		svcInfo, ok := p.serviceMap[svcPortName]
+		if !ok {
+			continue
+		}
+		svcInfo.(*serviceInfo).endpointWarmup = warmup
+		if warmup != 0 {
+			continue
+		}
+		families := make(map[utilnftables.TableFamily]bool)
+		for _, ep := range p.endpointsMap[svcPortName] {
+			epInfo, ok := ep.(*endpointsInfo)
+			if !ok || epInfo.warmup == nil {
+				continue
+			}
+			p.stopEndpointWarmup(epInfo)
+			for tableFamily := range epInfo.epnft.Rule {
+				families[tableFamily] = true
+			}
+		}
+		for tableFamily := range families {
+			if err := p.updateServiceChain(svcPortName, tableFamily); err != nil {
+				klog.Errorf("failed to update service %s chain after endpoint warmup removal with error: %+v", svcPortName.String(), err)
 			}
 		}
 	}
@@ -470,8 +1098,13 @@ func (p *proxy) processAffinityChange(svcNew *v1.Service, storedSvc *v1.Service)
 		defer p.mu.Unlock()
 		klog.V(6).Infof("Adding Service Affinity to Service Ports")
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.svcnft
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcInfo, ok := p.serviceMap[svcPortName]
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
+			svc := svcInfo.(*serviceInfo).BaseServiceInfo.svcnft
 			svcID := svc.ServiceID
 			chain := nftables.K8sSvcPrefix + svcID
 			maxAgeSeconds := svc.MaxAgeSeconds
@@ -513,8 +1146,13 @@ func (p *proxy) processAffinityChange(svcNew *v1.Service, storedSvc *v1.Service)
 		p.mu.Lock()
 		defer p.mu.Unlock()
 		for _, servicePort := range svcNew.Spec.Ports {
-			svcPortName := getSvcPortName(svcNew.Name, svcNew.Namespace, servicePort.Name, servicePort.Protocol)
-			svc := p.serviceMap[svcPortName].(*serviceInfo).BaseServiceInfo.svcnft
+			svcPortName := getObjSvcPortName(svcNew, servicePort.Name, servicePort.Protocol)
+			svcInfo, ok := p.serviceMap[svcPortName]
+			if !ok {
+				// Service Port has not been programmed, nothing to update
+				continue
+			}
+			svc := svcInfo.(*serviceInfo).BaseServiceInfo.svcnft
 			svcID := svc.ServiceID
 			chain := nftables.K8sSvcPrefix + svcID
 			// Only if Service Port has endpoints, proceed with clenaing up Affinity related rules
@@ -558,3 +1196,61 @@ func (p *proxy) processAffinityChange(svcNew *v1.Service, storedSvc *v1.Service)
 		}
 	}
 }
+
+// shouldSkipService returns true for services which are not proxied, headless and ExternalName services.
+// Unlike utilproxy.ShouldSkipService, services with empty ClusterIP are not skipped, such services are
+// programmed without ClusterIP. If headlessNodePorts is true, headless services with NodePorts are not skipped
+// either, they are programmed without ClusterIP as well.
+func shouldSkipService(svcName types.NamespacedName, svc *v1.Service, headlessNodePorts bool) bool {
+	if svc.Spec.ClusterIP == v1.ClusterIPNone && headlessNodePorts && hasNodePorts(svc) {
+		klog.V(3).Infof("Service %s is headless with node ports, only node ports are programmed", svcName)
+		return false
+	}
+	if svc.Spec.ClusterIP == v1.ClusterIPNone {
+		klog.V(3).Infof("Skipping service %s due to clusterIP = %q", svcName, svc.Spec.ClusterIP)
+		return true
+	}
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		klog.V(3).Infof("Skipping service %s due to Type=ExternalName", svcName)
+		return true
+	}
+
+	return false
+}
+
+// hasNodePorts returns true if any of service's ports has a NodePort allocated.
+func hasNodePorts(svc *v1.Service) bool {
+	for _, servicePort := range svc.Spec.Ports {
+		if servicePort.NodePort != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateClusterIP returns error if the service's ClusterIP is not a valid ip address, it happens
+// with partially populated services.
+func validateClusterIP(svc *v1.Service) error {
+	if net.ParseIP(svc.Spec.ClusterIP) == nil {
+		return fmt.Errorf("invalid cluster ip %q", svc.Spec.ClusterIP)
+	}
+
+	return nil
+}
+
+// warnUnsupportedProtocol logs and records an event for a Service Port skipped because of its protocol.
+func (p *proxy) warnUnsupportedProtocol(svc *v1.Service, servicePort *v1.ServicePort) {
+	klog.Warningf("service %s/%s port %s has unsupported protocol %q, skipping the port", svc.Namespace, svc.Name, servicePort.Name, servicePort.Protocol)
+	if p.recorder != nil {
+		p.recorder.Eventf(svc, v1.EventTypeWarning, "UnsupportedProtocol", "Port %s is not programmed, protocol %q is not supported", servicePort.Name, servicePort.Protocol)
+	}
+}
+
+// warnInvalidClusterIP logs and records an event for the service which ClusterIP cannot be programmed.
+func (p *proxy) warnInvalidClusterIP(svc *v1.Service, err error) {
+	klog.Warningf("service %s/%s has %+v, skipping programming of ClusterIP", svc.Namespace, svc.Name, err)
+	if p.recorder != nil {
+		p.recorder.Eventf(svc, v1.EventTypeWarning, "InvalidClusterIP", "ClusterIP is not programmed, %v", err)
+	}
+}
@@ -0,0 +1,937 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestZeroPortsServiceTransitions(t *testing.T) {
+	zeroPorts := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10"},
+	}
+	withPorts := zeroPorts.DeepCopy()
+	withPorts.ResourceVersion = "2"
+	withPorts.Spec.Ports = []v1.ServicePort{
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+		{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+	}
+	withoutPorts := zeroPorts.DeepCopy()
+	withoutPorts.ResourceVersion = "3"
+	serviceChains := func(conn *fake.Conn) int {
+		conn.Lock()
+		defer conn.Unlock()
+		n := 0
+		for _, chain := range conn.Chains {
+			if strings.HasPrefix(chain.Name, nftables.K8sSvcPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Service with zero ports must still be recorded in the cache
+	p, conn := newFakeNFTProxy(t, false)
+	p.AddService(zeroPorts)
+	if _, err := p.cache.getLastKnownSvcFromCache(nameOf(&zeroPorts.ObjectMeta)); err != nil {
+		t.Fatalf("expected service with zero ports to be stored in cache, got error: %+v", err)
+	}
+	if len(p.serviceMap) != 0 || serviceChains(conn) != 0 {
+		t.Fatalf("expected no Service Ports for a service with zero ports, got %d", len(p.serviceMap))
+	}
+
+	// Zero ports -> ports, all ports are added
+	p.UpdateService(zeroPorts, withPorts)
+	for _, name := range []string{"http", "https"} {
+		if _, ok := p.serviceMap[getSvcPortName("app", "default", name, v1.ProtocolTCP)]; !ok {
+			t.Errorf("expected port %s to be added", name)
+		}
+	}
+	if n := serviceChains(conn); n != 2 {
+		t.Errorf("expected chains of 2 Service Ports, got %d", n)
+	}
+
+	// Ports -> zero ports, all ports are removed
+	p.UpdateService(withPorts, withoutPorts)
+	if len(p.serviceMap) != 0 {
+		t.Errorf("expected all ports to be removed, got %d Service Ports", len(p.serviceMap))
+	}
+	if n := serviceChains(conn); n != 0 {
+		t.Errorf("expected chains of removed Service Ports to be deleted, got %d", n)
+	}
+}
+
+func TestLoadBalancerClass(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{loadBalancerClassAnnotation: "example.com/other-lb"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeLoadBalancer,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}}},
+		},
+	}
+	lbSteps := func(p *proxy) int {
+		baseSvcInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+		p.applyLoadBalancerClass(svc, baseSvcInfo)
+		n := 0
+		for _, step := range p.servicePortSetsSteps(baseSvcInfo, utilnftables.TableFamilyIPv4, "svcid") {
+			if strings.Contains(step.name, nftables.K8sLoadbalancerIPSet) {
+				n++
+			}
+		}
+		return n
+	}
+
+	p := newTestProxy()
+	p.lbClasses = sets.NewString("example.com/nfproxy")
+	if n := lbSteps(p); n != 0 {
+		t.Errorf("expected no LoadBalancer rules for a service with not managed class, got %d", n)
+	}
+	p.lbClasses = sets.NewString("example.com/nfproxy", "example.com/other-lb")
+	if n := lbSteps(p); n != 1 {
+		t.Errorf("expected LoadBalancer rules for a service with managed class, got %d", n)
+	}
+	// Empty set of classes means all classes are managed
+	p.lbClasses = nil
+	if n := lbSteps(p); n != 1 {
+		t.Errorf("expected LoadBalancer rules when all classes are managed, got %d", n)
+	}
+}
+
+func TestDuplicateAddService(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	changed := svc.DeepCopy()
+	changed.ResourceVersion = "2"
+	changed.Spec.Ports[0].Port = 8080
+
+	p := newTestProxy()
+	if _, ok := p.duplicateAdd(svc); ok {
+		t.Fatalf("expected first Add not to be considered duplicate")
+	}
+	// State after the first Add was programmed
+	p.cache.storeSvcInCache(svc)
+	svcPortName := getSvcPortName(svc.Name, svc.Namespace, "http", v1.ProtocolTCP)
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, newBaseServiceInfo(&svc.Spec.Ports[0], svc))
+
+	storedSvc, ok := p.duplicateAdd(changed)
+	if !ok {
+		t.Fatalf("expected second Add to be processed as an update")
+	}
+	if storedSvc.ResourceVersion != "1" {
+		t.Errorf("expected update against last known service version 1, got %s", storedSvc.ResourceVersion)
+	}
+	// Update diff must see the changed port, which gets reprogrammed as the port is matched by name
+	id, found := isServicePortInPorts(storedSvc.Spec.Ports, &changed.Spec.Ports[0])
+	if !found || storedSvc.Spec.Ports[id].Port == changed.Spec.Ports[0].Port {
+		t.Errorf("expected port change from 80 to 8080 to be detected")
+	}
+}
+
+func TestInvalidClusterIP(t *testing.T) {
+	for _, clusterIP := range []string{"", "10.96.0.300"} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:        v1.ServiceTypeNodePort,
+				ClusterIP:   clusterIP,
+				ExternalIPs: []string{"192.168.1.10"},
+				Ports:       []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		if shouldSkipService(types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}, svc, false) {
+			t.Fatalf("expected service with cluster ip %q not to be skipped", clusterIP)
+		}
+		if err := validateClusterIP(svc); err == nil {
+			t.Fatalf("expected cluster ip %q to fail validation", clusterIP)
+		}
+		recorder := record.NewFakeRecorder(1)
+		p := newTestProxy()
+		p.recorder = recorder
+		p.warnInvalidClusterIP(svc, validateClusterIP(svc))
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "InvalidClusterIP") {
+				t.Errorf("expected InvalidClusterIP event, got %q", event)
+			}
+		default:
+			t.Errorf("expected event for cluster ip %q", clusterIP)
+		}
+
+		// ClusterIP steps are skipped, external ip and node port are still programmed
+		baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+		steps := p.servicePortSetsSteps(baseInfo, utilnftables.TableFamilyIPv4, "svcid")
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.name)
+		}
+		if len(steps) != 3 {
+			t.Fatalf("expected 2 external ip and 1 node port steps for cluster ip %q, got %v", clusterIP, names)
+		}
+		for _, name := range names {
+			if strings.Contains(name, nftables.K8sClusterIPSet) {
+				t.Errorf("expected no cluster ip step for cluster ip %q, got %q", clusterIP, name)
+			}
+		}
+	}
+
+	svc := &v1.Service{Spec: v1.ServiceSpec{ClusterIP: "10.96.0.10"}}
+	if err := validateClusterIP(svc); err != nil {
+		t.Errorf("expected valid cluster ip, got error: %+v", err)
+	}
+}
+
+func TestHeadlessNodePorts(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeNodePort,
+			ClusterIP: v1.ClusterIPNone,
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcName := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	if !shouldSkipService(svcName, svc, false) {
+		t.Errorf("expected headless service to be skipped by default")
+	}
+	if shouldSkipService(svcName, svc, true) {
+		t.Fatalf("expected headless service with node port not to be skipped")
+	}
+	headless := svc.DeepCopy()
+	headless.Spec.Type = v1.ServiceTypeClusterIP
+	headless.Spec.Ports[0].NodePort = 0
+	if !shouldSkipService(svcName, headless, true) {
+		t.Errorf("expected headless service without node ports to be skipped")
+	}
+
+	// Node port is programmed, there is no ClusterIP to program
+	p := newTestProxy()
+	WithHeadlessNodePorts()(p)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	steps := p.servicePortSetsSteps(baseInfo, utilnftables.TableFamilyIPv4, "svcid")
+	if len(steps) != 1 || !strings.Contains(steps[0].name, "node port 30080") {
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.name)
+		}
+		t.Errorf("expected only node port step, got %v", names)
+	}
+}
+
+func TestIsRejecting(t *testing.T) {
+	p := &proxy{serviceMap: make(ServiceMap)}
+	for _, name := range []string{"empty", "backed"} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP:   "10.96.0.10",
+				ExternalIPs: []string{"192.168.1.10"},
+				Ports:       []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		if name == "backed" {
+			svc.Spec.ClusterIP = "10.96.0.20"
+			svc.Spec.ExternalIPs = nil
+		}
+		baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+		if name == "empty" {
+			baseInfo.noEndpoints[utilnftables.TableFamilyIPv4] = true
+		}
+		baseInfo.svcnft.WithEndpoints = name == "backed"
+		p.serviceMap[getSvcPortName(name, "default", "http", v1.ProtocolTCP)] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	}
+
+	if !p.IsRejecting("10.96.0.10", 80, v1.ProtocolTCP) {
+		t.Errorf("expected cluster ip of service without endpoints to be rejecting")
+	}
+	if !p.IsRejecting("192.168.1.10", 80, v1.ProtocolTCP) {
+		t.Errorf("expected external ip of service without endpoints to be rejecting")
+	}
+	if p.IsRejecting("10.96.0.20", 80, v1.ProtocolTCP) {
+		t.Errorf("expected cluster ip of service with endpoints not to be rejecting")
+	}
+	if p.IsRejecting("10.96.0.10", 80, v1.ProtocolUDP) || p.IsRejecting("10.96.0.10", 443, v1.ProtocolTCP) {
+		t.Errorf("expected not matching protocol or port not to be rejecting")
+	}
+}
+
+func TestUnsupportedProtocol(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "bogus", Port: 80, Protocol: v1.Protocol("BOGUS")}},
+		},
+	}
+	recorder := record.NewFakeRecorder(1)
+	p := newTestProxy()
+	p.recorder = recorder
+	p.AddService(svc)
+	if len(p.serviceMap) != 0 {
+		t.Fatalf("expected port with unsupported protocol to be skipped, got %d Service Ports", len(p.serviceMap))
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "UnsupportedProtocol") {
+			t.Errorf("expected UnsupportedProtocol event, got %q", event)
+		}
+	default:
+		t.Errorf("expected event for port with unsupported protocol")
+	}
+
+	// Endpoint Slice port with unsupported protocol is skipped as well
+	ready := true
+	portName, port, proto := "bogus", int32(8080), v1.Protocol("BOGUS")
+	epsl := &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-abc",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "app"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints:   []discovery.Endpoint{{Addresses: []string{"10.1.1.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}}},
+		Ports:       []discovery.EndpointPort{{Name: &portName, Port: &port, Protocol: &proto}},
+	}
+	info, err := processEpSlice(epsl, "")
+	if err != nil || len(info) != 0 {
+		t.Fatalf("expected endpoint slice port with unsupported protocol to be skipped, got %d ports and error: %+v", len(info), err)
+	}
+	p.warnUnsupportedSlicePorts(epsl)
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "UnsupportedProtocol") {
+			t.Errorf("expected UnsupportedProtocol event, got %q", event)
+		}
+	default:
+		t.Errorf("expected event for endpoint slice port with unsupported protocol")
+	}
+}
+
+func TestLoadBalancerMark(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeLoadBalancer,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.168.1.100"}}},
+		},
+	}
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	lbSteps := func(p *proxy) []string {
+		var names []string
+		for _, step := range p.servicePortSetsSteps(baseInfo, utilnftables.TableFamilyIPv4, "svcid") {
+			if strings.HasPrefix(step.name, "adding 192.168.1.100 ") {
+				names = append(names, step.name)
+			}
+		}
+		return names
+	}
+	p := newTestProxy()
+	if names := lbSteps(p); len(names) != 2 || !strings.HasSuffix(names[1], nftables.K8sMarkMasqSet) {
+		t.Fatalf("expected loadbalancer traffic to be masqueraded by default, got %v", names)
+	}
+	WithLoadBalancerMark(0x8000)(p)
+	names := lbSteps(p)
+	if len(names) != 2 || !strings.HasSuffix(names[1], nftables.K8sMarkLBSet) {
+		t.Fatalf("expected loadbalancer traffic to be marked with loadbalancer mark, got %v", names)
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, nftables.K8sMarkMasqSet) {
+			t.Errorf("expected marked loadbalancer traffic not to be masqueraded, got %q", name)
+		}
+	}
+}
+
+func TestServicePortChains(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	if chains := p.Chains(svcPortName); len(chains) != 0 {
+		t.Fatalf("expected no chains of not programmed service port, got %v", chains)
+	}
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "svcid")
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	ep1 := newTestEndpoint(svcPortName, "10.1.1.1", 8080, false, 0)
+	ep2 := newTestEndpoint(svcPortName, "10.1.1.2", 8080, false, 1)
+	p.endpointsMap[svcPortName] = []Endpoint{ep2, ep1}
+
+	// Service chain is followed by endpoint chains sorted by name
+	expected := []string{
+		nftables.K8sSvcPrefix + "svcid",
+		ep1.epnft.Rule[utilnftables.TableFamilyIPv4].Chain,
+		ep2.epnft.Rule[utilnftables.TableFamilyIPv4].Chain,
+	}
+	sort.Strings(expected[1:])
+	chains := p.Chains(svcPortName)
+	if len(chains) != 1 || !reflect.DeepEqual(chains[utilnftables.TableFamilyIPv4], expected) {
+		t.Fatalf("expected chains %v, got %v", expected, chains)
+	}
+	// Returned chains are a copy
+	chains[utilnftables.TableFamilyIPv4][0] = "modified"
+	if p.Chains(svcPortName)[utilnftables.TableFamilyIPv4][0] != expected[0] {
+		t.Errorf("expected returned chains not to alias proxy's state")
+	}
+}
+
+// fakeNodePortProgrammer records nodeports in node port set, adding fails while fail is set.
+type fakeNodePortProgrammer struct {
+	nodePorts map[uint16]string
+	fail      bool
+}
+
+func (n *fakeNodePortProgrammer) add(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error {
+	if n.fail {
+		return fmt.Errorf("failed to add node port %d", nodePort)
+	}
+	n.nodePorts[nodePort] = chain
+	return nil
+}
+
+func (n *fakeNodePortProgrammer) remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error {
+	delete(n.nodePorts, nodePort)
+	return nil
+}
+
+func TestNodePortAllocationTransitions(t *testing.T) {
+	p := newTestProxy()
+	programmer := &fakeNodePortProgrammer{nodePorts: make(map[uint16]string)}
+	p.nodePortRules = programmer
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeNodePort,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+
+	// NodePort gets allocated, 0 -> 31000
+	allocated := svc.DeepCopy()
+	allocated.Spec.Ports[0].NodePort = 31000
+	p.processServicePortChanges(allocated, svc)
+	if chain, ok := programmer.nodePorts[31000]; !ok || chain != nftables.K8sSvcPrefix+"svcid" {
+		t.Fatalf("expected nodeport 31000 to be programmed to service chain, got %v", programmer.nodePorts)
+	}
+	if baseInfo.NodePort() != 31000 {
+		t.Errorf("expected service port's nodeport 31000, got %d", baseInfo.NodePort())
+	}
+	// NodePort gets released, 31000 -> 0
+	p.processServicePortChanges(svc, allocated)
+	if len(programmer.nodePorts) != 0 {
+		t.Fatalf("expected nodeport to be removed, got %v", programmer.nodePorts)
+	}
+	if baseInfo.NodePort() != 0 {
+		t.Errorf("expected service port without nodeport, got %d", baseInfo.NodePort())
+	}
+}
+
+func TestMixedFamilyExternalIPs(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:   "10.96.0.10",
+			ExternalIPs: []string{"192.168.1.10", "2001:db8::10", "192.168.1.11"},
+			Ports:       []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	families := externalIPFamilies(baseInfo, utilnftables.TableFamilyIPv4)
+	if len(families) != 1 || families[0] != utilnftables.TableFamilyIPv6 {
+		t.Fatalf("expected service port to need chains in ipv6 table for its ipv6 external ip, got %v", families)
+	}
+	placement := map[string][]string{}
+	for _, step := range p.servicePortSetsSteps(baseInfo, utilnftables.TableFamilyIPv4, "svcid") {
+		if !strings.HasSuffix(step.name, " set "+nftables.K8sExternalIPSet) {
+			continue
+		}
+		// Step name is "adding <address> to <family> set <set>"
+		fields := strings.Fields(step.name)
+		placement[fields[3]] = append(placement[fields[3]], fields[1])
+	}
+	expected := map[string][]string{
+		"ipv4": {"192.168.1.10", "192.168.1.11"},
+		"ipv6": {"2001:db8::10"},
+	}
+	if !reflect.DeepEqual(placement, expected) {
+		t.Fatalf("expected external ips placed per family %v, got %v", expected, placement)
+	}
+}
+
+func TestClusterIPFamilyChange(t *testing.T) {
+	newService := func(clusterIP string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP: clusterIP,
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+	}
+	tests := []struct {
+		oldIP     string
+		newIP     string
+		oldFamily utilnftables.TableFamily
+		newFamily utilnftables.TableFamily
+		changed   bool
+	}{
+		{oldIP: "10.96.0.10", newIP: "fd00::10", oldFamily: utilnftables.TableFamilyIPv4, newFamily: utilnftables.TableFamilyIPv6, changed: true},
+		{oldIP: "fd00::10", newIP: "10.96.0.10", oldFamily: utilnftables.TableFamilyIPv6, newFamily: utilnftables.TableFamilyIPv4, changed: true},
+		{oldIP: "10.96.0.10", newIP: "10.96.0.11", oldFamily: utilnftables.TableFamilyIPv4, newFamily: utilnftables.TableFamilyIPv4},
+		{oldIP: v1.ClusterIPNone, newIP: "fd00::10"},
+		{oldIP: "10.96.0.10", newIP: ""},
+	}
+	for _, tt := range tests {
+		oldFamily, newFamily, changed := clusterIPFamilyChange(newService(tt.newIP), newService(tt.oldIP))
+		if changed != tt.changed || (changed && (oldFamily != tt.oldFamily || newFamily != tt.newFamily)) {
+			t.Errorf("ClusterIP %q -> %q: expected families %v -> %v changed %t, got %v -> %v changed %t",
+				tt.oldIP, tt.newIP, tt.oldFamily, tt.newFamily, tt.changed, oldFamily, newFamily, changed)
+		}
+	}
+
+	// Change within the family is left to the regular update processing
+	p := newTestProxy()
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	stored := newService("10.96.0.10")
+	baseInfo := newBaseServiceInfo(&stored.Spec.Ports[0], stored)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, "svcid")
+	p.serviceMap[svcPortName] = newServiceInfo(&stored.Spec.Ports[0], stored, baseInfo)
+	if p.processClusterIPFamilyChange(newService("10.96.0.11"), stored) {
+		t.Fatalf("expected ClusterIP change within the family not to rebuild the service")
+	}
+	if _, ok := p.serviceMap[svcPortName]; !ok {
+		t.Errorf("expected service port to be kept")
+	}
+}
+
+func TestClusterIPChangeMovesNoEndpoints(t *testing.T) {
+	p := newTestProxy()
+	elements := &fakeSetElementProgrammer{added: sets.NewString(), removed: sets.NewString()}
+	p.setElements = elements
+	stored := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	updated := stored.DeepCopy()
+	updated.Spec.ClusterIP = "10.96.0.11"
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&stored.Spec.Ports[0], stored)
+	baseInfo.svcnft.ServiceID = p.sepNamer.allocateServiceID(svcPortName.String(), string(v1.ProtocolTCP), baseInfo.String())
+	baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, baseInfo.svcnft.ServiceID)
+	// Service Port without endpoints has its ClusterIP in No Endpoints set
+	baseInfo.noEndpoints[utilnftables.TableFamilyIPv4] = true
+	p.serviceMap[svcPortName] = newServiceInfo(&stored.Spec.Ports[0], stored, baseInfo)
+
+	p.updateServicePortClusterIP(svcPortName, stored, updated)
+	if !elements.removed.Has(nftables.K8sNoEndpointsSet + " 10.96.0.10") {
+		t.Errorf("expected old ClusterIP to be removed from No Endpoints set, removed %v", elements.removed.List())
+	}
+	if !elements.added.Has(nftables.K8sNoEndpointsSet + " 10.96.0.11") {
+		t.Errorf("expected new ClusterIP to be added to No Endpoints set, added %v", elements.added.List())
+	}
+	if baseInfo.ClusterIP().String() != "10.96.0.11" || !baseInfo.noEndpoints[utilnftables.TableFamilyIPv4] {
+		t.Errorf("expected service port to follow the new ClusterIP and stay in No Endpoints set, got %s", baseInfo.ClusterIP())
+	}
+	// Endpoints arriving later remove the new ClusterIP, the old one is no longer the Service Port's address
+	if addrs := serviceAddressesByFamily(baseInfo)[utilnftables.TableFamilyIPv4]; len(addrs) != 1 || addrs[0] != "10.96.0.11" {
+		t.Errorf("expected only the new ClusterIP to be the service port's address, got %v", addrs)
+	}
+	// Service ID stays allocated for the Service Port, so deleting the Service Port releases it
+	p.sepNamer.releaseServiceID(baseInfo.svcnft.ServiceID, svcPortName.String(), string(v1.ProtocolTCP), baseInfo.String())
+	if _, ok := p.sepNamer.services[baseInfo.svcnft.ServiceID]; ok {
+		t.Errorf("expected service id %s to be released with the new ClusterIP", baseInfo.svcnft.ServiceID)
+	}
+}
+
+func TestDeleteServiceWithEndpoints(t *testing.T) {
+	p := newTestProxy()
+	deleter := &fakeEndpointRulesDeleter{}
+	p.epRules = deleter
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = p.sepNamer.allocateServiceID(svcPortName.String(), string(v1.ProtocolTCP), baseInfo.String())
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	var chains []string
+	for i, ip := range []string{"10.1.1.1", "10.1.1.2"} {
+		ep := newTestEndpoint(svcPortName, ip, 8080, false, i)
+		rule := ep.epnft.Rule[utilnftables.TableFamilyIPv4]
+		rule.Chain = p.sepNamer.allocate(svcPortName.String(), string(v1.ProtocolTCP), ep.Endpoint)
+		chains = append(chains, rule.Chain)
+		p.endpointsMap[svcPortName] = append(p.endpointsMap[svcPortName], ep)
+	}
+
+	// Service is deleted before its endpoints
+	p.DeleteService(svc)
+	sort.Strings(deleter.deleted)
+	sort.Strings(chains)
+	if !reflect.DeepEqual(deleter.deleted, chains) {
+		t.Errorf("expected endpoint chains %v to be deleted, deleted %v", chains, deleter.deleted)
+	}
+	if _, ok := p.endpointsMap[svcPortName]; ok {
+		t.Errorf("expected no endpoints map entry of deleted service port")
+	}
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Errorf("expected no service map entry of deleted service port")
+	}
+	if len(p.sepNamer.chains) != 0 || len(p.sepNamer.services) != 0 {
+		t.Errorf("expected chain names and service id to be released, got chains %v services %v", p.sepNamer.chains, p.sepNamer.services)
+	}
+}
+
+func TestPreserveDestinationPort(t *testing.T) {
+	// endpointDNAT returns DNAT expression of the endpoint chain
+	endpointDNAT := func(conn *fake.Conn) *expr.NAT {
+		conn.Lock()
+		defer conn.Unlock()
+		for _, rule := range conn.Rules {
+			if !strings.HasPrefix(rule.Chain.Name, defaultEndpointChainPrefix) {
+				continue
+			}
+			for _, e := range rule.Exprs {
+				if nat, ok := e.(*expr.NAT); ok && nat.Type == expr.NATTypeDestNAT {
+					return nat
+				}
+			}
+		}
+		return nil
+	}
+	for _, preserve := range []bool{false, true} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "10.96.0.10",
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			},
+		}
+		if preserve {
+			svc.Annotations = map[string]string{preserveDstPortAnnotation: "true"}
+		}
+		p, conn := newFakeNFTProxy(t, false)
+		p.AddService(svc)
+		p.AddEndpoints(newTestEndpoints("1", 8080, "10.244.0.1"))
+		nat := endpointDNAT(conn)
+		if nat == nil {
+			t.Fatalf("expected DNAT in endpoint chain of service preserving destination port %t", preserve)
+		}
+		if preserve && nat.RegProtoMin != 0 {
+			t.Errorf("expected DNAT to keep the original destination port, got port register %d", nat.RegProtoMin)
+		}
+		if !preserve && nat.RegProtoMin == 0 {
+			t.Errorf("expected DNAT to rewrite destination port to endpoint's port")
+		}
+	}
+}
+
+func TestPreserveDestinationPortUpdate(t *testing.T) {
+	// endpointDNATs returns DNAT expressions of endpoint chains
+	endpointDNATs := func(conn *fake.Conn) []*expr.NAT {
+		conn.Lock()
+		defer conn.Unlock()
+		var nats []*expr.NAT
+		for _, rule := range conn.Rules {
+			if !strings.HasPrefix(rule.Chain.Name, defaultEndpointChainPrefix) {
+				continue
+			}
+			for _, e := range rule.Exprs {
+				if nat, ok := e.(*expr.NAT); ok && nat.Type == expr.NATTypeDestNAT {
+					nats = append(nats, nat)
+				}
+			}
+		}
+		return nats
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	p, conn := newFakeNFTProxy(t, false)
+	p.AddService(svc)
+	p.AddEndpoints(newTestEndpoints("1", 8080, "10.244.0.1"))
+
+	// Annotation added by an update makes DNAT rule of the existing endpoint keep the original destination port
+	preserving := svc.DeepCopy()
+	preserving.ResourceVersion = "2"
+	preserving.Annotations = map[string]string{preserveDstPortAnnotation: "true"}
+	p.UpdateService(svc, preserving)
+	nats := endpointDNATs(conn)
+	if len(nats) != 1 || nats[0].RegProtoMin != 0 {
+		t.Fatalf("expected single DNAT rule keeping the original destination port, got %d rule(s)", len(nats))
+	}
+	if !baseServiceInfo(p.serviceMap[svcPortName]).preserveDstPort {
+		t.Errorf("expected service port to preserve destination port after update")
+	}
+
+	// Annotation removed by an update makes DNAT rule rewrite destination port to endpoint's port again
+	rewriting := svc.DeepCopy()
+	rewriting.ResourceVersion = "3"
+	p.UpdateService(preserving, rewriting)
+	nats = endpointDNATs(conn)
+	if len(nats) != 1 || nats[0].RegProtoMin == 0 {
+		t.Fatalf("expected single DNAT rule rewriting destination port, got %d rule(s)", len(nats))
+	}
+	ep := p.endpointsMap[svcPortName][0].(*endpointsInfo)
+	if ruleIDs := ep.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID; len(ruleIDs) != 3 {
+		t.Errorf("expected endpoint to keep 3 rules, got %v", ruleIDs)
+	}
+}
+
+func TestAddServicePortNodePortFailure(t *testing.T) {
+	p, conn := newFakeNFTProxy(t, false)
+	nodePorts := &fakeNodePortProgrammer{nodePorts: make(map[uint16]string), fail: true}
+	p.nodePortRules = nodePorts
+	elements := &fakeSetElementProgrammer{added: sets.NewString(), removed: sets.NewString()}
+	p.setElements = elements
+	timeout := int32(600)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeNodePort,
+			ClusterIP:             "10.96.0.10",
+			ExternalIPs:           []string{"192.168.1.10"},
+			SessionAffinity:       v1.ServiceAffinityClientIP,
+			SessionAffinityConfig: &v1.SessionAffinityConfig{ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout}},
+			Ports:                 []v1.ServicePort{{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	svcID := p.sepNamer.serviceID(svcPortName.String(), string(v1.ProtocolTCP), newBaseServiceInfo(&svc.Spec.Ports[0], svc).String())
+
+	// NodePort is the last step, all steps before it are rolled back when it fails
+	p.AddService(svc)
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Fatalf("expected no service map entry of not programmed service port")
+	}
+	if elements.added.Len() == 0 || !elements.added.Equal(elements.removed) {
+		t.Errorf("expected all added set elements to be removed, added %v removed %v", elements.added.List(), elements.removed.List())
+	}
+	if len(nodePorts.nodePorts) != 0 {
+		t.Errorf("expected no node ports, got %v", nodePorts.nodePorts)
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	for _, chain := range conn.Chains {
+		if strings.HasSuffix(chain.Name, svcID) {
+			t.Errorf("expected chain %s of not programmed service port to be deleted", chain.Name)
+		}
+	}
+	for _, set := range conn.Sets {
+		if set.Name == nftables.K8sAffinityMap+svcID {
+			t.Errorf("expected affinity map %s of not programmed service port to be deleted", set.Name)
+		}
+	}
+	if _, ok := p.sepNamer.services[svcID]; ok {
+		t.Errorf("expected service id %s of not programmed service port to be released", svcID)
+	}
+}
+
+// blockingChainConn blocks adding of service chains until released, adding is closed once the first one is added.
+type blockingChainConn struct {
+	*fake.Conn
+	once    sync.Once
+	adding  chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingChainConn) AddChain(ch *utilnftables.Chain) *utilnftables.Chain {
+	if strings.HasPrefix(ch.Name, nftables.K8sSvcPrefix) {
+		c.once.Do(func() { close(c.adding) })
+		<-c.release
+	}
+	return c.Conn.AddChain(ch)
+}
+
+func TestDeleteServiceDuringAdd(t *testing.T) {
+	conn := &blockingChainConn{Conn: &fake.Conn{}, adding: make(chan struct{}), release: make(chan struct{})}
+	p := newConnProxy(t, conn, false)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	added, deleted := make(chan struct{}), make(chan struct{})
+	go func() {
+		p.AddService(svc)
+		close(added)
+	}()
+	// Service Port's own chains are being added with p.mu released
+	<-conn.adding
+	go func() {
+		p.DeleteService(svc)
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+		t.Fatalf("expected deletion to wait for the add in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(conn.release)
+	<-added
+	<-deleted
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Errorf("expected service port deleted during its add not to be recorded")
+	}
+	conn.Lock()
+	defer conn.Unlock()
+	for _, ch := range conn.Chains {
+		if strings.HasPrefix(ch.Name, nftables.K8sSvcPrefix) {
+			t.Errorf("expected chain %s of deleted service port to be removed", ch.Name)
+		}
+	}
+}
+
+// failingChainConn fails the flush following the add of a chain until failures are exhausted.
+type failingChainConn struct {
+	*fake.Conn
+	mu       sync.Mutex
+	chain    string
+	failures int
+	adding   bool
+}
+
+func (c *failingChainConn) AddChain(ch *utilnftables.Chain) *utilnftables.Chain {
+	c.mu.Lock()
+	c.adding = ch.Name == c.chain
+	c.mu.Unlock()
+	return c.Conn.AddChain(ch)
+}
+
+func (c *failingChainConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.adding && c.failures > 0 {
+		c.adding = false
+		c.failures--
+		return fmt.Errorf("failed to add chain %s", c.chain)
+	}
+	c.adding = false
+	return c.Conn.Flush()
+}
+
+func TestPendingEndpointRetry(t *testing.T) {
+	conn := &failingChainConn{Conn: &fake.Conn{}}
+	p := newConnProxy(t, conn, false)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	p.AddEndpoints(newTestEndpoints("1", 8080, "10.1.1.1"))
+	p.mu.RLock()
+	epInfo := p.endpointsMap[svcPortName][0].(*endpointsInfo)
+	chain := epInfo.epnft.Rule[utilnftables.TableFamilyIPv4].Chain
+	p.mu.RUnlock()
+	conn.mu.Lock()
+	conn.chain, conn.failures = chain, 1
+	conn.mu.Unlock()
+
+	// Adding of the pending endpoint's rules fails, the endpoint is queued for retry and joins the service's
+	// load balancing once its rules are programmed
+	p.AddService(svc)
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return len(p.selectEndpoints(svcPortName, utilnftables.TableFamilyIPv4)) == 1, nil
+	}); err != nil {
+		t.Fatalf("expected pending endpoint to be programmed by retry")
+	}
+	conn.mu.Lock()
+	failures := conn.failures
+	conn.mu.Unlock()
+	if failures != 0 {
+		t.Fatalf("expected adding of pending endpoint's chain to fail once")
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if epInfo.pendingService {
+		t.Errorf("expected endpoint %s not to be pending once programmed", epInfo.Endpoint)
+	}
+	if epInfo.epnft.Rule[utilnftables.TableFamilyIPv4].RuleID == nil {
+		t.Errorf("expected rule ids of endpoint %s to be recorded", epInfo.Endpoint)
+	}
+}
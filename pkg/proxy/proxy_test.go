@@ -16,10 +16,68 @@ limitations under the License.
 package proxy
 
 import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables/fake"
+	"github.com/sbezverk/nftableslib"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	"testing"
 )
 
+// newFakeNFTProxy returns a proxy created by NewProxy which programs nftables over an in-memory connection,
+// it allows to test processing of services and endpoints events end to end.
+func newFakeNFTProxy(t *testing.T, endpointSlice bool, opts ...Option) (*proxy, *fake.Conn) {
+	conn := &fake.Conn{}
+
+	return newConnProxy(t, conn, endpointSlice, opts...), conn
+}
+
+// newConnProxy returns proxy programming nftables through conn, it is used to inject behaviour into fake.Conn.
+func newConnProxy(t *testing.T, conn nftableslib.NetNS, endpointSlice bool, opts ...Option) *proxy {
+	priorities := nftables.ChainPriorities{
+		Filter: utilnftables.ChainPriorityFilter,
+		DNAT:   utilnftables.ChainPriorityNATDest,
+		SNAT:   utilnftables.ChainPriorityNATSource,
+	}
+	nfti, err := nftables.NewNFTInterface(conn, "10.244.0.0/16", "fd00:10:244::/64", priorities, nftables.ExternalIPFirst)
+	if err != nil {
+		t.Fatalf("failed to initialize nftables with error: %+v", err)
+	}
+
+	return NewProxy(nfti, "node1", record.NewFakeRecorder(100), endpointSlice, opts...).(*proxy)
+}
+
+// newTestEndpoints returns Endpoints of the service default/app with addresses on node1 and port http.
+func newTestEndpoints(version string, port int32, ips ...string) *v1.Endpoints {
+	node := "node1"
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: version},
+		Subsets:    []v1.EndpointSubset{{Ports: []v1.EndpointPort{{Name: "http", Port: port, Protocol: v1.ProtocolTCP}}}},
+	}
+	for _, ip := range ips {
+		ep.Subsets[0].Addresses = append(ep.Subsets[0].Addresses, v1.EndpointAddress{IP: ip, NodeName: &node})
+	}
+
+	return ep
+}
+
+// verdictMaps returns verdict maps of services' load balancing rules, a new map is created every time
+// a service chain with endpoints gets programmed.
+func verdictMaps(conn *fake.Conn) []*utilnftables.Set {
+	conn.Lock()
+	defer conn.Unlock()
+	var vmaps []*utilnftables.Set
+	for _, s := range conn.Sets {
+		if s.Anonymous && s.IsMap && s.DataType == utilnftables.TypeVerdict {
+			vmaps = append(vmaps, s)
+		}
+	}
+
+	return vmaps
+}
+
 func TestIsServicePortInPorts(t *testing.T) {
 	tests := []struct {
 		name  string
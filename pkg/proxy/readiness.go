@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"time"
+
+	"k8s.io/klog"
+)
+
+// readinessChange is an endpoint's change of readiness waiting for the readiness hold period to be applied
+type readinessChange struct {
+	ready bool
+	timer *time.Timer
+}
+
+// applyReadiness adds the endpoint to its Service Port if it is ready and removes it otherwise.
+func (p *proxy) applyReadiness(e epInfo) error {
+	if e.ready {
+		return p.addEndpoint(e.name, e.addr, e.port, e.attrs)
+	}
+
+	return p.deleteEndpoint(e.name, e.addr, e.port)
+}
+
+// scheduleReadinessChange applies a change of endpoint's readiness. With readiness hold, the change is applied only
+// once the endpoint keeps the new readiness for the hold period, changing back before the period expires cancels it.
+func (p *proxy) scheduleReadinessChange(e epInfo) error {
+	if p.readinessHold <= 0 {
+		return p.applyReadiness(e)
+	}
+	key := epInfoKey(e)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.readinessPending[key]; ok {
+		if c.ready != e.ready {
+			// Endpoint flapped back to the readiness its rules are programmed for
+			c.timer.Stop()
+			delete(p.readinessPending, key)
+			klog.V(5).Infof("endpoint %s flapped back to ready %t, change is cancelled", key, !e.ready)
+		}
+		return nil
+	}
+	c := &readinessChange{ready: e.ready}
+	c.timer = time.AfterFunc(p.readinessHold, func() {
+		p.mu.Lock()
+		if p.readinessPending[key] != c {
+			// Change was cancelled while the timer was firing
+			p.mu.Unlock()
+			return
+		}
+		delete(p.readinessPending, key)
+		p.mu.Unlock()
+		if p.isStandby() {
+			return
+		}
+		klog.V(5).Infof("endpoint %s held ready %t for %v, applying the change", key, e.ready, p.readinessHold)
+		if err := p.applyReadiness(e); err != nil {
+			klog.Errorf("failed to apply readiness change of endpoint %s with error: %+v", key, err)
+		}
+	})
+	p.readinessPending[key] = c
+	klog.V(5).Infof("endpoint %s changed to ready %t, holding the change for %v", key, e.ready, p.readinessHold)
+
+	return nil
+}
+
+// cancelReadinessChange drops endpoint's pending change of readiness, true is returned if there was one. The rules
+// of an endpoint with a pending change are programmed as per its readiness before the change.
+func (p *proxy) cancelReadinessChange(e epInfo) bool {
+	if p.readinessHold <= 0 {
+		return false
+	}
+	key := epInfoKey(e)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.readinessPending[key]
+	if !ok {
+		return false
+	}
+	c.timer.Stop()
+	delete(p.readinessPending, key)
+
+	return true
+}
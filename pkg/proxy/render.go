@@ -0,0 +1,113 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+)
+
+// RenderRuleset returns nft script with chains, rules and map elements of all programmed Service Ports and their
+// endpoints. The script is derived from in-memory maps rather than read back from the kernel, so comparing it
+// with "nft list ruleset" shows whether the node's ruleset drifted from the proxy's desired state.
+func (p *proxy) RenderRuleset() (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	script := nftables.NewScript()
+	for svcPortName, svc := range p.serviceMap {
+		entry, ok := svc.(*serviceInfo)
+		if !ok || entry.svcnft == nil {
+			continue
+		}
+		svcID := entry.svcnft.ServiceID
+		for tableFamily := range entry.svcnft.Chains {
+			lbChains := p.getServicePortLoadBalancingChains(svcPortName, tableFamily)
+			script.AddServiceChain(tableFamily, svcID, lbChains, entry.svcnft.WithAffinity, svcPortName.String(), p.unmatchedLog)
+		}
+		p.renderServicePortSets(script, entry)
+		p.renderEndpoints(script, svcPortName, entry)
+	}
+
+	return script.String(), nil
+}
+
+// renderServicePortSets renders Service Port's elements of the sets servicePortSetsSteps and updateNoEndpointsList
+// program. It must be called with p.mu held.
+func (p *proxy) renderServicePortSets(script *nftables.Script, entry *serviceInfo) {
+	proto := entry.Protocol()
+	port := uint16(entry.Port())
+	chain := nftables.K8sSvcPrefix + entry.svcnft.ServiceID
+	// Service Port without valid ClusterIP is programmed in ipv4 table, the same as addServicePort does
+	tableFamily := utilnftables.TableFamilyIPv4
+	if entry.ClusterIP() != nil {
+		clusterIP := entry.ClusterIP().String()
+		_, tableFamily = getIPFamily(clusterIP)
+		script.AddToSet(tableFamily, proto, clusterIP, port, nftables.K8sClusterIPSet, chain)
+		script.AddToSet(tableFamily, proto, clusterIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+		if p.vipDefaultDeny {
+			script.AddVIP(tableFamily, clusterIP)
+			script.AddToVIPPortsSet(tableFamily, proto, clusterIP, port)
+		}
+	}
+	for family, inList := range entry.noEndpoints {
+		if !inList {
+			continue
+		}
+		for _, addr := range serviceAddressesByFamily(entry)[family] {
+			script.AddToSet(family, proto, addr, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject)
+		}
+	}
+	if entry.externalDrained {
+		// External paths are not programmed while the node is draining
+		return
+	}
+	for _, extIP := range entry.ExternalIPStrings() {
+		_, family := getIPFamily(extIP)
+		script.AddToSet(family, proto, extIP, port, nftables.K8sExternalIPSet, chain)
+		script.AddToSet(family, proto, extIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq)
+	}
+	markSet, markChain := p.loadBalancerMarkSet()
+	for _, lbIP := range entry.LoadBalancerIPStrings() {
+		script.AddToSet(tableFamily, proto, lbIP, port, nftables.K8sLoadbalancerIPSet, chain)
+		script.AddToSet(tableFamily, proto, lbIP, port, markSet, markChain)
+	}
+	if nodePort := uint16(entry.NodePort()); nodePort != 0 {
+		script.AddToNodeportSet(tableFamily, proto, nodePort, chain)
+	}
+}
+
+// renderEndpoints renders chains of Service Port's endpoints which rules are programmed. It must be called with
+// p.mu held.
+func (p *proxy) renderEndpoints(script *nftables.Script, svcPortName ServicePortName, entry *serviceInfo) {
+	var identity string
+	if p.identityComments {
+		identity = svcPortName.String()
+	}
+	for _, ep := range p.endpointsMap[svcPortName] {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok || epInfo.pendingService || epInfo.epnft == nil {
+			continue
+		}
+		dport := int32(epInfo.port)
+		if entry.preserveDstPort {
+			dport = 0
+		}
+		for tableFamily, epRule := range epInfo.epnft.Rule {
+			script.AddEndpointChain(tableFamily, epRule, epInfo.ip, dport, identity, epInfo.appProtocol)
+		}
+	}
+}
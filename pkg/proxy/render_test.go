@@ -0,0 +1,105 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderRuleset(t *testing.T) {
+	p := newTestProxy()
+	app := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}},
+		},
+	}
+	db := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.20",
+			Ports:     []v1.ServicePort{{Name: "sql", Port: 5432, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	appPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	dbPortName := getSvcPortName("db", "default", "sql", v1.ProtocolTCP)
+	for _, tt := range []struct {
+		svc         *v1.Service
+		svcPortName ServicePortName
+		svcID       string
+	}{
+		{app, appPortName, "appid"},
+		{db, dbPortName, "dbid"},
+	} {
+		baseInfo := newBaseServiceInfo(&tt.svc.Spec.Ports[0], tt.svc)
+		baseInfo.svcnft.ServiceID = tt.svcID
+		baseInfo.svcnft.Chains = nftables.GetSvcChain(utilnftables.TableFamilyIPv4, tt.svcID)
+		p.serviceMap[tt.svcPortName] = newServiceInfo(&tt.svc.Spec.Ports[0], tt.svc, baseInfo)
+	}
+	baseServiceInfo(p.serviceMap[dbPortName]).noEndpoints[utilnftables.TableFamilyIPv4] = true
+	ep1 := newTestEndpoint(appPortName, "10.1.1.1", 8080, false, 0)
+	ep2 := newTestEndpoint(appPortName, "10.1.1.2", 8080, false, 1)
+	p.endpointsMap[appPortName] = []Endpoint{ep2, ep1}
+
+	script, err := p.RenderRuleset()
+	if err != nil {
+		t.Fatalf("failed to render ruleset with error: %+v", err)
+	}
+	table := "ip kube-nfproxy-v4"
+	epChains := []string{ep1.epnft.Rule[utilnftables.TableFamilyIPv4].Chain, ep2.epnft.Rule[utilnftables.TableFamilyIPv4].Chain}
+	sort.Strings(epChains)
+	expected := []string{
+		"add chain " + table + " k8s-nfproxy-svc-appid\n",
+		"add chain " + table + " k8s-nfproxy-svc-dbid\n",
+		"add chain " + table + " " + epChains[0] + "\n",
+		"add chain " + table + " " + epChains[1] + "\n",
+		"add rule " + table + " k8s-nfproxy-svc-appid counter comment \"service chain for Service Port Name " + appPortName.String() + "\"\n",
+		fmt.Sprintf("add rule %s k8s-nfproxy-svc-appid numgen inc mod 2 vmap { 0 : jump %s, 1 : jump %s }\n", table, epChains[0], epChains[1]),
+		"add rule " + table + " " + ep1.epnft.Rule[utilnftables.TableFamilyIPv4].Chain + " ip saddr 10.1.1.1 meta mark set 0x00004000\n",
+		"add rule " + table + " " + ep1.epnft.Rule[utilnftables.TableFamilyIPv4].Chain + " dnat to 10.1.1.1:8080 fully-random\n",
+		"add rule " + table + " " + ep2.epnft.Rule[utilnftables.TableFamilyIPv4].Chain + " dnat to 10.1.1.2:8080 fully-random\n",
+		"add element " + table + " cluster-ip { tcp . 10.96.0.10 . 80 : jump k8s-nfproxy-svc-appid, tcp . 10.96.0.20 . 5432 : jump k8s-nfproxy-svc-dbid }\n",
+		"add element " + table + " no-endpoints { tcp . 10.96.0.20 . 5432 : jump k8s-filter-do-reject }\n",
+		"add element " + table + " nodeports { tcp . 30080 : jump k8s-nfproxy-svc-appid }\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(script, e) {
+			t.Errorf("expected rendered ruleset to contain %q, got:\n%s", e, script)
+		}
+	}
+	// Service without endpoints has an empty chain
+	if strings.Contains(script, "add rule "+table+" k8s-nfproxy-svc-dbid ") {
+		t.Errorf("expected no rules in chain of service without endpoints, got:\n%s", script)
+	}
+	// Chains are added before any rule jumps to them
+	if strings.LastIndex(script, "add chain ") > strings.Index(script, "add rule ") {
+		t.Errorf("expected all chains to be added before rules, got:\n%s", script)
+	}
+	// The same state renders the same script
+	if again, _ := p.RenderRuleset(); again != script {
+		t.Errorf("expected the same script for the same state, got:\n%s\nand:\n%s", script, again)
+	}
+}
@@ -19,12 +19,13 @@ package proxy
 import (
 	"fmt"
 	"net"
+	"time"
 
+	utilnftables "github.com/google/nftables"
 	"github.com/sbezverk/nfproxy/pkg/nftables"
 	"k8s.io/klog"
 
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/types"
 	apiservice "k8s.io/kubernetes/pkg/api/v1/service"
 )
 
@@ -35,6 +36,7 @@ import (
 type BaseServiceInfo struct {
 	svcName                  string
 	svcNamespace             string
+	svcCluster               string
 	ipFamily                 v1.IPFamily
 	clusterIP                net.IP
 	port                     int
@@ -48,7 +50,26 @@ type BaseServiceInfo struct {
 	healthCheckNodePort      int
 	onlyNodeLocalEndpoints   bool
 	topologyKeys             []string
-	svcnft                   *nftables.SVCnft
+	// endpointWarmup defines for how long a newly added endpoint is kept out of the service's load balancing.
+	endpointWarmup time.Duration
+	// preserveDstPort requests endpoints' DNAT to rewrite only the destination address, keeping the original service port.
+	preserveDstPort bool
+	// preferClose requests endpoints in the node's zone to be preferred for the service's load balancing.
+	preferClose bool
+	// zoneWeight overrides the proxy's share in percent of load balancing given to endpoints in the node's zone.
+	zoneWeight int
+	// preferNodeLocal requests node local endpoints to be used when there are any, remote endpoints are the fallback.
+	preferNodeLocal bool
+	// noEndpoints tracks ip families in which Service Port's addresses are in No Endpoints set,
+	// each family is managed independently based on endpoints of that family.
+	noEndpoints map[utilnftables.TableFamily]bool
+	// externalDrained is set when external addresses and nodeports of the Service Port are removed as the node is draining
+	externalDrained bool
+	// lastProgrammed is the time of the last successful programming of the Service Port
+	lastProgrammed time.Time
+	// lastError is the error of the last failed programming of the Service Port's chain, nil once it is programmed
+	lastError error
+	svcnft    *nftables.SVCnft
 }
 
 var _ ServicePort = &BaseServiceInfo{}
@@ -136,8 +157,7 @@ func newServiceInfo(port *v1.ServicePort, service *v1.Service, baseInfo *BaseSer
 	info := &serviceInfo{BaseServiceInfo: baseInfo}
 
 	// Store the following for performance reasons.
-	svcName := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
-	svcPortName := ServicePortName{NamespacedName: svcName, Port: port.Name}
+	svcPortName := getObjSvcPortName(service, port.Name, "")
 	info.serviceNameString = svcPortName.String()
 
 	return info
@@ -156,6 +176,7 @@ func newBaseServiceInfo(port *v1.ServicePort, service *v1.Service) *BaseServiceI
 	info := &BaseServiceInfo{
 		svcName:      service.ObjectMeta.Name,
 		svcNamespace: service.ObjectMeta.Namespace,
+		svcCluster:   clusterOf(service),
 		clusterIP:    net.ParseIP(service.Spec.ClusterIP),
 		port:         int(port.Port),
 		protocol:     port.Protocol,
@@ -166,7 +187,13 @@ func newBaseServiceInfo(port *v1.ServicePort, service *v1.Service) *BaseServiceI
 		stickyMaxAgeSeconds:    stickyMaxAgeSeconds,
 		onlyNodeLocalEndpoints: onlyNodeLocalEndpoints,
 		//		topologyKeys:           service.Spec.TopologyKeys,
-		svcnft: &nftables.SVCnft{},
+		endpointWarmup:  getEndpointWarmup(service),
+		preserveDstPort: isPreserveDstPort(service),
+		preferClose:     isPreferClose(service),
+		zoneWeight:      getZoneWeight(service),
+		preferNodeLocal: isPreferNodeLocal(service),
+		noEndpoints:     make(map[utilnftables.TableFamily]bool),
+		svcnft:          &nftables.SVCnft{},
 	}
 	if service.Spec.IPFamily != nil {
 		info.ipFamily = *service.Spec.IPFamily
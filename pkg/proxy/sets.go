@@ -17,69 +17,135 @@ limitations under the License.
 package proxy
 
 import (
+	"fmt"
+
 	utilnftables "github.com/google/nftables"
 	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 )
 
-// addServicePortToSets adds Service Port's Proto.Daddr.Port to cluster ip set, external ip set,
-// loadbalance ip set and node port set.
-func (p *proxy) addServicePortToSets(servicePort ServicePort, tableFamily utilnftables.TableFamily, svcID string) error {
+// nodePortProgrammer adds and removes Service Port's nodeports in node port set.
+type nodePortProgrammer interface {
+	add(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error
+	remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error
+}
+
+type nftNodePortProgrammer struct {
+	nfti *nftables.NFTInterface
+}
+
+func (n *nftNodePortProgrammer) add(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error {
+	return nftables.AddToNodeportSet(n.nfti, tableFamily, proto, nodePort, chain)
+}
+
+func (n *nftNodePortProgrammer) remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, nodePort uint16, chain string) error {
+	return nftables.RemoveFromNodeportSet(n.nfti, tableFamily, proto, nodePort, chain)
+}
+
+// setElementProgrammer adds and removes Service Port's proto.daddr.port elements to and from sets.
+type setElementProgrammer interface {
+	add(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error
+	remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error
+}
+
+type nftSetElementProgrammer struct {
+	nfti *nftables.NFTInterface
+}
+
+func (n *nftSetElementProgrammer) add(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error {
+	return nftables.AddToSet(n.nfti, tableFamily, proto, addr, port, set, chain)
+}
+
+func (n *nftSetElementProgrammer) remove(tableFamily utilnftables.TableFamily, proto v1.Protocol, addr string, port uint16, set string, chain string) error {
+	return nftables.RemoveFromSet(n.nfti, tableFamily, proto, addr, port, set, chain)
+}
+
+// servicePortSetsSteps returns steps adding Service Port's Proto.Daddr.Port to cluster ip set, external ip set,
+// loadbalance ip set and node port set, each step removes its entry on rollback.
+func (p *proxy) servicePortSetsSteps(servicePort ServicePort, tableFamily utilnftables.TableFamily, svcID string) []programStep {
 	proto := servicePort.Protocol()
 	port := uint16(servicePort.Port())
-	clusterIP := servicePort.ClusterIP().String()
+	setStep := func(family utilnftables.TableFamily, addr string, set string, chain string) programStep {
+		return programStep{
+			name: fmt.Sprintf("adding %s to %s set %s", addr, tableFamilyLabel(family), set),
+			apply: func() error {
+				return p.programNFT("adding to set "+set, func() error {
+					return p.setElements.add(family, proto, addr, port, set, chain)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("removing from set "+set, func() error {
+					return p.setElements.remove(family, proto, addr, port, set, chain)
+				})
+			},
+		}
+	}
 	// cluster IP needs to be added to 2 sets, to K8sClusterIPSet and if masquarade-all is true
 	// then it needs to be added to K8sMarkMasqSet
-	if err := nftables.AddToSet(p.nfti, tableFamily, proto, clusterIP, port, nftables.K8sClusterIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
-		return err
+	var steps []programStep
+	// Invalid ClusterIP is not parsed, such Service Port has no ClusterIP to program
+	if servicePort.ClusterIP() != nil {
+		clusterIP := servicePort.ClusterIP().String()
+		steps = append(steps,
+			setStep(tableFamily, clusterIP, nftables.K8sClusterIPSet, nftables.K8sSvcPrefix+svcID),
+			setStep(tableFamily, clusterIP, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq),
+		)
+		if p.vipDefaultDeny {
+			steps = append(steps, p.vipDefaultDenySteps(servicePort, tableFamily, clusterIP)...)
+		}
 	}
-	if err := nftables.AddToSet(p.nfti, tableFamily, proto, clusterIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
-		return err
+	if baseServiceInfo(servicePort).externalDrained {
+		// Node is draining, external paths of the Service Port are not programmed
+		return steps
 	}
-
-	if extIPs := servicePort.ExternalIPStrings(); len(extIPs) != 0 {
-		for _, extIP := range extIPs {
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
-				return err
-			}
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
-				return err
-			}
-		}
+	// External IPs are programmed into the table of their own family, pointing to the Service Port's chain in that table
+	for _, extIP := range servicePort.ExternalIPStrings() {
+		_, family := getIPFamily(extIP)
+		steps = append(steps, setStep(family, extIP, nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID))
+		steps = append(steps, setStep(family, extIP, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq))
 	}
-	if lbIPs := servicePort.LoadBalancerIPStrings(); len(lbIPs) != 0 {
-		for _, lbIP := range lbIPs {
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, lbIP, port, nftables.K8sLoadbalancerIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
-				return err
-			}
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, lbIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
-				return err
-			}
-		}
+	markSet, markChain := p.loadBalancerMarkSet()
+	for _, lbIP := range servicePort.LoadBalancerIPStrings() {
+		steps = append(steps, setStep(tableFamily, lbIP, nftables.K8sLoadbalancerIPSet, nftables.K8sSvcPrefix+svcID))
+		steps = append(steps, setStep(tableFamily, lbIP, markSet, markChain))
 	}
-	if nodePort := servicePort.NodePort(); nodePort != 0 {
-		if err := nftables.AddToNodeportSet(p.nfti, tableFamily, proto, uint16(nodePort), nftables.K8sSvcPrefix+svcID); err != nil {
-			return err
-		}
+	if nodePort := uint16(servicePort.NodePort()); nodePort != 0 {
+		steps = append(steps, programStep{
+			name: fmt.Sprintf("adding node port %d to node port set", nodePort),
+			apply: func() error {
+				return p.programNFT("adding to set "+nftables.K8sNodeportSet, func() error {
+					return p.nodePortRules.add(tableFamily, proto, nodePort, nftables.K8sSvcPrefix+svcID)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("removing from set "+nftables.K8sNodeportSet, func() error {
+					return p.nodePortRules.remove(tableFamily, proto, nodePort, nftables.K8sSvcPrefix+svcID)
+				})
+			},
+		})
 	}
 
-	return nil
+	return steps
 }
 
 // removeServicePortFromSets from Service Port's Proto.Daddr.Port from cluster ip set, external ip set,
 // loadbalance ip set and nodeport set.
 func (p *proxy) removeServicePortFromSets(servicePort ServicePort, tableFamily utilnftables.TableFamily, svcID string) error {
 	// To get the most current information about a Service Port, getting the last known Service Entry
-	svcName := servicePort.(*BaseServiceInfo).svcName
-	svcNamespace := servicePort.(*BaseServiceInfo).svcNamespace
-	storedSvc, err := p.cache.getLastKnownSvcFromCache(svcName, svcNamespace)
+	svcInfo := servicePort.(*BaseServiceInfo)
+	storedSvc, err := p.cache.getLastKnownSvcFromCache(objectName{
+		NamespacedName: types.NamespacedName{Namespace: svcInfo.svcNamespace, Name: svcInfo.svcName},
+		Cluster:        svcInfo.svcCluster,
+	})
 	if err != nil {
 		return err
 	}
 	proto := servicePort.Protocol()
 	port := uint16(servicePort.Port())
 	clusterIP := storedSvc.Spec.ClusterIP
-	if clusterIP != "" {
+	if validateClusterIP(storedSvc) == nil {
 		klog.V(6).Infof("removing Service port %s from Cluster IP Set, cluster ip address: %s, protocol: %s port: %d ",
 			servicePort.String(), clusterIP, proto, port)
 
@@ -91,27 +157,41 @@ func (p *proxy) removeServicePortFromSets(servicePort ServicePort, tableFamily u
 		if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, clusterIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
 			return err
 		}
+		if p.vipDefaultDeny {
+			if err := p.removeVIPPort(servicePort, tableFamily, clusterIP); err != nil {
+				return err
+			}
+		}
+	}
+	if baseServiceInfo(servicePort).externalDrained {
+		// External paths were removed when the node started draining
+		return nil
 	}
 	if extIPs := storedSvc.Spec.ExternalIPs; len(extIPs) != 0 {
 		for _, extIP := range extIPs {
 			klog.V(6).Infof("removing Service port %s from External IP Set, external ip address: %s, protocol: %s port: %d ",
 				servicePort.String(), extIP, proto, port)
-			if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
+			_, family := getIPFamily(extIP)
+			if err := nftables.RemoveFromSet(p.nfti, family, proto, extIP, port, nftables.K8sExternalIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
 				return err
 			}
-			if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
+			if err := nftables.RemoveFromSet(p.nfti, family, proto, extIP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
 				return err
 			}
 		}
 	}
-	// Loadbalancer IP is taken from the last known services object stored in cache
+	// Loadbalancer IP is taken from the last known services object stored in cache, unmanaged LoadBalancer has never been programmed
+	markSet, markChain := p.loadBalancerMarkSet()
 	for _, lbIP := range storedSvc.Status.LoadBalancer.Ingress {
+		if !p.isManagedLoadBalancer(storedSvc) {
+			break
+		}
 		klog.V(6).Infof("removing Service port %s from LoadBalancer Set, loadbalancer ip address: %s, protocol: %s port: %d ",
 			servicePort.String(), lbIP, proto, port)
 		if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, lbIP.IP, port, nftables.K8sLoadbalancerIPSet, nftables.K8sSvcPrefix+svcID); err != nil {
 			return err
 		}
-		if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, lbIP.IP, port, nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq); err != nil {
+		if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, lbIP.IP, port, markSet, markChain); err != nil {
 			return err
 		}
 	}
@@ -129,60 +209,143 @@ func (p *proxy) removeServicePortFromSets(servicePort ServicePort, tableFamily u
 	return nil
 }
 
-// addToNoEndpointsList adds to No Endpoints set  all without Endponts Service Port's proto.daddr.port
-func (p *proxy) addToNoEndpointsList(servicePort ServicePort, tableFamily utilnftables.TableFamily) error {
-	proto := servicePort.Protocol()
-	port := uint16(servicePort.Port())
-	if err := nftables.AddToSet(p.nfti, tableFamily, proto, servicePort.ClusterIP().String(), port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
-		return err
+// isManagedLoadBalancer returns true if LoadBalancer part of the service is managed by the proxy,
+// services without a class and services with a class in proxy's load balancer classes are managed.
+func (p *proxy) isManagedLoadBalancer(svc *v1.Service) bool {
+	class := getLoadBalancerClass(svc)
+	if class == "" || p.lbClasses.Len() == 0 {
+		return true
 	}
-	if extIPs := servicePort.ExternalIPStrings(); len(extIPs) != 0 {
-		for _, extIP := range extIPs {
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
-				return err
-			}
+
+	return p.lbClasses.Has(class)
+}
+
+// applyLoadBalancerClass clears Service Port's LoadBalancer addresses if LoadBalancer part of the service
+// is not managed by the proxy, as a result no LoadBalancer rules get programmed for the Service Port.
+func (p *proxy) applyLoadBalancerClass(svc *v1.Service, baseSvcInfo *BaseServiceInfo) {
+	if p.isManagedLoadBalancer(svc) {
+		return
+	}
+	if len(baseSvcInfo.loadBalancerStatus.Ingress) != 0 {
+		klog.V(5).Infof("service %s/%s has load balancer class %s which is not managed, skipping LoadBalancer programming",
+			svc.Namespace, svc.Name, getLoadBalancerClass(svc))
+	}
+	baseSvcInfo.loadBalancerStatus = v1.LoadBalancerStatus{}
+}
+
+// serviceAddressesByFamily returns Service Port's cluster, external and loadbalancer addresses grouped by ip family.
+func serviceAddressesByFamily(servicePort ServicePort) map[utilnftables.TableFamily][]string {
+	addrs := make(map[utilnftables.TableFamily][]string)
+	if servicePort.ClusterIP() != nil {
+		_, tableFamily := getIPFamily(servicePort.ClusterIP().String())
+		addrs[tableFamily] = append(addrs[tableFamily], servicePort.ClusterIP().String())
+	}
+	for _, ip := range append(servicePort.ExternalIPStrings(), servicePort.LoadBalancerIPStrings()...) {
+		if ip == "" {
+			continue
 		}
+		_, tableFamily := getIPFamily(ip)
+		addrs[tableFamily] = append(addrs[tableFamily], ip)
 	}
-	if lbIPs := servicePort.LoadBalancerIPStrings(); len(lbIPs) != 0 {
-		for _, lbIP := range lbIPs {
-			if err := nftables.AddToSet(p.nfti, tableFamily, proto, lbIP, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
-				return err
-			}
+
+	return addrs
+}
+
+// updateNoEndpointsList adds or removes Service Port's addresses of a specific ip family to/from No Endpoints set
+// depending on availability of the Service Port's endpoints of that family.
+func (p *proxy) updateNoEndpointsList(servicePort ServicePort, svcPortName ServicePortName, tableFamily utilnftables.TableFamily, hasEndpoints bool) {
+	base := baseServiceInfo(servicePort)
+	inList := base.noEndpoints[tableFamily]
+	if hasEndpoints && inList {
+		// ServicePort did not have any endpoints of the family until now, removing from no endpoint set
+		if err := p.removeFromNoEndpointsList(servicePort, tableFamily); err != nil {
+			klog.Errorf("failed to remove %s from \"No Endpoints Set\" with error: %+v", svcPortName.String(), err)
+			return
+		}
+		delete(base.noEndpoints, tableFamily)
+		return
+	}
+	if !hasEndpoints && !inList {
+		if len(serviceAddressesByFamily(servicePort)[tableFamily]) == 0 {
+			// Service Port has no addresses of the family, nothing to reject
+			return
+		}
+		klog.V(5).Infof("Service Port Name: %s has no endpoints of family %v", svcPortName.String(), tableFamily)
+		if err := p.addToNoEndpointsList(servicePort, tableFamily); err != nil {
+			klog.Errorf("failed to add %s to No Endpoints Set with error: %+v", svcPortName.String(), err)
+			return
+		}
+		base.noEndpoints[tableFamily] = true
+	}
+}
+
+// baseServiceInfo returns BaseServiceInfo of a ServicePort.
+func baseServiceInfo(servicePort ServicePort) *BaseServiceInfo {
+	if svc, ok := servicePort.(*serviceInfo); ok {
+		return svc.BaseServiceInfo
+	}
+	return servicePort.(*BaseServiceInfo)
+}
+
+// addToNoEndpointsList adds to No Endpoints set all Service Port's proto.daddr.port of a specific ip family
+func (p *proxy) addToNoEndpointsList(servicePort ServicePort, tableFamily utilnftables.TableFamily) error {
+	proto := servicePort.Protocol()
+	port := uint16(servicePort.Port())
+	for _, addr := range serviceAddressesByFamily(servicePort)[tableFamily] {
+		if err := p.setElements.add(tableFamily, proto, addr, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// removeFromNoEndpointsList removes to No Endpoints List all IPs/port pairs of a specific servicePort
+// removeFromNoEndpointsList removes from No Endpoints set all Service Port's proto.daddr.port of a specific ip family
 func (p *proxy) removeFromNoEndpointsList(servicePort ServicePort, tableFamily utilnftables.TableFamily) error {
 	proto := servicePort.Protocol()
 	port := uint16(servicePort.Port())
-	if servicePort.ClusterIP().String() != "" {
-		klog.V(6).Infof(" removing Service port %s from no endpoint list, cluster ip address: %s, protocol: %s port: %d ",
-			servicePort.String(), servicePort.ClusterIP().String(), proto, port)
-		if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, servicePort.ClusterIP().String(), port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
+	for _, addr := range serviceAddressesByFamily(servicePort)[tableFamily] {
+		klog.V(6).Infof(" removing Service port %s from no endpoint list, ip address: %s, protocol: %s port: %d ",
+			servicePort.String(), addr, proto, port)
+		if err := p.setElements.remove(tableFamily, proto, addr, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
 			return err
 		}
 	}
-	if extIPs := servicePort.ExternalIPStrings(); len(extIPs) != 0 {
-		for _, extIP := range extIPs {
-			klog.V(6).Infof(" removing Service port %s from no endpoint list, external ip address: %s, protocol: %s port: %d ",
-				servicePort.String(), extIP, proto, port)
-			if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, extIP, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
-				return err
-			}
+
+	return nil
+}
+
+// loadBalancerMarkSet returns the set and the chain marking traffic to loadbalancer ips, by default the traffic
+// is marked for masquerading. With loadbalancer mark, traffic keeps its source and carries the mark instead.
+func (p *proxy) loadBalancerMarkSet() (string, string) {
+	if p.lbMark != 0 {
+		return nftables.K8sMarkLBSet, nftables.K8sNATDoMarkLB
+	}
+
+	return nftables.K8sMarkMasqSet, nftables.K8sNATDoMarkMasq
+}
+
+// externalIPFamilies returns ip families of Service Port's external IPs other than the Service Port's own family,
+// the Service Port needs its chains in tables of these families too.
+func externalIPFamilies(servicePort ServicePort, tableFamily utilnftables.TableFamily) []utilnftables.TableFamily {
+	var families []utilnftables.TableFamily
+	for _, extIP := range servicePort.ExternalIPStrings() {
+		_, family := getIPFamily(extIP)
+		if family == tableFamily || isFamilyInFamilies(family, families) {
+			continue
 		}
+		families = append(families, family)
 	}
-	if lbIPs := servicePort.LoadBalancerIPStrings(); len(lbIPs) != 0 {
-		for _, lbIP := range lbIPs {
-			klog.V(6).Infof(" removing Service port %s from no endpoint list, loadbalancer ip address: %s, protocol: %s port: %d ",
-				servicePort.String(), lbIP, proto, port)
-			if err := nftables.RemoveFromSet(p.nfti, tableFamily, proto, lbIP, port, nftables.K8sNoEndpointsSet, nftables.K8sFilterDoReject); err != nil {
-				return err
-			}
+
+	return families
+}
+
+func isFamilyInFamilies(family utilnftables.TableFamily, families []utilnftables.TableFamily) bool {
+	for _, f := range families {
+		if f == family {
+			return true
 		}
 	}
 
-	return nil
+	return false
 }
@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	utilnftables "github.com/google/nftables"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ServiceSnapshot describes a Service Port as it is programmed in nftables, LastProgrammed compared with
+// ResourceVersion of the latest API object tells how stale the programmed state is.
+type ServiceSnapshot struct {
+	ClusterIP string
+	Port      int
+	Protocol  v1.Protocol
+	// ServiceID is the suffix of names of the Service Port's chains
+	ServiceID string
+	// ResourceVersion is the resource version of the last known service
+	ResourceVersion string
+	// LastProgrammed is the time of the last successful programming of the Service Port
+	LastProgrammed time.Time
+}
+
+// Service returns snapshot of a Service Port, false is returned if the Service Port is not programmed.
+func (p *proxy) Service(svcPortName ServicePortName) (ServiceSnapshot, bool) {
+	p.mu.RLock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		p.mu.RUnlock()
+		return ServiceSnapshot{}, false
+	}
+	base := baseServiceInfo(svc)
+	snapshot := ServiceSnapshot{
+		ClusterIP:      base.clusterIP.String(),
+		Port:           base.port,
+		Protocol:       base.protocol,
+		ServiceID:      base.svcnft.ServiceID,
+		LastProgrammed: base.lastProgrammed,
+	}
+	p.mu.RUnlock()
+	snapshot.ResourceVersion, _ = p.cache.getCachedSvcVersion(svcPortName.serviceName())
+
+	return snapshot, true
+}
+
+// Chains returns names of a Service Port's chains per ip family, service chains, firewall and external load balancer
+// chains if the Service Port has them, followed by chains of endpoints in the service's load balancing. No chains
+// are returned if the Service Port is not programmed.
+func (p *proxy) Chains(svcPortName ServicePortName) map[utilnftables.TableFamily][]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	chains := make(map[utilnftables.TableFamily][]string)
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return chains
+	}
+	for tableFamily, svcChains := range baseServiceInfo(svc).svcnft.Chains {
+		names := make([]string, 0, len(svcChains.Chain))
+		for chain := range svcChains.Chain {
+			names = append(names, chain)
+		}
+		sort.Strings(names)
+		for _, epRule := range p.getServicePortEndpointChains(svcPortName, tableFamily) {
+			names = append(names, epRule.Chain)
+		}
+		chains[tableFamily] = names
+	}
+
+	return chains
+}
+
+// TrafficPath identifies the way traffic reaches a Service Port.
+type TrafficPath int
+
+const (
+	// InternalPath is traffic to the Service Port's ClusterIP
+	InternalPath TrafficPath = iota
+	// ExternalPath is traffic to the Service Port's external ips, loadbalancer ips and nodeport
+	ExternalPath
+)
+
+// EffectiveEndpoints returns sorted ip addresses of endpoints traffic of the path is load balanced to. Both paths
+// jump to the same service chain, externalTrafficPolicy Local does not narrow endpoints of the external path, it only
+// makes the health check node port report local endpoints. The external path has no endpoints when the Service Port
+// has no external addresses nor nodeport, or when its external paths are drained.
+func (p *proxy) EffectiveEndpoints(svcPortName ServicePortName, path TrafficPath) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ips := []string{}
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return ips
+	}
+	baseInfo := baseServiceInfo(svc)
+	if path == ExternalPath {
+		if baseInfo.externalDrained {
+			return ips
+		}
+		if baseInfo.NodePort() == 0 && len(baseInfo.ExternalIPStrings()) == 0 && len(baseInfo.LoadBalancerIPStrings()) == 0 {
+			return ips
+		}
+	}
+	for tableFamily := range baseInfo.svcnft.Chains {
+		for _, ep := range p.selectEndpoints(svcPortName, tableFamily) {
+			ips = append(ips, ep.IP())
+		}
+	}
+	sort.Strings(ips)
+
+	return ips
+}
+
+// IsRejecting returns true if traffic to ip:port of the protocol is rejected, because the Service Port owning the address
+// has no endpoints of the address' ip family and it is in No Endpoints set.
+func (p *proxy) IsRejecting(ip string, port uint16, proto v1.Protocol) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	_, tableFamily := getIPFamily(ip)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, svc := range p.serviceMap {
+		if svc.Port() != int(port) || svc.Protocol() != proto {
+			continue
+		}
+		for _, vip := range serviceAddressesByFamily(svc)[tableFamily] {
+			if addr.Equal(net.ParseIP(vip)) {
+				return baseServiceInfo(svc).noEndpoints[tableFamily]
+			}
+		}
+	}
+
+	return false
+}
+
+// EndpointSnapshot describes an endpoint of a Service Port as it is programmed in nftables,
+// it is meant for debugging and reconciling with the output of "nft list chain".
+type EndpointSnapshot struct {
+	IP       string
+	Port     int
+	Protocol v1.Protocol
+	IPFamily v1.IPFamily
+	IsLocal  bool
+	// Chain is the name of the endpoint's chain
+	Chain string
+	// RuleID carries handles of the rules programmed in the endpoint's chain
+	RuleID []uint64
+	// LastProgrammed is the time of the last successful programming of the endpoint's rules
+	LastProgrammed time.Time
+}
+
+// Endpoints returns snapshots of all endpoints, regardless of their ip family, known for a Service Port.
+func (p *proxy) Endpoints(svcPortName ServicePortName) []EndpointSnapshot {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	snapshots := []EndpointSnapshot{}
+	for _, ep := range p.endpointsMap[svcPortName] {
+		epInfo, ok := ep.(*endpointsInfo)
+		if !ok {
+			// Not recognize, skipping it
+			continue
+		}
+		port, _ := epInfo.Port()
+		snapshot := EndpointSnapshot{
+			IP:             epInfo.IP(),
+			Port:           port,
+			Protocol:       epInfo.protocol,
+			IPFamily:       epInfo.IPFamily,
+			IsLocal:        epInfo.IsLocal,
+			LastProgrammed: epInfo.lastProgrammed,
+		}
+		if epInfo.epnft != nil {
+			// An endpoint is programmed only in the table of its own ip family
+			for _, rule := range epInfo.epnft.Rule {
+				snapshot.Chain = rule.Chain
+				snapshot.RuleID = append([]uint64{}, rule.RuleID...)
+			}
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+// ServiceSpec is a minimal description of a service, it allows to program a service without
+// Kubernetes Service object, for example when nfproxy is used as a library.
+type ServiceSpec struct {
+	Name      string
+	Namespace string
+	// ClusterIP is the service's virtual ip address, its family defines the family of the service.
+	ClusterIP string
+	// ExternalIPs and LoadBalancerIPs are optional additional virtual ip addresses of the service.
+	ExternalIPs     []string
+	LoadBalancerIPs []string
+	Ports           []ServicePortSpec
+	// ExternalTrafficPolicyLocal restricts external traffic to node local endpoints.
+	ExternalTrafficPolicyLocal bool
+	// AffinityTimeoutSeconds enables ClientIP Session Affinity with the timeout, 0 disables Session Affinity.
+	AffinityTimeoutSeconds int32
+}
+
+// ServicePortSpec describes a port of ServiceSpec, NodePort is optional.
+type ServicePortSpec struct {
+	Name     string
+	Protocol v1.Protocol
+	Port     int32
+	NodePort int32
+}
+
+// validate checks that the spec carries enough information to program a service.
+func (spec *ServiceSpec) validate() error {
+	if spec.Name == "" {
+		return fmt.Errorf("service spec has no name")
+	}
+	if net.ParseIP(spec.ClusterIP) == nil {
+		return fmt.Errorf("service spec %s/%s has invalid cluster ip \"%s\"", spec.Namespace, spec.Name, spec.ClusterIP)
+	}
+	if len(spec.Ports) == 0 {
+		return fmt.Errorf("service spec %s/%s has no ports", spec.Namespace, spec.Name)
+	}
+	for _, port := range spec.Ports {
+		if port.Port <= 0 || port.Port > 65535 {
+			return fmt.Errorf("service spec %s/%s has invalid port %d", spec.Namespace, spec.Name, port.Port)
+		}
+		if !isSupportedProtocol(port.Protocol) {
+			return fmt.Errorf("service spec %s/%s port %d has invalid protocol \"%s\"", spec.Namespace, spec.Name, port.Port, port.Protocol)
+		}
+	}
+
+	return nil
+}
+
+// service builds Kubernetes Service object from the spec, the service type is derived from
+// the presence of load balancer ips and node ports.
+func (spec *ServiceSpec) service() *v1.Service {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      spec.Name,
+			Namespace: spec.Namespace,
+		},
+		Spec: v1.ServiceSpec{
+			Type:            v1.ServiceTypeClusterIP,
+			ClusterIP:       spec.ClusterIP,
+			ExternalIPs:     spec.ExternalIPs,
+			SessionAffinity: v1.ServiceAffinityNone,
+		},
+	}
+	ipFamily, _ := getIPFamily(spec.ClusterIP)
+	svc.Spec.IPFamily = &ipFamily
+	for _, port := range spec.Ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{
+			Name:     port.Name,
+			Protocol: port.Protocol,
+			Port:     port.Port,
+			NodePort: port.NodePort,
+		})
+		if port.NodePort != 0 {
+			svc.Spec.Type = v1.ServiceTypeNodePort
+		}
+	}
+	if len(spec.LoadBalancerIPs) != 0 {
+		svc.Spec.Type = v1.ServiceTypeLoadBalancer
+		for _, ip := range spec.LoadBalancerIPs {
+			svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+		}
+	}
+	if spec.ExternalTrafficPolicyLocal && svc.Spec.Type != v1.ServiceTypeClusterIP {
+		svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	}
+	if spec.AffinityTimeoutSeconds != 0 {
+		timeout := spec.AffinityTimeoutSeconds
+		svc.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+		svc.Spec.SessionAffinityConfig = &v1.SessionAffinityConfig{
+			ClientIP: &v1.ClientIPConfig{TimeoutSeconds: &timeout},
+		}
+	}
+
+	return svc
+}
+
+// ProgramService programs a service described by the spec, it drives the same path as AddService does for
+// Kubernetes Service objects. The service can later be removed by DeleteService with a Service object
+// carrying the spec's name and namespace.
+func (p *proxy) ProgramService(spec ServiceSpec) error {
+	s := time.Now()
+	defer func() {
+		klog.V(5).Infof("ProgramService for a service %s/%s ran for: %d nanoseconds", spec.Namespace, spec.Name, time.Since(s))
+	}()
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	svc := spec.service()
+	p.cache.storeSvcInCache(svc)
+	var errs []error
+	for i := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		svcPortName := getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol)
+		if err := p.addServicePort(svcPortName, servicePort, svc, newBaseServiceInfo(servicePort, svc)); err != nil {
+			errs = append(errs, fmt.Errorf("failed to program service port %s with error: %+v", svcPortName.String(), err))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestServiceSpecService(t *testing.T) {
+	spec := ServiceSpec{
+		Name:            "app",
+		Namespace:       "default",
+		ClusterIP:       "2001:db8::10",
+		LoadBalancerIPs: []string{"2001:db8:1::10"},
+		Ports: []ServicePortSpec{
+			{Name: "http", Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+			{Name: "dns", Protocol: v1.ProtocolUDP, Port: 53},
+		},
+		ExternalTrafficPolicyLocal: true,
+		AffinityTimeoutSeconds:     60,
+	}
+	if err := spec.validate(); err != nil {
+		t.Fatalf("unexpected error validating spec: %+v", err)
+	}
+	svc := spec.service()
+	if svc.Name != "app" || svc.Namespace != "default" || svc.Spec.ClusterIP != "2001:db8::10" {
+		t.Errorf("unexpected service metadata or cluster ip: %+v", svc)
+	}
+	if svc.Spec.IPFamily == nil || *svc.Spec.IPFamily != v1.IPv6Protocol {
+		t.Errorf("expected service ip family %s", v1.IPv6Protocol)
+	}
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		t.Errorf("expected service type %s but got %s", v1.ServiceTypeLoadBalancer, svc.Spec.Type)
+	}
+	if len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != "2001:db8:1::10" {
+		t.Errorf("unexpected load balancer ingress: %+v", svc.Status.LoadBalancer.Ingress)
+	}
+	if svc.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		t.Errorf("expected Local external traffic policy")
+	}
+	if svc.Spec.SessionAffinity != v1.ServiceAffinityClientIP || *svc.Spec.SessionAffinityConfig.ClientIP.TimeoutSeconds != 60 {
+		t.Errorf("expected ClientIP Session Affinity with 60 seconds timeout")
+	}
+	if len(svc.Spec.Ports) != 2 || svc.Spec.Ports[0].NodePort != 30080 || svc.Spec.Ports[1].Protocol != v1.ProtocolUDP {
+		t.Errorf("unexpected service ports: %+v", svc.Spec.Ports)
+	}
+	// Service info built from the spec's service must carry the spec's values
+	info := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	if info.Port() != 80 || info.NodePort() != 30080 || info.StickyMaxAgeSeconds() != 60 || !info.OnlyNodeLocalEndpoints() {
+		t.Errorf("unexpected service info: %+v", info)
+	}
+
+	// Service without node ports and load balancer ips is ClusterIP service
+	spec = ServiceSpec{Name: "app", ClusterIP: "10.0.0.10", Ports: []ServicePortSpec{{Protocol: v1.ProtocolTCP, Port: 80}}}
+	if svc := spec.service(); svc.Spec.Type != v1.ServiceTypeClusterIP || svc.Spec.SessionAffinity != v1.ServiceAffinityNone {
+		t.Errorf("expected ClusterIP service without Session Affinity but got %+v", svc.Spec)
+	}
+}
+
+func TestProgramServiceInvalidSpec(t *testing.T) {
+	p := newTestProxy()
+	tests := []struct {
+		name string
+		spec ServiceSpec
+	}{
+		{name: "no name", spec: ServiceSpec{ClusterIP: "10.0.0.10", Ports: []ServicePortSpec{{Protocol: v1.ProtocolTCP, Port: 80}}}},
+		{name: "invalid cluster ip", spec: ServiceSpec{Name: "app", ClusterIP: "10.0.0", Ports: []ServicePortSpec{{Protocol: v1.ProtocolTCP, Port: 80}}}},
+		{name: "no ports", spec: ServiceSpec{Name: "app", ClusterIP: "10.0.0.10"}},
+		{name: "invalid port", spec: ServiceSpec{Name: "app", ClusterIP: "10.0.0.10", Ports: []ServicePortSpec{{Protocol: v1.ProtocolTCP, Port: 70000}}}},
+		{name: "invalid protocol", spec: ServiceSpec{Name: "app", ClusterIP: "10.0.0.10", Ports: []ServicePortSpec{{Protocol: "ICMP", Port: 80}}}},
+	}
+	for _, tt := range tests {
+		if err := p.ProgramService(tt.spec); err == nil {
+			t.Errorf("%s: expected error but succeeded", tt.name)
+		}
+	}
+	if len(p.serviceMap) != 0 || len(p.cache.svcCache) != 0 {
+		t.Errorf("invalid spec must not leave any state")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog"
+)
+
+// programStep is a single step of programming a Service Port along with the step's rollback.
+type programStep struct {
+	name  string
+	apply func() error
+	// rollback undoes successfully applied step, nil if there is nothing to undo.
+	rollback func() error
+	// prerequisite indicates that the following steps cannot succeed if this step fails.
+	prerequisite bool
+	// locked indicates that rollback touches state shared with other Service Ports, rollback of steps of an
+	// abandoned call holds p.mu for it.
+	locked bool
+}
+
+// applySteps attempts all steps and aggregates their errors, a failed prerequisite step skips the rest of steps.
+// If any step fails, all successfully applied steps are rolled back in reverse order, leaving nothing half-programmed.
+// If a step's call is abandoned after programming timeout, *abandonedStepsError is returned without rolling back.
+func applySteps(steps []programStep) error {
+	var errs []error
+	applied := make([]programStep, 0, len(steps))
+	for _, s := range steps {
+		if err := s.apply(); err != nil {
+			errs = append(errs, fmt.Errorf("%s failed with error: %w", s.name, err))
+			var call *abandonedCall
+			if errors.As(err, &call) {
+				// Abandoned call might still apply the step, rolling back is left to the caller
+				return &abandonedStepsError{
+					Aggregate: utilerrors.NewAggregate(errs),
+					call:      call,
+					step:      s,
+					applied:   applied,
+				}
+			}
+			if s.prerequisite {
+				break
+			}
+			continue
+		}
+		applied = append(applied, s)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	rollbackSteps(applied)
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// abandonedStepsError is returned by applySteps when a step's call is abandoned after programming timeout, the rest
+// of steps is not attempted. Applied steps are not rolled back, the caller must wait for the abandoned call and then
+// roll them back, so the rollback does not race with the call.
+type abandonedStepsError struct {
+	utilerrors.Aggregate
+	call *abandonedCall
+	// step is the step which call was abandoned, applied are steps applied before it.
+	step    programStep
+	applied []programStep
+}
+
+// wait blocks until the abandoned call completes.
+func (e *abandonedStepsError) wait() {
+	e.call.wait()
+}
+
+// steps returns steps to roll back, applied steps and the abandoned step if its call eventually succeeded, it must
+// be called after wait returns.
+func (e *abandonedStepsError) steps() []programStep {
+	applied := append([]programStep(nil), e.applied...)
+	if e.call.err == nil {
+		applied = append(applied, e.step)
+	}
+
+	return applied
+}
+
+// rollback rolls back applied steps and the abandoned step if its call eventually succeeded, it must be called
+// after wait returns.
+func (e *abandonedStepsError) rollback() {
+	rollbackSteps(e.steps())
+}
+
+// rollbackSteps rolls back applied steps in reverse order, rollback failures are logged.
+func rollbackSteps(applied []programStep) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		if applied[i].rollback == nil {
+			continue
+		}
+		klog.V(5).Infof("rolling back %s", applied[i].name)
+		if err := applied[i].rollback(); err != nil {
+			klog.Errorf("failed to roll back %s with error: %+v", applied[i].name, err)
+		}
+	}
+}
+
+// rollbackStepsLocking rolls back applied steps in reverse order as rollbackSteps does with lock released, lock is
+// held only for rollback of locked steps.
+func rollbackStepsLocking(applied []programStep, lock sync.Locker) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		if applied[i].rollback == nil {
+			continue
+		}
+		klog.V(5).Infof("rolling back %s", applied[i].name)
+		if applied[i].locked {
+			lock.Lock()
+		}
+		err := applied[i].rollback()
+		if applied[i].locked {
+			lock.Unlock()
+		}
+		if err != nil {
+			klog.Errorf("failed to roll back %s with error: %+v", applied[i].name, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyStepsRollback(t *testing.T) {
+	var applied, rolledBack []string
+	step := func(name string, fail bool, prerequisite bool) programStep {
+		return programStep{
+			name: name,
+			apply: func() error {
+				if fail {
+					return fmt.Errorf("injected failure")
+				}
+				applied = append(applied, name)
+				return nil
+			},
+			rollback: func() error {
+				rolledBack = append(rolledBack, name)
+				return nil
+			},
+			prerequisite: prerequisite,
+		}
+	}
+
+	// NodePort step fails, all other steps are still attempted and then rolled back in reverse order
+	err := applySteps([]programStep{
+		step("service chains", false, true),
+		step("cluster ip", false, false),
+		step("node port", true, false),
+		step("external ip", false, false),
+	})
+	if err == nil || !strings.Contains(err.Error(), "node port") {
+		t.Fatalf("expected aggregated error for node port step but got: %v", err)
+	}
+	if want := []string{"service chains", "cluster ip", "external ip"}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("expected steps %v to be attempted but got %v", want, applied)
+	}
+	if want := []string{"external ip", "cluster ip", "service chains"}; !reflect.DeepEqual(rolledBack, want) {
+		t.Errorf("expected steps %v to be rolled back but got %v", want, rolledBack)
+	}
+
+	// Failed prerequisite step skips the rest
+	applied, rolledBack = nil, nil
+	if err := applySteps([]programStep{
+		step("service chains", true, true),
+		step("cluster ip", false, false),
+	}); err == nil {
+		t.Fatalf("expected error for failed prerequisite step")
+	}
+	if len(applied) != 0 || len(rolledBack) != 0 {
+		t.Errorf("expected no steps applied or rolled back after prerequisite failure, got applied: %v rolled back: %v", applied, rolledBack)
+	}
+
+	// All steps succeed, nothing is rolled back
+	applied, rolledBack = nil, nil
+	if err := applySteps([]programStep{step("cluster ip", false, false)}); err != nil {
+		t.Fatalf("expected no error but got: %+v", err)
+	}
+	if len(rolledBack) != 0 {
+		t.Errorf("expected no rollback on success, got %v", rolledBack)
+	}
+}
+
+// recordingLocker records whether it is held.
+type recordingLocker struct {
+	held bool
+}
+
+func (l *recordingLocker) Lock()   { l.held = true }
+func (l *recordingLocker) Unlock() { l.held = false }
+
+func TestRollbackStepsLocking(t *testing.T) {
+	lock := &recordingLocker{}
+	var rolledBack []string
+	step := func(name string, locked bool) programStep {
+		return programStep{
+			name: name,
+			rollback: func() error {
+				rolledBack = append(rolledBack, fmt.Sprintf("%s locked: %t", name, lock.held))
+				return nil
+			},
+			locked: locked,
+		}
+	}
+
+	// Only locked steps are rolled back holding the lock, the order is kept
+	rollbackStepsLocking([]programStep{
+		step("service chains", false),
+		step("affinity update rules", true),
+		step("cluster ip", false),
+	}, lock)
+	want := []string{"cluster ip locked: false", "affinity update rules locked: true", "service chains locked: false"}
+	if !reflect.DeepEqual(rolledBack, want) {
+		t.Errorf("expected steps %v to be rolled back but got %v", want, rolledBack)
+	}
+	if lock.held {
+		t.Errorf("expected lock to be released after rollback")
+	}
+}
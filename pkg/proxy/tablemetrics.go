@@ -0,0 +1,60 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+// tableCounter reads back numbers of chains, rules and sets programmed in nftables.
+type tableCounter interface {
+	counts(tableFamily utilnftables.TableFamily) (nftables.TableCounts, error)
+}
+
+type nftTableCounter struct {
+	nfti *nftables.NFTInterface
+}
+
+func (c *nftTableCounter) counts(tableFamily utilnftables.TableFamily) (nftables.TableCounts, error) {
+	return nftables.GetTableCounts(c.nfti, tableFamily)
+}
+
+// updateTableMetrics sets gauges of chains, rules and sets to the numbers found in the kernel, they expose
+// divergence between what nfproxy programmed and what is actually programmed.
+func (p *proxy) updateTableMetrics() {
+	for _, tableFamily := range []utilnftables.TableFamily{utilnftables.TableFamilyIPv4, utilnftables.TableFamilyIPv6} {
+		counts, err := p.tables.counts(tableFamily)
+		if err != nil {
+			klog.Errorf("failed to read back nftables of family %v with error: %+v", tableFamily, err)
+			continue
+		}
+		family := tableFamilyLabel(tableFamily)
+		nftablesChains.WithLabelValues(family).Set(float64(counts.Chains))
+		nftablesRules.WithLabelValues(family).Set(float64(counts.Rules))
+		nftablesSets.WithLabelValues(family).Set(float64(counts.Sets))
+	}
+}
+
+func tableFamilyLabel(tableFamily utilnftables.TableFamily) string {
+	if tableFamily == utilnftables.TableFamilyIPv6 {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
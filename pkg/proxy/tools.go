@@ -136,13 +136,7 @@ func BootstrapRules(p Proxy, inHost, inPort string, extEndpoint *url.URL, endpoi
 func servicePortEndpointChainName(servicePortName string, protocol string, endpoint string) string {
 	hash := sha256.Sum256([]byte(servicePortName + protocol + endpoint))
 	encoded := base32.StdEncoding.EncodeToString(hash[:])
-	return "k8s-nfproxy-sep-" + encoded[:16]
-}
-
-func servicePortSvcID(servicePortName string, protocol string, service string) string {
-	hash := sha256.Sum256([]byte(servicePortName + protocol + service))
-	encoded := base32.StdEncoding.EncodeToString(hash[:])
-	return encoded[:16]
+	return defaultEndpointChainPrefix + encoded[:defaultEndpointChainLength]
 }
 
 func getSvcPortName(name, namespace string, portName string, protocol v1.Protocol) ServicePortName {
@@ -153,6 +147,16 @@ func getSvcPortName(name, namespace string, portName string, protocol v1.Protoco
 	}
 }
 
+// isSupportedProtocol returns true if Service Ports of the protocol can be programmed.
+func isSupportedProtocol(protocol v1.Protocol) bool {
+	switch protocol {
+	case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		return true
+	}
+
+	return false
+}
+
 func getIPFamily(ipaddr string) (v1.IPFamily, utilnftables.TableFamily) {
 	var ipFamily v1.IPFamily
 	var ipTableFamily utilnftables.TableFamily
@@ -166,29 +170,19 @@ func getIPFamily(ipaddr string) (v1.IPFamily, utilnftables.TableFamily) {
 	return ipFamily, ipTableFamily
 }
 
-func isPortInSubset(subsets []v1.EndpointSubset, port *v1.EndpointPort, addr *v1.EndpointAddress) bool {
-	for _, s := range subsets {
-		for _, subsetAddr := range s.Addresses {
-			for _, p := range s.Ports {
-				if p.Name == port.Name && p.Port == port.Port && p.Protocol == port.Protocol && strings.Compare(subsetAddr.IP, addr.IP) == 0 {
-					return true
-				}
-			}
-		}
-		for _, subsetAddr := range s.NotReadyAddresses {
-			for _, p := range s.Ports {
-				if p.Name == port.Name && p.Port == port.Port && p.Protocol == port.Protocol && strings.Compare(subsetAddr.IP, addr.IP) == 0 {
-					return true
-				}
-			}
-		}
+// ipFamilyOfTable returns ip family of a table family.
+func ipFamilyOfTable(tableFamily utilnftables.TableFamily) v1.IPFamily {
+	if tableFamily == utilnftables.TableFamilyIPv6 {
+		return v1.IPv6Protocol
 	}
-	return false
+
+	return v1.IPv4Protocol
 }
 
 // isPortInEndpointSlice looks for address/port pair, if found it returns true for found and also the ready state of endpoint in the slice
-func isPortInEndpointSlice(epsl *discovery.EndpointSlice, port *v1.EndpointPort, address *v1.EndpointAddress) (bool, bool) {
-	for _, e := range epsl.Endpoints {
+func isPortInEndpointSlice(epsl *discovery.EndpointSlice, port *v1.EndpointPort, address *v1.EndpointAddress, gate string) (bool, bool) {
+	for i := range epsl.Endpoints {
+		e := &epsl.Endpoints[i]
 		for _, p := range epsl.Ports {
 			checkName := ""
 			if p.Name != nil {
@@ -198,14 +192,14 @@ func isPortInEndpointSlice(epsl *discovery.EndpointSlice, port *v1.EndpointPort,
 			if p.Port != nil {
 				checkPort = *p.Port
 			}
-			var checkProto v1.Protocol
+			checkProto := v1.ProtocolTCP
 			if p.Protocol != nil {
 				checkProto = *p.Protocol
 			}
 			if checkName == port.Name && checkPort == port.Port && checkProto == port.Protocol {
 				for _, addr := range e.Addresses {
 					if strings.Compare(addr, address.IP) == 0 {
-						return *e.Conditions.Ready, true
+						return isEndpointReady(e, gate), true
 					}
 				}
 			}
@@ -30,12 +30,23 @@ type ServicePortName struct {
 	types.NamespacedName
 	Port     string
 	Protocol v1.Protocol
+	// Cluster identifies the cluster the service comes from when services of multiple clusters
+	// are proxied, it is empty for services of the local cluster.
+	Cluster string
 }
 
 func (spn ServicePortName) String() string {
+	if spn.Cluster != "" {
+		return fmt.Sprintf("%s/%s:%s:%s", spn.Cluster, spn.NamespacedName.String(), spn.Port, spn.Protocol)
+	}
 	return fmt.Sprintf("%s:%s:%s", spn.NamespacedName.String(), spn.Port, spn.Protocol)
 }
 
+// serviceName returns the name of the service the Service Port belongs to.
+func (spn ServicePortName) serviceName() objectName {
+	return objectName{NamespacedName: spn.NamespacedName, Cluster: spn.Cluster}
+}
+
 // ServicePort is an interface which abstracts information about a service.
 type ServicePort interface {
 	// String returns service string.  An example format can be: `IP:Port/Protocol`.
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+// ruleVerifier confirms that rules recorded as programmed exist in the kernel.
+type ruleVerifier interface {
+	verify(tableFamily utilnftables.TableFamily, chain string, ruleIDs []uint64) error
+}
+
+// nftRuleVerifier reads back rules from nfproxy tables in the kernel.
+type nftRuleVerifier struct {
+	nfti *nftables.NFTInterface
+}
+
+func (v *nftRuleVerifier) verify(tableFamily utilnftables.TableFamily, chain string, ruleIDs []uint64) error {
+	return nftables.VerifyRules(v.nfti, tableFamily, chain, ruleIDs)
+}
+
+// verifyServicePort confirms that rules of Service Port's chains exist in the kernel, it catches rules silently
+// rejected by the kernel. If verification fails, rollback is called and the Service Port is queued for retry.
+// Without verifier nothing is verified. It must be called with p.mu held.
+func (p *proxy) verifyServicePort(svcPortName ServicePortName, tableFamily utilnftables.TableFamily, rollback func()) error {
+	if p.verifier == nil {
+		return nil
+	}
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return nil
+	}
+	for chain, rules := range baseServiceInfo(svc).svcnft.Chains[tableFamily].Chain {
+		if len(rules.RuleID) == 0 {
+			continue
+		}
+		if err := p.verifier.verify(tableFamily, chain, rules.RuleID); err != nil {
+			klog.Errorf("verification of service port %s failed, rolling it back and retrying, error: %+v", svcPortName.String(), err)
+			rollback()
+			p.retries.AddRateLimited(svcPortName)
+			return fmt.Errorf("verification of service port %s failed with error: %+v", svcPortName.String(), err)
+		}
+	}
+	p.retries.Forget(svcPortName)
+
+	return nil
+}
+
+// runRetryWorker programs Service Ports and pending endpoints and completes endpoint deletions queued for retry until the queue is shut down.
+func (p *proxy) runRetryWorker() {
+	for p.processNextRetry() {
+	}
+}
+
+// processNextRetry programs the next Service Port queued for retry from the last known state of its service,
+// Service Ports which are gone or already programmed are dropped from the queue.
+func (p *proxy) processNextRetry() bool {
+	item, quit := p.retries.Get()
+	if quit {
+		return false
+	}
+	defer p.retries.Done(item)
+	if p.isStandby() {
+		p.dropRetry(item)
+		return true
+	}
+	if retry, ok := item.(endpointRetry); ok {
+		p.retryEndpointDeletion(retry)
+		return true
+	}
+	if retry, ok := item.(pendingEndpointRetry); ok {
+		p.retryPendingEndpoint(retry)
+		return true
+	}
+	svcPortName := item.(ServicePortName)
+	svc, err := p.cache.getLastKnownSvcFromCache(svcPortName.serviceName())
+	if err != nil {
+		klog.V(5).Infof("service of service port %s is gone, dropping retry", svcPortName.String())
+		p.retries.Forget(item)
+		return true
+	}
+	for i := range svc.Spec.Ports {
+		servicePort := &svc.Spec.Ports[i]
+		if getObjSvcPortName(svc, servicePort.Name, servicePort.Protocol) != svcPortName {
+			continue
+		}
+		klog.V(5).Infof("retrying to program service port %s", svcPortName.String())
+		// Failed verification queues the Service Port again
+		p.addServicePort(svcPortName, servicePort, svc, newBaseServiceInfo(servicePort, svc))
+		return true
+	}
+	klog.V(5).Infof("service port %s is gone, dropping retry", svcPortName.String())
+	p.retries.Forget(item)
+
+	return true
+}
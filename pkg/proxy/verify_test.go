@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// fakeRuleVerifier reports rules listed in missing as not found in the kernel.
+type fakeRuleVerifier struct {
+	missing map[uint64]bool
+}
+
+func (v *fakeRuleVerifier) verify(tableFamily utilnftables.TableFamily, chain string, ruleIDs []uint64) error {
+	for _, id := range ruleIDs {
+		if v.missing[id] {
+			return fmt.Errorf("rule %d of chain %s is missing", id, chain)
+		}
+	}
+	return nil
+}
+
+func TestVerifyServicePort(t *testing.T) {
+	p := newTestProxy()
+	verifier := &fakeRuleVerifier{missing: map[uint64]bool{}}
+	p.verifier = verifier
+	p.retries = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer p.retries.ShutDown()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	svcPortName := getSvcPortName("app", "default", "http", v1.ProtocolTCP)
+	baseInfo := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	baseInfo.svcnft.ServiceID = "svcid"
+	baseInfo.svcnft.Chains = map[utilnftables.TableFamily]nftables.SVCChain{
+		utilnftables.TableFamilyIPv4: {
+			Chain: map[string]*nftables.Rule{
+				nftables.K8sSvcPrefix + "svcid": {Chain: nftables.K8sSvcPrefix + "svcid", RuleID: []uint64{7}},
+			},
+		},
+	}
+	p.serviceMap[svcPortName] = newServiceInfo(&svc.Spec.Ports[0], svc, baseInfo)
+	var rolledBack bool
+	rollback := func() {
+		rolledBack = true
+		delete(p.serviceMap, svcPortName)
+	}
+
+	if err := p.verifyServicePort(svcPortName, utilnftables.TableFamilyIPv4, rollback); err != nil {
+		t.Fatalf("expected verification to succeed, got error: %+v", err)
+	}
+	if rolledBack || p.retries.Len() != 0 {
+		t.Fatalf("expected verified service port not to be rolled back or retried")
+	}
+
+	// Kernel reports the service rule missing
+	verifier.missing[7] = true
+	if err := p.verifyServicePort(svcPortName, utilnftables.TableFamilyIPv4, rollback); err == nil {
+		t.Fatalf("expected verification to fail")
+	}
+	if !rolledBack {
+		t.Errorf("expected failed verification to roll back the service port")
+	}
+	if _, ok := p.serviceMap[svcPortName]; ok {
+		t.Errorf("expected rolled back service port not to be in service map")
+	}
+	if p.retries.NumRequeues(svcPortName) != 1 {
+		t.Errorf("expected service port to be queued for retry, got %d requeues", p.retries.NumRequeues(svcPortName))
+	}
+}
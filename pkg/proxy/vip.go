@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	"k8s.io/klog"
+)
+
+// vipDefaultDenySteps returns steps adding Service Port's port to defined ports of its ClusterIP and adding
+// the ClusterIP to VIPs with default deny, so traffic to the ClusterIP on other ports is rejected.
+// The port is added first, so the port is never rejected while it is being programmed.
+func (p *proxy) vipDefaultDenySteps(servicePort ServicePort, tableFamily utilnftables.TableFamily, clusterIP string) []programStep {
+	proto := servicePort.Protocol()
+	port := uint16(servicePort.Port())
+	return []programStep{
+		{
+			name: fmt.Sprintf("adding %s port %d to %s set %s", clusterIP, port, tableFamilyLabel(tableFamily), nftables.K8sVIPPortsSet),
+			apply: func() error {
+				return p.programNFT("adding to set "+nftables.K8sVIPPortsSet, func() error {
+					return nftables.AddToVIPPortsSet(p.nfti, tableFamily, proto, clusterIP, port)
+				})
+			},
+			rollback: func() error {
+				return p.programNFT("removing from set "+nftables.K8sVIPPortsSet, func() error {
+					return nftables.RemoveFromVIPPortsSet(p.nfti, tableFamily, proto, clusterIP, port)
+				})
+			},
+		},
+		{
+			name: fmt.Sprintf("adding %s to %s set %s", clusterIP, tableFamilyLabel(tableFamily), nftables.K8sVIPSet),
+			apply: func() error {
+				return p.programNFT("adding to set "+nftables.K8sVIPSet, func() error {
+					return nftables.AddVIP(p.nfti, tableFamily, clusterIP)
+				})
+			},
+			rollback: func() error {
+				if p.isVIPInUse(clusterIP, servicePort) {
+					return nil
+				}
+				return p.programNFT("removing from set "+nftables.K8sVIPSet, func() error {
+					return nftables.RemoveVIP(p.nfti, tableFamily, clusterIP)
+				})
+			},
+		},
+	}
+}
+
+// addVIPPort adds a programmed Service Port's port to defined ports of a new ClusterIP of its service and the
+// ClusterIP to VIPs with default deny, if either fails, the change is rolled back.
+func (p *proxy) addVIPPort(svcPortName ServicePortName, tableFamily utilnftables.TableFamily, clusterIP string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok {
+		return nil
+	}
+
+	return applySteps(p.vipDefaultDenySteps(svc, tableFamily, clusterIP))
+}
+
+// removeVIPPort removes Service Port's port from defined ports of its ClusterIP, the ClusterIP is removed from
+// VIPs with default deny once no other Service Port uses it. It must be called with p.mu held.
+func (p *proxy) removeVIPPort(servicePort ServicePort, tableFamily utilnftables.TableFamily, clusterIP string) error {
+	if !p.isVIPInUse(clusterIP, servicePort) {
+		klog.V(6).Infof("removing %s from VIPs with default deny", clusterIP)
+		if err := nftables.RemoveVIP(p.nfti, tableFamily, clusterIP); err != nil {
+			return err
+		}
+	}
+
+	return nftables.RemoveFromVIPPortsSet(p.nfti, tableFamily, servicePort.Protocol(), clusterIP, uint16(servicePort.Port()))
+}
+
+// isVIPInUse returns true if a programmed Service Port other than servicePort has the ClusterIP.
+// It must be called with p.mu held.
+func (p *proxy) isVIPInUse(clusterIP string, servicePort ServicePort) bool {
+	base := baseServiceInfo(servicePort)
+	for _, svcInfo := range p.serviceMap {
+		other := baseServiceInfo(svcInfo)
+		if other == base || other.ClusterIP() == nil {
+			continue
+		}
+		if other.ClusterIP().String() == clusterIP {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestVIPDefaultDenySteps(t *testing.T) {
+	p := newTestProxy()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+				{Name: "https", Port: 443, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}
+	vipSteps := func(baseInfo *BaseServiceInfo) []string {
+		var names []string
+		for _, step := range p.servicePortSetsSteps(baseInfo, utilnftables.TableFamilyIPv4, "svcid") {
+			if strings.Contains(step.name, nftables.K8sVIPPortsSet) || strings.HasSuffix(step.name, " set "+nftables.K8sVIPSet) {
+				names = append(names, step.name)
+			}
+		}
+		return names
+	}
+	http := newBaseServiceInfo(&svc.Spec.Ports[0], svc)
+	if steps := vipSteps(http); len(steps) != 0 {
+		t.Fatalf("expected no default deny steps when it is not enabled, got %v", steps)
+	}
+	WithVIPDefaultDeny()(p)
+	// Defined port is added before the VIP, so it is never rejected
+	expected := []string{
+		"adding 10.96.0.10 port 80 to ipv4 set " + nftables.K8sVIPPortsSet,
+		"adding 10.96.0.10 to ipv4 set " + nftables.K8sVIPSet,
+	}
+	if steps := vipSteps(http); len(steps) != 2 || steps[0] != expected[0] || steps[1] != expected[1] {
+		t.Fatalf("expected default deny steps %v, got %v", expected, steps)
+	}
+
+	// VIP is kept while another Service Port of the service is programmed
+	https := newBaseServiceInfo(&svc.Spec.Ports[1], svc)
+	p.serviceMap[getSvcPortName("app", "default", "http", v1.ProtocolTCP)] = newServiceInfo(&svc.Spec.Ports[0], svc, http)
+	if p.isVIPInUse("10.96.0.10", http) {
+		t.Errorf("expected VIP not to be in use by other Service Ports")
+	}
+	p.serviceMap[getSvcPortName("app", "default", "https", v1.ProtocolTCP)] = newServiceInfo(&svc.Spec.Ports[1], svc, https)
+	if !p.isVIPInUse("10.96.0.10", http) {
+		t.Errorf("expected VIP to be in use by the other Service Port")
+	}
+}
+
+func TestVIPClusterIPChange(t *testing.T) {
+	p, conn := newFakeNFTProxy(t, false, WithVIPDefaultDeny())
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", ResourceVersion: "1"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	// isVIP returns true if the address is in VIPs with default deny
+	isVIP := func(addr string) bool {
+		conn.Lock()
+		defer conn.Unlock()
+		for set, elements := range conn.Elements {
+			if set.Name != nftables.K8sVIPSet {
+				continue
+			}
+			for _, e := range elements {
+				if bytes.Equal(e.Key, net.ParseIP(addr).To4()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	p.AddService(svc)
+	if !isVIP("10.96.0.10") {
+		t.Fatalf("expected ClusterIP to be added to VIPs with default deny")
+	}
+
+	// Changed ClusterIP replaces the old one in VIPs with default deny
+	changed := svc.DeepCopy()
+	changed.ResourceVersion = "2"
+	changed.Spec.ClusterIP = "10.96.0.20"
+	p.UpdateService(svc, changed)
+	if !isVIP("10.96.0.20") || isVIP("10.96.0.10") {
+		t.Errorf("expected VIPs with default deny to hold only the new ClusterIP")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2020 The nfproxy Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"math"
+
+	utilnftables "github.com/google/nftables"
+	"github.com/sbezverk/nfproxy/pkg/nftables"
+)
+
+// maxLoadBalancingSlots limits the number of slots a weighted split programs in the service's load balancing rule.
+const maxLoadBalancingSlots = 1024
+
+// serviceZoneWeight returns the share, in percent, of the service's load balancing given to endpoints in the node's zone.
+// 0 is returned when the service is not PreferClose or when in-zone endpoints are strictly preferred, which is 100%.
+func (p *proxy) serviceZoneWeight(svc ServicePort) int {
+	base := baseServiceInfo(svc)
+	if !base.preferClose || p.zone == "" {
+		return 0
+	}
+	weight := p.zoneWeight
+	if base.zoneWeight != 0 {
+		weight = base.zoneWeight
+	}
+	if weight <= 0 || weight >= 100 {
+		return 0
+	}
+
+	return weight
+}
+
+// getServicePortLoadBalancingChains returns endpoints chains for the service's load balancing rule, for services with
+// weighted zone split each chain is repeated so in-zone and remaining endpoints get their shares of the slots.
+func (p *proxy) getServicePortLoadBalancingChains(svcPortName ServicePortName, tableFamily utilnftables.TableFamily) []*nftables.EPRule {
+	svc, ok := p.serviceMap[svcPortName]
+	if !ok || p.serviceZoneWeight(svc) == 0 {
+		return p.getServicePortEndpointChains(svcPortName, tableFamily)
+	}
+
+	return zoneWeightedChains(p.selectEndpoints(svcPortName, tableFamily), p.zone, p.serviceZoneWeight(svc), tableFamily)
+}
+
+// zoneWeightedChains returns endpoints chains where each in-zone endpoint gets weight percent of slots divided among
+// in-zone endpoints and each other endpoint gets the rest divided among other endpoints. When all endpoints are either
+// in-zone or not, each endpoint gets one slot.
+func zoneWeightedChains(eps []*endpointsInfo, zone string, weight int, tableFamily utilnftables.TableFamily) []*nftables.EPRule {
+	var local, remote []*endpointsInfo
+	for _, ep := range eps {
+		if endpointZone(ep) == zone {
+			local = append(local, ep)
+		} else {
+			remote = append(remote, ep)
+		}
+	}
+	localSlots, remoteSlots := 1, 1
+	if len(local) != 0 && len(remote) != 0 {
+		localSlots, remoteSlots = weightedSlots(len(local), len(remote), weight)
+	}
+	chains := make([]*nftables.EPRule, 0, len(local)*localSlots+len(remote)*remoteSlots)
+	for _, ep := range local {
+		for i := 0; i < localSlots; i++ {
+			chains = append(chains, ep.epnft.Rule[tableFamily])
+		}
+	}
+	for _, ep := range remote {
+		for i := 0; i < remoteSlots; i++ {
+			chains = append(chains, ep.epnft.Rule[tableFamily])
+		}
+	}
+
+	return chains
+}
+
+// weightedSlots returns the number of slots for each of local and each of remote endpoints, so local endpoints
+// together get weight percent of all slots. If the exact split needs more than maxLoadBalancingSlots, it is approximated.
+func weightedSlots(local, remote int, weight int) (int, int) {
+	localSlots, remoteSlots := weight*remote, (100-weight)*local
+	g := gcd(localSlots, remoteSlots)
+	localSlots, remoteSlots = localSlots/g, remoteSlots/g
+	if total := local*localSlots + remote*remoteSlots; total > maxLoadBalancingSlots {
+		scale := float64(maxLoadBalancingSlots) / float64(total)
+		localSlots = int(math.Max(1, math.Round(float64(localSlots)*scale)))
+		remoteSlots = int(math.Max(1, math.Round(float64(remoteSlots)*scale)))
+	}
+
+	return localSlots, remoteSlots
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}